@@ -3,11 +3,13 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/mining-pool/not-only-mining-pool/config"
+	"github.com/mining-pool/not-only-mining-pool/daemons"
 	"github.com/mining-pool/not-only-mining-pool/storage"
 )
 
@@ -17,36 +19,52 @@ var log = logging.Logger("api")
 type Server struct {
 	*mux.Router
 
-	apiConf *config.APIOptions
-	storage *storage.DB
+	apiConf  *config.APIOptions
+	storage  storage.DB
+	daemons  *daemons.DaemonManager
+	coinName string
+	payment  *config.PaymentOptions // nil when payments are off
 
 	availablePaths []string
 	config         map[string]interface{}
 }
 
 // NewAPIServer creates a Server which follows [standard api](https://github.com/mining-pool/mining-pool-api)
-func NewAPIServer(options *config.Options, storage *storage.DB) *Server {
+func NewAPIServer(options *config.Options, storage storage.DB) *Server {
 	s := &Server{
 		Router: mux.NewRouter(),
 
-		apiConf: options.API,
-		storage: storage,
+		apiConf:  options.API,
+		storage:  storage,
+		coinName: options.Coin.Name,
 
 		availablePaths: make([]string, 0),
 		config:         make(map[string]interface{}),
 	}
 
+	if !options.DisablePayment {
+		s.payment = options.PaymentOptions
+	}
 	s.ConvertConf(options)
 
 	s.RegisterFunc("/", s.indexFunc)
 
 	s.RegisterFunc("/pool", s.poolFunc)
+	s.RegisterFunc("/blocks", s.blocksFunc)
+	s.RegisterFunc("/blocks/rejected", s.rejectedBlocksFunc)
+	s.RegisterFunc("/daemons", s.daemonsFunc)
+	s.RegisterFunc("/storage", s.storageFunc)
 
 	s.RegisterFunc("/config", s.configIndexFunc)
 	s.RegisterFunc("/config/{key}", s.configFunc)
 
 	s.RegisterFunc("/miner/{miner}", s.minerFunc)
 	s.RegisterFunc("/miner/{miner}/rig/{rig}", s.rigFunc)
+	s.RegisterFunc("/miner/{miner}/payments", s.minerPaymentsFunc)
+	s.RegisterFunc("/miner/{miner}/settings", s.minerSettingsFunc)
+
+	s.RegisterFunc("/payments", s.paymentsFunc)
+	s.RegisterFunc("/payments/{txid}", s.paymentFunc)
 	s.Use(mux.CORSMethodMiddleware(s.Router))
 
 	http.Handle("/", s)
@@ -54,6 +72,12 @@ func NewAPIServer(options *config.Options, storage *storage.DB) *Server {
 	return s
 }
 
+// SetDaemonManager exposes the health of dm's daemons under /daemons. Pools
+// without a DaemonManager (pluggable engines) report an empty list.
+func (s *Server) SetDaemonManager(dm *daemons.DaemonManager) {
+	s.daemons = dm
+}
+
 func (s *Server) ConvertConf(options *config.Options) {
 	s.config["ports"] = options.Ports
 	s.config["algorithm"] = options.Algorithm
@@ -99,6 +123,116 @@ func (s *Server) configFunc(writer http.ResponseWriter, r *http.Request) {
 	_, _ = writer.Write(raw)
 }
 
+// luckWindows are the block counts pool luck is averaged over.
+var luckWindows = []int{10, 50, 100}
+
+// BlocksInfo is the found-block history, newest first, with the pool luck: the
+// average effort over the newest luckWindows blocks, keyed by window.
+type BlocksInfo struct {
+	Luck   map[string]float64    `json:"luck"`
+	Blocks []*storage.FoundBlock `json:"blocks"`
+}
+
+// limitParam reads the ?limit= of a list endpoint: default 100, at most 1000.
+func limitParam(r *http.Request) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return 100
+	}
+	if limit > 1000 {
+		return 1000
+	}
+	return limit
+}
+
+// blocksFunc serves the newest ?limit= found blocks.
+func (s *Server) blocksFunc(w http.ResponseWriter, r *http.Request) {
+	limit := limitParam(r)
+	fetch := limit
+	if last := luckWindows[len(luckWindows)-1]; fetch < last {
+		fetch = last
+	}
+	blocks, err := s.storage.GetFoundBlocks(fetch)
+	if err != nil {
+		log.Error(err)
+	}
+
+	info := BlocksInfo{Luck: make(map[string]float64, len(luckWindows)), Blocks: blocks}
+	for _, n := range luckWindows {
+		info.Luck[strconv.Itoa(n)] = storage.AverageEffort(blocks, n)
+	}
+	if len(info.Blocks) > limit {
+		info.Blocks = info.Blocks[:limit]
+	}
+
+	raw, _ := json.Marshal(info)
+	_, _ = w.Write(raw)
+}
+
+func (s *Server) rejectedBlocksFunc(w http.ResponseWriter, _ *http.Request) {
+	blocks, err := s.storage.GetRejectedBlocks()
+	if err != nil {
+		log.Error(err)
+	}
+
+	raw, _ := json.Marshal(blocks)
+	_, _ = w.Write(raw)
+}
+
+func (s *Server) daemonsFunc(w http.ResponseWriter, _ *http.Request) {
+	health := make([]daemons.DaemonHealth, 0)
+	if s.daemons != nil {
+		health = s.daemons.Health()
+	}
+
+	raw, _ := json.Marshal(health)
+	_, _ = w.Write(raw)
+}
+
+// storageFunc reports the share writer's back-pressure: shares waiting for the
+// store, journal growth and whether the store is unreachable.
+func (s *Server) storageFunc(w http.ResponseWriter, _ *http.Request) {
+	raw, _ := json.Marshal(s.storage.ShareQueueStats())
+	_, _ = w.Write(raw)
+}
+
+// paymentsFunc serves the newest ?limit= entries of the payout ledger.
+func (s *Server) paymentsFunc(w http.ResponseWriter, r *http.Request) {
+	payouts, err := s.storage.GetPayouts(limitParam(r))
+	if err != nil {
+		log.Error(err)
+	}
+
+	raw, _ := json.Marshal(payouts)
+	_, _ = w.Write(raw)
+}
+
+// paymentFunc serves the ledger entry of one payout transaction.
+func (s *Server) paymentFunc(w http.ResponseWriter, r *http.Request) {
+	payout, err := s.storage.GetPayout(mux.Vars(r)["txid"])
+	if err != nil {
+		log.Error(err)
+	}
+	if payout == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	raw, _ := json.Marshal(payout)
+	_, _ = w.Write(raw)
+}
+
+// minerPaymentsFunc serves the newest ?limit= payouts to a miner.
+func (s *Server) minerPaymentsFunc(w http.ResponseWriter, r *http.Request) {
+	payouts, err := s.storage.GetMinerPayouts(mux.Vars(r)["miner"], limitParam(r))
+	if err != nil {
+		log.Error(err)
+	}
+
+	raw, _ := json.Marshal(payouts)
+	_, _ = w.Write(raw)
+}
+
 type PoolInfo struct {
 	CoinName string `json:"coinName"`
 
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mining-pool/not-only-mining-pool/storage"
+)
+
+// maxSettingsSkew is how far the time a miner signed their settings at may be
+// from the pool's clock.
+const maxSettingsSkew = 10 * time.Minute
+
+// SettingsRequest sets a miner's payout settings. Signature is the wallet's
+// signmessage of storage.MinerSettings.Message by the miner's payout address.
+type SettingsRequest struct {
+	storage.MinerSettings
+	Signature string `json:"signature"`
+}
+
+// minerSettingsFunc serves a miner's payout settings on GET and sets them on
+// POST, from a SettingsRequest verified with the payment daemon's
+// verifymessage.
+func (s *Server) minerSettingsFunc(w http.ResponseWriter, r *http.Request) {
+	miner := mux.Vars(r)["miner"]
+	if r.Method != http.MethodPost {
+		settings, err := s.storage.GetMinerSettings(miner)
+		if err != nil {
+			log.Error(err)
+		}
+
+		raw, _ := json.Marshal(settings)
+		_, _ = w.Write(raw)
+		return
+	}
+
+	if s.payment == nil || s.daemons == nil {
+		http.Error(w, "this pool doesn't pay from a wallet", http.StatusNotImplemented)
+		return
+	}
+	var req SettingsRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "bad settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkSettings(miner, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.verifyMessage(miner, req.Signature, req.Message(s.coinName, miner)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := s.storage.SetMinerSettings(miner, &req.MinerSettings); err != nil {
+		log.Error(err)
+		http.Error(w, "failed to save the settings", http.StatusInternalServerError)
+		return
+	}
+	log.Infof("%s set payout settings %s", miner, req.Message(s.coinName, miner))
+
+	raw, _ := json.Marshal(&req.MinerSettings)
+	_, _ = w.Write(raw)
+}
+
+// checkSettings validates settings before their signature is checked: the
+// threshold is at least the pool's, the hour is one, and the signing time is
+// recent and newer than the stored settings.
+func (s *Server) checkSettings(miner string, req *SettingsRequest) error {
+	if req.MinPayment != 0 && req.MinPayment < s.payment.MinPayment {
+		return fmt.Errorf("minPayment is below the pool's %v", s.payment.MinPayment)
+	}
+	if req.DailyAt != nil && (*req.DailyAt < 0 || *req.DailyAt > 23) {
+		return fmt.Errorf("dailyAt is an hour, 0-23")
+	}
+	signed := time.Unix(req.Time, 0)
+	if d := time.Since(signed); d > maxSettingsSkew || d < -maxSettingsSkew {
+		return fmt.Errorf("time is more than %s from the pool's clock", maxSettingsSkew)
+	}
+	old, err := s.storage.GetMinerSettings(miner)
+	if err != nil {
+		return err
+	}
+	if old != nil && req.Time <= old.Time {
+		return fmt.Errorf("settings signed at %d are not newer than the current ones", req.Time)
+	}
+	return nil
+}
+
+// verifyMessage checks with the payment daemon that address signed message.
+func (s *Server) verifyMessage(address, signature, message string) error {
+	_, result := s.daemons.CmdToDaemon(s.payment.Daemon, "verifymessage", []interface{}{address, signature, message})
+	if result == nil {
+		return fmt.Errorf("the wallet daemon is unreachable")
+	}
+	if result.Error != nil {
+		return fmt.Errorf("verifymessage: %s", result.Error.Message)
+	}
+	var ok bool
+	if err := json.Unmarshal(result.Result, &ok); err != nil || !ok {
+		return fmt.Errorf("the signature is not %s's", address)
+	}
+	return nil
+}
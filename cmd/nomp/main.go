@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"os"
+	"os/signal"
+	"syscall"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/mining-pool/not-only-mining-pool/config"
@@ -44,6 +47,17 @@ func main() {
 		log.Panic(err)
 	}
 
+	// the pool's lifetime: node calls and subscriptions end on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if flag.Arg(0) == "payments" {
+		if err := runPayments(ctx, &conf, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	var p *pool.Pool
 	if conf.Engine != "" && conf.Engine != "gbt" {
 		// pluggable engines register themselves via build-tagged imports
@@ -52,8 +66,7 @@ func main() {
 	} else {
 		p = pool.NewPool(&conf)
 	}
-	p.Init()
-	for {
-		select {}
-	}
+	p.Init(ctx)
+	<-ctx.Done()
+	log.Warn("shutting down")
 }
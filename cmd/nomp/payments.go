@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+	"github.com/mining-pool/not-only-mining-pool/daemons"
+	"github.com/mining-pool/not-only-mining-pool/engine"
+	"github.com/mining-pool/not-only-mining-pool/payments"
+	"github.com/mining-pool/not-only-mining-pool/storage"
+)
+
+const paymentsUsage = "usage: nomp [-c config.json] payments [audit]"
+
+// runPayments is the payments subcommand. Bare, it prints what the next payout
+// run would do; with "audit", how the accounting reconciles with the confirmed
+// blocks and the wallet. Neither writes to storage nor sends from the wallet,
+// so it works with payments still disabled.
+func runPayments(ctx context.Context, conf *config.Options, args []string) error {
+	audit := false
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "audit":
+		audit = true
+	default:
+		return errors.New(paymentsUsage)
+	}
+	if conf.PaymentOptions == nil {
+		return fmt.Errorf("the config has no payment section")
+	}
+
+	db := storage.Open(conf.Coin.Name, conf.Storage)
+	defer db.Close()
+	var pm *payments.PaymentManager
+	if rewards, ok := accountRewards(conf); ok {
+		pm = payments.NewAccountPaymentManager(conf.PaymentOptions, conf.PoolAddress, conf.Daemons, rewards, db)
+	} else {
+		dm := daemons.NewDaemonManager(conf.Daemons, conf.Coin)
+		pm = payments.NewPaymentManager(conf.PaymentOptions, conf.PoolAddress, dm, db)
+		// the gbt pool logs each share with its value for fpps and pps+
+		eng := strings.ToLower(conf.Engine)
+		pm.PricedShares = eng == "" || eng == "gbt"
+	}
+	if err := pm.Init(ctx); err != nil {
+		return err
+	}
+
+	if audit {
+		a, err := pm.Audit(ctx)
+		if err != nil {
+			return err
+		}
+		printAudit(a)
+		return nil
+	}
+	plan, err := pm.DryRun(ctx)
+	if err != nil {
+		return err
+	}
+	printPlan(plan)
+	return nil
+}
+
+// accountRewards returns the reward schedule of an account-model engine (one
+// built in with its tag), whose coin is paid from the pool's account.
+func accountRewards(conf *config.Options) (payments.AccountRewards, bool) {
+	eng, ok := engine.Get(strings.ToLower(conf.Engine))
+	if !ok {
+		return nil, false
+	}
+	rewards, ok := eng.(payments.AccountRewards)
+	return rewards, ok
+}
+
+func printPlan(plan *payments.Plan) {
+	fmt.Printf("dry run of the next %s payout run; nothing is written or sent\n", plan.PayMode)
+	if plan.Intent != "" {
+		fmt.Println("first:", plan.Intent)
+	}
+	for _, b := range plan.Confirmed {
+		fmt.Println("confirm", b)
+	}
+	for _, b := range plan.Orphaned {
+		fmt.Println("orphan ", b)
+	}
+	if len(plan.Miners) == 0 {
+		fmt.Println("no miner is credited or paid")
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "MINER\tBALANCE\tREWARD\tPAY\tOWED\t")
+	for _, m := range plan.Miners {
+		owed := coin(m.Owed)
+		if m.Held {
+			owed += " (daily)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t\n", m.Miner, coin(m.Balance), coin(m.Reward), coin(m.Pay), owed)
+	}
+	_ = tw.Flush()
+	fmt.Printf("credits %s, pays %s in %d transaction(s), carries %s over\n",
+		coin(plan.Credited), coin(plan.Paid), plan.Transactions, coin(plan.Owed))
+}
+
+func printAudit(a *payments.Audit) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "confirmed block rewards\t%s\t(%d blocks)\n", coin(a.Rewards), a.Blocks)
+	fmt.Fprintf(tw, "miner balances\t%s\t\n", coin(a.Balances))
+	fmt.Fprintf(tw, "paid to miners\t%s\t\n", coin(a.Paid))
+	fmt.Fprintf(tw, "retained by the pool\t%s\t\n", coin(a.Retained))
+	fmt.Fprintf(tw, "wallet balance\t%s\t\n", coin(a.Wallet))
+	_ = tw.Flush()
+
+	if a.Retained < 0 {
+		fmt.Printf("MISMATCH: miners were credited %s more than the confirmed blocks paid (expected in pps modes)\n", coin(-a.Retained))
+	}
+	if a.Shortfall > 0 {
+		fmt.Printf("SHORTFALL: the wallet is %s short of the balances owed\n", coin(a.Shortfall))
+	}
+	for _, b := range a.Reorged {
+		fmt.Println("REORGED: confirmed block is no longer on the chain:", b)
+	}
+	for _, b := range a.Unknown {
+		fmt.Println("UNKNOWN: the wallet can't tell the reward of", b)
+	}
+}
+
+func coin(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -14,7 +14,8 @@ import (
 // algorithms shipped as templates but registered only under a build tag (cgo).
 // They are legitimately absent from the default build's registry.
 var pendingBindingAlgos = map[string]bool{
-	"neoscrypt": true, // registered with -tags neoscrypt (github.com/sparkspay/go-neoscrypt)
+	"neoscrypt":  true, // registered with -tags neoscrypt (github.com/sparkspay/go-neoscrypt)
+	"ghostrider": true, // Raptoreum; no pure-Go implementation, bind via algorithm.RegisterHash
 }
 
 // TestCoinTemplates validates every shipped coin config template: it must be
@@ -72,9 +73,30 @@ func TestCoinTemplates(t *testing.T) {
 					t.Fatalf("port %d: minDiff > maxDiff", port)
 				}
 			}
+			for i, p := range opt.Coin.TemplatePayees {
+				// a top-level payee must name its keys, or it would read the
+				// template's own "payee"/"amount" fields by accident.
+				if p == nil || (p.Field == "" && p.PayeeKey == "" && p.ScriptKey == "") {
+					t.Fatalf("coin.templatePayees[%d] needs a field or payee/script keys", i)
+				}
+			}
 			if opt.PoolAddress == nil || opt.PoolAddress.Address == "" {
 				t.Fatal("poolAddress is required")
 			}
+			for name, n := range opt.Coin.Networks {
+				if name != "mainnet" && name != "testnet" && name != "regtest" {
+					t.Fatalf("coin.networks has unknown network %q", name)
+				}
+				if n == nil || (n.Bech32HRP == "" && n.CashAddrPrefix == "" && n.P2PKHVersion == nil) {
+					t.Fatalf("coin.networks.%s declares no address encoding", name)
+				}
+			}
+			// "auto" addresses are matched against coin.networks and fail without them
+			for _, r := range append([]*config.Recipient{opt.PoolAddress}, opt.RewardRecipients...) {
+				if strings.ToLower(r.Type) == "auto" && len(opt.Coin.Networks) == 0 {
+					t.Fatalf("%s uses type auto but coin.networks is empty", r.Address)
+				}
+			}
 
 			// x11/keccak-style coins must NOT use the sha256d block hasher, and
 			// sha256d/scrypt coins normally do — a common config mistake.
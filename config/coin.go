@@ -1,5 +1,7 @@
 package config
 
+import "github.com/mining-pool/not-only-mining-pool/utils"
+
 type CoinOptions struct {
 	Name       string `json:"name"`
 	Symbol     string `json:"symbol"`
@@ -9,8 +11,54 @@ type CoinOptions struct {
 	// Litecoin requires ["mweb","segwit"]; some coins need [] (no rules).
 	GBTRules []string `json:"gbtRules"`
 
+	// TemplatePayees declares the mandatory coinbase outputs the coin's
+	// getblocktemplate asks for beyond Dash's masternode/superblock, e.g.
+	// Raptoreum's "smartnode" and "founder", or a community fund.
+	TemplatePayees []*TemplatePayee `json:"templatePayees"`
+	// CoinbasePayloadType is the DIP2 special transaction type of the coinbase
+	// when the template carries coinbase_payload. 0 defaults to 5 (CbTx).
+	CoinbasePayloadType int `json:"coinbasePayloadType"`
+
+	// Networks lists the coin's address encodings per network, keyed
+	// "mainnet", "testnet" and "regtest". Recipients of type "auto" are matched
+	// against them, so an address of another coin is refused.
+	Networks map[string]*utils.AddressNetwork `json:"networks"`
+
 	// auto-filled from rpc
 	Reward        string `json:"reward"`
 	NoSubmitBlock bool   `json:"noSubmitBlock"`
 	Testnet       bool   `json:"testnet"`
 }
+
+// TemplatePayee describes where a getblocktemplate response lists payees the
+// coinbase must pay. Field may hold one payee object or an array of them; an
+// empty Field reads the keys from the top level of the template instead (for
+// forks with flat fields like "community_address"/"community_amount").
+type TemplatePayee struct {
+	Field string `json:"field"`
+
+	PayeeKey  string `json:"payeeKey"`  // address key, default "payee"
+	ScriptKey string `json:"scriptKey"` // hex scriptPubKey key, default "script"; preferred over the address
+	AmountKey string `json:"amountKey"` // amount key (satoshis), default "amount"
+
+	// EnabledKey names an optional template boolean gating the payee, e.g.
+	// "founder_payments_started". The payee is skipped while it is false.
+	EnabledKey string `json:"enabledKey"`
+	// Required rejects templates that lack the field instead of skipping it.
+	Required bool `json:"required"`
+}
+
+// WithDefaults returns a copy with the key names filled in.
+func (p *TemplatePayee) WithDefaults() *TemplatePayee {
+	c := *p
+	if c.PayeeKey == "" {
+		c.PayeeKey = "payee"
+	}
+	if c.ScriptKey == "" {
+		c.ScriptKey = "script"
+	}
+	if c.AmountKey == "" {
+		c.AmountKey = "amount"
+	}
+	return &c
+}
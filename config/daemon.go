@@ -1,7 +1,13 @@
 package config
 
 import (
+	"fmt"
+	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type DaemonOptions struct {
@@ -16,6 +22,80 @@ type DaemonOptions struct {
 	// fall back to polling when it is empty. bitcoind: -zmqpubhashblock;
 	// monerod: --zmq-pub.
 	ZMQ string `json:"zmq"`
+
+	// Timeout bounds each RPC request in seconds (default 30). A daemon that
+	// times out counts as failed and requests fail over to the next one.
+	Timeout int `json:"timeout"`
+
+	// CookieFile is the node's RPC cookie (bitcoind's <datadir>/.cookie),
+	// used instead of User/Password. It is re-read whenever the node answers
+	// 401, since the node writes a new cookie on every restart. Nodes set up
+	// with rpcauth= take the plain User/Password of that entry.
+	CookieFile string `json:"cookieFile"`
+
+	cookieMu   sync.Mutex
+	cookieUser string
+	cookiePass string
+}
+
+// SetAuth adds the basic auth credentials to req: those from CookieFile when
+// set, else User/Password.
+func (d *DaemonOptions) SetAuth(req *http.Request) error {
+	if d.CookieFile == "" {
+		if d.User != "" {
+			req.SetBasicAuth(d.User, d.Password)
+		}
+		return nil
+	}
+
+	d.cookieMu.Lock()
+	defer d.cookieMu.Unlock()
+	if d.cookieUser == "" {
+		if err := d.readCookie(); err != nil {
+			return err
+		}
+	}
+	req.SetBasicAuth(d.cookieUser, d.cookiePass)
+	return nil
+}
+
+// ReloadCookie re-reads CookieFile after the node rejected the cached cookie.
+// It reports whether the credentials changed, i.e. whether a retry can help.
+func (d *DaemonOptions) ReloadCookie() bool {
+	if d.CookieFile == "" {
+		return false
+	}
+
+	d.cookieMu.Lock()
+	defer d.cookieMu.Unlock()
+	user, pass := d.cookieUser, d.cookiePass
+	if err := d.readCookie(); err != nil {
+		log.Error(err)
+		return false
+	}
+	return d.cookieUser != user || d.cookiePass != pass
+}
+
+func (d *DaemonOptions) readCookie() error {
+	raw, err := os.ReadFile(d.CookieFile)
+	if err != nil {
+		return fmt.Errorf("reading rpc cookie: %w", err)
+	}
+
+	user, pass, ok := strings.Cut(strings.TrimSpace(string(raw)), ":")
+	if !ok || user == "" {
+		return fmt.Errorf("rpc cookie %s is not in user:password form", d.CookieFile)
+	}
+	d.cookieUser, d.cookiePass = user, pass
+	return nil
+}
+
+// RequestTimeout is Timeout as a duration, with the default applied.
+func (d *DaemonOptions) RequestTimeout() time.Duration {
+	if d.Timeout <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(d.Timeout) * time.Second
 }
 
 func (d *DaemonOptions) String() string {
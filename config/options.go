@@ -27,7 +27,7 @@ type Options struct {
 	Ports          map[int]*PortOptions `json:"ports"`
 	Daemons        []*DaemonOptions     `json:"daemons"`
 	P2P            *P2POptions          `json:"p2p"`
-	Storage        *RedisOptions        `json:"storage"`
+	Storage        *StorageOptions      `json:"storage"`
 	Algorithm      *AlgorithmOptions    `json:"algorithm"`
 	PaymentOptions *PaymentOptions      `json:"payment"`
 }
@@ -40,3 +40,19 @@ func (o *Options) TotalFeePercent() float64 {
 
 	return totalFeePercent
 }
+
+// BindAddressNetworks hands the coin's address networks to the pool address
+// and reward recipients, so those typed "auto" can be decoded. Call it before
+// the first GetScript.
+func (o *Options) BindAddressNetworks() {
+	if o.Coin == nil {
+		return
+	}
+
+	if o.PoolAddress != nil {
+		o.PoolAddress.networks = o.Coin.Networks
+	}
+	for _, r := range o.RewardRecipients {
+		r.networks = o.Coin.Networks
+	}
+}
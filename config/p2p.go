@@ -7,6 +7,22 @@ type P2POptions struct {
 	Port                int    `json:"port"`
 	Magic               string `json:"magic"`
 	DisableTransactions bool   `json:"disableTransactions"`
+
+	// Peers are more "host:port" nodes to listen to besides Host:Port. A block
+	// is notified once, by whichever peer announces it first.
+	Peers []string `json:"peers"`
+	// PingInterval is the keepalive period in seconds (default 60). A peer
+	// silent for three periods is dropped and redialed.
+	PingInterval int `json:"pingInterval"`
+}
+
+// Addrs lists every peer address, Host:Port first.
+func (p2p *P2POptions) Addrs() []string {
+	addrs := make([]string, 0, 1+len(p2p.Peers))
+	if p2p.Host != "" {
+		addrs = append(addrs, p2p.Addr())
+	}
+	return append(addrs, p2p.Peers...)
 }
 
 func (p2p *P2POptions) Addr() string {
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/mining-pool/not-only-mining-pool/utils"
@@ -11,7 +12,9 @@ type Recipient struct {
 	Type    string  `json:"type"`
 	Percent float64 `json:"percent"`
 
-	script []byte
+	script   []byte
+	networks map[string]*utils.AddressNetwork
+	network  string
 }
 
 func (r *Recipient) GetScript() []byte {
@@ -23,10 +26,23 @@ func (r *Recipient) GetScript() []byte {
 			r.script = utils.P2PKHAddressToScript(r.Address)
 		case "p2wsh":
 			r.script = utils.P2WSHAddressToScript(r.Address)
+		case "p2wpkh":
+			r.script = utils.P2WPKHAddressToScript(r.Address)
+		case "p2tr":
+			r.script = utils.P2TRAddressToScript(r.Address)
+		case "cashaddr":
+			r.script = utils.CashAddrToScript(r.Address, r.cashAddrPrefix())
 		case "pk", "publickey":
 			r.script = utils.PublicKeyToScript(r.Address)
 		case "script":
 			r.script = utils.ScriptPubKeyToScript(r.Address)
+		case "auto":
+			script, network, err := utils.AutoAddressToScript(r.Address, r.networks)
+			if err != nil {
+				log.Error(err)
+				break
+			}
+			r.script, r.network = script, network
 		case "":
 			log.Error(r.Address, " has no type!")
 		default:
@@ -38,6 +54,21 @@ func (r *Recipient) GetScript() []byte {
 	return r.script
 }
 
+// Network is the coin network ("mainnet", "testnet", ...) an "auto" address
+// was matched to, or "" before GetScript or for other types.
+func (r *Recipient) Network() string {
+	return r.network
+}
+
+// cashAddrPrefix is the mainnet CashAddr prefix used for addresses written
+// without one.
+func (r *Recipient) cashAddrPrefix() string {
+	if n := r.networks["mainnet"]; n != nil && n.CashAddrPrefix != "" {
+		return n.CashAddrPrefix
+	}
+	return "bitcoincash"
+}
+
 type PaymentOptions struct {
 	Interval   int64   `json:"interval"`   // seconds between payout runs (default 600)
 	MinPayment float64 `json:"minPayment"` // minimum coin owed before a miner is paid
@@ -47,17 +78,49 @@ type PaymentOptions struct {
 	// PayMode selects how miners are rewarded:
 	//   "prop"  (default) proportional to that block's round shares
 	//   "pplns"           proportional to the last-N-difficulty window of shares
+	//   "pplnt"           proportional to the shares of the last pplntWindow
+	//                     seconds before the block
+	//   "score"           proportional to share scores that decay exponentially
+	//                     with age (slush-style), scoreDecay the time constant
 	//   "solo"            the miner who found the block takes the whole reward
 	//   "pps"             pay a fixed rate per share immediately; found blocks
 	//                     just refill the pool wallet (the pool bears variance)
+	//   "fpps"            pps at the rate of each share's job template: its
+	//                     coinbase value (subsidy and fees) over the network
+	//                     difficulty, fixed when the share is logged
+	//   "pps+"            pps for the template's subsidy only; each block's
+	//                     actual fees are split over the pplns window instead
 	PayMode string `json:"payMode"`
 	// PPLNSWindow is the pplns look-back as a total share difficulty; <=0 falls
-	// back to the block's own round (so pplns degrades to prop).
+	// back to the block's own round (so pplns degrades to prop). "pps+" splits
+	// fees over it too, and requires it.
 	PPLNSWindow float64 `json:"pplnsWindow"`
+	// PPLNTWindow is the pplnt look-back in seconds (default 3600).
+	PPLNTWindow int64 `json:"pplntWindow"`
+	// ScoreDecay is the score time constant in seconds: a share's weight falls
+	// by a factor of e for every scoreDecay it is older than the block (default
+	// 300).
+	ScoreDecay float64 `json:"scoreDecay"`
 	// PPSRate is the pps price paid per unit of share difficulty (in coin). It
 	// must be set (>0) when payMode is "pps".
 	PPSRate float64 `json:"ppsRate"`
 
+	// CoinbasePayouts pays the PPLNS window directly in each block's coinbase
+	// instead of through the pool wallet (payMode "pplns" only). Miners owed less
+	// than CoinbaseDust, beyond the CoinbaseMaxOutputs largest, or whose names
+	// are not CoinbaseAddressType addresses stay in the pool output; the payer
+	// then pays only those remainders with sendmany.
+	CoinbasePayouts bool `json:"coinbasePayouts"`
+	// CoinbaseDust is the smallest coinbase output, in coin (default 0.0001).
+	CoinbaseDust float64 `json:"coinbaseDust"`
+	// CoinbaseMaxOutputs caps the miner outputs per coinbase (default 100).
+	CoinbaseMaxOutputs int `json:"coinbaseMaxOutputs"`
+	// CoinbaseAddressType is how miner names are paid: "p2pkh" (default), "p2sh"
+	// or "auto" (any address of coin.networks, including segwit and CashAddr).
+	// Names are checked against coin.networks, so a coin without them pays
+	// nobody in the coinbase.
+	CoinbaseAddressType string `json:"coinbaseAddressType"`
+
 	// --- coin-fork configurability ---
 
 	// Magnitude is the number of base units (satoshis) in one coin, e.g. 1e8 for
@@ -80,6 +143,33 @@ type PaymentOptions struct {
 	// OmitSendManyDummy drops the leading argument entirely for forks whose
 	// sendmany takes only the {address:amount} map.
 	OmitSendManyDummy bool `json:"omitSendManyDummy"`
+
+	// --- payout transactions ---
+
+	// MaxOutputs caps the miners paid by one sendmany; a run owing more sends
+	// several transactions (default 500).
+	MaxOutputs int `json:"maxOutputs"`
+	// FeeRate (sat/vB) or ConfTarget (blocks) sets the payout fee instead of
+	// the wallet's default; set one at most. Both need the sendmany of Bitcoin
+	// Core 0.21 or later.
+	FeeRate    float64 `json:"feeRate"`
+	ConfTarget int     `json:"confTarget"`
+	// SubtractFee takes each payout transaction's fee from the amounts of its
+	// recipients instead of the pool wallet. The ledger records the amounts
+	// before the fee.
+	SubtractFee bool `json:"subtractFee"`
+	// BumpAfter is how many seconds a payout may stay unconfirmed before its fee
+	// is bumped with bumpfee (RBF), at confTarget when set, or at feeRate raised
+	// past the payout's own rate by the incremental relay fee; 0 never bumps.
+	// Payouts are sent replaceable when it is set.
+	BumpAfter int64 `json:"bumpAfter"`
+
+	// --- account-model coins (ethash) ---
+
+	// GasPrice is the gas price of payout transfers, in gwei; 0 lets the node
+	// price them. A transfer stuck past bumpAfter is resent at its nonce for a
+	// quarter more, or GasPrice if that is higher.
+	GasPrice float64 `json:"gasPrice"`
 }
 
 // WithDefaults returns a copy with unset fork knobs filled with the Bitcoin
@@ -99,14 +189,87 @@ func (o *PaymentOptions) WithDefaults() *PaymentOptions {
 		c.PayMode = PayModeProp
 	}
 	c.PayMode = strings.ToLower(c.PayMode)
+	if c.PPLNTWindow <= 0 {
+		c.PPLNTWindow = 3600
+	}
+	if c.ScoreDecay <= 0 {
+		c.ScoreDecay = 300
+	}
+	if c.CoinbaseDust <= 0 {
+		c.CoinbaseDust = 0.0001
+	}
+	if c.CoinbaseMaxOutputs <= 0 {
+		c.CoinbaseMaxOutputs = 100
+	}
+	if c.CoinbaseAddressType == "" {
+		c.CoinbaseAddressType = "p2pkh"
+	}
+	c.CoinbaseAddressType = strings.ToLower(c.CoinbaseAddressType)
+	if c.MaxOutputs <= 0 {
+		c.MaxOutputs = 500
+	}
 	// SendManyDummy defaults to "" (its zero value), which is what Bitcoin Core wants.
 	return &c
 }
 
 // Reward schemes selectable via PayMode.
 const (
-	PayModeProp  = "prop"
-	PayModePPLNS = "pplns"
-	PayModeSolo  = "solo"
-	PayModePPS   = "pps"
+	PayModeProp    = "prop"
+	PayModePPLNS   = "pplns"
+	PayModePPLNT   = "pplnt"
+	PayModeScore   = "score"
+	PayModeSolo    = "solo"
+	PayModePPS     = "pps"
+	PayModeFPPS    = "fpps"
+	PayModePPSPlus = "pps+"
 )
+
+// PaysPerShare reports whether PayMode credits shares as they are logged (pps,
+// fpps and pps+) rather than splitting found blocks.
+func (o *PaymentOptions) PaysPerShare() bool {
+	switch o.PayMode {
+	case PayModePPS, PayModeFPPS, PayModePPSPlus:
+		return true
+	}
+	return false
+}
+
+// BlockPayModes are the pay modes that split each found block. A port or a
+// miner may choose one in place of PayMode, as their shares are then kept in
+// an accounting group of their own.
+var BlockPayModes = []string{PayModeProp, PayModePPLNS, PayModePPLNT, PayModeScore, PayModeSolo}
+
+// IsBlockPayMode reports whether mode is one of BlockPayModes.
+func IsBlockPayMode(mode string) bool {
+	for _, m := range BlockPayModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// ShareGroup returns the accounting group of shares mined under mode, as chosen
+// by a port or a miner: "" for the pool's own PayMode, else the mode itself.
+// Only block pay modes can be mixed, and coinbase payouts, paying one window in
+// every coinbase, can't be mixed with anything. o may be nil (payments off).
+func (o *PaymentOptions) ShareGroup(mode string) (string, error) {
+	mode = strings.ToLower(mode)
+	pool := PayModeProp
+	if o != nil {
+		pool = o.WithDefaults().PayMode
+	}
+	if mode == "" || mode == pool {
+		return "", nil
+	}
+	if !IsBlockPayMode(mode) {
+		return "", fmt.Errorf("pay mode %q can't be chosen per port or miner (want one of %s)", mode, strings.Join(BlockPayModes, ", "))
+	}
+	if !IsBlockPayMode(pool) {
+		return "", fmt.Errorf("payMode %q applies to the whole pool; %q can't be mixed with it", pool, mode)
+	}
+	if o != nil && o.CoinbasePayouts {
+		return "", fmt.Errorf("coinbasePayouts pays one window in every coinbase; %q can't be mixed with it", mode)
+	}
+	return mode, nil
+}
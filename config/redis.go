@@ -2,12 +2,25 @@ package config
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/go-redis/redis/v8"
 )
 
+// Redis deployment modes selectable with RedisOptions.Mode.
+const (
+	RedisSingle   = "single"
+	RedisSentinel = "sentinel"
+	RedisCluster  = "cluster"
+)
+
 type RedisOptions struct {
+	// Mode is "single" (default), "sentinel" or "cluster".
+	Mode string `json:"mode"`
+
 	// The network type, either tcp or unix.
 	// Default is tcp.
 	Network string `json:"network"`
@@ -15,12 +28,27 @@ type RedisOptions struct {
 	Host string `json:"host"`
 	Port int    `json:"port"`
 
+	// Addrs are the sentinels ("sentinel") or seed nodes ("cluster"), as
+	// "host:port". Host and Port are used in single mode only.
+	Addrs []string `json:"addrs"`
+	// MasterName is the sentinel-monitored master to follow.
+	MasterName       string `json:"masterName"`
+	SentinelPassword string `json:"sentinelPassword"`
+
 	Password string `json:"password"`
-	DB       int    `json:"db"`
+	DB       int    `json:"db"` // not available in cluster mode
 
 	TLS *TLSClientOptions `json:"tls"`
 }
 
+// GetMode returns the lower-cased mode, defaulting to single.
+func (ro *RedisOptions) GetMode() string {
+	if ro.Mode == "" {
+		return RedisSingle
+	}
+	return strings.ToLower(ro.Mode)
+}
+
 func (ro *RedisOptions) Addr() string {
 	return ro.Host + ":" + strconv.Itoa(ro.Port)
 }
@@ -40,3 +68,40 @@ func (ro *RedisOptions) ToRedisOptions() *redis.Options {
 		TLSConfig: tlsConfig,
 	}
 }
+
+// NewClient builds the client for the configured mode: a plain client, a
+// sentinel-following failover client, or a cluster client.
+func (ro *RedisOptions) NewClient() (redis.UniversalClient, error) {
+	var tlsConfig *tls.Config
+	if ro.TLS != nil {
+		tlsConfig = ro.TLS.ToTLSConfig()
+	}
+
+	switch ro.GetMode() {
+	case RedisSingle:
+		return redis.NewClient(ro.ToRedisOptions()), nil
+	case RedisSentinel:
+		if ro.MasterName == "" || len(ro.Addrs) == 0 {
+			return nil, errors.New("redis sentinel mode needs masterName and the sentinel addrs")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       ro.MasterName,
+			SentinelAddrs:    ro.Addrs,
+			SentinelPassword: ro.SentinelPassword,
+			Password:         ro.Password,
+			DB:               ro.DB,
+			TLSConfig:        tlsConfig,
+		}), nil
+	case RedisCluster:
+		if len(ro.Addrs) == 0 {
+			return nil, errors.New("redis cluster mode needs the seed node addrs")
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     ro.Addrs,
+			Password:  ro.Password,
+			TLSConfig: tlsConfig,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown redis mode %q, use single, sentinel or cluster", ro.Mode)
+	}
+}
@@ -4,4 +4,9 @@ type PortOptions struct {
 	Diff    float64           `json:"diff"`
 	VarDiff *VarDiffOptions   `json:"varDiff"`
 	TLS     *TLSServerOptions `json:"tls"`
+
+	// PayMode pays the blocks found on this port by a scheme of its own, e.g. a
+	// solo port beside a pplns pool; empty uses payment.payMode. See
+	// PaymentOptions.ShareGroup for the modes a port may choose.
+	PayMode string `json:"payMode"`
 }
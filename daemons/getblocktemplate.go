@@ -1,9 +1,12 @@
 package daemons
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+
+	"github.com/mining-pool/not-only-mining-pool/utils"
 )
 
 type MasternodeParams struct {
@@ -30,16 +33,16 @@ type TxParams struct {
 type GetBlockTemplate struct {
 	// Base fields from BIP 0022.  CoinbaseAux is optional.  One of
 	// CoinbaseTxn or CoinbaseValue must be specified, but not both.
-	Version int32  `json:"version"`
-	Bits    string `json:"bits"`
-	CurTime uint32 `json:"curtime"`
-	Height  int64  `json:"height"`
-	// Rules             []string    `json:"rules"`
-	PreviousBlockHash string `json:"previousblockhash"`
+	Version           int32    `json:"version"`
+	Bits              string   `json:"bits"`
+	CurTime           uint32   `json:"curtime"`
+	Height            int64    `json:"height"`
+	Rules             []string `json:"rules"`
+	PreviousBlockHash string   `json:"previousblockhash"`
 	// PreviousBits      string      `json:"previousbits"`
 	// SigOpLimit        int64       `json:"sigoplimit,omitempty"`
-	// SizeLimit         int64       `json:"sizelimit,omitempty"`
-	// WeightLimit       int64       `json:"weightlimit,omitempty"`
+	SizeLimit   int64 `json:"sizelimit,omitempty"`
+	WeightLimit int64 `json:"weightlimit,omitempty"`
 	// WorkID            string      `json:"workid,omitempty"`
 	Transactions []*TxParams `json:"transactions"`
 	// CoinbaseTxn       *TxParams   `json:"coinbasetxn,omitempty"` // Bitcoin does not produce the coinbasetxn for you, you will have to build it manually.
@@ -84,6 +87,14 @@ type GetBlockTemplate struct {
 	// SuperblocksEnabled bool               `json:"superblocks_enabled"`
 	CoinbasePayload string `json:"coinbase_payload"`
 
+	// Filled from the coin's config rather than the template's own keys:
+	// Payees are its declared mandatory outputs (config.TemplatePayee),
+	// CoinbasePayloadType the special tx type carrying coinbase_payload, and
+	// Networks the address encodings payee addresses are checked against.
+	Payees              []*TemplatePayee                 `json:"-"`
+	CoinbasePayloadType int                              `json:"-"`
+	Networks            map[string]*utils.AddressNetwork `json:"-"`
+
 	// unknown
 	Votes              []string
 	MasternodePayments interface{}
@@ -92,16 +103,21 @@ type GetBlockTemplate struct {
 }
 
 // then JobManager.ProcessTemplate(rpcData)
-func (dm *DaemonManager) GetBlockTemplate() (getBlockTemplate *GetBlockTemplate, err error) {
+func (dm *DaemonManager) GetBlockTemplate() (*GetBlockTemplate, error) {
+	return dm.GetBlockTemplateContext(context.Background())
+}
+
+// GetBlockTemplateContext is GetBlockTemplate bounded by ctx.
+func (dm *DaemonManager) GetBlockTemplateContext(ctx context.Context) (getBlockTemplate *GetBlockTemplate, err error) {
 	rules := []string{"segwit"}
 	if dm.Coin != nil && dm.Coin.GBTRules != nil {
 		rules = dm.Coin.GBTRules
 	}
-	instance, result, _ := dm.Cmd("getblocktemplate",
+	instance, result := dm.CmdContext(ctx, "getblocktemplate",
 		[]interface{}{map[string]interface{}{"capabilities": []string{"coinbasetxn", "workid", "coinbase/append"}, "rules": rules}},
 	)
-	if err != nil {
-		return nil, err
+	if result == nil {
+		return nil, errors.New("getblocktemplate call failed: no daemon answered")
 	}
 
 	if result.Error != nil {
@@ -113,6 +129,15 @@ func (dm *DaemonManager) GetBlockTemplate() (getBlockTemplate *GetBlockTemplate,
 		return nil, errors.New(fmt.Sprint("getblocktemplate call failed for daemon instance ", instance, " with error ", getBlockTemplate))
 	}
 
+	if dm.Coin != nil {
+		getBlockTemplate.Payees, err = ParseTemplatePayees(result.Result, dm.Coin.TemplatePayees)
+		if err != nil {
+			return nil, fmt.Errorf("getblocktemplate from daemon instance %s: %w", instance, err)
+		}
+		getBlockTemplate.CoinbasePayloadType = dm.Coin.CoinbasePayloadType
+		getBlockTemplate.Networks = dm.Coin.Networks
+	}
+
 	return getBlockTemplate, nil
 }
 
@@ -18,6 +18,7 @@ type GetTransaction struct {
 	Time              int                    `json:"time"`
 	Timereceived      int                    `json:"timereceived"`
 	Bip125Replaceable string                 `json:"bip125-replaceable"`
+	ReplacedByTxid    string                 `json:"replaced_by_txid"`
 	Details           []GetTransactionDetail `json:"details"`
 	Hex               string                 `json:"hex"`
 }
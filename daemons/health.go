@@ -0,0 +1,182 @@
+package daemons
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mining-pool/not-only-mining-pool/rpc"
+)
+
+// HealthCheckInterval is how often StartHealthCheck probes every daemon.
+const HealthCheckInterval = 15 * time.Second
+
+// RPC error codes with which bitcoind-family daemons refuse work they cannot
+// do yet. Requests answered with them fail over like unreachable daemons.
+const (
+	rpcClientNotConnected = -9
+	rpcInInitialDownload  = -10
+	rpcInWarmup           = -28
+)
+
+// DaemonHealth is a snapshot of one daemon's state as seen from its RPC
+// answers and the periodic probe.
+type DaemonHealth struct {
+	Daemon    string    `json:"daemon"`
+	Online    bool      `json:"online"`
+	Failures  int       `json:"failures"`  // consecutive failed requests
+	LatencyMs float64   `json:"latencyMs"` // moving average round trip
+	Height    int64     `json:"height"`    // last getblockcount, 0 if unknown
+	LastError string    `json:"lastError,omitempty"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Score     float64   `json:"score"` // 0 (offline) to 100; requests go to the highest first
+
+	RPC rpc.Stats `json:"rpc"` // request counters since startup
+}
+
+type health struct {
+	mu    sync.Mutex
+	state []DaemonHealth
+}
+
+func newHealth(names []string) *health {
+	h := &health{state: make([]DaemonHealth, len(names))}
+	for i, name := range names {
+		// unknown daemons start online so the first request tries them
+		h.state[i] = DaemonHealth{Daemon: name, Online: true}
+	}
+	return h
+}
+
+func (h *health) success(i int, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := &h.state[i]
+	ms := float64(latency) / float64(time.Millisecond)
+	if s.LatencyMs == 0 {
+		s.LatencyMs = ms
+	} else {
+		s.LatencyMs = 0.8*s.LatencyMs + 0.2*ms
+	}
+	s.Online = true
+	s.Failures = 0
+	s.LastError = ""
+	s.LastSeen = time.Now()
+}
+
+// failure records a failed request. offline is false for daemons that
+// answered but refused the work (warming up, syncing).
+func (h *health) failure(i int, err string, offline bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := &h.state[i]
+	if offline {
+		s.Online = false
+	}
+	s.Failures++
+	s.LastError = err
+}
+
+func (h *health) setHeight(i int, height int64) {
+	h.mu.Lock()
+	h.state[i].Height = height
+	h.mu.Unlock()
+}
+
+// snapshot returns the current states with their scores filled in.
+func (h *health) snapshot() []DaemonHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var best int64
+	for _, s := range h.state {
+		if s.Height > best {
+			best = s.Height
+		}
+	}
+
+	out := make([]DaemonHealth, len(h.state))
+	for i, s := range h.state {
+		if s.Online {
+			// every failure, block behind the tip and 100ms of latency halves
+			// the score roughly, so a lagging or flaky node loses to any good one
+			lag := float64(0)
+			if s.Height > 0 {
+				lag = float64(best - s.Height)
+			}
+			s.Score = 100 / (1 + float64(s.Failures)) / (1 + lag) * 100 / (100 + s.LatencyMs)
+		}
+		out[i] = s
+	}
+	return out
+}
+
+// order returns daemon indexes from healthiest to least healthy, keeping the
+// configured order between equals so the first daemon stays preferred.
+func (h *health) order() []int {
+	states := h.snapshot()
+	idx := make([]int, len(states))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		return states[idx[a]].Score > states[idx[b]].Score
+	})
+	return idx
+}
+
+// Health returns every daemon's state in configuration order.
+func (dm *DaemonManager) Health() []DaemonHealth {
+	states := dm.health.snapshot()
+	for i := range states {
+		states[i].RPC = dm.clients[i].Stats()
+	}
+	return states
+}
+
+// OnlineCount is the number of daemons whose last request succeeded.
+func (dm *DaemonManager) OnlineCount() int {
+	n := 0
+	for _, s := range dm.health.snapshot() {
+		if s.Online {
+			n++
+		}
+	}
+	return n
+}
+
+// Probe asks every daemon for its block count, refreshing their online state
+// and heights (a daemon behind the others scores lower).
+func (dm *DaemonManager) Probe() {
+	results := dm.CmdAll("getblockcount", []interface{}{})
+	for i, res := range results {
+		if res == nil || res.Error != nil {
+			continue
+		}
+		var height int64
+		if err := json.Unmarshal(res.Result, &height); err == nil {
+			dm.health.setHeight(i, height)
+		}
+	}
+}
+
+// StartHealthCheck probes the daemons every HealthCheckInterval until stop is
+// closed (never, for a nil stop), so offline daemons are noticed and rejoin
+// without a request failing on them first.
+func (dm *DaemonManager) StartHealthCheck(stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(HealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				dm.Probe()
+			}
+		}
+	}()
+}
@@ -1,25 +1,54 @@
 package daemons
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
-	"net/http"
+	"net"
 	"strconv"
 	"sync"
+	"time"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/mining-pool/not-only-mining-pool/config"
-	"github.com/mining-pool/not-only-mining-pool/utils"
+	"github.com/mining-pool/not-only-mining-pool/rpc"
 )
 
 var log = logging.Logger("daemons")
 
+// readRetries is how many more attempts the node's read-only calls get after a
+// transport failure or timeout. Every other call, the wallet's included, is
+// sent once: a sendmany that timed out may have been sent all the same.
+const readRetries = 1
+
+// readOnly are the chain, mining and network calls that are safe to repeat.
+var readOnly = map[string]bool{
+	"getbestblockhash":  true,
+	"getblock":          true,
+	"getblockchaininfo": true,
+	"getblockcount":     true,
+	"getblockhash":      true,
+	"getblockheader":    true,
+	"getblockstats":     true,
+	"getblocktemplate":  true,
+	"getdifficulty":     true,
+	"getinfo":           true,
+	"getmempoolentry":   true,
+	"getmempoolinfo":    true,
+	"getmininginfo":     true,
+	"getnetworkinfo":    true,
+	"getpeerinfo":       true,
+	"getrawtransaction": true,
+}
+
+func retryable(method string) bool { return readOnly[method] }
+
 type DaemonManager struct {
 	Daemons []*config.DaemonOptions
-	clients map[string]*http.Client
+	clients []*rpc.Client // same order as Daemons
 	Coin    *config.CoinOptions
+
+	health *health
 }
 
 func NewDaemonManager(daemons []*config.DaemonOptions, coin *config.CoinOptions) *DaemonManager {
@@ -27,169 +56,130 @@ func NewDaemonManager(daemons []*config.DaemonOptions, coin *config.CoinOptions)
 		log.Fatal("new daemon with empty options!")
 	}
 
-	clients := make(map[string]*http.Client)
-	for _, daemon := range daemons {
-		transport := &http.Transport{}
+	clients := make([]*rpc.Client, len(daemons))
+	names := make([]string, len(daemons))
+	for i, daemon := range daemons {
+		opts := rpc.Options{URL: daemon.URL(), Timeout: daemon.RequestTimeout(), Retries: readRetries, Retryable: retryable, Auth: daemon}
 		if daemon.TLS != nil {
-			transport.TLSClientConfig = daemon.TLS.ToTLSConfig()
+			opts.TLS = daemon.TLS.ToTLSConfig()
 		}
 
-		client := &http.Client{Transport: transport}
-		clients[daemon.String()] = client
+		clients[i] = rpc.NewClient(opts)
+		names[i] = net.JoinHostPort(daemon.Host, strconv.Itoa(daemon.Port)) // no rpc user: health is public via the API
 	}
 
 	return &DaemonManager{
 		Daemons: daemons,
 		Coin:    coin,
 		clients: clients,
+		health:  newHealth(names),
 	}
 }
 
+// Check probes the daemons and exits only when none of them answers. The pool
+// starts on any reachable subset; the rest rejoin once the health check sees
+// them online.
 func (dm *DaemonManager) Check() {
-	if !dm.IsAllOnline() {
-		log.Fatal("daemons are not all online!")
-	}
-}
+	dm.Probe()
 
-func (dm *DaemonManager) IsAllOnline() bool {
-	responses, _ := dm.CmdAll("getpeerinfo", []interface{}{})
-	for _, res := range responses {
-		if res.StatusCode/100 != 2 {
-			return false
-		}
-
-		var jsonRes JsonRpcResponse
-		err := json.NewDecoder(res.Body).Decode(&jsonRes)
-		if err != nil {
-			log.Error(err)
-			return false
-		}
-
-		if jsonRes.Error != nil {
-			log.Error(jsonRes.Error)
-			return false
+	online := dm.OnlineCount()
+	if online == 0 {
+		log.Fatal("no daemon is online!")
+	}
+	if online < len(dm.Daemons) {
+		for _, s := range dm.Health() {
+			if !s.Online {
+				log.Warnf("daemon %s is offline (%s), starting without it", s.Daemon, s.LastError)
+			}
 		}
-
 	}
-
-	return true
 }
 
-func (dm *DaemonManager) DoHttpRequest(daemon *config.DaemonOptions, reqRawData []byte) (*http.Response, error) {
-	client := dm.clients[daemon.String()]
-
-	req, err := http.NewRequest("POST", daemon.URL(), bytes.NewReader(reqRawData))
-	if err != nil {
-		log.Panic(err)
-	}
-	if daemon.User != "" {
-		req.SetBasicAuth(daemon.User, daemon.Password)
-	}
-
-	return client.Do(req)
+func (dm *DaemonManager) IsAllOnline() bool {
+	dm.Probe()
+	return dm.OnlineCount() == len(dm.Daemons)
 }
 
+// BatchCmd sends commands, each a [method, params] pair, as one batch to the
+// healthiest daemon that answers.
 func (dm *DaemonManager) BatchCmd(commands []interface{}) (*config.DaemonOptions, []*JsonRpcResponse, error) {
-	requestJson := make([]map[string]interface{}, len(commands))
+	reqs := make([]rpc.Request, len(commands))
 	for i := range commands {
-		requestJson[i] = map[string]interface{}{
-			"id":     utils.RandPositiveInt64(),
-			"method": commands[i].([]interface{})[0],
-			"params": commands[i].([]interface{})[1],
+		reqs[i] = rpc.Request{
+			Method: commands[i].([]interface{})[0].(string),
+			Params: commands[i].([]interface{})[1],
 		}
 	}
 
-	for i := range dm.Daemons {
-		raw, _ := json.Marshal(requestJson)
-		res, err := dm.DoHttpRequest(dm.Daemons[i], raw)
+	var lastErr error
+	for _, i := range dm.health.order() {
+		start := time.Now()
+		answers, err := dm.clients[i].Batch(context.Background(), reqs)
 		if err != nil {
-			return dm.Daemons[i], nil, err
-		}
-		var rpcResponses []*JsonRpcResponse
-		err = json.NewDecoder(res.Body).Decode(&rpcResponses)
-		if err != nil {
-			return dm.Daemons[i], nil, err
+			dm.health.failure(i, err.Error(), true)
+			lastErr = err
+			continue
 		}
+		dm.health.success(i, time.Since(start))
 
-		return dm.Daemons[i], rpcResponses, err
+		results := make([]*JsonRpcResponse, len(answers))
+		for j, a := range answers {
+			results[j] = toJsonRpcResponse(a)
+		}
+		return dm.Daemons[i], results, nil
 	}
 
-	return nil, nil, nil
+	if lastErr == nil {
+		lastErr = errors.New("no daemon configured")
+	}
+	return nil, nil, lastErr
 }
 
 // CmdAll sends the rpc call to all daemon, and never break because of any error.
-// So the elem in responses may be nil
-func (dm *DaemonManager) CmdAll(method string, params []interface{}) (responses []*http.Response, results []*JsonRpcResponse) {
-	responses = make([]*http.Response, len(dm.Daemons))
-	results = make([]*JsonRpcResponse, len(dm.Daemons))
-
-	msg := map[string]interface{}{
-		"id":     utils.RandPositiveInt64(),
-		"method": method,
-		"params": params,
-	}
-
-	reqRawData, err := json.Marshal(msg)
-	if err != nil {
-		log.Errorf("failed marshaling %v: %s", msg, err)
-		return // all elem are nil
-	}
+// So the elem in results may be nil
+func (dm *DaemonManager) CmdAll(method string, params []interface{}) (results []*JsonRpcResponse) {
+	return dm.CmdAllContext(context.Background(), method, params)
+}
 
-	log.Debug(string(reqRawData))
+// CmdAllContext is CmdAll bounded by ctx.
+func (dm *DaemonManager) CmdAllContext(ctx context.Context, method string, params []interface{}) (results []*JsonRpcResponse) {
+	results = make([]*JsonRpcResponse, len(dm.Daemons))
 
 	wg := sync.WaitGroup{}
 	for i := range dm.Daemons {
 		wg.Add(1)
 		go func(i int) {
-			res, err := dm.DoHttpRequest(dm.Daemons[i], reqRawData)
-			if err != nil {
-				log.Errorf("failed on daemon %s: %s", dm.Daemons[i].String(), err)
-				return
-			}
-
-			//if err := dm.CheckStatusCode(res.StatusCode); err != nil {
-			//	log.Println(err)
-			//}
-
-			responses[i] = res
-
-			var result JsonRpcResponse
-			raw, err := ioutil.ReadAll(res.Body)
-			if err != nil {
-				log.Error(err)
-			}
-			res.Body = ioutil.NopCloser(bytes.NewBuffer(raw))
-
-			err = json.Unmarshal(raw, &result)
-			if err != nil {
-				log.Panicf("failed to unmarshal response body: %s", raw)
-			}
-
-			results[i] = &result
-
-			wg.Done()
+			defer wg.Done()
+			results[i] = dm.do(ctx, i, method, params)
 		}(i)
 	}
 
 	wg.Wait()
 
-	return responses, results
+	return results
 }
 
-// CheckBlockAccepted asks every daemon for the block and reports whether they
-// all have it (accepted into the chain) along with its coinbase transaction id
-// (the block's first tx), which the payout processor needs to attribute the
-// reward. tx is empty when no daemon could return the block.
+// CheckBlockAccepted asks every daemon for the block and reports whether all
+// that answered have it (accepted into the chain) along with its coinbase
+// transaction id (the block's first tx), which the payout processor needs to
+// attribute the reward. Unreachable daemons don't count against acceptance,
+// but at least one must answer. tx is empty when no daemon returned the block.
 func (dm *DaemonManager) CheckBlockAccepted(blockHash string) (isAccepted bool, tx string) {
-	_, results := dm.CmdAll("getblock", []interface{}{blockHash})
+	results := dm.CmdAll("getblock", []interface{}{blockHash})
 
+	answered := 0
 	isAccepted = true
 	for i := range results {
-		isAccepted = isAccepted && results[i] != nil && results[i].Error == nil
+		if results[i] == nil {
+			continue
+		}
+		answered++
+		isAccepted = isAccepted && results[i].Error == nil
 	}
+	isAccepted = isAccepted && answered > 0
 
 	for i := range results {
-		if results[i] == nil {
+		if results[i] == nil || results[i].Error != nil {
 			continue
 		}
 		gb := BytesToGetBlock(results[i].Result)
@@ -228,60 +218,114 @@ func (dm *DaemonManager) CheckStatusCode(statusCode int) error {
 	return errors.New("unknown status code:" + strconv.Itoa(statusCode))
 }
 
-// Cmd will call daemons one by one and return the first answer
-// one by one not all is to try fetching from the same one not random one
-func (dm *DaemonManager) Cmd(method string, params []interface{}) (*config.DaemonOptions, *JsonRpcResponse, *http.Response) {
-	for i := range dm.Daemons {
-		return dm.cmdToIndex(i, method, params)
+// Cmd calls the daemons from healthiest to least healthy and returns the first
+// answer. Unreachable daemons, and those still warming up or syncing, are
+// skipped over; any other answer, RPC errors included, is returned as is. The
+// result is nil only when no daemon answered at all.
+func (dm *DaemonManager) Cmd(method string, params []interface{}) (*config.DaemonOptions, *JsonRpcResponse) {
+	return dm.CmdContext(context.Background(), method, params)
+}
+
+// CmdContext is Cmd bounded by ctx.
+func (dm *DaemonManager) CmdContext(ctx context.Context, method string, params []interface{}) (*config.DaemonOptions, *JsonRpcResponse) {
+	// if every daemon is busy, hand back the last refusal so the caller sees why
+	var busy *config.DaemonOptions
+	var busyResult *JsonRpcResponse
+	for _, i := range dm.health.order() {
+		result := dm.do(ctx, i, method, params)
+		if result == nil {
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if unavailable(result.Error) {
+			busy, busyResult = dm.Daemons[i], result
+			continue
+		}
+		return dm.Daemons[i], result
 	}
 
-	log.Error("failed getting GBT from all daemons!")
-	return nil, nil, nil
+	log.Errorf("%s failed on all daemons!", method)
+	return busy, busyResult
 }
 
 // CmdToDaemon runs method against a specific daemon by index. The payer uses it
 // so wallet RPCs (getaddressinfo/getbalance/gettransaction/sendmany) reach the
 // configured payment.daemon rather than always the first daemon.
-func (dm *DaemonManager) CmdToDaemon(index int, method string, params []interface{}) (*config.DaemonOptions, *JsonRpcResponse, *http.Response) {
+func (dm *DaemonManager) CmdToDaemon(index int, method string, params []interface{}) (*config.DaemonOptions, *JsonRpcResponse) {
+	return dm.CmdToDaemonContext(context.Background(), index, method, params)
+}
+
+// CmdToDaemonContext is CmdToDaemon bounded by ctx.
+func (dm *DaemonManager) CmdToDaemonContext(ctx context.Context, index int, method string, params []interface{}) (*config.DaemonOptions, *JsonRpcResponse) {
 	if index < 0 || index >= len(dm.Daemons) {
 		log.Errorf("daemon index %d out of range (have %d daemons)", index, len(dm.Daemons))
-		return nil, nil, nil
+		return nil, nil
 	}
-	return dm.cmdToIndex(index, method, params)
+
+	return dm.Daemons[index], dm.do(ctx, index, method, params)
 }
 
-func (dm *DaemonManager) cmdToIndex(i int, method string, params []interface{}) (*config.DaemonOptions, *JsonRpcResponse, *http.Response) {
-	reqRawData, err := json.Marshal(map[string]interface{}{
-		"id":     utils.RandPositiveInt64(),
-		"method": method,
-		"params": params,
-	})
-	if err != nil {
-		log.Error(err)
-		return dm.Daemons[i], nil, nil
+// Stats returns the request counters of each daemon's client, in
+// configuration order.
+func (dm *DaemonManager) Stats() []rpc.Stats {
+	stats := make([]rpc.Stats, len(dm.clients))
+	for i, c := range dm.clients {
+		stats[i] = c.Stats()
 	}
+	return stats
+}
 
-	// A nil result signals failure to the caller. Never fall through a transport,
-	// read or decode error: an unreachable daemon returns a nil response (so
-	// res.Body would panic) and a garbled body must not look like a success.
-	res, err := dm.DoHttpRequest(dm.Daemons[i], reqRawData)
-	if err != nil || res == nil {
-		log.Error("daemon request failed: ", err)
-		return dm.Daemons[i], nil, nil
+// do sends one request to daemon i and records the outcome in its health. A
+// nil result means no JSON-RPC answer came back; the reason is logged.
+func (dm *DaemonManager) do(ctx context.Context, i int, method string, params []interface{}) *JsonRpcResponse {
+	if params == nil {
+		params = []interface{}{}
 	}
 
-	raw, err := ioutil.ReadAll(res.Body)
+	start := time.Now()
+	res, err := dm.clients[i].CallRaw(ctx, method, params)
 	if err != nil {
-		log.Error(err)
-		return dm.Daemons[i], nil, res
+		log.Errorf("request to daemon %s failed: %s", dm.Daemons[i], err)
+		dm.health.failure(i, err.Error(), true)
+		return nil
+	}
+
+	result := toJsonRpcResponse(res)
+	if unavailable(result.Error) {
+		dm.health.failure(i, result.Error.Message, false)
+	} else {
+		dm.health.success(i, time.Since(start))
 	}
-	res.Body = ioutil.NopCloser(bytes.NewBuffer(raw))
 
-	var result JsonRpcResponse
-	if err := json.Unmarshal(raw, &result); err != nil {
-		log.Error(err)
-		return dm.Daemons[i], nil, res
+	return result
+}
+
+func toJsonRpcResponse(res *rpc.Response) *JsonRpcResponse {
+	if res == nil {
+		return nil
 	}
 
-	return dm.Daemons[i], &result, res
+	result := &JsonRpcResponse{Result: res.Result}
+	_ = json.Unmarshal(res.ID, &result.Id)
+	if res.Error != nil {
+		result.Error = &JsonRpcError{Code: res.Error.Code, Message: res.Error.Message}
+	}
+	return result
+}
+
+// unavailable reports RPC errors that mean the daemon can't serve requests
+// yet, as opposed to errors about the request itself.
+func unavailable(err *JsonRpcError) bool {
+	if err == nil {
+		return false
+	}
+
+	switch err.Code {
+	case rpcClientNotConnected, rpcInInitialDownload, rpcInWarmup:
+		return true
+	default:
+		return false
+	}
 }
@@ -0,0 +1,217 @@
+package daemons
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+)
+
+// rpcDaemon serves bitcoind-style JSON-RPC answers from handle, which returns
+// the result or an error for a method.
+func rpcDaemon(t *testing.T, handle func(method string) (interface{}, *JsonRpcError)) *config.DaemonOptions {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			Id     interface{} `json:"id"`
+			Method string      `json:"method"`
+		}
+		_ = json.Unmarshal(body, &req)
+
+		result, rpcErr := handle(req.Method)
+		raw, _ := json.Marshal(result)
+		_ = json.NewEncoder(rw).Encode(&JsonRpcResponse{Id: req.Id, Result: raw, Error: rpcErr})
+	}))
+	t.Cleanup(srv.Close)
+
+	return daemonAt(t, srv.Listener.Addr().String())
+}
+
+func daemonAt(t *testing.T, addr string) *config.DaemonOptions {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return &config.DaemonOptions{Host: host, Port: p, Timeout: 2}
+}
+
+// deadDaemon returns options pointing at a closed port.
+func deadDaemon(t *testing.T) *config.DaemonOptions {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return daemonAt(t, addr)
+}
+
+func fixedHeight(height int64) func(string) (interface{}, *JsonRpcError) {
+	return func(method string) (interface{}, *JsonRpcError) {
+		switch method {
+		case "getblockcount":
+			return height, nil
+		default:
+			return "from-" + strconv.FormatInt(height, 10), nil
+		}
+	}
+}
+
+func TestCmd_FailsOverUnreachableDaemon(t *testing.T) {
+	dead, live := deadDaemon(t), rpcDaemon(t, fixedHeight(100))
+	dm := NewDaemonManager([]*config.DaemonOptions{dead, live}, &config.CoinOptions{})
+
+	dm.Check() // must not exit with one daemon offline
+	if got := dm.OnlineCount(); got != 1 {
+		t.Fatalf("online = %d, want 1", got)
+	}
+
+	daemon, result := dm.Cmd("getdifficulty", nil)
+	if result == nil || daemon != live {
+		t.Fatalf("Cmd answered from %v (%v), want the live daemon", daemon, result)
+	}
+
+	health := dm.Health()
+	if health[0].Online || health[0].LastError == "" || !health[1].Online || health[1].Height != 100 {
+		t.Errorf("unexpected health %+v", health)
+	}
+	if health[0].Score != 0 || health[1].Score <= 0 {
+		t.Errorf("scores %v / %v, want 0 for the dead daemon and >0 for the live one", health[0].Score, health[1].Score)
+	}
+}
+
+func TestCmd_PrefersTheDaemonAtTheTip(t *testing.T) {
+	lagging, tip := rpcDaemon(t, fixedHeight(90)), rpcDaemon(t, fixedHeight(100))
+	dm := NewDaemonManager([]*config.DaemonOptions{lagging, tip}, &config.CoinOptions{})
+	dm.Probe()
+
+	_, result := dm.Cmd("getblocktemplate", nil)
+	var got string
+	if result == nil || json.Unmarshal(result.Result, &got) != nil || got != "from-100" {
+		t.Fatalf("Cmd answered %v, want the daemon at height 100", result)
+	}
+}
+
+func TestCmd_SkipsSyncingDaemon(t *testing.T) {
+	syncing := rpcDaemon(t, func(string) (interface{}, *JsonRpcError) {
+		return nil, &JsonRpcError{Code: rpcInInitialDownload, Message: "Bitcoin is downloading blocks..."}
+	})
+	ready := rpcDaemon(t, fixedHeight(100))
+	dm := NewDaemonManager([]*config.DaemonOptions{syncing, ready}, &config.CoinOptions{})
+
+	daemon, result := dm.Cmd("getblocktemplate", nil)
+	if daemon != ready || result == nil || result.Error != nil {
+		t.Fatalf("Cmd answered from %v with %+v, want the ready daemon", daemon, result)
+	}
+
+	// an answered request error is the caller's to handle, not a failover
+	refusing := rpcDaemon(t, func(string) (interface{}, *JsonRpcError) {
+		return nil, &JsonRpcError{Code: -32601, Message: "Method not found"}
+	})
+	dm = NewDaemonManager([]*config.DaemonOptions{refusing, ready}, &config.CoinOptions{})
+	daemon, result = dm.Cmd("submitblock", nil)
+	if daemon != refusing || result == nil || result.Error == nil {
+		t.Fatalf("Cmd answered from %v with %+v, want the first daemon's error", daemon, result)
+	}
+}
+
+func TestSubmitBlock_NoDaemonReachable(t *testing.T) {
+	dm := NewDaemonManager([]*config.DaemonOptions{deadDaemon(t)}, &config.CoinOptions{})
+	if got := dm.SubmitBlock("00"); got != RejectNoDaemon {
+		t.Fatalf("SubmitBlock = %q, want %q", got, RejectNoDaemon)
+	}
+}
+
+func TestCmd_RereadsRotatedCookie(t *testing.T) {
+	cookie := filepath.Join(t.TempDir(), ".cookie")
+	if err := os.WriteFile(cookie, []byte("__cookie__:first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	want := "first"
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		mu.Lock()
+		ok := user == "__cookie__" && pass == want
+		mu.Unlock()
+		if !ok {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = rw.Write([]byte(`{"id":1,"result":7,"error":null}`))
+	}))
+	defer srv.Close()
+
+	daemon := daemonAt(t, srv.Listener.Addr().String())
+	daemon.CookieFile = cookie
+	dm := NewDaemonManager([]*config.DaemonOptions{daemon}, &config.CoinOptions{})
+
+	if _, result := dm.Cmd("getblockcount", nil); result == nil || string(result.Result) != "7" {
+		t.Fatalf("first request: %+v", result)
+	}
+
+	// the node restarts and writes a new cookie
+	mu.Lock()
+	want = "second"
+	mu.Unlock()
+	if err := os.WriteFile(cookie, []byte("__cookie__:second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, result := dm.Cmd("getblockcount", nil); result == nil || string(result.Result) != "7" {
+		t.Fatalf("request after rotation: %+v", result)
+	}
+}
+
+// A dropped connection is retried for the node's read-only calls only; a
+// wallet call like sendmany may have gone through and is sent once.
+func TestCmd_RetriesReadOnlyCalls(t *testing.T) {
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			Method string `json:"method"`
+		}
+		_ = json.Unmarshal(body, &req)
+
+		mu.Lock()
+		attempts[req.Method]++
+		first := attempts[req.Method] == 1
+		mu.Unlock()
+		if first {
+			conn, _, _ := rw.(http.Hijacker).Hijack()
+			_ = conn.Close()
+			return
+		}
+		_, _ = rw.Write([]byte(`{"id":1,"result":"ok","error":null}`))
+	}))
+	defer srv.Close()
+
+	dm := NewDaemonManager([]*config.DaemonOptions{daemonAt(t, srv.Listener.Addr().String())}, &config.CoinOptions{})
+	if _, result := dm.Cmd("getblocktemplate", nil); result == nil || string(result.Result) != `"ok"` {
+		t.Errorf("getblocktemplate = %+v, want it retried", result)
+	}
+	if _, result := dm.CmdToDaemon(0, "sendmany", nil); result != nil {
+		t.Errorf("sendmany = %+v, want no answer", result)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts["getblocktemplate"] != 2 || attempts["sendmany"] != 1 {
+		t.Errorf("attempts = %v, want getblocktemplate twice and sendmany once", attempts)
+	}
+}
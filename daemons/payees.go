@@ -0,0 +1,117 @@
+package daemons
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+)
+
+// TemplatePayee is a mandatory coinbase output requested by the block template
+// through one of the coin's config.TemplatePayee declarations.
+type TemplatePayee struct {
+	Field  string `json:"field"` // template field it was read from
+	Payee  string `json:"payee"`
+	Script string `json:"script"` // hex scriptPubKey; empty when only the address is given
+	Amount uint64 `json:"amount"` // satoshis
+}
+
+// ParseTemplatePayees extracts the payees declared by decls from a raw
+// getblocktemplate result, in declaration order.
+func ParseTemplatePayees(raw []byte, decls []*config.TemplatePayee) ([]*TemplatePayee, error) {
+	if len(decls) == 0 {
+		return nil, nil
+	}
+
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &top); err != nil {
+		return nil, err
+	}
+
+	payees := make([]*TemplatePayee, 0)
+	for _, decl := range decls {
+		decl = decl.WithDefaults()
+
+		if decl.EnabledKey != "" {
+			var enabled bool
+			if v, ok := top[decl.EnabledKey]; ok {
+				if err := json.Unmarshal(v, &enabled); err != nil {
+					return nil, fmt.Errorf("template field %s: %w", decl.EnabledKey, err)
+				}
+			}
+			if !enabled {
+				continue
+			}
+		}
+
+		var objects []map[string]json.RawMessage
+		if decl.Field == "" {
+			objects = []map[string]json.RawMessage{top}
+		} else {
+			v := bytes.TrimSpace(top[decl.Field])
+			switch {
+			case len(v) == 0 || bytes.Equal(v, []byte("null")):
+				if decl.Required {
+					return nil, fmt.Errorf("template lacks required payee field %s", decl.Field)
+				}
+				continue
+			case v[0] == '[':
+				if err := json.Unmarshal(v, &objects); err != nil {
+					return nil, fmt.Errorf("template field %s: %w", decl.Field, err)
+				}
+			default:
+				var object map[string]json.RawMessage
+				if err := json.Unmarshal(v, &object); err != nil {
+					return nil, fmt.Errorf("template field %s: %w", decl.Field, err)
+				}
+				objects = append(objects, object)
+			}
+		}
+
+		for _, object := range objects {
+			payee, err := parseTemplatePayee(object, decl)
+			if err != nil {
+				return nil, err
+			}
+			if payee != nil {
+				payees = append(payees, payee)
+			}
+		}
+	}
+
+	return payees, nil
+}
+
+// parseTemplatePayee reads one payee object. It returns nil for an entry with
+// nothing to pay, which some daemons emit while a payment schedule is idle.
+func parseTemplatePayee(object map[string]json.RawMessage, decl *config.TemplatePayee) (*TemplatePayee, error) {
+	payee := &TemplatePayee{Field: decl.Field}
+	if v, ok := object[decl.PayeeKey]; ok {
+		_ = json.Unmarshal(v, &payee.Payee)
+	}
+	if v, ok := object[decl.ScriptKey]; ok {
+		_ = json.Unmarshal(v, &payee.Script)
+	}
+	if v, ok := object[decl.AmountKey]; ok {
+		var amount json.Number
+		if err := json.Unmarshal(v, &amount); err != nil {
+			return nil, fmt.Errorf("payee %s.%s: %w", decl.Field, decl.AmountKey, err)
+		}
+		// amounts are satoshis, but some daemons print them as floats (1.5e+09)
+		f, err := strconv.ParseFloat(amount.String(), 64)
+		if err != nil || f < 0 {
+			return nil, fmt.Errorf("payee %s.%s: invalid amount %s", decl.Field, decl.AmountKey, amount)
+		}
+		payee.Amount = uint64(f)
+	}
+
+	if payee.Amount == 0 {
+		return nil, nil
+	}
+	if payee.Payee == "" && payee.Script == "" {
+		return nil, fmt.Errorf("payee %s pays %d but has neither %s nor %s", decl.Field, payee.Amount, decl.PayeeKey, decl.ScriptKey)
+	}
+	return payee, nil
+}
@@ -6,23 +6,36 @@ import (
 	"github.com/mining-pool/not-only-mining-pool/utils"
 )
 
-// submitblock has no result
-func (dm *DaemonManager) SubmitBlock(blockHex string) {
+// RejectNoDaemon is SubmitBlock's reason when no daemon took the submission.
+const RejectNoDaemon = "no-daemon-reachable"
+
+// SubmitBlock sends the block to every daemon. submitblock returns null on
+// success, so rejectReason is empty unless a daemon refused the block, in which
+// case it holds the reason given by the healthiest refusing daemon (e.g.
+// "high-hash", "bad-txnmrklroot"), or RejectNoDaemon if none answered.
+func (dm *DaemonManager) SubmitBlock(blockHex string) (rejectReason string) {
+	order := dm.health.order() // before submitting, so it ranks the daemons as they were
+
 	var results []*JsonRpcResponse
 	if dm.Coin.NoSubmitBlock {
-		_, results = dm.CmdAll("getblocktemplate", []interface{}{map[string]interface{}{"mode": "submit", "data": blockHex}})
+		results = dm.CmdAll("getblocktemplate", []interface{}{map[string]interface{}{"mode": "submit", "data": blockHex}})
 	} else {
-		_, results = dm.CmdAll("submitblock", []interface{}{blockHex})
+		results = dm.CmdAll("submitblock", []interface{}{blockHex})
 	}
 
-	for i := range results {
+	answered := 0
+	for _, i := range order {
 		if results[i] == nil {
 			log.Errorf("failed submitting to daemon %s, see log above for details", dm.Daemons[i].String())
 			continue
 		}
+		answered++
 
 		if results[i].Error != nil {
 			log.Error("rpc error with daemon when submitting block: " + string(utils.Jsonify(results[i].Error)))
+			if rejectReason == "" {
+				rejectReason = results[i].Error.Message
+			}
 		} else {
 			var result string
 			err := json.Unmarshal(results[i].Result, &result)
@@ -30,7 +43,15 @@ func (dm *DaemonManager) SubmitBlock(blockHex string) {
 			// string (e.g. "high-hash", "bad-txnmrklroot", "duplicate").
 			if err == nil && result != "" {
 				log.Error("Daemon rejected the block: " + result)
+				if rejectReason == "" {
+					rejectReason = result
+				}
 			}
 		}
 	}
+
+	if answered == 0 {
+		return RejectNoDaemon
+	}
+	return rejectReason
 }
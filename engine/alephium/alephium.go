@@ -21,6 +21,7 @@
 package alephium
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -88,12 +89,12 @@ func (e *Engine) Name() string { return "alephium" }
 
 func (e *Engine) NotifyMethod() string { return "mining.notify" }
 
-func (e *Engine) Init(opts *config.Options) error {
+func (e *Engine) Init(ctx context.Context, opts *config.Options) error {
 	e.opts = opts
 	if len(opts.Daemons) == 0 {
 		return errors.New("alephium: no daemon configured")
 	}
-	if err := e.dial(); err != nil {
+	if err := e.dial(ctx); err != nil {
 		return err
 	}
 	// the node pushes an initial Jobs message on connect; read it so the first
@@ -108,9 +109,10 @@ func (e *Engine) Init(opts *config.Options) error {
 	return e.handleJobs(payload)
 }
 
-func (e *Engine) dial() error {
+func (e *Engine) dial(ctx context.Context) error {
 	d := e.opts.Daemons[0]
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", d.Host, d.Port), 10*time.Second)
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", d.Host, d.Port))
 	if err != nil {
 		return err
 	}
@@ -119,8 +121,8 @@ func (e *Engine) dial() error {
 }
 
 // Watch reads the node's binary stream; each Jobs message is an event.
-func (e *Engine) Watch(onNewWork func()) error {
-	source := worksource.Subscribe("alephium-node", func(onEvent func()) error {
+func (e *Engine) Watch(ctx context.Context, onNewWork func()) error {
+	source := worksource.Subscribe("alephium-node", func(_ context.Context, onEvent func()) error {
 		for {
 			_, msgType, payload, err := readFrame(e.conn)
 			if err != nil {
@@ -139,22 +141,26 @@ func (e *Engine) Watch(onNewWork func()) error {
 				log.Debug("alephium ignoring server msg type ", msgType)
 			}
 		}
-	}, func() (bool, error) { return true, nil })
+	}, func(context.Context) (bool, error) { return true, nil })
 	// reconnect handled by Subscribe; re-dial before each attempt
-	return worksource.Run(onNewWork, func(emit worksource.Emit) error {
+	return worksource.Run(ctx, onNewWork, func(ctx context.Context, emit worksource.Emit) error {
 		for {
 			if e.conn == nil {
-				if err := e.dial(); err != nil {
+				if err := e.dial(ctx); err != nil {
 					log.Warn("alephium redial failed: ", err)
-					time.Sleep(3 * time.Second)
+					if err := worksource.Sleep(ctx, 3*time.Second); err != nil {
+						return err
+					}
 					continue
 				}
 			}
-			err := source(emit)
+			err := source(ctx, emit)
 			log.Warn("alephium stream ended: ", err)
 			_ = e.conn.Close()
 			e.conn = nil
-			time.Sleep(time.Second)
+			if err := worksource.Sleep(ctx, time.Second); err != nil {
+				return err
+			}
 		}
 	})
 }
@@ -19,6 +19,7 @@ package beam
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
@@ -83,25 +84,26 @@ func (e *Engine) TargetParams(diff float64) (string, []interface{}) {
 	return "mining.set_difficulty", []interface{}{diff}
 }
 
-func (e *Engine) Init(opts *config.Options) error {
+func (e *Engine) Init(ctx context.Context, opts *config.Options) error {
 	e.opts = opts
 	if len(opts.Daemons) == 0 {
 		return errors.New("beam: no daemon configured")
 	}
-	return e.connectAndLogin()
+	return e.connectAndLogin(ctx)
 }
 
-func (e *Engine) connectAndLogin() error {
+func (e *Engine) connectAndLogin(ctx context.Context) error {
 	d := e.opts.Daemons[0]
 	addr := fmt.Sprintf("%s:%d", d.Host, d.Port)
 
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
 	var conn net.Conn
 	var err error
 	if d.TLS != nil {
-		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr,
-			&tls.Config{InsecureSkipVerify: true}) // beam-node uses a self-signed cert
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{InsecureSkipVerify: true}} // beam-node uses a self-signed cert
+		conn, err = tlsDialer.DialContext(ctx, "tcp", addr)
 	} else {
-		conn, err = net.DialTimeout("tcp", addr, 10*time.Second)
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
 	}
 	if err != nil {
 		return err
@@ -124,8 +126,8 @@ func (e *Engine) send(msg interface{}) error {
 }
 
 // Watch consumes the node's pushed job stream (event-driven by construction).
-func (e *Engine) Watch(onNewWork func()) error {
-	source := worksource.Subscribe("beam-node", func(onEvent func()) error {
+func (e *Engine) Watch(ctx context.Context, onNewWork func()) error {
+	source := worksource.Subscribe("beam-node", func(_ context.Context, onEvent func()) error {
 		scanner := bufio.NewScanner(e.conn)
 		scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
 		for scanner.Scan() {
@@ -137,24 +139,28 @@ func (e *Engine) Watch(onNewWork func()) error {
 			return err
 		}
 		return errors.New("beam node closed the stream")
-	}, func() (bool, error) { return true, nil })
+	}, func(context.Context) (bool, error) { return true, nil })
 
-	return worksource.Run(onNewWork, func(emit worksource.Emit) error {
+	return worksource.Run(ctx, onNewWork, func(ctx context.Context, emit worksource.Emit) error {
 		for {
 			if e.conn == nil {
-				if err := e.connectAndLogin(); err != nil {
+				if err := e.connectAndLogin(ctx); err != nil {
 					log.Warn("beam reconnect failed: ", err)
-					time.Sleep(3 * time.Second)
+					if err := worksource.Sleep(ctx, 3*time.Second); err != nil {
+						return err
+					}
 					continue
 				}
 			}
-			err := source(emit)
+			err := source(ctx, emit)
 			log.Warn("beam stream ended: ", err)
 			if e.conn != nil {
 				_ = e.conn.Close()
 			}
 			e.conn, e.enc = nil, nil
-			time.Sleep(time.Second)
+			if err := worksource.Sleep(ctx, time.Second); err != nil {
+				return err
+			}
 		}
 	})
 }
@@ -15,6 +15,7 @@
 package cryptonote
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -93,7 +94,7 @@ func (e *Engine) NotifyMethod() string { return "job" }
 // ObjectParams: ... with a bare JSON object as params.
 func (e *Engine) ObjectParams() bool { return true }
 
-func (e *Engine) Init(opts *config.Options) error {
+func (e *Engine) Init(ctx context.Context, opts *config.Options) error {
 	if newPowHasher == nil {
 		return errors.New("cryptonote engine requires RandomX: rebuild with `-tags randomx`")
 	}
@@ -107,9 +108,9 @@ func (e *Engine) Init(opts *config.Options) error {
 	if len(opts.Daemons) == 0 {
 		return errors.New("cryptonote: no daemon configured")
 	}
-	e.rpc = newXmrRPC(opts.Daemons[0].URL())
+	e.rpc = newXmrRPC(opts.Daemons[0].URL(), opts.Daemons[0])
 
-	gbt, err := e.rpc.GetBlockTemplate(opts.PoolAddress.Address, 8)
+	gbt, err := e.rpc.GetBlockTemplate(ctx, opts.PoolAddress.Address, 8)
 	if err != nil {
 		return err
 	}
@@ -175,18 +176,18 @@ func (e *Engine) currentJob() *job {
 
 // Watch subscribes to monerod's ZMQ chain-tip notifications when a zmq endpoint
 // is configured, with a poll safety net; otherwise it polls get_block_template.
-func (e *Engine) Watch(onNewWork func()) error {
+func (e *Engine) Watch(ctx context.Context, onNewWork func()) error {
 	sources := []worksource.Source{worksource.Poll(e.pollInterval, e.refresh)}
 	if zmq := e.opts.Daemons[0].ZMQ; zmq != "" {
 		sources = append([]worksource.Source{
 			worksource.ZMQSource("monerod-zmq", zmq, "json-minimal-chain_main", e.refresh),
 		}, sources...)
 	}
-	return worksource.Run(onNewWork, sources...)
+	return worksource.Run(ctx, onNewWork, sources...)
 }
 
-func (e *Engine) refresh() (bool, error) {
-	tmpl, err := e.rpc.GetBlockTemplate(e.opts.PoolAddress.Address, 8)
+func (e *Engine) refresh(ctx context.Context) (bool, error) {
+	tmpl, err := e.rpc.GetBlockTemplate(ctx, e.opts.PoolAddress.Address, 8)
 	if err != nil {
 		return false, err
 	}
@@ -308,7 +309,8 @@ func (e *Engine) OnSubmit(s engine.Session, params []interface{}) *types.Share {
 	if j.diff > 0 && share.Diff >= float64(j.diff) {
 		blockBlob := withNonce(j.blob, j.nonceOff, nonce)
 		blockHex := hex.EncodeToString(blockBlob)
-		if err := e.rpc.SubmitBlock(blockHex); err != nil {
+		// a solved block goes to the node even while the pool shuts down
+		if err := e.rpc.SubmitBlock(context.Background(), blockHex); err != nil {
 			log.Error("cryptonote submit_block failed: ", err)
 		} else {
 			share.BlockHex = blockHex
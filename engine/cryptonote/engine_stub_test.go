@@ -4,6 +4,7 @@
 package cryptonote
 
 import (
+	"context"
 	"strings"
 	"testing"
 
@@ -13,7 +14,7 @@ import (
 // Without -tags randomx the engine must refuse to start with a clear message
 // rather than panic or silently accept unverifiable shares.
 func TestInitRefusesWithoutRandomX(t *testing.T) {
-	err := New().Init(&config.Options{})
+	err := New().Init(context.Background(), &config.Options{})
 	if err == nil || !strings.Contains(err.Error(), "-tags randomx") {
 		t.Fatalf("expected a build-tag hint error, got %v", err)
 	}
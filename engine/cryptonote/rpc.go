@@ -1,27 +1,28 @@
 package cryptonote
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"strings"
 	"time"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+	"github.com/mining-pool/not-only-mining-pool/rpc"
 )
 
 // xmrRPC talks to monerod's /json_rpc endpoint (JSON-RPC 2.0).
 type xmrRPC struct {
-	url    string
-	client *http.Client
-	id     int64
+	client *rpc.Client
 }
 
-func newXmrRPC(baseURL string) *xmrRPC {
-	return &xmrRPC{
-		url:    strings.TrimRight(baseURL, "/") + "/json_rpc",
-		client: &http.Client{Timeout: 10 * time.Second},
+// newXmrRPC talks to baseURL, authenticating with auth's credentials or cookie
+// file when it is non-nil.
+func newXmrRPC(baseURL string, auth *config.DaemonOptions) *xmrRPC {
+	opts := rpc.Options{URL: strings.TrimRight(baseURL, "/") + "/json_rpc", Version: rpc.V2, Timeout: 10 * time.Second}
+	if auth != nil { // a nil *DaemonOptions must not become a non-nil Authenticator
+		opts.Auth = auth
 	}
+	return &xmrRPC{client: rpc.NewClient(opts)}
 }
 
 type blockTemplate struct {
@@ -36,56 +37,15 @@ type blockTemplate struct {
 	Status            string `json:"status"`
 }
 
-func (r *xmrRPC) call(method string, params interface{}, out interface{}) error {
-	r.id++
-	body, err := json.Marshal(map[string]interface{}{
-		"jsonrpc": "2.0", "id": r.id, "method": method, "params": params,
-	})
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(body))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := r.client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	raw, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-
-	var envelope struct {
-		Result json.RawMessage `json:"result"`
-		Error  *struct {
-			Code    int    `json:"code"`
-			Message string `json:"message"`
-		} `json:"error"`
-	}
-	if err := json.Unmarshal(raw, &envelope); err != nil {
-		return fmt.Errorf("decode %s: %w (body %s)", method, err, raw)
-	}
-	if envelope.Error != nil {
-		return fmt.Errorf("%s: rpc error %d: %s", method, envelope.Error.Code, envelope.Error.Message)
-	}
-	if out == nil {
-		return nil
-	}
-	return json.Unmarshal(envelope.Result, out)
+func (r *xmrRPC) call(ctx context.Context, method string, params interface{}, out interface{}) error {
+	return r.client.Call(ctx, method, params, out)
 }
 
 // GetBlockTemplate asks monerod for a template paying walletAddress, with
 // reserveSize bytes reserved in tx_extra for the pool's extranonce.
-func (r *xmrRPC) GetBlockTemplate(walletAddress string, reserveSize int) (*blockTemplate, error) {
+func (r *xmrRPC) GetBlockTemplate(ctx context.Context, walletAddress string, reserveSize int) (*blockTemplate, error) {
 	var t blockTemplate
-	err := r.call("get_block_template", map[string]interface{}{
+	err := r.call(ctx, "get_block_template", map[string]interface{}{
 		"wallet_address": walletAddress,
 		"reserve_size":   reserveSize,
 	}, &t)
@@ -99,11 +59,11 @@ func (r *xmrRPC) GetBlockTemplate(walletAddress string, reserveSize int) (*block
 }
 
 // SubmitBlock submits a full block blob (hex).
-func (r *xmrRPC) SubmitBlock(blockHex string) error {
+func (r *xmrRPC) SubmitBlock(ctx context.Context, blockHex string) error {
 	var res struct {
 		Status string `json:"status"`
 	}
-	if err := r.call("submit_block", []string{blockHex}, &res); err != nil {
+	if err := r.call(ctx, "submit_block", []string{blockHex}, &res); err != nil {
 		return err
 	}
 	if res.Status != "OK" {
@@ -31,6 +31,7 @@
 package engine
 
 import (
+	"context"
 	"net"
 
 	"github.com/mining-pool/not-only-mining-pool/config"
@@ -64,8 +65,9 @@ type Engine interface {
 	Name() string
 
 	// Init wires the engine to its node(s) and any shared services it needs.
-	// It should perform the initial work fetch so the first job is ready.
-	Init(opts *config.Options) error
+	// It should perform the initial work fetch so the first job is ready,
+	// bounded by ctx.
+	Init(ctx context.Context, opts *config.Options) error
 
 	// OnSubscribe handles mining.subscribe for a new client and returns the
 	// dialect-specific reply plus the extranonce assignment. Engines that do not
@@ -85,8 +87,10 @@ type Engine interface {
 	// onNewWork whenever the shared layer must re-broadcast a job to all miners.
 	// Engines are EVENT-DRIVEN where the node offers a push API (gRPC/ZMQ/WS/p2p
 	// notifications) and fall back to polling only otherwise — see the
-	// worksource package. It returns only on a fatal error.
-	Watch(onNewWork func()) error
+	// worksource package. ctx is the pool's lifetime: the engine's node calls and
+	// subscriptions end once it is cancelled. It returns only on a fatal error or
+	// then.
+	Watch(ctx context.Context, onNewWork func()) error
 }
 
 // Factory builds a fresh Engine instance.
@@ -25,6 +25,7 @@
 package equihash
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
@@ -148,7 +149,7 @@ func (e *Engine) TargetParams(diff float64) (string, []interface{}) {
 	return "mining.set_target", []interface{}{engine.TargetHex(engine.TargetFromDiff(diff1, diff))}
 }
 
-func (e *Engine) Init(opts *config.Options) error {
+func (e *Engine) Init(ctx context.Context, opts *config.Options) error {
 	e.opts = opts
 
 	v, err := variantFor(opts.Algorithm.Name)
@@ -158,7 +159,7 @@ func (e *Engine) Init(opts *config.Options) error {
 	e.v = v
 
 	e.dm = daemons.NewDaemonManager(opts.Daemons, opts.Coin)
-	gbt, err := e.getTemplate()
+	gbt, err := e.getTemplate(ctx)
 	if err != nil {
 		return err
 	}
@@ -167,8 +168,8 @@ func (e *Engine) Init(opts *config.Options) error {
 
 // getTemplate fetches and parses a zcash-style template (zcashd rejects
 // unknown rules, so this deliberately does not reuse the segwit GBT call).
-func (e *Engine) getTemplate() (*zGBT, error) {
-	_, result, _ := e.dm.Cmd("getblocktemplate", []interface{}{
+func (e *Engine) getTemplate(ctx context.Context) (*zGBT, error) {
+	_, result := e.dm.CmdContext(ctx, "getblocktemplate", []interface{}{
 		map[string]interface{}{"capabilities": []string{"coinbasetxn", "workid"}},
 	})
 	if result == nil {
@@ -271,18 +272,18 @@ func (e *Engine) currentJob() *job {
 
 // Watch subscribes to the daemon's ZMQ hashblock topic when configured, with a
 // poll safety net; otherwise it polls getblocktemplate.
-func (e *Engine) Watch(onNewWork func()) error {
+func (e *Engine) Watch(ctx context.Context, onNewWork func()) error {
 	sources := []worksource.Source{worksource.Poll(e.pollInterval, e.refresh)}
 	if zmq := e.opts.Daemons[0].ZMQ; zmq != "" {
 		sources = append([]worksource.Source{
 			worksource.ZMQSource("zcashd-zmq", zmq, "hashblock", e.refresh),
 		}, sources...)
 	}
-	return worksource.Run(onNewWork, sources...)
+	return worksource.Run(ctx, onNewWork, sources...)
 }
 
-func (e *Engine) refresh() (bool, error) {
-	gbt, err := e.getTemplate()
+func (e *Engine) refresh(ctx context.Context) (bool, error) {
+	gbt, err := e.getTemplate(ctx)
 	if err != nil {
 		return false, err
 	}
@@ -419,6 +420,7 @@ func (e *Engine) OnSubmit(s engine.Session, params []interface{}) *types.Share {
 		e.dm.SubmitBlock(blockHex)
 		share.BlockHex = blockHex
 		share.BlockHash = hex.EncodeToString(utils.ReverseBytes(utils.Sha256d(full)))
+		share.NetworkDiff = engine.DiffFromValue(diff1, j.target)
 		// Zcash-family coins are bitcoin-family (t-address) wallets, so resolve the
 		// coinbase txid the payout processor needs (empty if the node rejected it).
 		if _, tx := e.dm.CheckBlockAccepted(share.BlockHash); tx != "" {
@@ -21,11 +21,11 @@ package ergo
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"math/big"
 	"net/http"
 	"strconv"
@@ -41,6 +41,7 @@ import (
 
 	"github.com/mining-pool/not-only-mining-pool/config"
 	"github.com/mining-pool/not-only-mining-pool/engine"
+	"github.com/mining-pool/not-only-mining-pool/rpc"
 	"github.com/mining-pool/not-only-mining-pool/types"
 )
 
@@ -89,7 +90,7 @@ func (e *Engine) TargetParams(diff float64) (string, []interface{}) {
 	return "mining.set_target", []interface{}{engine.TargetHex(engine.TargetFromDiff(engine.Pow256, diff))}
 }
 
-func (e *Engine) Init(opts *config.Options) error {
+func (e *Engine) Init(ctx context.Context, opts *config.Options) error {
 	e.opts = opts
 	if len(opts.Daemons) == 0 {
 		return errors.New("ergo: no daemon configured")
@@ -97,7 +98,7 @@ func (e *Engine) Init(opts *config.Options) error {
 	d := opts.Daemons[0]
 	e.rest = newErgoREST(fmt.Sprintf("http://%s:%d", d.Host, d.Port), d.Password)
 
-	cand, err := e.rest.Candidate()
+	cand, err := e.rest.Candidate(ctx)
 	if err != nil {
 		return err
 	}
@@ -139,12 +140,12 @@ func (e *Engine) currentJob() *job {
 }
 
 // Watch polls the Ergo node's REST candidate endpoint (it exposes no push API).
-func (e *Engine) Watch(onNewWork func()) error {
-	return worksource.Run(onNewWork, worksource.Poll(e.pollInterval, e.refresh))
+func (e *Engine) Watch(ctx context.Context, onNewWork func()) error {
+	return worksource.Run(ctx, onNewWork, worksource.Poll(e.pollInterval, e.refresh))
 }
 
-func (e *Engine) refresh() (bool, error) {
-	cand, err := e.rest.Candidate()
+func (e *Engine) refresh(ctx context.Context) (bool, error) {
+	cand, err := e.rest.Candidate(ctx)
 	if err != nil {
 		return false, err
 	}
@@ -241,7 +242,8 @@ func (e *Engine) OnSubmit(s engine.Session, params []interface{}) *types.Share {
 
 	// network solution?
 	if resultNum.Cmp(j.target) <= 0 {
-		if err := e.rest.SubmitNonce(nonceHex); err != nil {
+		// a solved block goes to the node even while the pool shuts down
+		if err := e.rest.SubmitNonce(context.Background(), nonceHex); err != nil {
 			log.Error("ergo submit solution failed: ", err)
 		} else {
 			share.BlockHash = hex.EncodeToString(result)
@@ -255,13 +257,15 @@ func (e *Engine) OnSubmit(s engine.Session, params []interface{}) *types.Share {
 // --- REST client ---
 
 type ergoREST struct {
-	base   string
-	apiKey string
-	client *http.Client
+	client *rpc.Client
 }
 
 func newErgoREST(base, apiKey string) *ergoREST {
-	return &ergoREST{base: strings.TrimRight(base, "/"), apiKey: apiKey, client: &http.Client{Timeout: 10 * time.Second}}
+	opts := rpc.Options{URL: strings.TrimRight(base, "/"), Timeout: 10 * time.Second}
+	if apiKey != "" {
+		opts.Header = http.Header{"api_key": []string{apiKey}}
+	}
+	return &ergoREST{client: rpc.NewClient(opts)}
 }
 
 type candidate struct {
@@ -271,31 +275,7 @@ type candidate struct {
 	PK  string `json:"pk"`
 }
 
-func (r *ergoREST) do(method, path string, body []byte, out interface{}) error {
-	req, err := http.NewRequest(method, r.base+path, bytes.NewReader(body))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	if r.apiKey != "" {
-		req.Header.Set("api_key", r.apiKey)
-	}
-	resp, err := r.client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	raw, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("%s %s: HTTP %d: %s", method, path, resp.StatusCode, raw)
-	}
-	if out == nil {
-		return nil
-	}
-	return json.Unmarshal(raw, out)
-}
-
-func (r *ergoREST) Candidate() (*candidate, error) {
+func (r *ergoREST) Candidate(ctx context.Context) (*candidate, error) {
 	// b is a JSON number that can exceed int64; decode leniently
 	var raw struct {
 		Msg string      `json:"msg"`
@@ -303,15 +283,14 @@ func (r *ergoREST) Candidate() (*candidate, error) {
 		H   uint64      `json:"h"`
 		PK  string      `json:"pk"`
 	}
-	if err := r.do(http.MethodGet, "/mining/candidate", nil, &raw); err != nil {
+	if err := r.client.REST(ctx, http.MethodGet, "/mining/candidate", nil, &raw); err != nil {
 		return nil, err
 	}
 	return &candidate{Msg: raw.Msg, B: raw.B.String(), H: raw.H, PK: raw.PK}, nil
 }
 
-func (r *ergoREST) SubmitNonce(nonceHex string) error {
-	body, _ := json.Marshal(map[string]string{"n": nonceHex})
-	return r.do(http.MethodPost, "/mining/solution", body, nil)
+func (r *ergoREST) SubmitNonce(ctx context.Context, nonceHex string) error {
+	return r.client.REST(ctx, http.MethodPost, "/mining/solution", map[string]string{"n": nonceHex}, nil)
 }
 
 // --- math helpers ---
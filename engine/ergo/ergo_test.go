@@ -1,6 +1,7 @@
 package ergo
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"math/big"
@@ -103,7 +104,7 @@ func TestRESTCandidateParsing(t *testing.T) {
 	}))
 	defer srv.Close()
 
-	c, err := newErgoREST(srv.URL, "apikey").Candidate()
+	c, err := newErgoREST(srv.URL, "apikey").Candidate(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
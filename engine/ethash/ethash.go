@@ -21,7 +21,9 @@
 package ethash
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"math/big"
 	"os"
 	"strconv"
@@ -65,6 +67,7 @@ type Engine struct {
 	rpc          *ethRPC
 	light        *etchash.Etchash
 	pollInterval time.Duration
+	eraLength    uint64 // ECIP-1017 era, for the payer's block rewards
 
 	mu      sync.RWMutex
 	cur     *work
@@ -72,16 +75,23 @@ type Engine struct {
 }
 
 func New() *Engine {
-	return &Engine{pollInterval: 500 * time.Millisecond, seen: map[string]struct{}{}}
+	e := &Engine{pollInterval: 500 * time.Millisecond, eraLength: ECIP1017EraLength, seen: map[string]struct{}{}}
+	// read here rather than in Init: the payer prices blocks without a node
+	if v := os.Getenv("ETC_ECIP1017_ERA"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			e.eraLength = n
+		}
+	}
+	return e
 }
 
 func (e *Engine) Name() string { return "ethash" }
 
-func (e *Engine) Init(opts *config.Options) error {
+func (e *Engine) Init(ctx context.Context, opts *config.Options) error {
 	if len(opts.Daemons) == 0 {
 		return errors.New("ethash: no daemon configured")
 	}
-	e.rpc = newEthRPC(opts.Daemons[0].URL())
+	e.rpc = newEthRPC(opts.Daemons[0].URL(), opts.Daemons[0])
 
 	ecip := ECIP1099FBlock
 	if v := os.Getenv("ETC_ECIP1099_FBLOCK"); v != "" {
@@ -91,14 +101,14 @@ func (e *Engine) Init(opts *config.Options) error {
 	}
 	e.light = etchash.New(&ecip, nil)
 
-	_, err := e.RefreshWork()
+	_, err := e.RefreshWork(ctx)
 	return err
 }
 
 // RefreshWork fetches the latest work from the node. It returns true when the
 // header hash changed (i.e. miners must be re-notified).
-func (e *Engine) RefreshWork() (changed bool, err error) {
-	w, err := e.rpc.GetWork()
+func (e *Engine) RefreshWork(ctx context.Context) (changed bool, err error) {
+	w, err := e.rpc.GetWork(ctx)
 	if err != nil {
 		return false, err
 	}
@@ -115,7 +125,7 @@ func (e *Engine) RefreshWork() (changed bool, err error) {
 		}
 	}
 	if blockNumber == 0 {
-		if hn, err := e.rpc.BlockNumber(); err == nil {
+		if hn, err := e.rpc.BlockNumber(ctx); err == nil {
 			if n, ok := hexToBig(hn); ok {
 				blockNumber = n.Uint64() + 1 // work is for head+1
 			}
@@ -170,8 +180,8 @@ func (e *Engine) JobParamsForDifficulty(diff float64) []interface{} {
 
 // Watch polls eth_getWork; geth exposes new work over HTTP request/response
 // (its push channel is WebSocket eth_subscribe, not wired here).
-func (e *Engine) Watch(onNewWork func()) error {
-	return worksource.Run(onNewWork, worksource.Poll(e.pollInterval, e.RefreshWork))
+func (e *Engine) Watch(ctx context.Context, onNewWork func()) error {
+	return worksource.Run(ctx, onNewWork, worksource.Poll(e.pollInterval, e.RefreshWork))
 }
 
 // OnSubscribe handles the ethproxy eth_submitLogin. Ethash has no extranonce.
@@ -253,11 +263,15 @@ func (e *Engine) OnSubmit(s engine.Session, params []interface{}) *types.Share {
 
 	// block candidate?
 	if MeetsTarget(resultBig, cur.target) {
-		accepted, err := e.rpc.SubmitWork(nonceHex, cur.headerHash, mixDigest.Hex())
+		// a solved block goes to the node even while the pool shuts down
+		accepted, err := e.rpc.SubmitWork(context.Background(), nonceHex, cur.headerHash, mixDigest.Hex())
 		if err != nil {
 			log.Error("ethash eth_submitWork error: ", err)
 		} else if accepted {
 			share.BlockHash = cur.headerHash
+			// The node assembled the block, so there is no coinbase txid: the
+			// seal nonce is what the payer finds it by, in the chain or its uncles.
+			share.TxHash = fmt.Sprintf("0x%016x", nonce)
 			log.Warn("ethash block sealed at height ", cur.blockNumber, " header ", cur.headerHash)
 		} else {
 			log.Warn("ethash block rejected by node at height ", cur.blockNumber)
@@ -1,6 +1,7 @@
 package ethash
 
 import (
+	"context"
 	"encoding/json"
 	"math"
 	"math/big"
@@ -79,8 +80,8 @@ func TestRPCGetAndSubmit(t *testing.T) {
 	srv := fakeNode(t, []string{"0xaa", "0xbb", "0x0f", "0x1234"}, true)
 	defer srv.Close()
 
-	rpc := newEthRPC(srv.URL)
-	work, err := rpc.GetWork()
+	rpc := newEthRPC(srv.URL, nil)
+	work, err := rpc.GetWork(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -88,7 +89,7 @@ func TestRPCGetAndSubmit(t *testing.T) {
 		t.Fatalf("unexpected work: %v", work)
 	}
 
-	ok, err := rpc.SubmitWork("0x01", "0xaa", "0xcc")
+	ok, err := rpc.SubmitWork(context.Background(), "0x01", "0xaa", "0xcc")
 	if err != nil || !ok {
 		t.Fatalf("submitWork: ok=%v err=%v", ok, err)
 	}
@@ -100,9 +101,9 @@ func TestRefreshWorkAndJobParams(t *testing.T) {
 	defer srv.Close()
 
 	e := New()
-	e.rpc = newEthRPC(srv.URL)
+	e.rpc = newEthRPC(srv.URL, nil)
 
-	changed, err := e.RefreshWork()
+	changed, err := e.RefreshWork(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -116,7 +117,7 @@ func TestRefreshWorkAndJobParams(t *testing.T) {
 	}
 
 	// re-fetch identical work -> not changed
-	changed, err = e.RefreshWork()
+	changed, err = e.RefreshWork(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -142,3 +143,34 @@ func TestRefreshWorkAndJobParams(t *testing.T) {
 func TestPoWVerify_NeedsLiveChain(t *testing.T) {
 	t.Skip("etchash Compute needs a real header/nonce/mix vector + DAG cache; verify on a live chain")
 }
+
+func TestBlockAndUncleRewards(t *testing.T) {
+	e := New()
+	etc := func(s string) *big.Int {
+		r, _ := new(big.Float).Mul(big.NewFloat(1e18), mustFloat(s)).Int(nil)
+		return r
+	}
+	cases := []struct {
+		name string
+		got  *big.Int
+		want *big.Int
+	}{
+		{"era 0", e.BlockReward(5_000_000, 0), etc("5")},
+		{"era 1", e.BlockReward(5_000_001, 0), etc("4")},
+		{"era 4", e.BlockReward(20_000_001, 0), etc("2.048")},
+		{"era 0 with two uncles", e.BlockReward(100, 2), etc("5.3125")},
+		{"era 0 uncle one deep", e.UncleReward(99, 100), etc("4.375")},
+		{"era 0 uncle seven deep", e.UncleReward(93, 100), etc("0.625")},
+		{"era 1 uncle", e.UncleReward(5_000_001, 5_000_002), etc("0.125")},
+	}
+	for _, c := range cases {
+		if c.got.Cmp(c.want) != 0 {
+			t.Errorf("%s: %s wei, want %s", c.name, c.got, c.want)
+		}
+	}
+}
+
+func mustFloat(s string) *big.Float {
+	f, _ := new(big.Float).SetPrec(256).SetString(s)
+	return f
+}
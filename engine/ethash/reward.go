@@ -0,0 +1,56 @@
+package ethash
+
+import "math/big"
+
+// ECIP1017EraLength is the ECIP-1017 era: every this many blocks the block
+// reward falls by a fifth and uncles earn a flat 1/32 of it. Default is ETC
+// mainnet (5_000_000). Override via ETC_ECIP1017_ERA, e.g. 2_000_000 on
+// Mordor; a chain that never reduces its reward (Ethereum's rules) sets it
+// beyond its height.
+var ECIP1017EraLength uint64 = 5_000_000
+
+// BaseBlockReward is the era-0 block reward in wei (5 ETC).
+var BaseBlockReward = new(big.Int).Mul(big.NewInt(5), big.NewInt(1e18))
+
+// era is the ECIP-1017 era of the block at height, 0 for the first.
+func (e *Engine) era(height uint64) uint64 {
+	if height == 0 || e.eraLength == 0 {
+		return 0
+	}
+	return (height - 1) / e.eraLength
+}
+
+// eraReward is the block reward of era: BaseBlockReward reduced by a fifth
+// per era.
+func eraReward(era uint64) *big.Int {
+	r := new(big.Int).Set(BaseBlockReward)
+	for i := uint64(0); i < era; i++ {
+		r.Mul(r, big.NewInt(4))
+		r.Div(r, big.NewInt(5))
+	}
+	return r
+}
+
+// BlockReward is what the miner of the block at height earns before fees, in
+// wei: the era's reward plus 1/32 of it for each of the block's uncles.
+func (e *Engine) BlockReward(height uint64, uncles int) *big.Int {
+	r := eraReward(e.era(height))
+	inclusion := new(big.Int).Div(r, big.NewInt(32))
+	return r.Add(r, inclusion.Mul(inclusion, big.NewInt(int64(uncles))))
+}
+
+// UncleReward is what the miner of an uncle at uncleHeight earns once the
+// block at height includes it, in wei: (uncleHeight+8-height)/8 of the reward
+// in era 0, a flat 1/32 after.
+func (e *Engine) UncleReward(uncleHeight, height uint64) *big.Int {
+	era := e.era(height)
+	r := eraReward(era)
+	if era > 0 {
+		return r.Div(r, big.NewInt(32))
+	}
+	if uncleHeight+8 <= height {
+		return new(big.Int)
+	}
+	r.Mul(r, new(big.Int).SetUint64(uncleHeight+8-height))
+	return r.Div(r, big.NewInt(8))
+}
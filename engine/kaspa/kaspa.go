@@ -34,6 +34,7 @@
 package kaspa
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -106,7 +107,7 @@ func (e *Engine) TargetParams(diff float64) (string, []interface{}) {
 	return "mining.set_difficulty", []interface{}{diff}
 }
 
-func (e *Engine) Init(opts *config.Options) error {
+func (e *Engine) Init(ctx context.Context, opts *config.Options) error {
 	e.opts = opts
 	if len(opts.Daemons) == 0 {
 		return errors.New("kaspa: no daemon configured")
@@ -129,11 +130,13 @@ func (e *Engine) Init(opts *config.Options) error {
 		return err
 	}
 
-	_, err = e.refresh()
+	_, err = e.refresh(ctx)
 	return err
 }
 
-func (e *Engine) refresh() (bool, error) {
+// refresh fetches a template; kaspad's gRPC client takes no context, so its
+// calls are bounded by the client's own timeout instead.
+func (e *Engine) refresh(_ context.Context) (bool, error) {
 	resp, err := e.client.GetBlockTemplate(e.opts.PoolAddress.Address, "not-only-mining-pool")
 	if err != nil {
 		return false, err
@@ -193,14 +196,21 @@ func (e *Engine) currentJob() *job {
 
 // Watch is driven by kaspad's gRPC new-template notifications (fed into
 // templateKick from Init); a slow poll backs it up against dropped events.
-func (e *Engine) Watch(onNewWork func()) error {
-	events := worksource.Subscribe("kaspad-grpc", func(onEvent func()) error {
-		for range e.templateKick {
-			onEvent()
+func (e *Engine) Watch(ctx context.Context, onNewWork func()) error {
+	events := worksource.Subscribe("kaspad-grpc", func(ctx context.Context, onEvent func()) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case _, ok := <-e.templateKick:
+				if !ok {
+					return errors.New("kaspa template stream closed")
+				}
+				onEvent()
+			}
 		}
-		return errors.New("kaspa template stream closed")
 	}, e.refresh)
-	return worksource.Run(onNewWork, events, worksource.Poll(5*time.Second, e.refresh))
+	return worksource.Run(ctx, onNewWork, events, worksource.Poll(5*time.Second, e.refresh))
 }
 
 // OnSubscribe follows the bridge convention.
@@ -28,6 +28,7 @@
 package kawpow
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"math/big"
@@ -104,16 +105,18 @@ func (e *Engine) Name() string { return "kawpow" }
 // NotifyMethod tells the stratum router to push work as mining.notify.
 func (e *Engine) NotifyMethod() string { return "mining.notify" }
 
-func (e *Engine) Init(opts *config.Options) error {
+func (e *Engine) Init(ctx context.Context, opts *config.Options) error {
 	e.opts = opts
 	e.pow = kawpow.NewRavencoin()
 	e.dm = daemons.NewDaemonManager(opts.Daemons, opts.Coin)
 
-	gbt, err := e.dm.GetBlockTemplate()
+	gbt, err := e.dm.GetBlockTemplateContext(ctx)
 	if err != nil {
 		return err
 	}
-	e.acceptTemplate(gbt)
+	if err := e.acceptTemplate(gbt); err != nil {
+		return err
+	}
 
 	// warm the epoch cache off the hot path so the first share doesn't stall
 	go func() {
@@ -131,10 +134,10 @@ func (e *Engine) Init(opts *config.Options) error {
 }
 
 // acceptTemplate builds a new job from a GBT and makes it current.
-func (e *Engine) acceptTemplate(gbt *daemons.GetBlockTemplate) {
+func (e *Engine) acceptTemplate(gbt *daemons.GetBlockTemplate) error {
 	id := strconv.FormatUint(atomic.AddUint64(&e.jobCounter, 1), 16)
 
-	inner := jobs.NewJob(
+	inner, err := jobs.NewJob(
 		id,
 		gbt,
 		e.opts.PoolAddress.GetScript(),
@@ -143,7 +146,11 @@ func (e *Engine) acceptTemplate(gbt *daemons.GetBlockTemplate) {
 		e.opts.Coin.TxMessages,
 		e.opts.RewardRecipients,
 		nil, // RVN uses the default double-SHA256 merkle
+		nil,
 	)
+	if err != nil {
+		return err
+	}
 
 	// KawPow miners roll the 64-bit header nonce, never the coinbase — so the
 	// coinbase extranonce space is pinned per job (job counter keeps it unique).
@@ -182,6 +189,7 @@ func (e *Engine) acceptTemplate(gbt *daemons.GetBlockTemplate) {
 	}
 	e.mu.Unlock()
 	log.Info("new kawpow job ", id, " height ", gbt.Height)
+	return nil
 }
 
 func (e *Engine) currentJob() *job {
@@ -192,25 +200,27 @@ func (e *Engine) currentJob() *job {
 
 // Watch subscribes to the daemon's ZMQ hashblock topic when configured, with a
 // poll safety net; otherwise it polls getblocktemplate.
-func (e *Engine) Watch(onNewWork func()) error {
+func (e *Engine) Watch(ctx context.Context, onNewWork func()) error {
 	sources := []worksource.Source{worksource.Poll(e.pollInterval, e.refresh)}
 	if zmq := e.opts.Daemons[0].ZMQ; zmq != "" {
 		sources = append([]worksource.Source{
 			worksource.ZMQSource("bitcoind-zmq", zmq, "hashblock", e.refresh),
 		}, sources...)
 	}
-	return worksource.Run(onNewWork, sources...)
+	return worksource.Run(ctx, onNewWork, sources...)
 }
 
-func (e *Engine) refresh() (bool, error) {
-	gbt, err := e.dm.GetBlockTemplate()
+func (e *Engine) refresh(ctx context.Context) (bool, error) {
+	gbt, err := e.dm.GetBlockTemplateContext(ctx)
 	if err != nil {
 		return false, err
 	}
 	if cur := e.currentJob(); cur != nil && cur.inner.GetBlockTemplate.PreviousBlockHash == gbt.PreviousBlockHash {
 		return false, nil
 	}
-	e.acceptTemplate(gbt)
+	if err := e.acceptTemplate(gbt); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
@@ -328,6 +338,7 @@ func (e *Engine) OnSubmit(s engine.Session, params []interface{}) *types.Share {
 		// PoW already produced. Using sha256d here yields a hash the node doesn't
 		// know, so getblock/CheckBlockAccepted can't resolve the coinbase txid.
 		share.BlockHash = hex.EncodeToString(digest)
+		share.NetworkDiff = engine.DiffFromValue(diff1, j.inner.Target)
 		// Ravencoin is bitcoin-family, so resolve the coinbase txid the payout
 		// processor needs to attribute this block's reward (empty if the node
 		// rejected it — the share stays a normal contribution then).
@@ -4,7 +4,7 @@
 //
 // An engine composes Sources and hands them to Run:
 //
-//	worksource.Run(emit,
+//	worksource.Run(ctx, emit,
 //	    worksource.Subscribe("kaspad-grpc", openStream, e.refresh), // real events
 //	    worksource.Poll(5*time.Second, e.refresh),                  // safety net
 //	)
@@ -15,6 +15,7 @@
 package worksource
 
 import (
+	"context"
 	"time"
 
 	logging "github.com/ipfs/go-log/v2"
@@ -25,24 +26,30 @@ var log = logging.Logger("worksource")
 // Emit signals the shared layer to re-broadcast work to miners.
 type Emit func()
 
-// Refresh pulls the latest template/candidate and updates engine state. It
-// returns changed==true when miners must be re-notified. Errors are logged and
-// treated as "no change".
-type Refresh func() (changed bool, err error)
+// Refresh pulls the latest template/candidate, bounded by ctx, and updates
+// engine state. It returns changed==true when miners must be re-notified.
+// Errors are logged and treated as "no change".
+type Refresh func(ctx context.Context) (changed bool, err error)
 
 // Source is a long-running work watcher; it calls emit whenever new work is
-// available and returns only on a fatal (unrecoverable) error.
-type Source func(emit Emit) error
+// available and returns only on a fatal (unrecoverable) error or once ctx is
+// done.
+type Source func(ctx context.Context, emit Emit) error
 
 // Poll builds a polling Source (the FALLBACK strategy): every interval it runs
 // refresh and emits on change. Use only for nodes without a push API, or as a
 // safety net raced beside a real event Source.
 func Poll(interval time.Duration, refresh Refresh) Source {
-	return func(emit Emit) error {
+	return func(ctx context.Context, emit Emit) error {
 		t := time.NewTicker(interval)
 		defer t.Stop()
-		for range t.C {
-			changed, err := refresh()
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-t.C:
+			}
+			changed, err := refresh(ctx)
 			if err != nil {
 				log.Debug("poll refresh error: ", err)
 				continue
@@ -51,18 +58,18 @@ func Poll(interval time.Duration, refresh Refresh) Source {
 				emit()
 			}
 		}
-		return nil
 	}
 }
 
 // Subscribe builds an EVENT-driven Source. open blocks, invoking onEvent once
-// per node notification, and returns when the subscription dies; Subscribe then
-// reconnects with a fixed backoff. Each onEvent runs refresh and emits on
-// change, so spurious events cost only a refresh.
-func Subscribe(name string, open func(onEvent func()) error, refresh Refresh) Source {
-	return func(emit Emit) error {
+// per node notification, and returns when the subscription dies or ctx is
+// done; Subscribe then reconnects with a fixed backoff until ctx is done. Each
+// onEvent runs refresh and emits on change, so spurious events cost only a
+// refresh.
+func Subscribe(name string, open func(ctx context.Context, onEvent func()) error, refresh Refresh) Source {
+	return func(ctx context.Context, emit Emit) error {
 		onEvent := func() {
-			changed, err := refresh()
+			changed, err := refresh(ctx)
 			if err != nil {
 				log.Debug(name, " refresh error: ", err)
 				return
@@ -72,24 +79,43 @@ func Subscribe(name string, open func(onEvent func()) error, refresh Refresh) So
 			}
 		}
 		for {
-			err := open(onEvent) // blocks until the stream ends
+			err := open(ctx, onEvent) // blocks until the stream ends
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			log.Warn(name, " subscription ended, reconnecting in 3s: ", err)
-			time.Sleep(3 * time.Second)
+			if err := Sleep(ctx, 3*time.Second); err != nil {
+				return err
+			}
 		}
 	}
 }
 
-// Run races the given Sources concurrently against a single Emit and returns
-// when the first Source returns (a fatal error). With no Sources it blocks
-// forever (nothing to watch).
-func Run(emit Emit, sources ...Source) error {
-	if len(sources) == 0 {
-		select {}
+// Sleep waits for d, or returns ctx's error as soon as it is done.
+func Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
 	}
+}
+
+// Run races the given Sources concurrently against a single Emit and returns
+// when the first Source returns (a fatal error) or ctx is done. With no Sources
+// it just waits for ctx (nothing to watch).
+func Run(ctx context.Context, emit Emit, sources ...Source) error {
 	errCh := make(chan error, len(sources))
 	for _, s := range sources {
 		s := s
-		go func() { errCh <- s(emit) }()
+		go func() { errCh <- s(ctx, emit) }()
+	}
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return <-errCh
 }
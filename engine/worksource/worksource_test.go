@@ -1,6 +1,7 @@
 package worksource
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"sync/atomic"
@@ -11,14 +12,14 @@ import (
 func TestPollEmitsOnChangeOnly(t *testing.T) {
 	var calls int32
 	var emits int32
-	refresh := func() (bool, error) {
+	refresh := func(context.Context) (bool, error) {
 		n := atomic.AddInt32(&calls, 1)
 		return n%2 == 0, nil // change on every 2nd tick
 	}
 	src := Poll(5*time.Millisecond, refresh)
 
 	done := make(chan struct{})
-	go func() { _ = src(func() { atomic.AddInt32(&emits, 1) }); close(done) }()
+	go func() { _ = src(context.Background(), func() { atomic.AddInt32(&emits, 1) }); close(done) }()
 
 	time.Sleep(60 * time.Millisecond)
 	c, e := atomic.LoadInt32(&calls), atomic.LoadInt32(&emits)
@@ -32,8 +33,10 @@ func TestPollEmitsOnChangeOnly(t *testing.T) {
 
 func TestPollSwallowsErrors(t *testing.T) {
 	var emits int32
-	refresh := func() (bool, error) { return true, errors.New("boom") }
-	go func() { _ = Poll(2*time.Millisecond, refresh)(func() { atomic.AddInt32(&emits, 1) }) }()
+	refresh := func(context.Context) (bool, error) { return true, errors.New("boom") }
+	go func() {
+		_ = Poll(2*time.Millisecond, refresh)(context.Background(), func() { atomic.AddInt32(&emits, 1) })
+	}()
 	time.Sleep(30 * time.Millisecond)
 	if atomic.LoadInt32(&emits) != 0 {
 		t.Fatal("errors must not emit")
@@ -45,15 +48,17 @@ func TestSubscribeRefreshesPerEventAndReconnects(t *testing.T) {
 	var opens int32
 
 	// open fires 2 events then "dies"; Subscribe should reconnect and repeat.
-	open := func(onEvent func()) error {
+	open := func(_ context.Context, onEvent func()) error {
 		atomic.AddInt32(&opens, 1)
 		onEvent()
 		onEvent()
 		return errors.New("stream closed")
 	}
-	refresh := func() (bool, error) { return true, nil }
+	refresh := func(context.Context) (bool, error) { return true, nil }
 
-	go func() { _ = Subscribe("test", open, refresh)(func() { atomic.AddInt32(&emits, 1) }) }()
+	go func() {
+		_ = Subscribe("test", open, refresh)(context.Background(), func() { atomic.AddInt32(&emits, 1) })
+	}()
 
 	// within a few seconds we should see the first connection's 2 emits;
 	// reconnect backoff is 3s so exactly the first batch is deterministic here.
@@ -64,9 +69,9 @@ func TestSubscribeRefreshesPerEventAndReconnects(t *testing.T) {
 }
 
 func TestRunRacesSourcesAndReturnsFirstError(t *testing.T) {
-	fatal := func(emit Emit) error { return errors.New("fatal") }
+	fatal := func(_ context.Context, emit Emit) error { return errors.New("fatal") }
 	var ticks int32
-	ticker := func(emit Emit) error {
+	ticker := func(_ context.Context, emit Emit) error {
 		for {
 			time.Sleep(2 * time.Millisecond)
 			atomic.AddInt32(&ticks, 1)
@@ -77,9 +82,30 @@ func TestRunRacesSourcesAndReturnsFirstError(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	var err error
-	go func() { defer wg.Done(); err = Run(func() {}, ticker, fatal) }()
+	go func() { defer wg.Done(); err = Run(context.Background(), func() {}, ticker, fatal) }()
 	wg.Wait()
 	if err == nil {
 		t.Fatal("Run must return the first source's fatal error")
 	}
 }
+
+// Cancelling ctx stops Run and the Sources that watch it.
+func TestRunStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	refresh := func(context.Context) (bool, error) { return false, nil }
+	open := func(ctx context.Context, _ func()) error { <-ctx.Done(); return ctx.Err() }
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, func() {}, Poll(time.Millisecond, refresh), Subscribe("test", open, refresh))
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Run returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run kept running after ctx was cancelled")
+	}
+}
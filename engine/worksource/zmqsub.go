@@ -38,8 +38,8 @@ func ZMQSubscribe(ctx context.Context, endpoint, topic string, onMessage func(fr
 // topic frame matches triggers refresh. Compose it with a Poll safety net via
 // Run.
 func ZMQSource(name, endpoint, topic string, refresh Refresh) Source {
-	return Subscribe(name, func(onEvent func()) error {
-		return ZMQSubscribe(context.Background(), endpoint, topic, func(frames [][]byte) {
+	return Subscribe(name, func(ctx context.Context, onEvent func()) error {
+		return ZMQSubscribe(ctx, endpoint, topic, func(frames [][]byte) {
 			if len(frames) > 0 && bytes.HasPrefix(frames[0], []byte(topic)) {
 				onEvent()
 			}
@@ -15,6 +15,7 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/ipfs/go-log/v2 v2.1.1
 	github.com/kaspanet/kaspad v0.12.22
+	github.com/lib/pq v1.12.3
 	github.com/mining-pool/go-randomx v1.2.1
 	github.com/mr-tron/base58 v1.2.0
 	github.com/samli88/go-x11-hash v0.0.0-20180604013825-c37c1282f506
@@ -22,6 +23,7 @@ require (
 	github.com/sparkspay/go-neoscrypt v0.0.0-20190218120108-0a1ceb318941
 	golang.org/x/crypto v0.28.0
 	lukechampine.com/blake3 v1.4.1
+	modernc.org/sqlite v1.34.5
 )
 
 require (
@@ -32,14 +34,19 @@ require (
 	github.com/dchest/blake256 v1.1.0 // indirect
 	github.com/dchest/blake2b v1.0.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/edsrzf/mmap-go v1.0.0 // indirect
 	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/go-zeromq/goczmq/v4 v4.2.2 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
+	github.com/google/uuid v1.6.0 // indirect
 	github.com/hashicorp/golang-lru v0.5.4 // indirect
 	github.com/jrick/logrotate v1.0.0 // indirect
 	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/stretchr/testify v1.9.0 // indirect
 	github.com/yuin/gopher-lua v1.1.1 // indirect
 	go.uber.org/atomic v1.6.0 // indirect
@@ -54,4 +61,7 @@ require (
 	google.golang.org/grpc v1.69.2 // indirect
 	google.golang.org/protobuf v1.35.1 // indirect
 	honnef.co/go/tools v0.1.3 // indirect
+	modernc.org/libc v1.55.3 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.8.0 // indirect
 )
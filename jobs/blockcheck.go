@@ -0,0 +1,121 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/mining-pool/not-only-mining-pool/merkletree"
+	"github.com/mining-pool/not-only-mining-pool/transactions"
+	"github.com/mining-pool/not-only-mining-pool/types"
+	"github.com/mining-pool/not-only-mining-pool/utils"
+)
+
+// Reject reasons reported by CheckBlock. Where bitcoind has an equivalent the
+// same code is used, so a local rejection can be matched with the daemon's.
+const (
+	RejectBadEncoding     = "bad-blk-encoding"
+	RejectHighHash        = "high-hash"
+	RejectTxCount         = "bad-blk-txcount"
+	RejectMerkleRoot      = "bad-txnmrklroot"
+	RejectCoinbaseMissing = "bad-cb-missing"
+	RejectCoinbaseAmount  = "bad-cb-amount"
+	RejectCoinbaseHeight  = "bad-cb-height"
+	RejectWeight          = "bad-blk-weight"
+	RejectSize            = "bad-blk-length"
+)
+
+// BlockCheck carries the coin-specific hashing and transaction layout the
+// pre-submit check needs to re-validate a serialized block.
+type BlockCheck struct {
+	PowHasher func([]byte) []byte   // header proof-of-work hash
+	TxHasher  merkletree.Hasher     // txid / merkle hasher; nil = double-SHA256
+	Layout    transactions.TxLayout // fork fields around each transaction
+}
+
+func reject(reason, format string, args ...interface{}) *types.BlockRejection {
+	return &types.BlockRejection{Reason: reason, Detail: fmt.Sprintf(format, args...)}
+}
+
+// CheckBlock parses a serialized block candidate built from this job and
+// re-validates what the daemon would: header PoW against the job target, the
+// transaction count and merkle root, the coinbase value against coinbasevalue,
+// the BIP34 height in the coinbase and the weight (or size) limit. It returns
+// nil when the block passes, otherwise the first failure found.
+func (j *Job) CheckBlock(block []byte, check *BlockCheck) *types.BlockRejection {
+	hasher := check.TxHasher
+	if hasher == nil {
+		hasher = utils.Sha256d
+	}
+	rpcData := j.GetBlockTemplate
+
+	if len(block) < 80 {
+		return reject(RejectBadEncoding, "block is %d bytes, shorter than its header", len(block))
+	}
+	header := block[:80]
+
+	powHash := new(big.Int).SetBytes(utils.ReverseBytes(check.PowHasher(header)))
+	if j.Target.Cmp(powHash) <= 0 {
+		return reject(RejectHighHash, "header hash %064x is not below target %064x", powHash, j.Target)
+	}
+
+	txCount, n, err := transactions.ReadVarInt(block[80:])
+	if err != nil {
+		return reject(RejectBadEncoding, "reading transaction count: %s", err)
+	}
+	if want := uint64(len(rpcData.Transactions) + 1); txCount != want {
+		return reject(RejectTxCount, "block has %d transactions, template has %d plus the coinbase", txCount, want-1)
+	}
+
+	pos := 80 + n
+	weight := pos * 4 // header and count are non-witness data
+	txids := make([][]byte, txCount)
+	var coinbase *transactions.Tx
+	for i := range txids {
+		tx, used, err := transactions.ParseTx(block[pos:], check.Layout)
+		if err != nil {
+			return reject(RejectBadEncoding, "parsing transaction %d at offset %d: %s", i, pos, err)
+		}
+		pos += used
+		weight += tx.Weight()
+		txids[i] = hasher(tx.Stripped)
+		if i == 0 {
+			coinbase = tx
+		}
+	}
+
+	if root := merkletree.MerkleRoot(txids, hasher); !bytes.Equal(root, header[36:68]) {
+		return reject(RejectMerkleRoot, "header commits to %x, transactions hash to %x", utils.ReverseBytes(header[36:68]), utils.ReverseBytes(root))
+	}
+
+	if len(coinbase.Inputs) != 1 || !bytes.Equal(coinbase.Inputs[0].PrevOutHash, make([]byte, 32)) || coinbase.Inputs[0].PrevOutIndex != 0xffffffff {
+		return reject(RejectCoinbaseMissing, "first transaction does not spend the null outpoint")
+	}
+
+	if value := coinbase.OutputValue(); value > rpcData.CoinbaseValue {
+		return reject(RejectCoinbaseAmount, "coinbase pays %d, template allows %d", value, rpcData.CoinbaseValue)
+	}
+
+	// BIP34 applies to version 2+ blocks: the scriptSig starts with the height.
+	if int32(binary.LittleEndian.Uint32(header[0:4])) >= 2 {
+		want := utils.SerializeNumber(uint64(rpcData.Height))
+		if scriptSig := coinbase.Inputs[0].ScriptSig; !bytes.HasPrefix(scriptSig, want) {
+			return reject(RejectCoinbaseHeight, "coinbase scriptSig %s does not start with height %d (%s)", hex.EncodeToString(scriptSig), rpcData.Height, hex.EncodeToString(want))
+		}
+	}
+
+	switch {
+	case rpcData.WeightLimit > 0:
+		if int64(weight) > rpcData.WeightLimit {
+			return reject(RejectWeight, "block weight %d exceeds the template limit %d", weight, rpcData.WeightLimit)
+		}
+	case rpcData.SizeLimit > 0:
+		if int64(pos) > rpcData.SizeLimit {
+			return reject(RejectSize, "block size %d exceeds the template limit %d", pos, rpcData.SizeLimit)
+		}
+	}
+
+	return nil
+}
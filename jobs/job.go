@@ -27,9 +27,20 @@ type Job struct {
 	TransactionData       []byte
 	Reward                string
 	MerkleTree            *merkletree.MerkleTree
+
+	// CoinbasePaid is what this job's coinbase pays miners directly (miner ->
+	// satoshis); nil unless coinbase payouts are on.
+	CoinbasePaid map[string]uint64
+	// CoinbaseWindow is the PPLNS window CoinbasePaid was split from; nil with
+	// it.
+	CoinbaseWindow map[string]float64
 }
 
-func NewJob(jobId string, rpcData *daemons.GetBlockTemplate, poolAddressScript, extraNoncePlaceholder []byte, reward string, txMessages bool, recipients []*config.Recipient, coinbaseHasher merkletree.Hasher) *Job {
+// NewJob builds mining work from a block template. It fails rather than
+// returning a job whose blocks the daemon would reject, e.g. when the template's
+// witness commitment does not match its transactions. A non-nil split pays the
+// PPLNS window directly in the coinbase.
+func NewJob(jobId string, rpcData *daemons.GetBlockTemplate, poolAddressScript, extraNoncePlaceholder []byte, reward string, txMessages bool, recipients []*config.Recipient, coinbaseHasher merkletree.Hasher, split *transactions.CoinbaseSplit) (*Job, error) {
 	var bigTarget *big.Int
 
 	if rpcData.Target != "" {
@@ -61,14 +72,19 @@ func NewJob(jobId string, rpcData *daemons.GetBlockTemplate, poolAddressScript,
 	txsBytes := GetTransactionBytes(rpcData.Transactions)
 	merkleTree := merkletree.NewMerkleTree(txsBytes, coinbaseHasher)
 	merkleBranch := merkletree.GetMerkleHashes(merkleTree.Steps)
-	generationTransaction := transactions.CreateGeneration(
+	generationTransaction, err := transactions.CreateGeneration(
 		rpcData,
 		poolAddressScript,
 		extraNoncePlaceholder,
 		reward,
 		txMessages,
 		recipients,
+		coinbaseHasher,
+		split,
 	)
+	if err != nil {
+		return nil, err
+	}
 
 	txData := make([][]byte, len(rpcData.Transactions))
 	for i := 0; i < len(rpcData.Transactions); i++ {
@@ -94,7 +110,9 @@ func NewJob(jobId string, rpcData *daemons.GetBlockTemplate, poolAddressScript,
 		TransactionData:       bytes.Join(txData, nil),
 		Reward:                "",
 		MerkleTree:            merkleTree,
-	}
+		CoinbasePaid:          split.PaidAmounts(),
+		CoinbaseWindow:        split.PaidWindow(),
+	}, nil
 }
 
 func (j *Job) SerializeCoinbase(extraNonce1, extraNonce2 []byte) []byte {
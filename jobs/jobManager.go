@@ -2,10 +2,12 @@ package jobs
 
 import (
 	"encoding/hex"
+	"math"
 	"math/big"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	logging "github.com/ipfs/go-log/v2"
@@ -13,6 +15,7 @@ import (
 	"github.com/mining-pool/not-only-mining-pool/config"
 	"github.com/mining-pool/not-only-mining-pool/daemons"
 	"github.com/mining-pool/not-only-mining-pool/storage"
+	"github.com/mining-pool/not-only-mining-pool/transactions"
 	"github.com/mining-pool/not-only-mining-pool/types"
 	"github.com/mining-pool/not-only-mining-pool/utils"
 )
@@ -26,7 +29,7 @@ type JobCounter struct {
 type JobManager struct {
 	PoolAddress *config.Recipient
 
-	Storage               *storage.DB
+	Storage               storage.DB
 	Options               *config.Options
 	JobCounter            *JobCounter
 	ExtraNonce1Generator  *ExtraNonce1Generator
@@ -40,10 +43,25 @@ type JobManager struct {
 
 	DaemonManager *daemons.DaemonManager
 
+	// BlockRelay, when set, pushes a found block to p2p peers before it is
+	// submitted over RPC.
+	BlockRelay func(block []byte, layout transactions.TxLayout)
+
 	NewBlockEvent chan *Job
+
+	// splitWindow caches the PPLNS window coinbaseSplit pays from, read at
+	// most every coinbaseSplitRefresh rather than for every job.
+	splitMu     sync.Mutex
+	splitWindow map[string]float64
+	splitRead   time.Time
 }
 
-func NewJobManager(options *config.Options, dm *daemons.DaemonManager, storage *storage.DB) *JobManager {
+// coinbaseSplitRefresh is how long a PPLNS window read for coinbase payouts is
+// reused. A stale window only shifts who the coinbase pays directly: what it
+// paid is recorded with the block, and the payer pays the rest.
+const coinbaseSplitRefresh = 30 * time.Second
+
+func NewJobManager(options *config.Options, dm *daemons.DaemonManager, storage storage.DB) *JobManager {
 	placeholder, _ := hex.DecodeString("f000000ff111111f")
 	extraNonce1Generator := NewExtraNonce1Generator()
 
@@ -71,6 +89,9 @@ func NewJobManager(options *config.Options, dm *daemons.DaemonManager, storage *
 
 func (jm *JobManager) Init(gbt *daemons.GetBlockTemplate) {
 	jm.ProcessTemplate(gbt)
+	if jm.CurrentJob == nil {
+		log.Fatal("failed to create the initial job from the daemon's block template, see log above for details")
+	}
 }
 
 func (jm *JobManager) ProcessShare(share *types.Share) {
@@ -78,8 +99,20 @@ func (jm *JobManager) ProcessShare(share *types.Share) {
 	var isAccepted bool
 	var tx string
 	if share.BlockHex != "" {
+		// The daemon stays the authority: a block that failed the local check is
+		// still submitted, so a false positive there can never cost a block.
 		log.Info("submitting new Block: ", share.BlockHex)
-		jm.DaemonManager.SubmitBlock(share.BlockHex)
+		if jm.BlockRelay != nil && share.BlockRejection == nil {
+			if block, err := hex.DecodeString(share.BlockHex); err == nil {
+				jm.BlockRelay(block, jm.blockCheck().Layout)
+			}
+		}
+		if rejectReason := jm.DaemonManager.SubmitBlock(share.BlockHex); rejectReason != "" {
+			if share.BlockRejection == nil {
+				share.BlockRejection = &types.BlockRejection{}
+			}
+			share.BlockRejection.DaemonReason = rejectReason
+		}
 
 		isAccepted, tx = jm.DaemonManager.CheckBlockAccepted(share.BlockHash)
 		share.TxHash = tx
@@ -87,11 +120,13 @@ func (jm *JobManager) ProcessShare(share *types.Share) {
 			log.Info("Block ", share.BlockHash, " Accepted! generation tx: ", share.TxHash, ". Wait for pendding!")
 		}
 
+		// polling picks the new template up if every daemon is unreachable now
 		gbt, err := jm.DaemonManager.GetBlockTemplate()
 		if err != nil {
-			log.Panic("failed fetching GBT: ", err)
+			log.Error("failed fetching GBT after a block: ", err)
+		} else {
+			jm.ProcessTemplate(gbt)
 		}
-		jm.ProcessTemplate(gbt)
 	}
 
 	// notValidBlock but isValidShare. PutShare enqueues to a single ordered writer
@@ -101,9 +136,194 @@ func (jm *JobManager) ProcessShare(share *types.Share) {
 
 }
 
+// expectedReward is what a block found on job would pay the pool address,
+// split into subsidy and transaction fees (satoshis), with the network
+// difficulty it must reach in share-difficulty units. Template payees
+// (masternodes, superblocks, ...) come out of the subsidy, and the reward
+// recipients take their percent of both parts. ok is false without a job.
+func (jm *JobManager) expectedReward(job *Job) (networkDiff float64, subsidy, fees uint64, ok bool) {
+	if job == nil {
+		return 0, 0, 0, false
+	}
+	gbt := job.GetBlockTemplate
+	for _, tx := range gbt.Transactions {
+		fees += tx.Fee
+	}
+	if fees > gbt.CoinbaseValue {
+		fees = gbt.CoinbaseValue
+	}
+	subsidy = gbt.CoinbaseValue - fees
+	if payees := templatePayouts(gbt); payees < subsidy {
+		subsidy -= payees
+	} else {
+		subsidy = 0
+	}
+
+	keep := 1 - jm.Options.TotalFeePercent()
+	return jm.networkDiff(job), uint64(float64(subsidy) * keep), uint64(float64(fees) * keep), true
+}
+
+// shareValue is what a share of diff on job earns when the pool pays fpps or
+// pps+ (satoshis): its part of the job's expected reward, fees included under
+// fpps only. It is 0 under any other pay mode. Pricing each share on its own
+// job keeps a payout run from repricing old shares at the current template.
+func (jm *JobManager) shareValue(job *Job, diff float64) float64 {
+	if jm.Options.PaymentOptions == nil {
+		return 0
+	}
+	mode := jm.Options.PaymentOptions.WithDefaults().PayMode
+	if mode != config.PayModeFPPS && mode != config.PayModePPSPlus {
+		return 0
+	}
+	networkDiff, subsidy, fees, ok := jm.expectedReward(job)
+	if !ok || networkDiff <= 0 {
+		return 0
+	}
+	if mode == config.PayModeFPPS {
+		subsidy += fees
+	}
+	return diff * float64(subsidy) / networkDiff
+}
+
+// templatePayouts sums the outputs a template requires besides the pool's, as
+// transactions.GenerateOutputTransactions pays them.
+func templatePayouts(gbt *daemons.GetBlockTemplate) uint64 {
+	var total uint64
+	for _, mn := range gbt.Masternode {
+		total += mn.Amount
+	}
+	for _, sb := range gbt.Superblock {
+		total += sb.Amount
+	}
+	for _, payee := range gbt.Payees {
+		total += payee.Amount
+	}
+	if gbt.Payee != nil && total < gbt.CoinbaseValue {
+		if amount, ok := gbt.PayeeAmount.(uint64); ok {
+			total += amount
+		} else {
+			total += uint64(math.Ceil(float64(gbt.CoinbaseValue-total) / 5))
+		}
+	}
+	return total
+}
+
+// networkDiff is the job's network difficulty in the units share difficulties
+// are credited in: the job's own leaves out the algorithm multiplier.
+func (jm *JobManager) networkDiff(job *Job) float64 {
+	diff, _ := new(big.Float).SetMantExp(job.Difficulty, jm.Options.Algorithm.Multiplier).Float64()
+	return diff
+}
+
+// BlockHasher returns the function computing a header's block id (internal
+// byte order) for this coin.
+func (jm *JobManager) BlockHasher() func([]byte) []byte {
+	switch {
+	case jm.Options.Algorithm.BlockHasher != "":
+		// explicit block-id algorithm, e.g. GRS uses a single "sha256"
+		return algorithm.GetHashFunc(jm.Options.Algorithm.BlockHasher)
+	case jm.Options.Algorithm.SHA256dBlockHasher:
+		// LTC
+		return utils.Sha256d
+	default:
+		// DASH
+		return algorithm.GetHashFunc(jm.Options.Algorithm.Name)
+	}
+}
+
+// blockCheck describes how this coin's blocks are hashed and laid out for the
+// pre-submit check. It is built per block since the reward type is detected
+// from the daemon after the manager is created.
+func (jm *JobManager) blockCheck() *BlockCheck {
+	return &BlockCheck{
+		PowHasher: algorithm.GetHashFunc(jm.Options.Algorithm.Name),
+		TxHasher:  jm.CoinbaseHasher,
+		Layout: transactions.TxLayout{
+			Timestamp: jm.Options.Coin.Reward == "POS",
+			Comment:   jm.Options.Coin.TxMessages,
+		},
+	}
+}
+
+// coinbaseSplit snapshots the PPLNS window for a new job when coinbase payouts
+// are on, or returns nil. The window is the cached one while it is fresher
+// than coinbaseSplitRefresh. If it can't be read the job pays the pool output
+// only, and the payer pays everyone from the wallet instead.
+func (jm *JobManager) coinbaseSplit() *transactions.CoinbaseSplit {
+	if jm.Options.DisablePayment || jm.Options.PaymentOptions == nil || !jm.Options.PaymentOptions.CoinbasePayouts {
+		return nil
+	}
+	options := jm.Options.PaymentOptions.WithDefaults()
+
+	shares, err := jm.pplnsWindow(options.PPLNSWindow)
+	if err != nil {
+		log.Error("failed reading the pplns window, this job pays the pool output only: ", err)
+		return nil
+	}
+
+	magnitude := options.Magnitude
+	if magnitude <= 0 {
+		magnitude = 1e8 // same fallback as the payer
+	}
+
+	return &transactions.CoinbaseSplit{
+		Shares:     shares,
+		Dust:       uint64(math.Floor(options.CoinbaseDust * magnitude)),
+		MaxOutputs: options.CoinbaseMaxOutputs,
+		Script: func(miner string) []byte {
+			return minerScript(miner, options.CoinbaseAddressType, jm.Options.Coin.Networks)
+		},
+	}
+}
+
+// pplnsWindow returns the cached PPLNS window, reading it again from storage
+// once it is older than coinbaseSplitRefresh. A failed read drops the cache.
+func (jm *JobManager) pplnsWindow(window float64) (map[string]float64, error) {
+	jm.splitMu.Lock()
+	defer jm.splitMu.Unlock()
+
+	if jm.splitWindow != nil && time.Since(jm.splitRead) < coinbaseSplitRefresh {
+		return jm.splitWindow, nil
+	}
+	shares, err := jm.Storage.GetPPLNSShares("", math.MaxInt64, window)
+	if err != nil {
+		jm.splitWindow = nil
+		return nil, err
+	}
+	jm.splitWindow, jm.splitRead = shares, time.Now()
+	return shares, nil
+}
+
+// minerScript returns the output script for a miner name that is an address
+// of the coin's networks and of the given type, or nil. Worker names are
+// unauthenticated, so anything else (another network's or coin's address, or
+// a p2sh address under "p2pkh") is left for the payer to pay from the wallet
+// rather than burned on a script nobody holds. "auto" accepts any address of
+// the coin's networks.
+func minerScript(miner, addressType string, networks map[string]*utils.AddressNetwork) []byte {
+	script, _, err := utils.AutoAddressToScript(miner, networks)
+	if err != nil {
+		return nil
+	}
+
+	switch addressType {
+	case "auto":
+		return script
+	case "p2sh":
+		if len(script) == 23 && script[0] == 0xA9 && script[1] == 0x14 && script[22] == 0x87 {
+			return script
+		}
+	default: // p2pkh
+		if len(script) == 25 && script[0] == 0x76 && script[1] == 0xA9 && script[2] == 0x14 && script[23] == 0x88 && script[24] == 0xAC {
+			return script
+		}
+	}
+	return nil
+}
+
 // UpdateCurrentJob updates the job when mining the same height but tx changes
 func (jm *JobManager) UpdateCurrentJob(rpcData *daemons.GetBlockTemplate) {
-	tmpBlockTemplate := NewJob(
+	tmpBlockTemplate, err := NewJob(
 		jm.CurrentJob.JobId,
 		rpcData,
 		jm.PoolAddress.GetScript(),
@@ -112,7 +332,12 @@ func (jm *JobManager) UpdateCurrentJob(rpcData *daemons.GetBlockTemplate) {
 		jm.Options.Coin.TxMessages,
 		jm.Options.RewardRecipients,
 		jm.CoinbaseHasher,
+		jm.coinbaseSplit(),
 	)
+	if err != nil {
+		log.Error("rejected block template at height ", rpcData.Height, ", keeping the current job: ", err)
+		return
+	}
 
 	jm.CurrentJob = tmpBlockTemplate
 	jm.ValidJobs[tmpBlockTemplate.JobId] = tmpBlockTemplate
@@ -124,7 +349,7 @@ func (jm *JobManager) UpdateCurrentJob(rpcData *daemons.GetBlockTemplate) {
 func (jm *JobManager) CreateNewJob(rpcData *daemons.GetBlockTemplate) {
 	// creates a new job when mining new height
 
-	tmpBlockTemplate := NewJob(
+	tmpBlockTemplate, err := NewJob(
 		utils.RandHexUint64(),
 		rpcData,
 		jm.PoolAddress.GetScript(),
@@ -133,7 +358,12 @@ func (jm *JobManager) CreateNewJob(rpcData *daemons.GetBlockTemplate) {
 		jm.Options.Coin.TxMessages,
 		jm.Options.RewardRecipients,
 		jm.CoinbaseHasher,
+		jm.coinbaseSplit(),
 	)
+	if err != nil {
+		log.Error("rejected block template at height ", rpcData.Height, ", no new job created: ", err)
+		return
+	}
 
 	jm.CurrentJob = tmpBlockTemplate
 	jm.ValidJobs[tmpBlockTemplate.JobId] = tmpBlockTemplate
@@ -173,6 +403,7 @@ func (jm *JobManager) ProcessSubmit(jobId string, prevDiff, diff *big.Float, ext
 		return &types.Share{
 			JobId:      jobId,
 			RemoteAddr: ipAddr,
+			Time:       submitTime.Unix(),
 			Miner:      miner,
 			Rig:        rig,
 
@@ -189,6 +420,7 @@ func (jm *JobManager) ProcessSubmit(jobId string, prevDiff, diff *big.Float, ext
 		return &types.Share{
 			JobId:      jobId,
 			RemoteAddr: ipAddr,
+			Time:       submitTime.Unix(),
 			Miner:      miner,
 			Rig:        rig,
 
@@ -200,6 +432,7 @@ func (jm *JobManager) ProcessSubmit(jobId string, prevDiff, diff *big.Float, ext
 		return &types.Share{
 			JobId:      jobId,
 			RemoteAddr: ipAddr,
+			Time:       submitTime.Unix(),
 			Miner:      miner,
 			Rig:        rig,
 
@@ -217,6 +450,7 @@ func (jm *JobManager) ProcessSubmit(jobId string, prevDiff, diff *big.Float, ext
 		return &types.Share{
 			JobId:      jobId,
 			RemoteAddr: ipAddr,
+			Time:       submitTime.Unix(),
 			Miner:      miner,
 			Rig:        rig,
 
@@ -228,6 +462,7 @@ func (jm *JobManager) ProcessSubmit(jobId string, prevDiff, diff *big.Float, ext
 		return &types.Share{
 			JobId:      jobId,
 			RemoteAddr: ipAddr,
+			Time:       submitTime.Unix(),
 			Miner:      miner,
 			Rig:        rig,
 
@@ -239,6 +474,7 @@ func (jm *JobManager) ProcessSubmit(jobId string, prevDiff, diff *big.Float, ext
 		return &types.Share{
 			JobId:      jobId,
 			RemoteAddr: ipAddr,
+			Time:       submitTime.Unix(),
 			Miner:      miner,
 			Rig:        rig,
 
@@ -277,31 +513,34 @@ func (jm *JobManager) ProcessSubmit(jobId string, prevDiff, diff *big.Float, ext
 
 	// Check if share is a block candidate (reaches network difficulty)
 	if job.Target.Cmp(headerHashBigInt) > 0 {
-		blockHex := hex.EncodeToString(job.SerializeBlock(headerBytes, coinbaseBytes))
-		var blockHash string
-		if jm.Options.Algorithm.BlockHasher != "" {
-			// explicit block-id algorithm, e.g. GRS uses a single "sha256"
-			blockHash = hex.EncodeToString(utils.ReverseBytes(algorithm.GetHashFunc(jm.Options.Algorithm.BlockHasher)(headerBytes)))
-		} else if jm.Options.Algorithm.SHA256dBlockHasher {
-			// LTC
-			blockHash = hex.EncodeToString(utils.ReverseBytes(utils.Sha256d(headerBytes)))
-		} else {
-			// DASH
-			blockHash = hex.EncodeToString(utils.ReverseBytes(algorithm.GetHashFunc(jm.Options.Algorithm.Name)(headerBytes)))
-		}
+		blockBytes := job.SerializeBlock(headerBytes, coinbaseBytes)
+		blockHex := hex.EncodeToString(blockBytes)
+		blockHash := hex.EncodeToString(utils.ReverseBytes(jm.BlockHasher()(headerBytes)))
 
 		log.Warn("Found Block: ", blockHash)
+		rejection := job.CheckBlock(blockBytes, jm.blockCheck())
+		if rejection != nil {
+			log.Error("block ", blockHash, " failed the pre-submit check (", rejection.Reason, "): ", rejection.Detail)
+		}
+
 		return &types.Share{
 			JobId:      jobId,
 			RemoteAddr: ipAddr,
+			Time:       submitTime.Unix(),
 			Miner:      miner,
 			Rig:        rig,
 
 			BlockHeight: job.GetBlockTemplate.Height,
 			BlockReward: job.GetBlockTemplate.CoinbaseValue,
 			Diff:        assignedDiff,
+			Value:       jm.shareValue(job, assignedDiff),
 			BlockHash:   blockHash,
 			BlockHex:    blockHex,
+			NetworkDiff: jm.networkDiff(job),
+
+			BlockRejection: rejection,
+			CoinbasePaid:   job.CoinbasePaid,
+			CoinbaseWindow: job.CoinbaseWindow,
 		}
 	}
 
@@ -313,17 +552,20 @@ func (jm *JobManager) ProcessSubmit(jobId string, prevDiff, diff *big.Float, ext
 			return &types.Share{
 				JobId:      jobId,
 				RemoteAddr: ipAddr,
+				Time:       submitTime.Unix(),
 				Miner:      miner,
 				Rig:        rig,
 
 				BlockHeight: job.GetBlockTemplate.Height,
 				BlockReward: job.GetBlockTemplate.CoinbaseValue,
 				Diff:        prevAssigned,
+				Value:       jm.shareValue(job, prevAssigned),
 			}
 		} else {
 			return &types.Share{
 				JobId:      jobId,
 				RemoteAddr: ipAddr,
+				Time:       submitTime.Unix(),
 				Miner:      workerName,
 
 				ErrorCode: types.ErrLowDiffShare,
@@ -335,10 +577,12 @@ func (jm *JobManager) ProcessSubmit(jobId string, prevDiff, diff *big.Float, ext
 	return &types.Share{
 		JobId:      jobId,
 		RemoteAddr: ipAddr,
+		Time:       submitTime.Unix(),
 		Miner:      miner,
 		Rig:        rig,
 
-		Diff: assignedDiff,
+		Diff:  assignedDiff,
+		Value: jm.shareValue(job, assignedDiff),
 	}
 }
 
@@ -0,0 +1,130 @@
+package jobs
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+	"github.com/mining-pool/not-only-mining-pool/daemons"
+	"github.com/mining-pool/not-only-mining-pool/storage"
+	"github.com/mining-pool/not-only-mining-pool/utils"
+)
+
+// Masternode payments come out of the subsidy; recipients take their percent
+// of what is left, fees included.
+func TestJobManager_ShareValue(t *testing.T) {
+	jm := &JobManager{Options: &config.Options{
+		Algorithm:        &config.AlgorithmOptions{Multiplier: 8},
+		RewardRecipients: []*config.Recipient{{Percent: 0.1}},
+	}}
+	if _, _, _, ok := jm.expectedReward(nil); ok {
+		t.Error("an expected reward without a job")
+	}
+
+	job := &Job{
+		Difficulty: big.NewFloat(2),
+		GetBlockTemplate: &daemons.GetBlockTemplate{
+			CoinbaseValue: 1300,
+			Transactions:  []*daemons.TxParams{{Fee: 200}, {Fee: 100}},
+			Masternode:    []daemons.MasternodeParams{{Amount: 500}},
+		},
+	}
+	networkDiff, subsidy, fees, ok := jm.expectedReward(job)
+	if !ok || networkDiff != 512 || subsidy != 450 || fees != 270 {
+		t.Errorf("expected reward = %v, %d + %d (%v), want 512, 450 + 270", networkDiff, subsidy, fees, ok)
+	}
+
+	// a share is priced on its job: fpps with the fees, pps+ without
+	if v := jm.shareValue(job, 64); v != 0 {
+		t.Errorf("share value without payments = %v, want 0", v)
+	}
+	for mode, want := range map[string]float64{"fpps": 64 * 720.0 / 512, "pps+": 64 * 450.0 / 512, "pplns": 0} {
+		jm.Options.PaymentOptions = &config.PaymentOptions{PayMode: mode}
+		if v := jm.shareValue(job, 64); v != want {
+			t.Errorf("%s share value = %v, want %v", mode, v, want)
+		}
+	}
+}
+
+// Only addresses of the coin's networks and of the configured type are paid in
+// the coinbase; the hash of any other would be paid to a script nobody holds.
+func TestMinerScript(t *testing.T) {
+	v := func(b byte) *byte { return &b }
+	networks := map[string]*utils.AddressNetwork{
+		"mainnet": {Bech32HRP: "bc", P2PKHVersion: v(0), P2SHVersion: v(5)},
+	}
+	const (
+		p2pkh   = "1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu"
+		p2sh    = "3CMNFxN1oHBc4R1EpboAL5yzHGgE611Xou"
+		testnet = "mrCDrCybB6J1vRfbwM5hemdJz73FwDBC8r"
+		segwit  = "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+	)
+	cases := []struct {
+		miner, addressType, script string
+	}{
+		{p2pkh, "p2pkh", "76a91476a04053bda0a88bda5177b86a15c3b29f55987388ac"},
+		{p2sh, "p2pkh", ""},
+		{testnet, "p2pkh", ""},
+		{segwit, "p2pkh", ""},
+		{"worker1", "p2pkh", ""},
+		{p2sh, "p2sh", "a91474f209f6ea907e2ea48f74fae05782ae8a66525787"},
+		{p2pkh, "p2sh", ""},
+		{testnet, "auto", ""},
+		{segwit, "auto", "0014751e76e8199196d454941c45d1b3a323f1433bd6"},
+	}
+	for _, c := range cases {
+		if got := hex.EncodeToString(minerScript(c.miner, c.addressType, networks)); got != c.script {
+			t.Errorf("minerScript(%s, %s) = %s, want %q", c.miner, c.addressType, got, c.script)
+		}
+	}
+	if minerScript(p2pkh, "p2pkh", nil) != nil {
+		t.Error("a coin without networks must pay nobody in the coinbase")
+	}
+}
+
+// windowStore counts PPLNS window reads and fails them while err is set.
+type windowStore struct {
+	storage.DB
+	reads int
+	err   error
+}
+
+func (s *windowStore) GetPPLNSShares(string, int64, float64) (map[string]float64, error) {
+	s.reads++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return map[string]float64{"A": 1}, nil
+}
+
+// Jobs reuse the PPLNS window for coinbaseSplitRefresh instead of reading it
+// for each, and a failed read gives the job no split.
+func TestCoinbaseSplit_CachesWindow(t *testing.T) {
+	db := &windowStore{}
+	jm := &JobManager{Storage: db, Options: &config.Options{
+		Coin:           &config.CoinOptions{},
+		PaymentOptions: &config.PaymentOptions{PayMode: config.PayModePPLNS, PPLNSWindow: 10, CoinbasePayouts: true},
+	}}
+
+	for i := 0; i < 3; i++ {
+		if split := jm.coinbaseSplit(); split == nil || split.Shares["A"] != 1 {
+			t.Fatalf("split = %+v, want A's window", split)
+		}
+	}
+	if db.reads != 1 {
+		t.Errorf("window read %d times for 3 jobs, want once", db.reads)
+	}
+
+	jm.splitRead = time.Now().Add(-coinbaseSplitRefresh)
+	db.err = errors.New("storage down")
+	if split := jm.coinbaseSplit(); split != nil {
+		t.Errorf("split with storage down = %+v, want none", split)
+	}
+	db.err = nil
+	if split := jm.coinbaseSplit(); split == nil || db.reads != 3 {
+		t.Errorf("split after storage recovered = %+v after %d reads, want a fresh read", split, db.reads)
+	}
+}
@@ -76,3 +76,31 @@ func GetMerkleHashes(steps [][]byte) []string {
 
 	return hashes
 }
+
+// MerkleRoot folds a full list of leaves (internal byte order) into the tree's
+// root, duplicating the last node of an odd level as Bitcoin does. Unlike
+// CalculateSteps it needs every leaf up front, e.g. the witness tree whose
+// coinbase leaf is fixed at zero. A nil hasher defaults to double-SHA256.
+func MerkleRoot(leaves [][]byte, hasher Hasher) []byte {
+	if hasher == nil {
+		hasher = utils.Sha256d
+	}
+	if len(leaves) == 0 {
+		return make([]byte, 32)
+	}
+
+	level := append([][]byte(nil), leaves...) // never grow the caller's slice
+	for len(level) > 1 {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			next[i] = hasher(bytes.Join([][]byte{level[2*i], level[2*i+1]}, nil))
+		}
+		level = next
+	}
+
+	return level[0]
+}
@@ -0,0 +1,311 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+
+	"github.com/mining-pool/not-only-mining-pool/transactions"
+	"github.com/mining-pool/not-only-mining-pool/utils"
+)
+
+// relayedBlocks is how many of our own blocks are kept to answer getdata and
+// getblocktxn after they were announced.
+const relayedBlocks = 4
+
+// relayBlock is a found block prepared for BIP152 relay.
+type relayBlock struct {
+	hash   []byte // block id, internal byte order
+	header []byte
+	raw    []byte   // full serialization, witness included
+	txs    [][]byte // each transaction with witness
+	strip  [][]byte // each transaction without witness
+}
+
+// parseRelayBlock splits a serialized block into its transactions. Blocks with
+// bytes after the last transaction (POS signature slots, vote data) are
+// completed by the daemon and are not relayed.
+//
+// Our blocks are serialized for submitblock, which adds the coinbase witness
+// itself; peers would reject a segwit block without it as mutated, so a
+// coinbase committing to witnesses is given its reserved value here.
+func parseRelayBlock(raw []byte, layout transactions.TxLayout, hasher func([]byte) []byte) (*relayBlock, error) {
+	if len(raw) < 81 {
+		return nil, errors.New("block shorter than its header")
+	}
+	count, n, err := readVarInt(raw[80:])
+	if err != nil {
+		return nil, err
+	}
+
+	b := &relayBlock{header: raw[:80], hash: hasher(raw[:80])}
+	parts := [][]byte{raw[:80+n]}
+	pos := 80 + n
+	for i := uint64(0); i < count; i++ {
+		tx, used, err := transactions.ParseTx(raw[pos:], layout)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d: %w", i, err)
+		}
+		full := raw[pos : pos+used]
+		if i == 0 && !tx.HasWitness && transactions.HasWitnessCommitment(tx) {
+			if full, err = transactions.AddCoinbaseWitness(full, layout); err != nil {
+				return nil, fmt.Errorf("coinbase witness: %w", err)
+			}
+		}
+		b.txs = append(b.txs, full)
+		b.strip = append(b.strip, tx.Stripped)
+		parts = append(parts, full)
+		pos += used
+	}
+	if pos != len(raw) {
+		return nil, fmt.Errorf("%d bytes follow the transactions", len(raw)-pos)
+	}
+	b.raw = bytes.Join(parts, nil)
+	return b, nil
+}
+
+// stripped is the block without witness data, for peers that asked for
+// MSG_BLOCK rather than MSG_WITNESS_BLOCK.
+func (b *relayBlock) stripped() []byte {
+	return bytes.Join(append([][]byte{b.header, utils.VarIntBytes(uint64(len(b.strip)))}, b.strip...), nil)
+}
+
+// cmpctBlock builds a BIP152 cmpctblock payload: the coinbase is prefilled
+// and every other transaction is sent as a 6-byte short id of its txid
+// (version 1) or wtxid (version 2).
+func (b *relayBlock) cmpctBlock(version uint64) []byte {
+	nonce := make([]byte, 8)
+	_, _ = rand.Read(nonce)
+
+	key := sha256.Sum256(append(append([]byte{}, b.header...), nonce...))
+	k0, k1 := binary.LittleEndian.Uint64(key[0:8]), binary.LittleEndian.Uint64(key[8:16])
+
+	parts := [][]byte{b.header, nonce, utils.VarIntBytes(uint64(len(b.txs) - 1))}
+	for i := 1; i < len(b.txs); i++ {
+		id := utils.Sha256d(b.strip[i])
+		if version >= 2 {
+			id = utils.Sha256d(b.txs[i])
+		}
+		short := utils.PackUint64LE(sipHash24(k0, k1, id))
+		parts = append(parts, short[:6])
+	}
+
+	coinbase := b.strip[0]
+	if version >= 2 {
+		coinbase = b.txs[0]
+	}
+	parts = append(parts, utils.VarIntBytes(1), utils.VarIntBytes(0), coinbase)
+	return bytes.Join(parts, nil)
+}
+
+// blockTxn answers a getblocktxn payload (block hash, then differentially
+// encoded indexes) with the blocktxn payload, or nil if it isn't ours.
+func (b *relayBlock) blockTxn(request []byte, version uint64) ([]byte, error) {
+	if len(request) < 32 || !bytes.Equal(request[:32], b.hash) {
+		return nil, nil
+	}
+	count, n, err := readVarInt(request[32:])
+	if err != nil {
+		return nil, err
+	}
+
+	buf := request[32+n:]
+	parts := [][]byte{b.hash, utils.VarIntBytes(count)}
+	next := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		diff, used, err := readVarInt(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[used:]
+		index := next + diff
+		if index >= uint64(len(b.txs)) {
+			return nil, fmt.Errorf("getblocktxn index %d out of %d transactions", index, len(b.txs))
+		}
+		if version >= 2 {
+			parts = append(parts, b.txs[index])
+		} else {
+			parts = append(parts, b.strip[index])
+		}
+		next = index + 1
+	}
+	return bytes.Join(parts, nil), nil
+}
+
+// blockCache remembers the blocks we relayed most recently.
+type blockCache struct {
+	mu     sync.Mutex
+	blocks []*relayBlock
+}
+
+func (c *blockCache) add(b *relayBlock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blocks = append(c.blocks, b)
+	if len(c.blocks) > relayedBlocks {
+		c.blocks = c.blocks[1:]
+	}
+}
+
+func (c *blockCache) get(hash []byte) *relayBlock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range c.blocks {
+		if bytes.Equal(b.hash, hash) {
+			return b
+		}
+	}
+	return nil
+}
+
+// RelayBlock pushes one of our found blocks to the peer: as a cmpctblock if
+// the node announced BIP152 support with sendcmpct, otherwise as a full block.
+func (p *Peer) RelayBlock(b *relayBlock) error {
+	p.blocks.add(b)
+
+	p.mu.Lock()
+	version := p.cmpctVersion
+	p.mu.Unlock()
+
+	if version > 0 {
+		log.Info("relaying block ", hex.EncodeToString(utils.ReverseBytes(b.hash)), " to ", p.Addr, " as a compact block")
+		return p.SendMessage("cmpctblock", b.cmpctBlock(version))
+	}
+	log.Info("relaying block ", hex.EncodeToString(utils.ReverseBytes(b.hash)), " to ", p.Addr)
+	return p.SendMessage("block", b.raw)
+}
+
+// handleSendCmpct records the highest compact block version the node accepts
+// (BIP152: 1 = txid short ids, 2 = wtxid short ids).
+func (p *Peer) handleSendCmpct(payload []byte) {
+	if len(payload) < 9 {
+		return
+	}
+	version := binary.LittleEndian.Uint64(payload[1:9])
+	if version != 1 && version != 2 {
+		return
+	}
+
+	p.mu.Lock()
+	if version > p.cmpctVersion {
+		p.cmpctVersion = version
+	}
+	p.mu.Unlock()
+}
+
+// handleGetData serves requests for blocks we relayed; anything else is the
+// node's business, not ours.
+func (p *Peer) handleGetData(payload []byte) error {
+	count, n, err := readVarInt(payload)
+	if err != nil {
+		return nil
+	}
+	buf := payload[n:]
+	for i := uint64(0); i < count && len(buf) >= 36; i++ {
+		kind, hash := binary.LittleEndian.Uint32(buf), buf[4:36]
+		buf = buf[36:]
+
+		b := p.blocks.get(hash)
+		if b == nil {
+			continue
+		}
+		switch kind {
+		case invWitnessBlock:
+			err = p.SendMessage("block", b.raw)
+		case invBlock:
+			err = p.SendMessage("block", b.stripped())
+		case invCmpctBlock:
+			version := uint64(1)
+			p.mu.Lock()
+			if p.cmpctVersion > 0 {
+				version = p.cmpctVersion
+			}
+			p.mu.Unlock()
+			err = p.SendMessage("cmpctblock", b.cmpctBlock(version))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleGetBlockTxn sends the transactions a node could not rebuild from its
+// mempool after our cmpctblock.
+func (p *Peer) handleGetBlockTxn(payload []byte) error {
+	if len(payload) < 32 {
+		return nil
+	}
+	b := p.blocks.get(payload[:32])
+	if b == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	version := p.cmpctVersion
+	p.mu.Unlock()
+
+	answer, err := b.blockTxn(payload, version)
+	if err != nil {
+		log.Warn("bad getblocktxn from ", p.Addr, ": ", err)
+		return nil
+	}
+	return p.SendMessage("blocktxn", answer)
+}
+
+// sipHash24 is SipHash-2-4 of msg under the key (k0, k1), as BIP152 uses it.
+func sipHash24(k0, k1 uint64, msg []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	n := len(msg)
+	for len(msg) >= 8 {
+		m := binary.LittleEndian.Uint64(msg)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		msg = msg[8:]
+	}
+
+	last := uint64(n&0xff) << 56
+	for i := len(msg) - 1; i >= 0; i-- {
+		last |= uint64(msg[i]) << (8 * uint(i))
+	}
+	v3 ^= last
+	round()
+	round()
+	v0 ^= last
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,231 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/mining-pool/not-only-mining-pool/daemons"
+	"github.com/mining-pool/not-only-mining-pool/jobs"
+	"github.com/mining-pool/not-only-mining-pool/merkletree"
+	"github.com/mining-pool/not-only-mining-pool/transactions"
+	"github.com/mining-pool/not-only-mining-pool/utils"
+)
+
+func TestSipHash24(t *testing.T) {
+	// reference vector from the SipHash paper: key 00..0f, empty message
+	k0 := binary.LittleEndian.Uint64([]byte{0, 1, 2, 3, 4, 5, 6, 7})
+	k1 := binary.LittleEndian.Uint64([]byte{8, 9, 10, 11, 12, 13, 14, 15})
+	if got := sipHash24(k0, k1, nil); got != 0x726fdb47dd0e0e31 {
+		t.Fatalf("siphash of empty message is %x", got)
+	}
+	msg := make([]byte, 15)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	if got := sipHash24(k0, k1, msg); got != 0xa129ca6149be45e5 {
+		t.Fatalf("siphash of 00..0e is %x", got)
+	}
+}
+
+// testTx serializes a one-in one-out transaction, with a witness if given.
+func testTx(scriptSig []byte, witness []byte) []byte {
+	parts := [][]byte{utils.PackUint32LE(2)}
+	if witness != nil {
+		parts = append(parts, []byte{0, 1})
+	}
+	parts = append(parts,
+		[]byte{1}, make([]byte, 32), utils.PackUint32LE(0xffffffff), utils.VarStringBytes(string(scriptSig)), utils.PackUint32LE(0xffffffff),
+		[]byte{1}, utils.PackUint64LE(5000), utils.VarStringBytes("\x51"),
+	)
+	if witness != nil {
+		parts = append(parts, []byte{1}, utils.VarStringBytes(string(witness)))
+	}
+	return bytes.Join(append(parts, utils.PackUint32LE(0)), nil)
+}
+
+func testBlock() ([]byte, [][]byte) {
+	txs := [][]byte{
+		testTx([]byte{1, 2}, make([]byte, 32)),
+		testTx([]byte{3}, []byte{9, 9}),
+		testTx([]byte{4}, nil),
+	}
+	header := make([]byte, 80)
+	header[0] = 0x20
+	block := bytes.Join(append([][]byte{header, {byte(len(txs))}}, txs...), nil)
+	return block, txs
+}
+
+func TestCompactBlock(t *testing.T) {
+	raw, txs := testBlock()
+	b, err := parseRelayBlock(raw, transactions.TxLayout{}, utils.Sha256d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []uint64{1, 2} {
+		payload := b.cmpctBlock(version)
+		if !bytes.Equal(payload[:80], raw[:80]) {
+			t.Fatal("cmpctblock does not start with the header")
+		}
+		nonce := payload[80:88]
+		key := sha256.Sum256(append(append([]byte{}, raw[:80]...), nonce...))
+		k0, k1 := binary.LittleEndian.Uint64(key[0:8]), binary.LittleEndian.Uint64(key[8:16])
+
+		if payload[88] != 2 {
+			t.Fatalf("v%d: %d short ids, want 2", version, payload[88])
+		}
+		for i := 1; i <= 2; i++ {
+			id := utils.Sha256d(b.strip[i])
+			if version == 2 {
+				id = utils.Sha256d(txs[i])
+			}
+			want := utils.PackUint64LE(sipHash24(k0, k1, id))[:6]
+			if got := payload[89+6*(i-1) : 95+6*(i-1)]; !bytes.Equal(got, want) {
+				t.Fatalf("v%d: short id %d is %x, want %x", version, i, got, want)
+			}
+		}
+
+		prefilled := payload[101:]
+		coinbase := b.strip[0]
+		if version == 2 {
+			coinbase = txs[0]
+		}
+		if !bytes.Equal(prefilled, append([]byte{1, 0}, coinbase...)) {
+			t.Fatalf("v%d: prefilled coinbase is %x", version, prefilled)
+		}
+	}
+}
+
+// A block from Job.SerializeBlock has no coinbase witness (submitblock adds
+// it); relayed on a segwit template it must carry one matching its commitment.
+func TestCompactBlock_AddsCoinbaseWitness(t *testing.T) {
+	spend := testTx([]byte{3}, []byte{9, 9})
+	parsed, _, _ := transactions.ParseTx(spend, transactions.TxLayout{})
+	rpcData := &daemons.GetBlockTemplate{
+		Version:           0x20000000,
+		PreviousBlockHash: hex.EncodeToString(make([]byte, 32)),
+		Transactions: []*daemons.TxParams{{
+			Data: hex.EncodeToString(spend),
+			TxId: hex.EncodeToString(utils.ReverseBytes(utils.Sha256d(parsed.Stripped))),
+			Hash: hex.EncodeToString(utils.ReverseBytes(utils.Sha256d(spend))),
+		}},
+		CoinbaseValue: 5000,
+		Target:        strings.Repeat("f", 64),
+		Bits:          "207fffff",
+		CurTime:       1581749398,
+		Height:        1000,
+	}
+	job, err := jobs.NewJob("1", rpcData, []byte{0x51}, make([]byte, 8), "POW", false, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := job.SerializeCoinbase([]byte{1, 2, 3, 4}, []byte{5, 6, 7, 8})
+	merkleRoot := utils.ReverseBytes(job.MerkleTree.WithFirst(utils.Sha256d(coinbase)))
+	raw := job.SerializeBlock(job.SerializeHeader(merkleRoot, make([]byte, 4), make([]byte, 4)), coinbase)
+
+	b, err := parseRelayBlock(raw, transactions.TxLayout{}, utils.Sha256d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.strip[0], coinbase) {
+		t.Fatal("the coinbase changed beyond its witness")
+	}
+
+	cb, _, err := transactions.ParseTx(b.txs[0], transactions.TxLayout{})
+	if err != nil || !cb.HasWitness {
+		t.Fatalf("relayed coinbase %x has no witness (%v)", b.txs[0], err)
+	}
+	reserved := make([]byte, 32)
+	if !bytes.HasSuffix(b.txs[0], append(append([]byte{1, 32}, reserved...), utils.PackUint32LE(0)...)) {
+		t.Fatalf("relayed coinbase witness is not the reserved value: %x", b.txs[0])
+	}
+	root := merkletree.MerkleRoot([][]byte{make([]byte, 32), utils.Sha256d(spend)}, utils.Sha256d)
+	commitment := utils.Sha256d(append(root, reserved...))
+	found := false
+	for _, out := range cb.Outputs {
+		found = found || bytes.HasSuffix(out.ScriptPubKey, commitment)
+	}
+	if !found {
+		t.Fatal("the coinbase does not commit to the relayed witnesses")
+	}
+
+	want := bytes.Join([][]byte{raw[:81], b.txs[0], spend}, nil)
+	if !bytes.Equal(b.raw, want) {
+		t.Fatalf("relayed block is %x, want %x", b.raw, want)
+	}
+	if prefilled := b.cmpctBlock(2); !bytes.HasSuffix(prefilled, append([]byte{1, 0}, b.txs[0]...)) {
+		t.Fatal("cmpctblock v2 does not prefill the coinbase with its witness")
+	}
+}
+
+func TestCompactBlock_RejectsTrailingData(t *testing.T) {
+	raw, _ := testBlock()
+	if _, err := parseRelayBlock(append(raw, 0), transactions.TxLayout{}, utils.Sha256d); err == nil {
+		t.Fatal("a block with a signature slot after its transactions was accepted for relay")
+	}
+}
+
+func TestPeer_RelaysCompactBlockAndServesBlockTxn(t *testing.T) {
+	options, conns := fakeNode(t)
+	magic, _ := hex.DecodeString(options.Magic)
+	m := NewManager(70016, options, nil)
+	m.Init()
+	defer m.Peers[0].Stop()
+
+	c := <-conns
+	expect(t, c, magic, "version")
+	_, _ = c.Write(encodeMessage(magic, "version", make([]byte, 86)))
+	_, _ = c.Write(encodeMessage(magic, "verack", nil))
+	expect(t, c, magic, "sendheaders")
+	_, _ = c.Write(encodeMessage(magic, "sendcmpct", append([]byte{0}, utils.PackUint64LE(2)...)))
+	// a ping round trip makes sure sendcmpct was handled
+	_, _ = c.Write(encodeMessage(magic, "ping", []byte("12345678")))
+	expect(t, c, magic, "pong")
+
+	raw, txs := testBlock()
+	m.RelayBlock(raw, transactions.TxLayout{})
+	cmpct := expect(t, c, magic, "cmpctblock")
+	if !bytes.Equal(cmpct.payload[:80], raw[:80]) {
+		t.Fatal("relayed cmpctblock is for another block")
+	}
+
+	// ask for the last transaction (differential index 2)
+	hash := utils.Sha256d(raw[:80])
+	_, _ = c.Write(encodeMessage(magic, "getblocktxn", append(append([]byte{}, hash...), 1, 2)))
+	blocktxn := expect(t, c, magic, "blocktxn")
+	want := bytes.Join([][]byte{hash, {1}, txs[2]}, nil)
+	if !bytes.Equal(blocktxn.payload, want) {
+		t.Fatalf("blocktxn is %x, want %x", blocktxn.payload, want)
+	}
+
+	// getdata for the witness block gets the full serialization
+	getdata := bytes.Join([][]byte{{1}, utils.PackUint32LE(invWitnessBlock), hash}, nil)
+	_, _ = c.Write(encodeMessage(magic, "getdata", getdata))
+	if block := expect(t, c, magic, "block"); !bytes.Equal(block.payload, raw) {
+		t.Fatal("getdata answered with a different block")
+	}
+}
+
+func TestPeer_RelaysFullBlockWithoutCompactSupport(t *testing.T) {
+	options, conns := fakeNode(t)
+	magic, _ := hex.DecodeString(options.Magic)
+	m := NewManager(70016, options, nil)
+	m.Init()
+	defer m.Peers[0].Stop()
+
+	c := <-conns
+	expect(t, c, magic, "version")
+	_, _ = c.Write(encodeMessage(magic, "version", make([]byte, 86)))
+	_, _ = c.Write(encodeMessage(magic, "verack", nil))
+	expect(t, c, magic, "sendheaders")
+
+	raw, _ := testBlock()
+	m.RelayBlock(raw, transactions.TxLayout{})
+	if block := expect(t, c, magic, "block"); !bytes.Equal(block.payload, raw) {
+		t.Fatal("relayed a different block")
+	}
+}
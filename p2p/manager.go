@@ -0,0 +1,121 @@
+package p2p
+
+import (
+	"sync"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+	"github.com/mining-pool/not-only-mining-pool/transactions"
+	"github.com/mining-pool/not-only-mining-pool/utils"
+)
+
+// notifyBuffer is how many block notifications may wait for the pool.
+const notifyBuffer = 8
+
+// recentBlocks is how many notified hashes the manager remembers, so a block
+// announced by several peers is notified once.
+const recentBlocks = 16
+
+// Manager runs a Peer per configured node and merges their announcements into
+// one BlockNotifyCh, which is never closed.
+type Manager struct {
+	Peers         []*Peer
+	BlockNotifyCh chan string
+
+	mu          sync.Mutex
+	recent      []string
+	in          chan string
+	blockHasher func([]byte) []byte
+	blocks      *blockCache
+}
+
+func NewManager(protocolVersion int, options *config.P2POptions, blockHasher func([]byte) []byte) *Manager {
+	m := &Manager{
+		BlockNotifyCh: make(chan string, notifyBuffer),
+		in:            make(chan string, notifyBuffer),
+		blockHasher:   blockHasher,
+		blocks:        &blockCache{},
+	}
+	if m.blockHasher == nil {
+		m.blockHasher = utils.Sha256d
+	}
+	for _, addr := range options.Addrs() {
+		peer := newPeer(protocolVersion, options, addr, m.in)
+		peer.BlockHasher = blockHasher
+		peer.blocks = m.blocks
+		m.Peers = append(m.Peers, peer)
+	}
+	return m
+}
+
+// Init connects every peer and starts forwarding their notifications.
+func (m *Manager) Init() {
+	for _, peer := range m.Peers {
+		peer.Init()
+	}
+
+	go func() {
+		for hash := range m.in {
+			if m.seen(hash) {
+				continue
+			}
+			select {
+			case m.BlockNotifyCh <- hash:
+			default:
+			}
+		}
+	}()
+}
+
+// Connected counts peers with a completed handshake.
+func (m *Manager) Connected() int {
+	n := 0
+	for _, peer := range m.Peers {
+		if peer.Connected() {
+			n++
+		}
+	}
+	return n
+}
+
+// RelayBlock pushes a block we found to every connected peer, as a BIP152
+// compact block where the node supports it. It doesn't wait for the sends, so
+// the caller can go on to submitblock straight away.
+func (m *Manager) RelayBlock(block []byte, layout transactions.TxLayout) {
+	b, err := parseRelayBlock(block, layout, m.blockHasher)
+	if err != nil {
+		log.Debug("not relaying block over p2p: ", err)
+		return
+	}
+
+	for _, peer := range m.Peers {
+		if !peer.Connected() {
+			continue
+		}
+		go func(peer *Peer) {
+			if err := peer.RelayBlock(b); err != nil {
+				log.Warn("relaying block to ", peer.Addr, " failed: ", err)
+			}
+		}(peer)
+	}
+}
+
+// seen records hash and reports whether it was already notified. Unparsed
+// announcements ("") are always passed on.
+func (m *Manager) seen(hash string) bool {
+	if hash == "" {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, h := range m.recent {
+		if h == hash {
+			return true
+		}
+	}
+	m.recent = append(m.recent, hash)
+	if len(m.recent) > recentBlocks {
+		m.recent = m.recent[1:]
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mining-pool/not-only-mining-pool/utils"
+)
+
+// maxPayload bounds a message we are willing to read (bitcoind's limit is 4MB
+// plus headers; blocks are never requested, so this is generous).
+const maxPayload = 32 << 20
+
+// Inventory types, https://en.bitcoin.it/wiki/Protocol_documentation#Inventory_Vectors
+const (
+	invTx            = 1
+	invBlock         = 2
+	invCmpctBlock    = 4
+	invWitnessFlag   = 1 << 30
+	invWitnessBlock  = invBlock | invWitnessFlag
+	sendHeadersProto = 70012 // BIP130
+)
+
+type message struct {
+	command string
+	payload []byte
+}
+
+// encodeMessage frames payload as magic | command | length | checksum | payload.
+func encodeMessage(magic []byte, command string, payload []byte) []byte {
+	return bytes.Join([][]byte{
+		magic,
+		utils.CommandStringBytes(command),
+		utils.PackUint32LE(uint32(len(payload))),
+		utils.Sha256d(payload)[0:4],
+		payload,
+	}, nil)
+}
+
+// readMessage reads the next message, skipping bytes until the network magic
+// so a desynchronised stream recovers. A bad checksum is an error.
+func readMessage(r io.Reader, magic []byte) (*message, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header[:4]); err != nil {
+		return nil, err
+	}
+	for !bytes.Equal(header[:4], magic) {
+		copy(header, header[1:4])
+		if _, err := io.ReadFull(r, header[3:4]); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := io.ReadFull(r, header[4:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[16:20])
+	if length > maxPayload {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(utils.Sha256d(payload)[0:4], header[20:24]) {
+		return nil, errors.New("bad message checksum")
+	}
+
+	return &message{command: string(bytes.TrimRight(header[4:16], "\x00")), payload: payload}, nil
+}
+
+// readVarInt decodes a CompactSize from the start of b.
+func readVarInt(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	switch b[0] {
+	case 0xfd:
+		if len(b) < 3 {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		return uint64(binary.LittleEndian.Uint16(b[1:])), 3, nil
+	case 0xfe:
+		if len(b) < 5 {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		return uint64(binary.LittleEndian.Uint32(b[1:])), 5, nil
+	case 0xff:
+		if len(b) < 9 {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		return binary.LittleEndian.Uint64(b[1:]), 9, nil
+	default:
+		return uint64(b[0]), 1, nil
+	}
+}
+
+// parseInvBlocks returns the block hashes (internal byte order) announced in
+// an inv payload.
+func parseInvBlocks(payload []byte) ([][]byte, error) {
+	count, n, err := readVarInt(payload)
+	if err != nil {
+		return nil, err
+	}
+	buf := payload[n:]
+	if uint64(len(buf)) < count*36 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var blocks [][]byte
+	for i := uint64(0); i < count; i++ {
+		switch binary.LittleEndian.Uint32(buf) {
+		case invBlock, invWitnessBlock, invCmpctBlock:
+			blocks = append(blocks, buf[4:36])
+		}
+		buf = buf[36:]
+	}
+	return blocks, nil
+}
+
+// parseHeaders returns the 80-byte block headers of a headers payload, each
+// followed on the wire by a zero transaction count.
+func parseHeaders(payload []byte) ([][]byte, error) {
+	count, n, err := readVarInt(payload)
+	if err != nil {
+		return nil, err
+	}
+	buf := payload[n:]
+
+	headers := make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if len(buf) < 80 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		header := buf[:80]
+		_, used, err := readVarInt(buf[80:])
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+		buf = buf[80+used:]
+	}
+	return headers, nil
+}
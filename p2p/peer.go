@@ -3,10 +3,9 @@ package p2p
 import (
 	"bytes"
 	"crypto/rand"
-	"encoding/binary"
 	"encoding/hex"
-	"io"
 	"net"
+	"sync"
 	"time"
 
 	logging "github.com/ipfs/go-log/v2"
@@ -16,217 +15,292 @@ import (
 
 var log = logging.Logger("p2p")
 
-type Peer struct {
-	Magic []byte
-
-	VerAck                bool
-	ValidConnectionConfig bool
-
-	NetworkServices   []byte
-	EmptyNetAddress   []byte
-	UserAgent         []byte
-	BlockStartHeight  []byte
-	RelayTransactions []byte
+// Reconnect backoff bounds and the default keepalive.
+const (
+	minBackoff          = time.Second
+	maxBackoff          = time.Minute
+	defaultPingInterval = 60 * time.Second
+	dialTimeout         = 10 * time.Second
+	writeTimeout        = 30 * time.Second
+)
 
-	InvCodes        map[string]uint32
-	Commands        map[string][]byte
-	Options         *config.P2POptions
-	Conn            net.Conn
+// Peer is one connection to a coin node, used to hear about new blocks before
+// polling would. It redials with backoff whenever the connection drops, so
+// BlockNotifyCh stays open for the life of the process.
+type Peer struct {
+	Addr            string
+	Magic           []byte
 	ProtocolVersion int
+	Options         *config.P2POptions
+
+	// BlockHasher turns an announced 80-byte header into the block id; nil is
+	// sha256d. Only headers announcements need it.
+	BlockHasher func([]byte) []byte
 
 	BlockNotifyCh chan string
+
+	mu           sync.Mutex // guards conn and writes
+	conn         net.Conn
+	connected    bool
+	lastPing     []byte
+	cmpctVersion uint64 // highest BIP152 version the node announced, 0 = none
+	blocks       *blockCache
+	stop         chan struct{}
 }
 
+// NewPeer creates a peer for options' Host:Port with its own notify channel.
 func NewPeer(protocolVersion int, options *config.P2POptions) *Peer {
+	return newPeer(protocolVersion, options, options.Addr(), make(chan string, notifyBuffer))
+}
+
+func newPeer(protocolVersion int, options *config.P2POptions, addr string, notify chan string) *Peer {
 	magic, err := hex.DecodeString(options.Magic)
-	if err != nil {
+	if err != nil || len(magic) != 4 {
 		log.Fatal("magic hex string is incorrect")
 	}
 
-	networkServices, _ := hex.DecodeString("0100000000000000") // NODE_NETWORK services (value 1 packed as uint64)
-	emptyNetAddress, _ := hex.DecodeString("010000000000000000000000000000000000ffff000000000000")
-	userAgent := utils.VarStringBytes("/node-stratum/")
-	blockStartHeight, _ := hex.DecodeString("00000000") // block start_height, can be empty
-
-	//If protocol version is new enough, add do not relay transactions flag byte, outlined in BIP37
-	//https://github.com/bitcoin/bips/blob/master/bip-0037.mediawiki#extensions-to-existing-messages
-	var relayTransactions []byte
-	if options.DisableTransactions {
-		relayTransactions = []byte{0}
-	} else {
-		relayTransactions = []byte{}
-	}
-
 	return &Peer{
-		Magic:                 magic,
-		VerAck:                false,
-		ValidConnectionConfig: true,
-
-		Options:         options,
+		Addr:            addr,
+		Magic:           magic,
 		ProtocolVersion: protocolVersion,
-
-		NetworkServices:   networkServices,
-		EmptyNetAddress:   emptyNetAddress,
-		UserAgent:         userAgent,
-		BlockStartHeight:  blockStartHeight,
-		RelayTransactions: relayTransactions,
-
-		InvCodes: map[string]uint32{
-			"error": 0,
-			"tx":    1,
-			"block": 2,
-		},
-
-		Commands: map[string][]byte{
-			"version":   utils.CommandStringBytes("version"),
-			"inv":       utils.CommandStringBytes("inv"),
-			"verack":    utils.CommandStringBytes("verack"),
-			"addr":      utils.CommandStringBytes("addr"),
-			"getblocks": utils.CommandStringBytes("getblocks"),
-		},
-
-		BlockNotifyCh: make(chan string),
+		Options:         options,
+		BlockNotifyCh:   notify,
+		blocks:          &blockCache{},
+		stop:            make(chan struct{}),
 	}
 }
 
+// Init starts the connect / read / reconnect loop in the background.
 func (p *Peer) Init() {
-	p.Connect()
+	go p.run()
 }
 
-func (p *Peer) Connect() {
-	var err error
-	p.Conn, err = net.Dial("tcp", p.Options.Addr())
-	if err != nil {
-		log.Fatal("failed to connect to coin's p2p port: ", err)
+// Stop closes the connection and ends the reconnect loop.
+func (p *Peer) Stop() {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
 	}
+	p.mu.Lock()
+	if p.conn != nil {
+		_ = p.conn.Close()
+	}
+	p.mu.Unlock()
+}
 
-	p.SetupMessageParser()
+// Connected reports whether the handshake with the node has completed.
+func (p *Peer) Connected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connected
 }
 
-func (p *Peer) SetupMessageParser() {
-	go func() {
-		p.SendVersion()
+func (p *Peer) pingInterval() time.Duration {
+	if p.Options.PingInterval > 0 {
+		return time.Duration(p.Options.PingInterval) * time.Second
+	}
+	return defaultPingInterval
+}
 
-		header := make([]byte, 24)
-		for {
-			n, err := p.Conn.Read(header)
-			if err == io.EOF {
-				continue
-			}
+func (p *Peer) run() {
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		err := p.session()
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
 
-			if err != nil || n < 24 {
-				log.Error(err)
-				continue
-			}
+		// a session that lasted resets the backoff; a flapping one grows it
+		if time.Since(start) > maxBackoff {
+			backoff = minBackoff
+		}
+		log.Warnf("p2p peer %s disconnected (%v), reconnecting in %s", p.Addr, err, backoff)
 
-			if !bytes.Equal(header[0:4], p.Magic) {
-				continue
-			}
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
 
-			payload := make([]byte, binary.LittleEndian.Uint32(header[16:20]))
-			_, err = p.Conn.Read(payload)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
+// session dials, handshakes and reads messages until the connection fails.
+func (p *Peer) session() error {
+	conn, err := net.DialTimeout("tcp", p.Addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.conn = conn
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.connected = false
+		p.cmpctVersion = 0
+		p.conn = nil
+		p.mu.Unlock()
+		_ = conn.Close()
+	}()
 
-			if bytes.Equal(utils.Sha256d(payload)[0:4], header[20:24]) {
-				go p.HandleMessage(header[4:16], payload)
+	if err := p.SendVersion(); err != nil {
+		return err
+	}
+
+	keepalive := time.NewTicker(p.pingInterval())
+	defer keepalive.Stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-keepalive.C:
+				if err := p.sendPing(); err != nil {
+					log.Warn("p2p ping to ", p.Addr, " failed: ", err)
+				}
 			}
 		}
 	}()
-}
 
-func (p *Peer) HandleMessage(command, payload []byte) {
-	log.Info("handling: ", command, payload)
-	switch string(command) {
-	case string(p.Commands["inv"]):
-		p.HandleInv(payload)
-	case string(p.Commands["verack"]):
-		if !p.VerAck {
-			p.VerAck = true
-			// connected
+	for {
+		// the node pings us too, so three quiet periods mean a dead link
+		_ = conn.SetReadDeadline(time.Now().Add(3 * p.pingInterval()))
+		msg, err := readMessage(conn, p.Magic)
+		if err != nil {
+			return err
+		}
+		if err := p.HandleMessage(msg.command, msg.payload); err != nil {
+			return err
 		}
-	case string(p.Commands["version"]):
-		p.SendMessage(p.Commands["verack"], make([]byte, 0))
-	default:
-		break
 	}
 }
 
-// Parsing inv message https://en.bitcoin.it/wiki/Protocol_specification#inv
-func (p *Peer) HandleInv(payload []byte) {
-	// sloppy varint decoding
-	var count int
-	var buf []byte
-	if payload[0] < 0xFD {
-		count = int(payload[0])
-		buf = payload[1:]
-	} else {
-		count = int(binary.LittleEndian.Uint16(payload[0:2]))
-		buf = payload[2:]
-	}
-
-	for count--; count != 0; count-- {
-		switch binary.LittleEndian.Uint32(buf) {
-		case p.InvCodes["error"]:
-		case p.InvCodes["tx"]:
-			// tx := hex.EncodeToString(buf[4:36])
-		case p.InvCodes["block"]:
-			block := hex.EncodeToString(buf[4:36])
-			log.Warn("block found: ", block)
-			// block found
-			p.ProcessBlockNotify(block)
+// HandleMessage reacts to one message from the node.
+func (p *Peer) HandleMessage(command string, payload []byte) error {
+	log.Debug("handling: ", command)
+	switch command {
+	case "version":
+		return p.SendMessage("verack", nil)
+	case "verack":
+		p.mu.Lock()
+		p.connected = true
+		p.mu.Unlock()
+		log.Info("p2p peer ", p.Addr, " connected")
+		if p.ProtocolVersion >= sendHeadersProto {
+			// BIP130: announce new blocks with headers rather than inv
+			return p.SendMessage("sendheaders", nil)
+		}
+	case "ping":
+		// BIP31: echo the nonce
+		return p.SendMessage("pong", payload)
+	case "pong":
+		p.mu.Lock()
+		if !bytes.Equal(payload, p.lastPing) {
+			log.Debug("p2p peer ", p.Addr, " answered an unknown ping")
+		}
+		p.mu.Unlock()
+	case "inv":
+		hashes, err := parseInvBlocks(payload)
+		if err != nil {
+			log.Warn("malformed inv from ", p.Addr, ": ", err)
+			return nil
+		}
+		for _, hash := range hashes {
+			p.ProcessBlockNotify(hex.EncodeToString(utils.ReverseBytes(hash)))
 		}
-		buf = buf[36:]
+	case "headers":
+		headers, err := parseHeaders(payload)
+		if err != nil {
+			// e.g. merge-mined coins append auxpow to headers: still a new block
+			log.Debug("unparsed headers from ", p.Addr, ": ", err)
+			p.ProcessBlockNotify("")
+			return nil
+		}
+		if len(headers) > 0 {
+			p.ProcessBlockNotify(hex.EncodeToString(utils.ReverseBytes(p.blockHash(headers[len(headers)-1]))))
+		}
+	case "sendcmpct":
+		p.handleSendCmpct(payload)
+	case "getdata":
+		return p.handleGetData(payload)
+	case "getblocktxn":
+		return p.handleGetBlockTxn(payload)
 	}
+	return nil
 }
 
-func (p *Peer) SendMessage(command, payload []byte) {
-	log.Info("sending: ", command, payload)
-	if p.Conn == nil {
-		p.Connect()
+func (p *Peer) blockHash(header []byte) []byte {
+	if p.BlockHasher != nil {
+		return p.BlockHasher(header)
 	}
+	return utils.Sha256d(header)
+}
 
-	message := bytes.Join([][]byte{
-		p.Magic,
-		command,
-		utils.PackUint32LE(uint32(len(payload))),
-		utils.Sha256d(payload)[0:4],
-		payload,
-	}, nil)
-
-	_, err := p.Conn.Write(message)
-	if err != nil {
-		log.Error(err)
+// SendMessage frames and writes one message; it fails when not connected.
+func (p *Peer) SendMessage(command string, payload []byte) error {
+	log.Debug("sending: ", command)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return net.ErrClosed
 	}
 
-	log.Info(string(message))
+	_ = p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := p.conn.Write(encodeMessage(p.Magic, command, payload))
+	return err
 }
 
-func (p *Peer) SendVersion() {
+func (p *Peer) sendPing() error {
 	nonce := make([]byte, 8)
-	rand.Read(nonce)
+	_, _ = rand.Read(nonce)
+	p.mu.Lock()
+	p.lastPing = nonce
+	p.mu.Unlock()
+	return p.SendMessage("ping", nonce)
+}
+
+// emptyNetAddress is a version message net_addr (services, IPv6-mapped
+// 0.0.0.0, port 0): nodes don't need a real one.
+var emptyNetAddress, _ = hex.DecodeString("010000000000000000000000000000000000ffff000000000000")
+
+func (p *Peer) SendVersion() error {
+	nonce := make([]byte, 8)
+	_, _ = rand.Read(nonce)
+
+	// BIP37 relay flag: 0 asks the node not to announce transactions
+	relay := []byte{1}
+	if p.Options.DisableTransactions {
+		relay = []byte{0}
+	}
+
 	payload := bytes.Join([][]byte{
 		utils.PackUint32LE(uint32(p.ProtocolVersion)),
-		p.NetworkServices,
+		utils.PackUint64LE(0), // services: none, we serve nothing
 		utils.PackUint64LE(uint64(time.Now().Unix())),
-		p.EmptyNetAddress, // addr_recv, can be empty
-
-		p.EmptyNetAddress, // addr_from, can be empty
-		nonce,             // nonce, random unique ID
-		p.UserAgent,
-		p.BlockStartHeight,
-
-		p.RelayTransactions,
+		emptyNetAddress, // addr_recv
+		emptyNetAddress, // addr_from
+		nonce,
+		utils.VarStringBytes("/node-stratum/"),
+		make([]byte, 4), // start_height
+		relay,
 	}, nil)
 
-	p.SendMessage(p.Commands["version"], payload)
+	return p.SendMessage("version", payload)
 }
 
 func (p *Peer) ProcessBlockNotify(blockHash string) {
-	log.Info("Block notification via p2p")
-	// if p.JobManager.CurrentJob != nil && blockHash != p.JobManager.CurrentJob.GetBlockTemplate.PreviousBlockHash {
-	p.BlockNotifyCh <- blockHash
-	//}
+	log.Info("Block notification via p2p from ", p.Addr, ": ", blockHash)
+	select {
+	case p.BlockNotifyCh <- blockHash:
+	default:
+		// a notify is already pending, which refreshes the template anyway
+	}
 }
@@ -1,11 +1,15 @@
 package p2p
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"net"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/mining-pool/not-only-mining-pool/config"
+	"github.com/mining-pool/not-only-mining-pool/utils"
 )
 
 func TestNewPeer(t *testing.T) {
@@ -32,3 +36,114 @@ func TestNewPeer(t *testing.T) {
 		}
 	}
 }
+
+// fakeNode accepts p2p connections on a local port and hands each to the test.
+func fakeNode(t *testing.T) (*config.P2POptions, <-chan net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return &config.P2POptions{Host: host, Port: p, Magic: "fabfb5da"}, conns
+}
+
+func expect(t *testing.T, c net.Conn, magic []byte, command string) *message {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := readMessage(c, magic)
+		if err != nil {
+			t.Fatalf("waiting for %s: %s", command, err)
+		}
+		if msg.command == command {
+			return msg
+		}
+	}
+}
+
+func recv(t *testing.T, ch <-chan string) string {
+	t.Helper()
+	select {
+	case hash := <-ch:
+		return hash
+	case <-time.After(5 * time.Second):
+		t.Fatal("no block notification")
+		return ""
+	}
+}
+
+func TestPeer_HandshakePingAndHeaders(t *testing.T) {
+	options, conns := fakeNode(t)
+	magic, _ := hex.DecodeString(options.Magic)
+	m := NewManager(70016, options, nil)
+	m.Init()
+	defer m.Peers[0].Stop()
+
+	c := <-conns
+	expect(t, c, magic, "version")
+	_, _ = c.Write(encodeMessage(magic, "version", make([]byte, 86)))
+	expect(t, c, magic, "verack")
+	_, _ = c.Write(encodeMessage(magic, "verack", nil))
+	expect(t, c, magic, "sendheaders")
+
+	_, _ = c.Write(encodeMessage(magic, "ping", []byte("12345678")))
+	if pong := expect(t, c, magic, "pong"); string(pong.payload) != "12345678" {
+		t.Fatalf("pong nonce %q", pong.payload)
+	}
+
+	header := make([]byte, 80)
+	header[0] = 4
+	payload := append(append([]byte{1}, header...), 0)
+	_, _ = c.Write(encodeMessage(magic, "headers", payload))
+	want := hex.EncodeToString(utils.ReverseBytes(utils.Sha256d(header)))
+	if got := recv(t, m.BlockNotifyCh); got != want {
+		t.Fatalf("notified %s, want %s", got, want)
+	}
+
+	// the same block announced again by inv is not notified twice
+	inv := append([]byte{1}, utils.PackUint32LE(invBlock)...)
+	_, _ = c.Write(encodeMessage(magic, "inv", append(inv, utils.Sha256d(header)...)))
+	other := append(append([]byte{1}, utils.PackUint32LE(invWitnessBlock)...), make([]byte, 32)...)
+	_, _ = c.Write(encodeMessage(magic, "inv", other))
+	if got := recv(t, m.BlockNotifyCh); got != hex.EncodeToString(make([]byte, 32)) {
+		t.Fatalf("notified %s, want the second block only", got)
+	}
+}
+
+func TestPeer_Reconnects(t *testing.T) {
+	options, conns := fakeNode(t)
+	magic, _ := hex.DecodeString(options.Magic)
+	peer := NewPeer(70016, options)
+	peer.Init()
+	defer peer.Stop()
+
+	c := <-conns
+	expect(t, c, magic, "version")
+	_ = c.Close()
+
+	select {
+	case c = <-conns:
+		expect(t, c, magic, "version")
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer did not redial after the node dropped it")
+	}
+
+	// notifications still flow after the reconnect
+	_, _ = c.Write(encodeMessage(magic, "inv", append(append([]byte{1}, utils.PackUint32LE(invBlock)...), make([]byte, 32)...)))
+	recv(t, peer.BlockNotifyCh)
+}
@@ -0,0 +1,421 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+	"github.com/mining-pool/not-only-mining-pool/rpc"
+	"github.com/mining-pool/not-only-mining-pool/storage"
+)
+
+// AccountRewards is the block reward schedule of an account-model chain, in
+// wei. The ethash engine implements it.
+type AccountRewards interface {
+	// BlockReward is what the miner of the block at height earns before fees,
+	// the inclusion rewards of its uncles included.
+	BlockReward(height uint64, uncles int) *big.Int
+	// UncleReward is what the miner of an uncle at uncleHeight earns once the
+	// block at height includes it.
+	UncleReward(uncleHeight, height uint64) *big.Int
+}
+
+const (
+	transferGas   = 21000 // a plain transfer to an externally owned account
+	maxUncleDepth = 7     // how many blocks later an uncle can still be included
+)
+
+var weiPerCoin = big.NewInt(1e18)
+
+// account pays an account-model coin (ethash) from the pool address's account
+// on its node. Found blocks are matched by their seal nonce in the chain or
+// its uncles, and each miner is paid by an eth_sendTransaction of their own,
+// at a nonce the payer tracks, so a stuck transfer can be replaced.
+type account struct {
+	node       *rpc.Client
+	rewards    AccountRewards
+	from       string   // the pool address
+	weiPerUnit *big.Int // wei in one base unit of the accounting
+	gasPrice   *big.Int // payment.gasPrice in wei, nil = the node's
+
+	nonce *uint64 // the next transfer's, nil = ask the node
+}
+
+// NewAccountPaymentManager pays an account-model coin from the pool address's
+// account on payment.daemon, which must hold it unlocked or sign through an
+// external signer. rewards prices the blocks. Every miner is paid by a
+// transaction of their own: maxOutputs is 1.
+func NewAccountPaymentManager(options *config.PaymentOptions, poolAddr *config.Recipient, daemons []*config.DaemonOptions, rewards AccountRewards, db storage.DB) *PaymentManager {
+	pm := NewPaymentManager(options, poolAddr, nil, db)
+	pm.options.MaxOutputs = 1
+	pm.account = &account{rewards: rewards, from: poolAddr.Address}
+	if i := pm.options.Daemon; i >= 0 && i < len(daemons) {
+		pm.account.node = rpc.NewClient(rpc.Options{URL: daemons[i].URL(), Version: rpc.V2, Auth: daemons[i]})
+	}
+	return pm
+}
+
+func (a *account) call(ctx context.Context, method string, params []interface{}, out interface{}) error {
+	return a.node.Call(ctx, method, params, out)
+}
+
+// initAccount refuses the options only sendmany has and checks that the node
+// holds the pool address's account.
+func (pm *PaymentManager) initAccount(ctx context.Context) error {
+	a := pm.account
+	if a.node == nil {
+		return fmt.Errorf("payment.daemon %d is not configured", pm.options.Daemon)
+	}
+	if pm.options.CoinbasePayouts {
+		return fmt.Errorf("coinbasePayouts needs a bitcoin-family coinbase")
+	}
+	if pm.options.FeeRate > 0 || pm.options.ConfTarget > 0 {
+		return fmt.Errorf("feeRate and confTarget price sendmany; price account transfers with gasPrice")
+	}
+	if pm.options.GasPrice > 0 {
+		a.gasPrice, _ = new(big.Float).Mul(big.NewFloat(pm.options.GasPrice), big.NewFloat(1e9)).Int(nil)
+	}
+
+	var accounts []string
+	if err := a.call(ctx, "eth_accounts", nil, &accounts); err != nil {
+		return fmt.Errorf("payment daemon eth_accounts: %w", err)
+	}
+	for _, acc := range accounts {
+		if strings.EqualFold(acc, a.from) {
+			return nil
+		}
+	}
+	return fmt.Errorf("payment daemon does not hold pool address %s; payouts impossible", a.from)
+}
+
+// ethBlock is a block or uncle header of eth_getBlockByNumber and
+// eth_getUncleByBlockNumberAndIndex.
+type ethBlock struct {
+	Number       string          `json:"number"`
+	Nonce        string          `json:"nonce"`
+	Miner        string          `json:"miner"`
+	BaseFee      string          `json:"baseFeePerGas"`
+	Uncles       []string        `json:"uncles"`
+	Transactions json.RawMessage `json:"transactions"` // hashes, or ethTxs when asked for in full
+}
+
+type ethTx struct {
+	Hash     string `json:"hash"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Value    string `json:"value"`
+	Gas      string `json:"gas"`
+	GasPrice string `json:"gasPrice"`
+	Nonce    string `json:"nonce"`
+}
+
+type ethReceipt struct {
+	BlockNumber       string `json:"blockNumber"`
+	GasUsed           string `json:"gasUsed"`
+	EffectiveGasPrice string `json:"effectiveGasPrice"`
+	Status            string `json:"status"`
+}
+
+// block returns the canonical block at height, nil when there is none yet.
+func (a *account) block(ctx context.Context, height uint64, fullTxs bool) (*ethBlock, error) {
+	var blk *ethBlock
+	err := a.call(ctx, "eth_getBlockByNumber", []interface{}{hexUint(height), fullTxs}, &blk)
+	return blk, err
+}
+
+// classifyAccountBlock finds a pending ethash block by its seal nonce (stored
+// as its TxHash). In the canonical chain at its height it earns the block
+// reward, with its uncles' inclusion rewards and its fees; as an uncle of one
+// of the next blocks, the uncle reward. One found nowhere is orphaned once as
+// deep as a payable block, and until then may still turn up as an uncle.
+func (pm *PaymentManager) classifyAccountBlock(ctx context.Context, pb *storage.PendingBlock) (reward float64, category string, confirmations int64, ok bool) {
+	a := pm.account
+	var headHex string
+	if err := a.call(ctx, "eth_blockNumber", nil, &headHex); err != nil {
+		log.Warn("eth_blockNumber: ", err)
+		return 0, "", 0, false
+	}
+	head := uintFromHex(headHex)
+	if head < pb.Height {
+		return 0, string(storage.Immature), 0, true // the node is behind
+	}
+
+	blk, err := a.block(ctx, pb.Height, true)
+	if err != nil || blk == nil {
+		log.Warnf("block %d: %v", pb.Height, err)
+		return 0, "", 0, false
+	}
+	if sameNonce(blk.Nonce, pb.TxHash) {
+		if !strings.EqualFold(blk.Miner, a.from) {
+			log.Errorf("block %d was sealed by the pool but pays %s, not the pool address %s; orphaning it (is the node's etherbase the pool address?)",
+				pb.Height, blk.Miner, a.from)
+			return 0, string(storage.Kicked), 0, true
+		}
+		fees, err := a.fees(ctx, blk)
+		if err != nil {
+			log.Warnf("fees of block %d: %v", pb.Height, err)
+			return 0, "", 0, false
+		}
+		wei := a.rewards.BlockReward(pb.Height, len(blk.Uncles))
+		return pm.SatToCoin(a.units(wei.Add(wei, fees))), string(storage.Generate), int64(head - pb.Height + 1), true
+	}
+
+	for n := pb.Height + 1; n <= pb.Height+maxUncleDepth && n <= head; n++ {
+		including, err := a.block(ctx, n, false)
+		if err != nil || including == nil {
+			log.Warnf("block %d: %v", n, err)
+			return 0, "", 0, false
+		}
+		for i := range including.Uncles {
+			var uncle ethBlock
+			if err := a.call(ctx, "eth_getUncleByBlockNumberAndIndex", []interface{}{hexUint(n), hexUint(uint64(i))}, &uncle); err != nil {
+				log.Warnf("uncle %d of block %d: %v", i, n, err)
+				return 0, "", 0, false
+			}
+			if uintFromHex(uncle.Number) == pb.Height && sameNonce(uncle.Nonce, pb.TxHash) && strings.EqualFold(uncle.Miner, a.from) {
+				wei := a.rewards.UncleReward(pb.Height, n)
+				return pm.SatToCoin(a.units(wei)), string(storage.Generate), int64(head - n + 1), true
+			}
+		}
+	}
+	if int64(head-pb.Height) >= pm.options.MinConfirmations {
+		return 0, string(storage.Orphan), 0, true
+	}
+	return 0, string(storage.Immature), 0, true
+}
+
+// fees is what the transactions of blk paid its miner, in wei: the gas each
+// used at its price, less the base fee a London chain burns.
+func (a *account) fees(ctx context.Context, blk *ethBlock) (*big.Int, error) {
+	var txs []ethTx
+	if err := json.Unmarshal(blk.Transactions, &txs); err != nil {
+		return nil, err
+	}
+	total := new(big.Int)
+	if len(txs) == 0 {
+		return total, nil
+	}
+
+	reqs := make([]rpc.Request, len(txs))
+	for i, tx := range txs {
+		reqs[i] = rpc.Request{Method: "eth_getTransactionReceipt", Params: []interface{}{tx.Hash}}
+	}
+	answers, err := a.node.Batch(ctx, reqs)
+	if err != nil {
+		return nil, err
+	}
+	baseFee := bigFromHex(blk.BaseFee)
+	for i, answer := range answers {
+		var receipt *ethReceipt
+		if answer == nil || answer.Error != nil || json.Unmarshal(answer.Result, &receipt) != nil || receipt == nil {
+			return nil, fmt.Errorf("no receipt for %s", txs[i].Hash)
+		}
+		price := bigFromHex(receipt.EffectiveGasPrice)
+		if price.Sign() == 0 {
+			price = bigFromHex(txs[i].GasPrice)
+		}
+		price.Sub(price, baseFee)
+		total.Add(total, price.Mul(price, bigFromHex(receipt.GasUsed)))
+	}
+	return total, nil
+}
+
+// transfer sends the one payout of amounts from the pool's account at the
+// next nonce and stamps its hash on the intent. A transfer the node refused
+// clears the intent; one it may have taken without answering leaves it for
+// review, as sendmany does.
+func (pm *PaymentManager) transfer(ctx context.Context, amounts map[string]float64, update *storage.PaymentUpdate) error {
+	a := pm.account
+	var to string
+	var amount float64
+	for to, amount = range amounts {
+	}
+	value := a.wei(pm.CoinToSat(amount))
+	tx := map[string]interface{}{"from": a.from, "to": to, "gas": hexUint(transferGas)}
+
+	price := a.gasPrice
+	if price == nil && pm.options.SubtractFee {
+		var hex string
+		if err := a.call(ctx, "eth_gasPrice", nil, &hex); err != nil {
+			_ = pm.db.DelPayoutIntent()
+			return fmt.Errorf("eth_gasPrice: %w", err)
+		}
+		price = bigFromHex(hex)
+	}
+	if price != nil {
+		tx["gasPrice"] = hexBig(price)
+	}
+	if pm.options.SubtractFee {
+		value.Sub(value, new(big.Int).Mul(price, big.NewInt(transferGas)))
+		if value.Sign() <= 0 {
+			_ = pm.db.DelPayoutIntent()
+			return fmt.Errorf("the fee takes all of %s's %v", to, amount)
+		}
+	}
+	tx["value"] = hexBig(value)
+
+	nonce, err := a.nextNonce(ctx)
+	if err != nil {
+		_ = pm.db.DelPayoutIntent()
+		return fmt.Errorf("eth_getTransactionCount: %w", err)
+	}
+	tx["nonce"] = hexUint(nonce)
+
+	var txid string
+	err = a.call(ctx, "eth_sendTransaction", []interface{}{tx}, &txid)
+	var rpcErr *rpc.Error
+	switch {
+	case errors.As(err, &rpcErr):
+		// refused, so never broadcast; the next transfer asks the node for its nonce
+		a.nonce = nil
+		_ = pm.db.DelPayoutIntent()
+		return fmt.Errorf("eth_sendTransaction failed: %s", rpcErr.Message)
+	case err != nil:
+		a.nonce = nil
+		return fmt.Errorf("no answer from payment daemon on eth_sendTransaction (payout intent left for review): %w", err)
+	}
+	*a.nonce++
+
+	if err := pm.db.SetPayoutIntentTxid(txid); err != nil {
+		return err
+	}
+	update.Txid = txid
+	log.Infof("paid %s %v (txid %s, nonce %d)", to, amount, txid, nonce)
+	return nil
+}
+
+// nextNonce is the nonce of the pool account's next transaction.
+func (a *account) nextNonce(ctx context.Context) (uint64, error) {
+	if a.nonce == nil {
+		var hex string
+		if err := a.call(ctx, "eth_getTransactionCount", []interface{}{a.from, "pending"}, &hex); err != nil {
+			return 0, err
+		}
+		n := uintFromHex(hex)
+		a.nonce = &n
+	}
+	return *a.nonce, nil
+}
+
+// watchTransfers follows the unconfirmed payout transfers as watchPayouts
+// does payouts, by their receipts. A transfer the node no longer knows is
+// alerted on: it holds up every later transfer of the account until its nonce
+// is used again.
+func (pm *PaymentManager) watchTransfers(ctx context.Context, now time.Time, watched map[string]int64) error {
+	a := pm.account
+	for txid, since := range watched {
+		var receipt *ethReceipt
+		if err := a.call(ctx, "eth_getTransactionReceipt", []interface{}{txid}, &receipt); err != nil {
+			log.Warnf("cannot look up payout %s, checking it next run: %v", txid, err)
+			continue
+		}
+		if receipt != nil && receipt.BlockNumber != "" {
+			if receipt.Status == "0x0" {
+				log.Errorf("ALERT: payout %s was mined but failed; its miner is recorded as paid", txid)
+			}
+			if err := pm.db.ConfirmPayout(txid); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var tx *ethTx
+		if err := a.call(ctx, "eth_getTransactionByHash", []interface{}{txid}, &tx); err != nil {
+			log.Warnf("cannot look up payout %s, checking it next run: %v", txid, err)
+			continue
+		}
+		switch {
+		case tx == nil:
+			log.Errorf("ALERT: payout %s is unconfirmed and unknown to the node since %s; resend it at its nonce or repay it",
+				txid, time.Unix(since, 0).UTC().Format(time.RFC3339))
+		case pm.options.BumpAfter > 0 && now.Unix()-since >= pm.options.BumpAfter:
+			if err := pm.replaceTransfer(ctx, txid, tx, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replaceTransfer resends a stuck transfer at its nonce for a gas price a
+// quarter higher (nodes want at least a tenth), or gasPrice if that is more,
+// and moves its ledger entry to the replacement.
+func (pm *PaymentManager) replaceTransfer(ctx context.Context, txid string, tx *ethTx, now time.Time) error {
+	a := pm.account
+	price := bigFromHex(tx.GasPrice)
+	price.Add(price.Div(price.Mul(price, big.NewInt(5)), big.NewInt(4)), big.NewInt(1))
+	if a.gasPrice != nil && a.gasPrice.Cmp(price) > 0 {
+		price = a.gasPrice
+	}
+
+	var replacement string
+	err := a.call(ctx, "eth_sendTransaction", []interface{}{map[string]interface{}{
+		"from": tx.From, "to": tx.To, "value": tx.Value, "gas": tx.Gas, "gasPrice": hexBig(price), "nonce": tx.Nonce,
+	}}, &replacement)
+	if err != nil {
+		log.Errorf("failed to replace stuck payout %s: %v", txid, err)
+		return nil
+	}
+	log.Warnf("payout %s was stuck; replaced by %s at a gas price of %s wei", txid, replacement, price)
+	return pm.db.ReplacePayout(txid, replacement, now.Unix())
+}
+
+// accountBalance is the pool account's balance, in coin.
+func (pm *PaymentManager) accountBalance(ctx context.Context) (float64, error) {
+	var hex string
+	if err := pm.account.call(ctx, "eth_getBalance", []interface{}{pm.account.from, "latest"}, &hex); err != nil {
+		return 0, fmt.Errorf("eth_getBalance: %w", err)
+	}
+	balance, _ := new(big.Float).Quo(new(big.Float).SetInt(bigFromHex(hex)), new(big.Float).SetInt(weiPerCoin)).Float64()
+	return balance, nil
+}
+
+// units converts wei to base units of the accounting, rounding down.
+func (a *account) units(wei *big.Int) uint64 {
+	return new(big.Int).Div(wei, a.weiPerUnit).Uint64()
+}
+
+func (a *account) wei(units uint64) *big.Int {
+	return new(big.Int).Mul(new(big.Int).SetUint64(units), a.weiPerUnit)
+}
+
+// sameNonce compares a block's 0x nonce with the one a share sealed it with.
+func sameNonce(nonce, sealed string) bool {
+	return nonce != "" && sealed != "" && uintFromHex(nonce) == uintFromHex(sealed)
+}
+
+// isHexAddress reports whether addr is a 0x-prefixed 20-byte hex address.
+func isHexAddress(addr string) bool {
+	if len(addr) != 42 || !strings.HasPrefix(addr, "0x") && !strings.HasPrefix(addr, "0X") {
+		return false
+	}
+	_, ok := new(big.Int).SetString(addr[2:], 16)
+	return ok
+}
+
+func bigFromHex(s string) *big.Int {
+	n, ok := new(big.Int).SetString(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X"), 16)
+	if !ok {
+		return new(big.Int)
+	}
+	return n
+}
+
+func uintFromHex(s string) uint64 {
+	n, _ := strconv.ParseUint(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X"), 16, 64)
+	return n
+}
+
+func hexBig(n *big.Int) string {
+	return "0x" + n.Text(16)
+}
+
+func hexUint(n uint64) string {
+	return "0x" + strconv.FormatUint(n, 16)
+}
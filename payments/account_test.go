@@ -0,0 +1,345 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+)
+
+const (
+	poolAccount = "0x00000000000000000000000000000000000000f0"
+	minerAA     = "0x00000000000000000000000000000000000000aa"
+	minerBB     = "0x00000000000000000000000000000000000000bb"
+	minerCC     = "0x00000000000000000000000000000000000000cc"
+)
+
+// fixedRewards prices every block at 2 coin, 0.1 more per uncle, and every
+// uncle at 1 coin.
+type fixedRewards struct{}
+
+func (fixedRewards) BlockReward(_ uint64, uncles int) *big.Int {
+	return new(big.Int).Add(coinWei("2"), new(big.Int).Mul(coinWei("0.1"), big.NewInt(int64(uncles))))
+}
+
+func (fixedRewards) UncleReward(_, _ uint64) *big.Int { return coinWei("1") }
+
+func coinWei(coin string) *big.Int {
+	f, _ := new(big.Float).SetPrec(256).SetString(coin)
+	wei, _ := f.Mul(f, new(big.Float).SetInt(weiPerCoin)).Int(nil)
+	return wei
+}
+
+// fakeNode is a minimal geth-style JSON-RPC 2.0 node holding the pool's
+// account. Blocks not set are empty blocks of another miner up to head.
+type fakeNode struct {
+	mu       sync.Mutex
+	head     uint64
+	accounts []string
+	blocks   map[uint64]map[string]interface{}
+	uncles   map[uint64][]map[string]interface{} // by including block
+	receipts map[string]map[string]interface{}
+	txs      map[string]map[string]interface{}
+	nonce    uint64 // the account's pending transaction count
+	refuse   string // eth_sendTransaction's error, "" = accept
+
+	Sent []map[string]interface{} // captured eth_sendTransaction calls
+}
+
+func newFakeNode() *fakeNode {
+	return &fakeNode{
+		head:     300,
+		accounts: []string{poolAccount},
+		blocks:   map[uint64]map[string]interface{}{},
+		uncles:   map[uint64][]map[string]interface{}{},
+		receipts: map[string]map[string]interface{}{},
+		txs:      map[string]map[string]interface{}{},
+		nonce:    7,
+	}
+}
+
+type nodeRequest struct {
+	ID     interface{}   `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+func (n *fakeNode) handler(rw http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var batch []nodeRequest
+	if json.Unmarshal(body, &batch) == nil {
+		answers := make([]interface{}, len(batch))
+		for i, req := range batch {
+			answers[i] = n.answer(req)
+		}
+		_ = json.NewEncoder(rw).Encode(answers)
+		return
+	}
+	var req nodeRequest
+	_ = json.Unmarshal(body, &req)
+	_ = json.NewEncoder(rw).Encode(n.answer(req))
+}
+
+func (n *fakeNode) answer(req nodeRequest) map[string]interface{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+	var result interface{}
+
+	switch req.Method {
+	case "eth_accounts":
+		result = n.accounts
+	case "eth_blockNumber":
+		result = hexUint(n.head)
+	case "eth_getBlockByNumber":
+		height := uintFromHex(req.Params[0].(string))
+		if height > n.head {
+			break
+		}
+		blk := map[string]interface{}{"number": hexUint(height), "nonce": "0x0000000000000000", "miner": minerCC, "uncles": []string{}, "transactions": []interface{}{}}
+		for k, v := range n.blocks[height] {
+			blk[k] = v
+		}
+		if uncles := n.uncles[height]; len(uncles) > 0 {
+			hashes := make([]string, len(uncles))
+			for i := range uncles {
+				hashes[i] = "0xuncle" + strconv.Itoa(i)
+			}
+			blk["uncles"] = hashes
+		}
+		result = blk
+	case "eth_getUncleByBlockNumberAndIndex":
+		height := uintFromHex(req.Params[0].(string))
+		result = n.uncles[height][uintFromHex(req.Params[1].(string))]
+	case "eth_getTransactionReceipt":
+		if rc, ok := n.receipts[req.Params[0].(string)]; ok {
+			result = rc
+		}
+	case "eth_getTransactionByHash":
+		if tx, ok := n.txs[req.Params[0].(string)]; ok {
+			result = tx
+		}
+	case "eth_getTransactionCount":
+		result = hexUint(n.nonce)
+	case "eth_gasPrice":
+		result = "0x3b9aca00"
+	case "eth_getBalance":
+		result = hexBig(coinWei("1.5"))
+	case "eth_sendTransaction":
+		tx := req.Params[0].(map[string]interface{})
+		n.Sent = append(n.Sent, tx)
+		if n.refuse != "" {
+			resp["error"] = map[string]interface{}{"code": -32000, "message": n.refuse}
+			return resp
+		}
+		hash := "0xtx" + strconv.Itoa(len(n.Sent))
+		stored := map[string]interface{}{"hash": hash, "gasPrice": "0x3b9aca00"}
+		for k, v := range tx {
+			stored[k] = v
+		}
+		n.txs[hash] = stored
+		if nonce := uintFromHex(tx["nonce"].(string)); nonce >= n.nonce {
+			n.nonce = nonce + 1
+		}
+		result = hash
+	default:
+		resp["error"] = map[string]interface{}{"code": -32601, "message": "the method " + req.Method + " does not exist"}
+		return resp
+	}
+	resp["result"] = result
+	return resp
+}
+
+// newAccountHarness wires an account payer to miniredis and a fakeNode.
+func newAccountHarness(t *testing.T, opts *config.PaymentOptions) (*harness, *fakeNode) {
+	t.Helper()
+	h := newHarness(t, opts)
+	node := newFakeNode()
+	srv := httptest.NewServer(http.HandlerFunc(node.handler))
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+	daemons := []*config.DaemonOptions{{Host: u.Hostname(), Port: port}}
+	h.pm = NewAccountPaymentManager(opts, &config.Recipient{Address: poolAccount}, daemons, fixedRewards{}, h.db)
+	return h, node
+}
+
+// A canonical block earns its reward, uncle inclusion and fees; an uncle
+// found in a later block earns the uncle reward. Each miner is paid by a
+// transfer of their own, at consecutive nonces.
+func TestAccountPayout_BlocksAndUncles(t *testing.T) {
+	h, node := newAccountHarness(t, &config.PaymentOptions{MinConfirmations: 100})
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 100: ours, with an uncle and a transaction paying 1 gwei over the base fee
+	node.blocks[100] = map[string]interface{}{
+		"nonce": "0x00000000000000ab", "miner": poolAccount, "baseFeePerGas": "0x3b9aca00",
+		"transactions": []interface{}{map[string]interface{}{"hash": "0xfee", "gasPrice": "0x77359400"}},
+	}
+	node.uncles[100] = []map[string]interface{}{{"number": "0x63"}}
+	node.receipts["0xfee"] = map[string]interface{}{"blockNumber": "0x64", "gasUsed": "0x5208", "effectiveGasPrice": "0x77359400"}
+	// 105: lost to another miner's block, then included as an uncle by 106
+	node.uncles[106] = []map[string]interface{}{{"number": "0x69", "nonce": "0x00000000000000cd", "miner": poolAccount}}
+
+	h.seedRound(100, "0xab", map[string]float64{minerAA: 1, minerBB: 1})
+	h.seedRound(105, "0xcd", map[string]float64{minerCC: 1})
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(node.Sent) != 3 {
+		t.Fatalf("sent %d transfers, want one per miner", len(node.Sent))
+	}
+	half := coinWei("1.0500105") // (2 + 0.1 + 21000 gwei of fees) / 2
+	want := []struct {
+		to    string
+		value *big.Int
+		nonce string
+	}{{minerAA, half, "0x7"}, {minerBB, half, "0x8"}, {minerCC, coinWei("1"), "0x9"}}
+	for i, w := range want {
+		tx := node.Sent[i]
+		if tx["to"] != w.to || tx["value"] != hexBig(w.value) || tx["nonce"] != w.nonce || tx["from"] != poolAccount || tx["gas"] != "0x5208" {
+			t.Errorf("transfer %d = %v, want %s of %s at nonce %s", i, tx, w.to, w.value, w.nonce)
+		}
+	}
+	if payouts, _ := h.db.GetPayouts(10); len(payouts) != 3 {
+		t.Errorf("%d ledger entries, want one per transfer", len(payouts))
+	}
+	if pending, _ := h.db.GetAllPendingBlocks(); len(pending) != 0 {
+		t.Errorf("pending after paying = %v", pending)
+	}
+}
+
+// A block found neither in the chain nor among its uncles is orphaned once as
+// deep as a payable block; a younger one may still turn up as an uncle.
+func TestAccountPayout_OrphansLostBlocks(t *testing.T) {
+	h, node := newAccountHarness(t, &config.PaymentOptions{MinConfirmations: 100})
+	_ = h.pm.Init(context.Background())
+	h.seedRound(200, "0x11", map[string]float64{minerAA: 1})
+	h.seedRound(250, "0x22", map[string]float64{minerAA: 1})
+	// sealed by the pool's nonce but paying another address
+	node.blocks[180] = map[string]interface{}{"nonce": "0x33", "miner": minerCC}
+	h.seedRound(180, "0x33", map[string]float64{minerAA: 1})
+
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.Sent) != 0 {
+		t.Errorf("paid for lost blocks: %v", node.Sent)
+	}
+	pending, _ := h.db.GetAllPendingBlocks()
+	if len(pending) != 1 || pending[0].Height != 250 {
+		t.Errorf("pending = %v, want only the young 250", pending)
+	}
+	if n, _ := h.mr.SCard("TEST:blocks:orphaned"); n != 2 {
+		t.Errorf("%d orphaned, want 200 and 180", n)
+	}
+}
+
+// A refused transfer clears its intent and leaves the block pending; the next
+// run pays at the same nonce.
+func TestAccountPayout_RefusedTransfer(t *testing.T) {
+	h, node := newAccountHarness(t, &config.PaymentOptions{MinConfirmations: 100})
+	_ = h.pm.Init(context.Background())
+	node.blocks[100] = map[string]interface{}{"nonce": "0xab", "miner": poolAccount}
+	h.seedRound(100, "0xab", map[string]float64{minerAA: 1})
+
+	node.refuse = "insufficient funds for gas * price + value"
+	if err := h.pm.processPayments(context.Background()); err == nil {
+		t.Fatal("a refused transfer must be reported")
+	}
+	if h.mr.Exists("TEST:payouts:intent") {
+		t.Error("a refused transfer must clear its intent")
+	}
+	if pending, _ := h.db.GetAllPendingBlocks(); len(pending) != 1 {
+		t.Errorf("pending = %v, want the block kept", pending)
+	}
+
+	node.refuse = ""
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if last := node.Sent[len(node.Sent)-1]; last["nonce"] != "0x7" || last["value"] != hexBig(coinWei("2")) {
+		t.Errorf("retry = %v, want 2 coin at nonce 7", last)
+	}
+}
+
+// A transfer stuck past bumpAfter is resent at its nonce for more gas; the
+// ledger follows it until its receipt shows up.
+func TestAccountPayout_ReplacesStuckTransfer(t *testing.T) {
+	h, node := newAccountHarness(t, &config.PaymentOptions{MinConfirmations: 100, BumpAfter: 600})
+	_ = h.pm.Init(context.Background())
+	node.blocks[100] = map[string]interface{}{"nonce": "0xab", "miner": poolAccount}
+	h.seedRound(100, "0xab", map[string]float64{minerAA: 1})
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	watched, _ := h.db.GetUnconfirmedPayouts()
+	since, ok := watched["0xtx1"]
+	if !ok {
+		t.Fatalf("watched %v, want the transfer followed", watched)
+	}
+
+	if err := h.pm.watchPayouts(context.Background(), time.Unix(since+600, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.Sent) != 2 {
+		t.Fatalf("sent %v, want the replacement", node.Sent)
+	}
+	replacement, original := node.Sent[1], node.Sent[0]
+	if replacement["nonce"] != original["nonce"] || replacement["value"] != original["value"] || replacement["gasPrice"] != hexUint(1250000001) {
+		t.Errorf("replacement = %v of %v, want its nonce at 1.25 gwei", replacement, original)
+	}
+	if p, _ := h.db.GetPayout("0xtx2"); p == nil || !reflect.DeepEqual(p.Replaced, []string{"0xtx1"}) {
+		t.Errorf("replacement ledger entry = %+v", p)
+	}
+
+	node.receipts["0xtx2"] = map[string]interface{}{"blockNumber": "0x12d", "status": "0x1"}
+	if err := h.pm.watchPayouts(context.Background(), time.Unix(since+700, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if watched, _ := h.db.GetUnconfirmedPayouts(); len(watched) != 0 {
+		t.Errorf("watched %v after the receipt, want none", watched)
+	}
+}
+
+func TestAccountPayout_Init(t *testing.T) {
+	h, node := newAccountHarness(t, &config.PaymentOptions{})
+	node.accounts = []string{minerAA}
+	if err := h.pm.Init(context.Background()); err == nil {
+		t.Error("a node without the pool's account must be refused")
+	}
+
+	h, _ = newAccountHarness(t, &config.PaymentOptions{FeeRate: 2})
+	if err := h.pm.Init(context.Background()); err == nil {
+		t.Error("feeRate must be refused for account transfers")
+	}
+
+	h, _ = newAccountHarness(t, &config.PaymentOptions{Magnitude: 3})
+	if err := h.pm.Init(context.Background()); err == nil {
+		t.Error("a magnitude not dividing 1e18 wei must be refused")
+	}
+
+	h, _ = newAccountHarness(t, &config.PaymentOptions{})
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if h.pm.Magnitude != 1e9 || h.pm.options.MaxOutputs != 1 {
+		t.Errorf("magnitude %v, maxOutputs %d; want gwei and one payee per transfer", h.pm.Magnitude, h.pm.options.MaxOutputs)
+	}
+	if a, err := h.pm.Audit(context.Background()); err != nil || a.Wallet != 1.5 {
+		t.Errorf("audit = %+v, %v; want the account's 1.5 coin", a, err)
+	}
+}
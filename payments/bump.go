@@ -0,0 +1,136 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/mining-pool/not-only-mining-pool/daemons"
+)
+
+// watchPayouts follows the payout transactions not yet confirmed. One is
+// dropped from the watch at its first confirmation, and its fee is bumped
+// (RBF) once it has waited bumpAfter. A payout that left the mempool or lost
+// to a conflicting transaction is alerted on each run, the latter flagged
+// conflicted in the ledger: its miners' balances were settled, so an operator
+// has to rebroadcast or repay it.
+func (pm *PaymentManager) watchPayouts(ctx context.Context, now time.Time) error {
+	watched, err := pm.db.GetUnconfirmedPayouts()
+	if err != nil {
+		return err
+	}
+	if pm.account != nil {
+		return pm.watchTransfers(ctx, now, watched)
+	}
+	for txid, since := range watched {
+		_, result := pm.cmd(ctx, "gettransaction", []interface{}{txid})
+		if result == nil || result.Error != nil {
+			log.Warnf("cannot look up payout %s, checking it next run: %v", txid, result)
+			continue
+		}
+		tx, err := daemons.BytesToGetTransaction(result.Result)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		switch {
+		case tx.Confirmations > 0:
+			err = pm.db.ConfirmPayout(txid)
+		case tx.ReplacedByTxid != "":
+			// bumped, but the replacement was never recorded (a crash after bumpfee)
+			log.Warnf("payout %s was replaced by %s", txid, tx.ReplacedByTxid)
+			err = pm.db.ReplacePayout(txid, tx.ReplacedByTxid, now.Unix())
+		case tx.Confirmations < 0:
+			log.Errorf("ALERT: payout %s conflicts with a confirmed transaction and will never confirm; "+
+				"repay its miners (%v)", txid, tx.Details)
+			err = pm.db.ConflictPayout(txid)
+		case !pm.inMempool(ctx, txid):
+			log.Errorf("ALERT: payout %s is unconfirmed and not in the mempool since %s; rebroadcast or abandon it",
+				txid, time.Unix(since, 0).UTC().Format(time.RFC3339))
+		case pm.options.BumpAfter > 0 && now.Unix()-since >= pm.options.BumpAfter:
+			err = pm.bumpFee(ctx, txid, now)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inMempool reports whether the payment daemon's mempool holds txid. Anything
+// but a definite "not in mempool" counts as held.
+func (pm *PaymentManager) inMempool(ctx context.Context, txid string) bool {
+	_, result := pm.cmd(ctx, "getmempoolentry", []interface{}{txid})
+	return result == nil || result.Error == nil || result.Error.Code != -5
+}
+
+// bumpFee replaces a stuck payout with bumpfee, at confTarget or at a rate
+// above both feeRate and what the payout pays, and moves its ledger entry to
+// the replacement. A wallet refusing the bump (not replaceable, or too little
+// to pay the fee from) is logged and retried next run.
+func (pm *PaymentManager) bumpFee(ctx context.Context, txid string, now time.Time) error {
+	options := map[string]interface{}{}
+	if pm.options.FeeRate > 0 {
+		// BIP 125 refuses a replacement at the rate the payout was sent at
+		if rate, ok := pm.bumpRate(ctx, txid); ok {
+			options["fee_rate"] = rate
+		}
+	}
+	if pm.options.ConfTarget > 0 {
+		options["conf_target"] = pm.options.ConfTarget
+	}
+	_, result := pm.cmd(ctx, "bumpfee", []interface{}{txid, options})
+	if result == nil || result.Error != nil {
+		log.Errorf("failed to bump the fee of payout %s: %v", txid, result)
+		return nil
+	}
+	var bumped struct {
+		Txid string  `json:"txid"`
+		Fee  float64 `json:"fee"`
+	}
+	if err := json.Unmarshal(result.Result, &bumped); err != nil || bumped.Txid == "" {
+		log.Errorf("bumpfee of payout %s returned no txid: %s", txid, result.Result)
+		return nil
+	}
+	log.Warnf("payout %s was stuck; replaced by %s paying a fee of %v", txid, bumped.Txid, bumped.Fee)
+	return pm.db.ReplacePayout(txid, bumped.Txid, now.Unix())
+}
+
+// defaultIncrementalFee is Bitcoin Core's incremental relay fee in sat/vB, for
+// daemons whose getnetworkinfo does not tell it.
+const defaultIncrementalFee = 1.0
+
+// bumpRate is the fee rate in sat/vB to bump txid at: feeRate, or the rate it
+// pays now plus the incremental relay fee when that is higher. ok is false
+// when its mempool entry can't be read; bumpfee then picks the rate itself.
+func (pm *PaymentManager) bumpRate(ctx context.Context, txid string) (rate float64, ok bool) {
+	_, result := pm.cmd(ctx, "getmempoolentry", []interface{}{txid})
+	if result == nil || result.Error != nil {
+		return 0, false
+	}
+	var entry struct {
+		Vsize float64 `json:"vsize"`
+		Fees  struct {
+			Base float64 `json:"base"`
+		} `json:"fees"`
+	}
+	if err := json.Unmarshal(result.Result, &entry); err != nil || entry.Vsize <= 0 {
+		return 0, false
+	}
+
+	incremental := defaultIncrementalFee
+	if _, result := pm.cmd(ctx, "getnetworkinfo", []interface{}{}); result != nil && result.Error == nil {
+		var info daemons.GetNetworkInfo
+		if json.Unmarshal(result.Result, &info) == nil && info.Incrementalfee > 0 {
+			incremental = info.Incrementalfee * pm.Magnitude / 1000 // coin/kvB
+		}
+	}
+
+	rate = entry.Fees.Base*pm.Magnitude/entry.Vsize + incremental
+	if rate < pm.options.FeeRate {
+		rate = pm.options.FeeRate
+	}
+	return math.Ceil(rate*1000) / 1000, true // fee_rate takes 3 decimals
+}
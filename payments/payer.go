@@ -1,9 +1,12 @@
 package payments
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math"
+	"math/big"
+	"sort"
 	"time"
 
 	logging "github.com/ipfs/go-log/v2"
@@ -21,16 +24,24 @@ var log = logging.Logger("payments")
 type PaymentManager struct {
 	options *config.PaymentOptions
 	dm      *daemons.DaemonManager
-	db      *storage.DB
+	db      storage.DB
 
 	PoolAddress *config.Recipient
 	Magnitude   float64 // base units (satoshis) per coin
 	MinPayment  uint64  // satoshis
 
+	// PricedShares is set when the job manager logs each share with its value
+	// (types.Share.Value), which fpps and pps+ credit. Only the gbt pool does.
+	PricedShares bool
+
 	validAddr map[string]bool // cache of address-ownership/validity checks
+
+	// account pays an account-model coin (ethash) from its node instead of a
+	// bitcoind wallet; nil for the bitcoin family.
+	account *account
 }
 
-func NewPaymentManager(options *config.PaymentOptions, poolAddr *config.Recipient, dm *daemons.DaemonManager, db *storage.DB) *PaymentManager {
+func NewPaymentManager(options *config.PaymentOptions, poolAddr *config.Recipient, dm *daemons.DaemonManager, db storage.DB) *PaymentManager {
 	pm := &PaymentManager{
 		dm:          dm,
 		db:          db,
@@ -46,29 +57,54 @@ func NewPaymentManager(options *config.PaymentOptions, poolAddr *config.Recipien
 
 // cmd routes a wallet RPC to the configured payment daemon (payment.daemon),
 // which may differ from the mining daemon used for getblocktemplate/submitblock.
-func (pm *PaymentManager) cmd(method string, params []interface{}) (*config.DaemonOptions, *daemons.JsonRpcResponse) {
-	instance, result, _ := pm.dm.CmdToDaemon(pm.options.Daemon, method, params)
+func (pm *PaymentManager) cmd(ctx context.Context, method string, params []interface{}) (*config.DaemonOptions, *daemons.JsonRpcResponse) {
+	instance, result := pm.dm.CmdToDaemonContext(ctx, pm.options.Daemon, method, params)
 	return instance, result
 }
 
 // Init validates the pay mode, the pool address ownership, and the coin
-// precision. It must be called (once) before Serve, only when payments are on.
-func (pm *PaymentManager) Init() error {
+// precision, bounded by ctx. It must be called (once) before Serve, only when
+// payments are on.
+func (pm *PaymentManager) Init(ctx context.Context) error {
 	switch pm.options.PayMode {
-	case config.PayModeProp, config.PayModePPLNS, config.PayModeSolo:
+	case config.PayModeProp, config.PayModePPLNS, config.PayModePPLNT, config.PayModeScore, config.PayModeSolo:
 	case config.PayModePPS:
 		if pm.options.PPSRate <= 0 {
 			return fmt.Errorf("payMode %q requires a positive ppsRate", config.PayModePPS)
 		}
+	case config.PayModeFPPS, config.PayModePPSPlus:
+		if !pm.PricedShares {
+			return fmt.Errorf("payMode %q needs shares priced by the gbt engine's templates", pm.options.PayMode)
+		}
+		if pm.options.PayMode == config.PayModePPSPlus && pm.options.PPLNSWindow <= 0 {
+			return fmt.Errorf("payMode %q requires a positive pplnsWindow to split fees over", config.PayModePPSPlus)
+		}
 	default:
-		return fmt.Errorf("unsupported payMode %q (want prop, pplns, solo or pps)", pm.options.PayMode)
+		return fmt.Errorf("unsupported payMode %q (want prop, pplns, pplnt, score, solo, pps, fpps or pps+)", pm.options.PayMode)
+	}
+	if pm.options.CoinbasePayouts {
+		if pm.options.PayMode != config.PayModePPLNS || pm.options.PPLNSWindow <= 0 {
+			return fmt.Errorf("coinbasePayouts requires payMode %q with a positive pplnsWindow", config.PayModePPLNS)
+		}
+		switch pm.options.CoinbaseAddressType {
+		case "p2pkh", "p2sh", "auto":
+		default:
+			return fmt.Errorf("unsupported coinbaseAddressType %q (want p2pkh, p2sh or auto)", pm.options.CoinbaseAddressType)
+		}
+	}
+	if pm.options.FeeRate > 0 && pm.options.ConfTarget > 0 {
+		return fmt.Errorf("set feeRate or confTarget, not both")
 	}
-	if err := pm.validatePoolAddress(); err != nil {
+	if pm.account != nil {
+		if err := pm.initAccount(ctx); err != nil {
+			return err
+		}
+	} else if err := pm.validatePoolAddress(ctx); err != nil {
 		return err
 	}
 	// In PPS the share log must retain uncredited shares (trimmed by the cursor,
 	// not rank-capped), or a burst between runs would drop unpaid work.
-	pm.db.SetPPSMode(pm.options.PayMode == config.PayModePPS)
+	pm.db.SetPPSMode(pm.options.PaysPerShare())
 	return pm.setMagnitude()
 }
 
@@ -76,7 +112,12 @@ func (pm *PaymentManager) Init() error {
 // payMode, returning miner -> reward (satoshis). An empty result means the block
 // cannot be attributed (no shares / unknown finder) and should be orphaned.
 func (pm *PaymentManager) attribute(pb *storage.PendingBlock, rewardSat uint64) (map[string]uint64, error) {
-	switch pm.options.PayMode {
+	// a block solved by a share of another group is split the way that group pays
+	mode := pb.PayMode
+	if mode == "" {
+		mode = pm.options.PayMode
+	}
+	switch mode {
 	case config.PayModeSolo:
 		if pb.Finder == "" {
 			return nil, nil
@@ -93,10 +134,31 @@ func (pm *PaymentManager) attribute(pb *storage.PendingBlock, rewardSat uint64)
 			}
 			return splitByShares(rewardSat, shares), nil
 		}
-		shares, err := pm.db.GetPPLNSShares(pb.Mark, pm.options.PPLNSWindow)
+		shares, err := pm.db.GetPPLNSShares(pb.PayMode, pb.Mark, pm.options.PPLNSWindow)
 		if err != nil {
 			return nil, err
 		}
+		if pm.options.CoinbasePayouts {
+			if shares, err = pm.coinbaseRemainder(pb, shares); err != nil {
+				return nil, err
+			}
+		}
+		return splitByShares(rewardSat, shares), nil
+	case config.PayModePPLNT, config.PayModeScore:
+		window := pm.pplntShares
+		if mode == config.PayModeScore {
+			window = pm.scoreShares
+		}
+		shares, ok, err := window(pb)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// the block was logged before shares carried times: pay its round
+			if shares, err = pm.db.GetRoundContrib(pb.Height); err != nil {
+				return nil, err
+			}
+		}
 		return splitByShares(rewardSat, shares), nil
 	default: // prop
 		shares, err := pm.db.GetRoundContrib(pb.Height)
@@ -107,6 +169,55 @@ func (pm *PaymentManager) attribute(pb *storage.PendingBlock, rewardSat uint64)
 	}
 }
 
+// coinbaseRemainder narrows a block's window to the miners its coinbase did not
+// pay directly, who are owed the pool output (the reward passed to attribute).
+// The window is the one the coinbase was split over, which may be older than
+// the block's; blocks recorded without it keep the block's. If the coinbase
+// paid everyone, the output is only rounding dust and is split over the whole
+// window rather than orphaning the block.
+func (pm *PaymentManager) coinbaseRemainder(pb *storage.PendingBlock, shares map[string]float64) (map[string]float64, error) {
+	paid, err := pm.db.GetCoinbasePaid(pb.Height)
+	if err != nil {
+		return nil, err
+	}
+	if len(paid) == 0 {
+		return shares, nil
+	}
+	window, err := pm.db.GetCoinbaseWindow(pb.Height)
+	if err != nil {
+		return nil, err
+	}
+	if len(window) > 0 {
+		shares = window
+	}
+
+	unpaid := make(map[string]float64, len(shares))
+	for miner, s := range shares {
+		if _, ok := paid[miner]; !ok {
+			unpaid[miner] = s
+		}
+	}
+	if len(unpaid) == 0 {
+		return shares, nil
+	}
+	return unpaid, nil
+}
+
+// coinbasePayout is the ledger entry of what a block's coinbase paid miners
+// directly, by its coinbase txid; nil when it paid nobody. The miners are
+// recorded as paid once the block is confirmed.
+func (pm *PaymentManager) coinbasePayout(pb *storage.PendingBlock) (*storage.Payout, error) {
+	paid, err := pm.db.GetCoinbasePaid(pb.Height)
+	if err != nil || len(paid) == 0 {
+		return nil, err
+	}
+	amounts := make(map[string]float64, len(paid))
+	for miner, sat := range paid {
+		amounts[miner] = pm.SatToCoin(sat)
+	}
+	return &storage.Payout{Txid: pb.TxHash, Amounts: amounts, Blocks: []uint64{pb.Height}}, nil
+}
+
 // splitByShares divides rewardSat proportionally to each miner's share weight.
 func splitByShares(rewardSat uint64, shares map[string]float64) map[string]uint64 {
 	var total float64
@@ -123,11 +234,18 @@ func splitByShares(rewardSat uint64, shares map[string]float64) map[string]uint6
 	return out
 }
 
-func (pm *PaymentManager) Serve() {
+// Serve runs a payout every interval until ctx, the pool's lifetime, is done.
+// ctx bounds each run's wallet and node calls.
+func (pm *PaymentManager) Serve(ctx context.Context) {
 	ticker := time.NewTicker(time.Duration(pm.options.Interval) * time.Second)
 	defer ticker.Stop()
-	for range ticker.C {
-		if err := pm.processPayments(); err != nil {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := pm.processPayments(ctx); err != nil {
 			log.Error("payment run failed: ", err)
 		}
 	}
@@ -135,8 +253,8 @@ func (pm *PaymentManager) Serve() {
 
 // validatePoolAddress confirms the payment wallet owns the pool payout address,
 // so its coinbase rewards land somewhere the pool can spend from.
-func (pm *PaymentManager) validatePoolAddress() error {
-	instance, result := pm.cmd(pm.options.AddressCheckMethod, []interface{}{pm.PoolAddress.Address})
+func (pm *PaymentManager) validatePoolAddress(ctx context.Context) error {
+	instance, result := pm.cmd(ctx, pm.options.AddressCheckMethod, []interface{}{pm.PoolAddress.Address})
 	if result == nil {
 		return fmt.Errorf("no response from payment daemon on %s", pm.options.AddressCheckMethod)
 	}
@@ -157,17 +275,20 @@ func (pm *PaymentManager) validatePoolAddress() error {
 // validRecipient reports whether addr is a payable address, caching the result
 // since addresses rarely change. An unpayable worker name is skipped (its
 // balance carries over) so it cannot fail the whole sendmany batch.
-func (pm *PaymentManager) validRecipient(addr string) bool {
+func (pm *PaymentManager) validRecipient(ctx context.Context, addr string) bool {
 	if v, ok := pm.validAddr[addr]; ok {
 		return v
 	}
-	_, result := pm.cmd(pm.options.AddressCheckMethod, []interface{}{addr})
-	// getaddressinfo rejects a malformed address with an error; validateaddress
-	// instead returns isvalid=false without an error, so check both.
-	ok := result != nil && result.Error == nil
-	if ok && pm.options.AddressCheckMethod == "validateaddress" {
-		if va, err := daemons.BytesToValidateAddress(result.Result); err != nil || !va.Isvalid {
-			ok = false
+	ok := pm.account != nil && isHexAddress(addr)
+	if pm.account == nil {
+		_, result := pm.cmd(ctx, pm.options.AddressCheckMethod, []interface{}{addr})
+		// getaddressinfo rejects a malformed address with an error; validateaddress
+		// instead returns isvalid=false without an error, so check both.
+		ok = result != nil && result.Error == nil
+		if ok && pm.options.AddressCheckMethod == "validateaddress" {
+			if va, err := daemons.BytesToValidateAddress(result.Result); err != nil || !va.Isvalid {
+				ok = false
+			}
 		}
 	}
 	if !ok {
@@ -184,9 +305,23 @@ func (pm *PaymentManager) validRecipient(addr string) bool {
 func (pm *PaymentManager) setMagnitude() error {
 	if pm.options.Magnitude > 0 {
 		pm.Magnitude = pm.options.Magnitude
+	} else if pm.account != nil {
+		pm.Magnitude = 1e9 // gwei: counted in wei, 18.4 coins would overflow a balance
 	} else {
 		pm.Magnitude = 1e8 // satoshis; set payment.magnitude for coins with other precision
 	}
+	if pm.account != nil {
+		unit, rem := new(big.Int), new(big.Int)
+		if pm.Magnitude != math.Trunc(pm.Magnitude) || pm.Magnitude > 1e18 {
+			rem.SetInt64(1)
+		} else {
+			unit.DivMod(weiPerCoin, big.NewInt(int64(pm.Magnitude)), rem)
+		}
+		if rem.Sign() != 0 {
+			return fmt.Errorf("magnitude %v does not divide the coin's 1e18 wei", pm.Magnitude)
+		}
+		pm.account.weiPerUnit = unit
+	}
 	pm.MinPayment = pm.CoinToSat(pm.options.MinPayment)
 	log.Infof("payments: magnitude=%.0f min=%d sat interval=%ds maturity=%d", pm.Magnitude, pm.MinPayment, pm.options.Interval, pm.options.MinConfirmations)
 	return nil
@@ -198,12 +333,16 @@ type worker struct {
 	Balance uint64 // carried-over unpaid balance (satoshis)
 	Reward  uint64 // rewards earned this run (satoshis)
 	Sent    uint64 // paid out this run (satoshis)
+
+	MinPayment uint64 // the miner's threshold (satoshis), set by applySettings
+	Held       bool   // the miner's daily schedule isn't due this run
 }
 
 // matureBlock is a pending block whose reward is confirmed and ready to split.
 type matureBlock struct {
-	block  *storage.PendingBlock
-	reward uint64 // satoshis credited to the pool address
+	block    *storage.PendingBlock
+	reward   uint64          // satoshis credited to the pool address
+	coinbase *storage.Payout // what its coinbase paid miners directly, or nil
 }
 
 // processPayments runs one payout cycle: classify pending blocks by their
@@ -227,6 +366,7 @@ func (pm *PaymentManager) reconcile() error {
 		// The sendmany broadcast (we have its txid) but ApplyPayments was interrupted
 		// — finish it now (atomic, and it clears the intent). No re-send.
 		log.Warnf("resuming interrupted payout run (txid %s)", txid)
+		update.Txid = txid
 		return pm.db.ApplyPayments(update)
 	}
 	// No txid: a sendmany may have broadcast in the instant before the crash. Halt
@@ -236,20 +376,54 @@ func (pm *PaymentManager) reconcile() error {
 		"verify the wallet, then delete the payouts:intent key to resume", update.Paid)
 }
 
-func (pm *PaymentManager) processPayments() error {
+func (pm *PaymentManager) processPayments(ctx context.Context) error {
 	if err := pm.reconcile(); err != nil {
 		return err
 	}
-	if pm.options.PayMode == config.PayModePPS {
-		return pm.processPPS()
+	if err := pm.watchPayouts(ctx, time.Now()); err != nil {
+		return err
 	}
+	workers, update, pay, err := pm.planRun(ctx, time.Now())
+	if err != nil || update == nil {
+		return err
+	}
+	if !pay {
+		// nothing to pay this run; still persist orphan moves so we don't rescan them.
+		return pm.db.ApplyPayments(update)
+	}
+	return pm.payout(ctx, workers, update) // if the first sendmany fails, blocks (and the pps cursor) stay for a retry
+}
 
+// planRun works out a payout run from storage and the daemons without writing
+// or sending anything: every miner owed, with their settings applied, and the
+// update to persist. pay is false when the run only moves orphans; update is
+// nil when there is nothing to do at all.
+func (pm *PaymentManager) planRun(ctx context.Context, now time.Time) (workers map[string]*worker, update *storage.PaymentUpdate, pay bool, err error) {
+	if pm.options.PaysPerShare() {
+		workers, update, err = pm.planPPS(ctx)
+		pay = err == nil
+	} else {
+		workers, update, pay, err = pm.planBlocks(ctx)
+	}
+	if err != nil || !pay {
+		return workers, update, false, err
+	}
+	if err := pm.applySettings(workers, now); err != nil {
+		return nil, nil, false, err
+	}
+	return workers, update, true, nil
+}
+
+// planBlocks classifies the pending blocks by their coinbase transaction
+// (orphan / immature / mature) and splits each mature block's reward across the
+// miners of its round.
+func (pm *PaymentManager) planBlocks(ctx context.Context) (map[string]*worker, *storage.PaymentUpdate, bool, error) {
 	pendingBlocks, err := pm.db.GetAllPendingBlocks()
 	if err != nil {
-		return err
+		return nil, nil, false, err
 	}
 	if len(pendingBlocks) == 0 {
-		return nil
+		return nil, nil, false, nil
 	}
 
 	update := &storage.PaymentUpdate{Balances: map[string]float64{}, Paid: map[string]float64{}}
@@ -258,7 +432,7 @@ func (pm *PaymentManager) processPayments() error {
 	// seed workers from carried-over balances
 	balances, err := pm.db.GetAllMinerBalances()
 	if err != nil {
-		return err
+		return nil, nil, false, err
 	}
 	workers := make(map[string]*worker, len(balances))
 	for miner, bal := range balances {
@@ -266,7 +440,7 @@ func (pm *PaymentManager) processPayments() error {
 	}
 
 	for _, pb := range pendingBlocks {
-		reward, category, confirmations, ok := pm.classifyBlock(pb)
+		reward, category, confirmations, ok := pm.classifyBlock(ctx, pb)
 		if !ok {
 			continue // transient RPC problem; retry this block next run
 		}
@@ -282,7 +456,7 @@ func (pm *PaymentManager) processPayments() error {
 			rewardSat := pm.CoinToSat(reward)
 			dist, err := pm.attribute(pb, rewardSat)
 			if err != nil {
-				return err
+				return nil, nil, false, err
 			}
 			if len(dist) == 0 {
 				// matured but nothing to attribute (no shares / unknown finder):
@@ -299,16 +473,19 @@ func (pm *PaymentManager) processPayments() error {
 				}
 				w.Reward += r
 			}
-			matured = append(matured, matureBlock{block: pb, reward: rewardSat})
+			coinbase, err := pm.coinbasePayout(pb)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			matured = append(matured, matureBlock{block: pb, reward: rewardSat, coinbase: coinbase})
 		}
 	}
 
 	if len(matured) == 0 {
-		// nothing to pay this run; still persist orphan moves so we don't rescan them.
 		if len(update.Orphaned) == 0 {
-			return nil
+			return nil, nil, false, nil
 		}
-		return pm.db.ApplyPayments(update)
+		return workers, update, false, nil
 	}
 
 	// Build the COMPLETE update (including the blocks being confirmed) before
@@ -316,54 +493,64 @@ func (pm *PaymentManager) processPayments() error {
 	for _, mb := range matured {
 		update.Confirmed = append(update.Confirmed, mb.block.String())
 		update.DeleteRounds = append(update.DeleteRounds, mb.block.Height)
+		if mb.coinbase != nil {
+			update.Coinbase = append(update.Coinbase, mb.coinbase)
+		}
 	}
-	if err := pm.settle(workers, update, 0); err != nil {
-		return err // sendmany failed — persist nothing, blocks stay pending for retry
-	}
-	return pm.db.ApplyPayments(update)
+	return workers, update, true, nil
 }
 
-// processPPS pays a fixed rate per share: it credits every share logged since
-// the cursor (reward = difficulty * ppsRate), pays balances over the threshold,
-// and confirms matured blocks — whose rewards refill the pool wallet rather than
-// being distributed (the pool, not the miners, carries the luck variance).
-func (pm *PaymentManager) processPPS() error {
+// planPPS pays per share: it credits every share logged since the cursor (pps
+// at difficulty * ppsRate, fpps and pps+ at the value the share was logged
+// with), pays balances over the threshold, and
+// confirms matured blocks — whose rewards refill the pool wallet rather than
+// being distributed (the pool, not the miners, carries the luck variance). In
+// pps+ the wallet keeps only the subsidy part: each matured block's fees are
+// split over its pplns window.
+func (pm *PaymentManager) planPPS(ctx context.Context) (map[string]*worker, *storage.PaymentUpdate, error) {
 	cursor, err := pm.db.GetPPSCursor()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	newShares, maxSeq, err := pm.db.GetSharesSince(cursor)
+	diffs, values, maxSeq, err := pm.db.GetSharesSince(cursor)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	balances, err := pm.db.GetAllMinerBalances()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	workers := make(map[string]*worker, len(balances))
-	for miner, bal := range balances {
-		workers[miner] = &worker{Address: miner, Balance: pm.CoinToSat(bal)}
-	}
-	for miner, diff := range newShares {
+	credit := func(miner string, sat uint64) {
 		w := workers[miner]
 		if w == nil {
 			w = &worker{Address: miner}
 			workers[miner] = w
 		}
-		w.Reward += pm.CoinToSat(diff * pm.options.PPSRate)
+		w.Reward += sat
+	}
+	for miner, bal := range balances {
+		workers[miner] = &worker{Address: miner, Balance: pm.CoinToSat(bal)}
+	}
+	for miner, diff := range diffs {
+		if pm.options.PayMode == config.PayModePPS {
+			credit(miner, pm.CoinToSat(diff*pm.options.PPSRate))
+		} else {
+			credit(miner, uint64(values[miner]))
+		}
 	}
 
 	update := &storage.PaymentUpdate{Balances: map[string]float64{}, Paid: map[string]float64{}, PPSCursor: maxSeq}
 
 	// Move matured blocks out of pending (their reward funds the wallet, so it is
-	// not split); orphan the rest. Nothing here is distributed to miners.
+	// not split); orphan the rest.
 	pendingBlocks, err := pm.db.GetAllPendingBlocks()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	for _, pb := range pendingBlocks {
-		_, category, confirmations, ok := pm.classifyBlock(pb)
+		reward, category, confirmations, ok := pm.classifyBlock(ctx, pb)
 		if !ok {
 			continue
 		}
@@ -374,22 +561,66 @@ func (pm *PaymentManager) processPPS() error {
 		case confirmations < pm.options.MinConfirmations:
 			// fewer than minConfirmations — leave pending until mature
 		default:
+			if pm.options.PayMode == config.PayModePPSPlus {
+				dist, ok, err := pm.splitFees(ctx, pb, pm.CoinToSat(reward))
+				if err != nil {
+					return nil, nil, err
+				}
+				if !ok {
+					continue // the block's fees are unknown for now; retry next run
+				}
+				for miner, r := range dist {
+					credit(miner, r)
+				}
+			}
 			update.Confirmed = append(update.Confirmed, pb.String())
 			update.DeleteRounds = append(update.DeleteRounds, pb.Height)
 		}
 	}
+	return workers, update, nil
+}
 
-	if err := pm.settle(workers, update, 0); err != nil {
-		return err // payout failed — leave the cursor/blocks so we retry next run
+// splitFees divides the transaction fees in a matured block's reward over its
+// pplns window (pps+). The fees are taken from getblockstats, as the part of
+// the reward the pool address received in proportion to the fees' part of the
+// whole coinbase. ok is false when the daemon can't tell (retry next run).
+func (pm *PaymentManager) splitFees(ctx context.Context, pb *storage.PendingBlock, rewardSat uint64) (dist map[string]uint64, ok bool, err error) {
+	instance, result := pm.cmd(ctx, "getblockstats", []interface{}{pb.Hash, []string{"subsidy", "totalfee"}})
+	if result == nil {
+		return nil, false, nil
+	}
+	if result.Error != nil {
+		log.Warnf("getblockstats %s on %s (pps+ needs it to split fees): %s", pb.Hash, instance.String(), result.Error.Message)
+		return nil, false, nil
 	}
-	return pm.db.ApplyPayments(update)
+	var stats struct {
+		Subsidy  uint64 `json:"subsidy"`
+		TotalFee uint64 `json:"totalfee"`
+	}
+	if err := json.Unmarshal(result.Result, &stats); err != nil {
+		log.Error(err)
+		return nil, false, nil
+	}
+	if stats.TotalFee == 0 {
+		return nil, true, nil
+	}
+
+	fees := uint64(math.Floor(float64(rewardSat) * float64(stats.TotalFee) / float64(stats.Subsidy+stats.TotalFee)))
+	shares, err := pm.db.GetPPLNSShares(pb.PayMode, pb.Mark, pm.options.PPLNSWindow)
+	if err != nil {
+		return nil, false, err
+	}
+	return splitByShares(fees, shares), true, nil
 }
 
 // classifyBlock looks up a pending block's coinbase transaction and reports the
 // reward credited to the pool address, its category and its confirmations. ok is
 // false only on a transient RPC failure (retry next run).
-func (pm *PaymentManager) classifyBlock(pb *storage.PendingBlock) (reward float64, category string, confirmations int64, ok bool) {
-	_, result := pm.cmd("gettransaction", []interface{}{pb.TxHash})
+func (pm *PaymentManager) classifyBlock(ctx context.Context, pb *storage.PendingBlock) (reward float64, category string, confirmations int64, ok bool) {
+	if pm.account != nil {
+		return pm.classifyAccountBlock(ctx, pb)
+	}
+	_, result := pm.cmd(ctx, "gettransaction", []interface{}{pb.TxHash})
 	if result == nil {
 		return 0, "", 0, false
 	}
@@ -398,7 +629,7 @@ func (pm *PaymentManager) classifyBlock(pb *storage.PendingBlock) (reward float6
 			// Don't orphan on a bare -5: a syncing/rescanning payment wallet can
 			// transiently miss a valid block's tx. Confirm the block is really
 			// off-chain before orphaning it (irreversible).
-			return pm.classifyMissingTx(pb)
+			return pm.classifyMissingTx(ctx, pb)
 		}
 		log.Warnf("gettransaction %s: %s", pb.TxHash, result.Error.Message)
 		return 0, "", 0, false
@@ -431,8 +662,8 @@ func (pm *PaymentManager) classifyBlock(pb *storage.PendingBlock) (reward float6
 // classifyMissingTx decides orphan vs transient miss when the wallet doesn't know
 // a pending block's coinbase tx: it checks whether the block itself is on-chain,
 // so a resyncing wallet doesn't cause a valid block to be orphaned.
-func (pm *PaymentManager) classifyMissingTx(pb *storage.PendingBlock) (reward float64, category string, confirmations int64, ok bool) {
-	_, result := pm.cmd("getblock", []interface{}{pb.Hash})
+func (pm *PaymentManager) classifyMissingTx(ctx context.Context, pb *storage.PendingBlock) (reward float64, category string, confirmations int64, ok bool) {
+	_, result := pm.cmd(ctx, "getblock", []interface{}{pb.Hash})
 	if result == nil {
 		return 0, "", 0, false // transient RPC — retry, don't orphan
 	}
@@ -455,6 +686,63 @@ func (pm *PaymentManager) classifyMissingTx(pb *storage.PendingBlock) (reward fl
 	return 0, "", 0, false
 }
 
+// payout pays the workers owed and applies update, in transactions of at most
+// maxOutputs payees. The first goes out with the whole update, which credits
+// every worker, so the later ones, each with its own intent, only pay out
+// balances: a failure or crash between transactions leaves the rest owed as
+// balances for the next run, never unpaid or paid twice.
+func (pm *PaymentManager) payout(ctx context.Context, workers map[string]*worker, update *storage.PaymentUpdate) error {
+	var payees []*worker
+	for _, w := range workers {
+		if pm.payable(ctx, w, w.Balance+w.Reward) {
+			payees = append(payees, w)
+		}
+	}
+	sort.Slice(payees, func(i, j int) bool { return payees[i].Address < payees[j].Address })
+
+	var later [][]*worker
+	for i, max := pm.options.MaxOutputs, pm.options.MaxOutputs; i < len(payees); i += max {
+		end := i + max
+		if end > len(payees) {
+			end = len(payees)
+		}
+		later = append(later, payees[i:end])
+		for _, w := range payees[i:end] {
+			w.Held = true // carried over by the first transaction, paid by its own
+		}
+	}
+
+	if err := pm.settle(ctx, workers, update, 0); err != nil {
+		return err
+	}
+	if err := pm.db.ApplyPayments(update); err != nil {
+		return err
+	}
+	for i, batch := range later {
+		batchWorkers := make(map[string]*worker, len(batch))
+		for _, w := range batch {
+			w.Balance, w.Reward, w.Held = w.Balance+w.Reward, 0, false
+			batchWorkers[w.Address] = w
+		}
+		u := &storage.PaymentUpdate{Balances: map[string]float64{}, Paid: map[string]float64{}}
+		if err := pm.settle(ctx, batchWorkers, u, 0); err != nil {
+			return fmt.Errorf("payout transaction %d of %d, the rest stay owed: %w", i+2, len(later)+1, err)
+		}
+		if err := pm.db.ApplyPayments(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// payable reports whether w is paid toSend this run.
+func (pm *PaymentManager) payable(ctx context.Context, w *worker, toSend uint64) bool {
+	// Worker names are unauthenticated (AuthorizeFn accepts any name), so a
+	// single malformed one must not fail the whole sendmany batch: skip it and
+	// carry its balance forward instead of poisoning everyone's payout.
+	return !w.Held && toSend >= w.MinPayment && toSend > 0 && pm.validRecipient(ctx, w.Address)
+}
+
 // settle computes each worker's payout and, if anything is owed, persists a
 // durable intent, broadcasts sendmany, and stamps the returned txid — filling the
 // update with the resulting balances/payouts. On -6 (insufficient funds for fees)
@@ -463,15 +751,12 @@ func (pm *PaymentManager) classifyMissingTx(pb *storage.PendingBlock) (reward fl
 // The intent is written BEFORE the broadcast and the txid stamped immediately
 // AFTER, so a crash between sendmany and ApplyPayments is resolved by reconcile()
 // instead of paying the same round twice.
-func (pm *PaymentManager) settle(workers map[string]*worker, update *storage.PaymentUpdate, withhold float64) error {
+func (pm *PaymentManager) settle(ctx context.Context, workers map[string]*worker, update *storage.PaymentUpdate, withhold float64) error {
 	amounts := map[string]float64{}
 	for _, w := range workers {
 		owed := w.Balance + w.Reward
 		toSend := uint64(math.Floor(float64(owed) * (1 - withhold)))
-		// Worker names are unauthenticated (AuthorizeFn accepts any name), so a
-		// single malformed one must not fail the whole sendmany batch: skip it and
-		// carry its balance forward instead of poisoning everyone's payout.
-		if toSend >= pm.MinPayment && toSend > 0 && pm.validRecipient(w.Address) {
+		if pm.payable(ctx, w, toSend) {
 			amounts[w.Address] = pm.SatToCoin(toSend)
 			w.Sent = toSend
 		} else {
@@ -491,21 +776,18 @@ func (pm *PaymentManager) settle(workers map[string]*worker, update *storage.Pay
 	}
 
 	if len(amounts) == 0 {
-		return nil // nothing to pay this run; caller still applies block/round moves
+		return nil // nothing to pay this run; payout still applies block/round moves
 	}
 
 	// Persist the intent BEFORE broadcasting.
 	if err := pm.db.PutPayoutIntent(update); err != nil {
 		return err
 	}
-
-	args := []interface{}{}
-	if !pm.options.OmitSendManyDummy {
-		args = append(args, pm.options.SendManyDummy)
+	if pm.account != nil {
+		return pm.transfer(ctx, amounts, update)
 	}
-	args = append(args, amounts)
 
-	_, result := pm.cmd("sendmany", args)
+	_, result := pm.cmd(ctx, "sendmany", pm.sendManyArgs(amounts))
 	if result == nil {
 		// No response — the request may or may not have broadcast. Leave the intent
 		// (txid empty) so the next run halts for review rather than risk re-paying.
@@ -525,7 +807,7 @@ func (pm *PaymentManager) settle(workers map[string]*worker, update *storage.Pay
 				return fmt.Errorf("wallet cannot cover sendmany fees even at 100%% withholding")
 			}
 			log.Warnf("insufficient funds for fees; retrying with %.0f%% withheld", next*100)
-			return pm.settle(workers, update, next)
+			return pm.settle(ctx, workers, update, next)
 		}
 		// Any other error means the node rejected it (no broadcast) — clear the intent.
 		_ = pm.db.DelPayoutIntent()
@@ -539,6 +821,7 @@ func (pm *PaymentManager) settle(workers map[string]*worker, update *storage.Pay
 	if err := pm.db.SetPayoutIntentTxid(txid); err != nil {
 		return err
 	}
+	update.Txid = txid // the ledger entry ApplyPayments writes
 	if withhold > 0 {
 		log.Warnf("paid %d workers (txid %s; withheld %.0f%% for fees)", len(amounts), txid, withhold*100)
 	} else {
@@ -547,6 +830,40 @@ func (pm *PaymentManager) settle(workers map[string]*worker, update *storage.Pay
 	return nil
 }
 
+// sendManyArgs builds the sendmany arguments paying amounts. The fee options
+// follow the amounts positionally: minconf, comment, subtractfeefrom,
+// replaceable, conf_target, estimate_mode and fee_rate, null where unset.
+func (pm *PaymentManager) sendManyArgs(amounts map[string]float64) []interface{} {
+	args := []interface{}{}
+	if !pm.options.OmitSendManyDummy {
+		args = append(args, pm.options.SendManyDummy)
+	}
+	args = append(args, amounts)
+	if !pm.options.SubtractFee && pm.options.ConfTarget <= 0 && pm.options.FeeRate <= 0 && pm.options.BumpAfter <= 0 {
+		return args
+	}
+
+	var subtractFrom, replaceable, confTarget, feeRate interface{}
+	if pm.options.SubtractFee {
+		addrs := make([]string, 0, len(amounts))
+		for addr := range amounts {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		subtractFrom = addrs
+	}
+	if pm.options.BumpAfter > 0 {
+		replaceable = true
+	}
+	if pm.options.ConfTarget > 0 {
+		confTarget = pm.options.ConfTarget
+	}
+	if pm.options.FeeRate > 0 {
+		feeRate = pm.options.FeeRate
+	}
+	return append(args, nil, nil, subtractFrom, replaceable, confTarget, nil, feeRate)
+}
+
 func (pm *PaymentManager) SatToCoin(sat uint64) float64 {
 	return float64(sat) / pm.Magnitude
 }
@@ -1,14 +1,18 @@
 package payments
 
 import (
+	"context"
 	"encoding/json"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis/v2"
 
@@ -27,8 +31,16 @@ type fakeWallet struct {
 	sendmany func(dummyPresent bool, amounts map[string]float64) (string, *daemons.JsonRpcError)
 	gettx    func(txid string) (*daemons.GetTransaction, *daemons.JsonRpcError)
 	getblk   func(hash string) (confirmations int64, err *daemons.JsonRpcError) // getblock; nil = block not found
+	stats    func(hash string) (subsidy, totalfee uint64)                       // getblockstats; nil = method not found
+	mempool  func(txid string) bool                                             // getmempoolentry; nil = every tx is in the mempool
+	bump     func(txid string) (string, *daemons.JsonRpcError)                  // bumpfee; nil = method not found
+
+	mempoolFee     float64 // getmempoolentry's fees.base, in coin
+	incrementalFee float64 // getnetworkinfo's incrementalfee, coin/kvB; 0 = method not found
 
 	SentBatches []map[string]float64 // captured sendmany calls
+	SentOptions [][]interface{}      // their arguments after the amounts
+	BumpOptions []interface{}        // captured bumpfee options
 	AddrMethod  string               // captured address-check method actually called
 	badAddr     map[string]bool      // addresses the wallet rejects as unpayable
 }
@@ -75,17 +87,50 @@ func (w *fakeWallet) handler(rw http.ResponseWriter, r *http.Request) {
 			break
 		}
 		result = map[string]interface{}{"hash": req.Params[0], "confirmations": conf}
+	case "getblockstats":
+		if w.stats == nil {
+			rpcErr = &daemons.JsonRpcError{Code: -32601, Message: "Method not found"}
+			break
+		}
+		subsidy, totalfee := w.stats(req.Params[0].(string))
+		result = map[string]interface{}{"subsidy": subsidy, "totalfee": totalfee}
+	case "getmempoolentry":
+		if w.mempool != nil && !w.mempool(req.Params[0].(string)) {
+			rpcErr = &daemons.JsonRpcError{Code: -5, Message: "Transaction not in mempool"}
+			break
+		}
+		result = map[string]interface{}{"vsize": 250, "fees": map[string]interface{}{"base": w.mempoolFee}}
+	case "getnetworkinfo":
+		if w.incrementalFee == 0 {
+			rpcErr = &daemons.JsonRpcError{Code: -32601, Message: "Method not found"}
+			break
+		}
+		result = map[string]interface{}{"incrementalfee": w.incrementalFee}
+	case "bumpfee":
+		if w.bump == nil {
+			rpcErr = &daemons.JsonRpcError{Code: -32601, Message: "Method not found"}
+			break
+		}
+		w.mu.Lock()
+		w.BumpOptions = append(w.BumpOptions, req.Params[1])
+		w.mu.Unlock()
+		txid, e := w.bump(req.Params[0].(string))
+		if e != nil {
+			rpcErr = e
+			break
+		}
+		result = map[string]interface{}{"txid": txid, "origfee": 0.0001, "fee": 0.0002}
 	case "sendmany":
-		dummyPresent := false
-		var amounts map[string]float64
-		if len(req.Params) == 2 { // [dummy, {addr:amt}]
-			dummyPresent = true
-			amounts = toAmounts(req.Params[1])
-		} else if len(req.Params) == 1 { // [{addr:amt}]
-			amounts = toAmounts(req.Params[0])
+		// [dummy, {addr:amt}, fee options...] or [{addr:amt}, ...]
+		params := req.Params
+		_, dummyPresent := params[0].(string)
+		if dummyPresent {
+			params = params[1:]
 		}
+		amounts := toAmounts(params[0])
 		w.mu.Lock()
 		w.SentBatches = append(w.SentBatches, amounts)
+		w.SentOptions = append(w.SentOptions, params[1:])
 		w.mu.Unlock()
 		txid, e := w.sendmany(dummyPresent, amounts)
 		result, rpcErr = txid, e
@@ -121,7 +166,7 @@ func writeRPC(rw http.ResponseWriter, id interface{}, result json.RawMessage, rp
 // harness wires a PaymentManager to miniredis + the fakeWallet.
 type harness struct {
 	pm     *PaymentManager
-	db     *storage.DB
+	db     *storage.RedisDB
 	wallet *fakeWallet
 	mr     *miniredis.Miniredis
 }
@@ -136,7 +181,7 @@ func newHarness(t *testing.T, opts *config.PaymentOptions) *harness {
 
 	host, portStr := splitHostPort(mr.Addr())
 	port, _ := strconv.Atoi(portStr)
-	db := storage.NewStorage("TEST", &config.RedisOptions{Network: "tcp", Host: host, Port: port})
+	db := storage.NewRedisDB("TEST", &config.RedisOptions{Network: "tcp", Host: host, Port: port})
 
 	w := &fakeWallet{balance: "12.34567890"}
 	srv := httptest.NewServer(http.HandlerFunc(w.handler))
@@ -184,6 +229,19 @@ func (h *harness) seedPPLNS(miner string, diff float64, seq int64) {
 		miner+":"+strconv.FormatFloat(diff, 'f', -1, 64)+":"+strconv.FormatInt(seq, 10))
 }
 
+// seedShareAt appends one share logged at time t, as PutShare writes it.
+func (h *harness) seedShareAt(miner string, diff float64, seq, t int64) {
+	h.mr.ZAdd("TEST:shares:pplnslog", float64(seq),
+		miner+":"+strconv.FormatFloat(diff, 'f', -1, 64)+":"+strconv.FormatInt(seq, 10)+":"+strconv.FormatInt(t, 10))
+}
+
+// seedPricedShare appends one share logged with its fpps / pps+ value
+// (satoshis), as PutShare writes it.
+func (h *harness) seedPricedShare(miner string, diff, value float64, seq int64) {
+	h.mr.ZAdd("TEST:shares:pplnslog", float64(seq),
+		miner+":"+strconv.FormatFloat(diff, 'f', -1, 64)+":"+strconv.FormatInt(seq, 10)+":0:"+strconv.FormatFloat(value, 'f', -1, 64))
+}
+
 func generateTx(confirmations int, reward float64) func(string) (*daemons.GetTransaction, *daemons.JsonRpcError) {
 	return func(txid string) (*daemons.GetTransaction, *daemons.JsonRpcError) {
 		return &daemons.GetTransaction{
@@ -197,7 +255,7 @@ func generateTx(confirmations int, reward float64) func(string) (*daemons.GetTra
 
 func TestPayout_FullFlow(t *testing.T) {
 	h := newHarness(t, &config.PaymentOptions{Interval: 1, MinPayment: 0, MinConfirmations: 100})
-	if err := h.pm.Init(); err != nil {
+	if err := h.pm.Init(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	// round 100: A contributed 30% of shares, B 70%; block reward 50 coin.
@@ -210,7 +268,7 @@ func TestPayout_FullFlow(t *testing.T) {
 		return "payouttxid", nil
 	}
 
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 
@@ -239,6 +297,15 @@ func TestPayout_FullFlow(t *testing.T) {
 	if h.mr.Exists("TEST:shares:round100") {
 		t.Error("sealed round 100 should be deleted after payout")
 	}
+
+	// the ledger records the transaction with what it paid and settled
+	mine, err := h.db.GetMinerPayouts("minerB", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mine) != 1 || mine[0].Txid != "payouttxid" || mine[0].Amount != 35 || !reflect.DeepEqual(mine[0].Blocks, []uint64{100}) {
+		t.Errorf("ledger of minerB = %+v, want 35 in payouttxid for block 100", mine)
+	}
 }
 
 // --- double-spend guard (durable payout intent) ---
@@ -246,13 +313,13 @@ func TestPayout_FullFlow(t *testing.T) {
 // A successful run leaves no lingering intent.
 func TestPayout_IntentClearedOnSuccess(t *testing.T) {
 	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100})
-	if err := h.pm.Init(); err != nil {
+	if err := h.pm.Init(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	h.seedRound(100, "tx100", map[string]float64{"minerA": 100})
 	h.wallet.gettx = generateTx(120, 50.0)
 	h.wallet.sendmany = func(bool, map[string]float64) (string, *daemons.JsonRpcError) { return "txid", nil }
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	if h.mr.Exists("TEST:payouts:intent") {
@@ -265,7 +332,7 @@ func TestPayout_IntentClearedOnSuccess(t *testing.T) {
 // land exactly once.
 func TestPayout_ResumesSentIntentWithoutRepaying(t *testing.T) {
 	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100})
-	if err := h.pm.Init(); err != nil {
+	if err := h.pm.Init(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	// A block is still pending, but the interrupted run already paid minerA (txid
@@ -288,7 +355,7 @@ func TestPayout_ResumesSentIntentWithoutRepaying(t *testing.T) {
 		t.Fatal("resuming a sent intent must NOT broadcast sendmany again")
 		return "", nil
 	}
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	if v := h.mr.HGet("TEST:payouts", "minerA"); v != "50" {
@@ -300,13 +367,16 @@ func TestPayout_ResumesSentIntentWithoutRepaying(t *testing.T) {
 	if h.mr.Exists("TEST:payouts:intent") {
 		t.Error("intent should be cleared after resume")
 	}
+	if p, _ := h.db.GetPayout("alreadysent"); p == nil || p.Amounts["minerA"] != 50 {
+		t.Errorf("ledger entry of the resumed run = %+v, want minerA 50", p)
+	}
 }
 
 // If a run died mid-sendmany (intent present, NO txid), we can't tell whether the
 // broadcast happened — halt for review rather than risk double-paying.
 func TestPayout_HaltsOnAmbiguousIntent(t *testing.T) {
 	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100})
-	if err := h.pm.Init(); err != nil {
+	if err := h.pm.Init(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	h.seedRound(100, "tx100", map[string]float64{"minerA": 100})
@@ -315,7 +385,7 @@ func TestPayout_HaltsOnAmbiguousIntent(t *testing.T) {
 		t.Fatal("must not pay while an ambiguous intent is unresolved")
 		return "", nil
 	}
-	if err := h.pm.processPayments(); err == nil {
+	if err := h.pm.processPayments(context.Background()); err == nil {
 		t.Error("processPayments must halt (error) on an intent with no txid")
 	}
 	if !h.mr.Exists("TEST:payouts:intent") {
@@ -325,14 +395,14 @@ func TestPayout_HaltsOnAmbiguousIntent(t *testing.T) {
 
 func TestPayout_ImmatureStaysPending(t *testing.T) {
 	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100})
-	_ = h.pm.Init()
+	_ = h.pm.Init(context.Background())
 	h.seedRound(101, "tx101", map[string]float64{"minerA": 100})
 	h.wallet.gettx = generateTx(10, 50.0) // only 10 confs < 100
 	h.wallet.sendmany = func(bool, map[string]float64) (string, *daemons.JsonRpcError) {
 		t.Fatal("must not pay an immature block")
 		return "", nil
 	}
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	if ok, _ := h.mr.SIsMember("TEST:blocks:pending", (&storage.PendingBlock{Hash: "blk101", TxHash: "tx101", Height: 101}).String()); !ok {
@@ -342,7 +412,7 @@ func TestPayout_ImmatureStaysPending(t *testing.T) {
 
 func TestPayout_OrphanNotPaid(t *testing.T) {
 	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100})
-	_ = h.pm.Init()
+	_ = h.pm.Init(context.Background())
 	h.seedRound(102, "tx102", map[string]float64{"minerA": 100})
 	h.wallet.gettx = func(string) (*daemons.GetTransaction, *daemons.JsonRpcError) {
 		return nil, &daemons.JsonRpcError{Code: -5, Message: "Invalid or non-wallet transaction id"}
@@ -351,7 +421,7 @@ func TestPayout_OrphanNotPaid(t *testing.T) {
 		t.Fatal("must not pay an orphaned block")
 		return "", nil
 	}
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	if ok, _ := h.mr.SIsMember("TEST:blocks:orphaned", (&storage.PendingBlock{Hash: "blk102", TxHash: "tx102", Height: 102}).String()); !ok {
@@ -366,7 +436,7 @@ func TestPayout_OrphanNotPaid(t *testing.T) {
 // on-chain — a resyncing wallet is transient; leave it pending and retry.
 func TestPayout_MissingTxButOnChainStaysPending(t *testing.T) {
 	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100})
-	_ = h.pm.Init()
+	_ = h.pm.Init(context.Background())
 	h.seedRound(102, "tx102", map[string]float64{"minerA": 100})
 	h.wallet.gettx = func(string) (*daemons.GetTransaction, *daemons.JsonRpcError) {
 		return nil, &daemons.JsonRpcError{Code: -5, Message: "Invalid or non-wallet transaction id"}
@@ -376,7 +446,7 @@ func TestPayout_MissingTxButOnChainStaysPending(t *testing.T) {
 		t.Fatal("must not pay")
 		return "", nil
 	}
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	pb := (&storage.PendingBlock{Hash: "blk102", TxHash: "tx102", Height: 102}).String()
@@ -394,7 +464,7 @@ func TestPayout_MissingTxButOnChainStaysPending(t *testing.T) {
 // A reorged coinbase (negative confirmations from gettransaction) is orphaned.
 func TestPayout_ReorgedCoinbaseOrphaned(t *testing.T) {
 	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100})
-	_ = h.pm.Init()
+	_ = h.pm.Init(context.Background())
 	h.seedRound(102, "tx102", map[string]float64{"minerA": 100})
 	h.wallet.gettx = func(string) (*daemons.GetTransaction, *daemons.JsonRpcError) {
 		return &daemons.GetTransaction{Amount: 50, Confirmations: -3, Generated: true}, nil
@@ -403,7 +473,7 @@ func TestPayout_ReorgedCoinbaseOrphaned(t *testing.T) {
 		t.Fatal("must not pay a reorged block")
 		return "", nil
 	}
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	pb := (&storage.PendingBlock{Hash: "blk102", TxHash: "tx102", Height: 102}).String()
@@ -415,7 +485,7 @@ func TestPayout_ReorgedCoinbaseOrphaned(t *testing.T) {
 func TestPayout_BelowMinPaymentCarriesOver(t *testing.T) {
 	// min payment 10 coin; A earns 15 (paid), B earns 5 (carried over as balance).
 	h := newHarness(t, &config.PaymentOptions{MinPayment: 10, MinConfirmations: 100})
-	_ = h.pm.Init()
+	_ = h.pm.Init(context.Background())
 	h.seedRound(103, "tx103", map[string]float64{"minerA": 75, "minerB": 25})
 	h.wallet.gettx = generateTx(120, 20.0) // reward 20 -> A=15, B=5
 	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
@@ -424,7 +494,7 @@ func TestPayout_BelowMinPaymentCarriesOver(t *testing.T) {
 		}
 		return "txid", nil
 	}
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	if v := h.mr.HGet("TEST:balances", "minerB"); v != "5" {
@@ -435,11 +505,400 @@ func TestPayout_BelowMinPaymentCarriesOver(t *testing.T) {
 	}
 }
 
+// A miner's own threshold carries their balance over, and a daily schedule
+// holds it until their hour comes round since the last payout.
+func TestPayout_MinerSettings(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinPayment: 1, MinConfirmations: 100})
+	_ = h.pm.Init(context.Background())
+	hour := 0
+	_ = h.db.SetMinerSettings("minerA", &storage.MinerSettings{MinPayment: 20, Time: 1})
+	_ = h.db.SetMinerSettings("minerB", &storage.MinerSettings{DailyAt: &hour, Time: 1})
+	_ = h.db.SetMinerSettings("minerC", &storage.MinerSettings{DailyAt: &hour, Time: 1})
+	// minerB was paid moments ago, minerC never
+	_ = h.db.ApplyPayments(&storage.PaymentUpdate{Paid: map[string]float64{"minerB": 1}, Txid: "earlier"})
+
+	h.seedRound(104, "tx104", map[string]float64{"minerA": 1, "minerB": 1, "minerC": 1})
+	h.wallet.gettx = generateTx(120, 30.0)
+	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
+		if want := map[string]float64{"minerC": 10}; !reflect.DeepEqual(amounts, want) {
+			t.Errorf("sent %v, want %v", amounts, want)
+		}
+		return "txid", nil
+	}
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, miner := range []string{"minerA", "minerB"} {
+		if v := h.mr.HGet("TEST:balances", miner); v != "10" {
+			t.Errorf("%s carried balance = %q, want 10", miner, v)
+		}
+	}
+}
+
+func TestDailyDue(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinConfirmations: 100})
+	_ = h.db.ApplyPayments(&storage.PaymentUpdate{Paid: map[string]float64{"minerA": 1}, Txid: "t"})
+	paid, _ := h.db.GetMinerPayouts("minerA", 1)
+	next := time.Unix(paid[0].Time, 0).UTC().Truncate(time.Hour).Add(time.Hour)
+
+	for _, tc := range []struct {
+		now  time.Time
+		want bool
+	}{
+		{next.Add(-time.Minute), false},
+		{next.Add(time.Minute), true},
+		{next.Add(23 * time.Hour), true},
+	} {
+		if due, err := h.pm.dailyDue("minerA", next.Hour(), tc.now); err != nil || due != tc.want {
+			t.Errorf("due at %s = %v, %v; want %v", tc.now, due, err, tc.want)
+		}
+	}
+	if due, _ := h.pm.dailyDue("minerB", 0, time.Now()); !due {
+		t.Error("a miner never paid isn't due")
+	}
+}
+
+// Payees past maxOutputs go out in further transactions, each with its own
+// ledger entry.
+func TestPayout_Batches(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinConfirmations: 100, MaxOutputs: 2})
+	_ = h.pm.Init(context.Background())
+	h.seedRound(105, "tx105", map[string]float64{"m1": 1, "m2": 1, "m3": 1, "m4": 1, "m5": 1})
+	h.wallet.gettx = generateTx(120, 50.0)
+	n := 0
+	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
+		n++
+		return "tx" + strconv.Itoa(n), nil
+	}
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []map[string]float64{{"m1": 10, "m2": 10}, {"m3": 10, "m4": 10}, {"m5": 10}}
+	if !reflect.DeepEqual(h.wallet.SentBatches, want) {
+		t.Errorf("sent %v, want %v", h.wallet.SentBatches, want)
+	}
+	if payouts, _ := h.db.GetPayouts(10); len(payouts) != 3 {
+		t.Errorf("%d ledger entries, want one per transaction", len(payouts))
+	}
+	for _, m := range []string{"m1", "m3", "m5"} {
+		if v := h.mr.HGet("TEST:balances", m); v != "0" {
+			t.Errorf("%s balance = %q, want 0", m, v)
+		}
+	}
+}
+
+// A failed later transaction leaves its payees owed, and the block settled: a
+// later run pays them from their balances.
+func TestPayout_BatchFailureLeavesBalances(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinConfirmations: 100, MaxOutputs: 1})
+	_ = h.pm.Init(context.Background())
+	h.seedRound(106, "tx106", map[string]float64{"m1": 1, "m2": 1})
+	h.wallet.gettx = generateTx(120, 20.0)
+	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
+		if _, ok := amounts["m2"]; ok {
+			return "", &daemons.JsonRpcError{Code: -4, Message: "Transaction too large"}
+		}
+		return "tx1", nil
+	}
+	if err := h.pm.processPayments(context.Background()); err == nil {
+		t.Fatal("a failed transaction must be reported")
+	}
+	if !h.mr.Exists("TEST:blocks:confirmed") {
+		t.Error("the block must be settled by the first transaction")
+	}
+	if v := h.mr.HGet("TEST:balances", "m2"); v != "10" {
+		t.Errorf("m2 balance = %q, want 10 owed", v)
+	}
+
+	// the next block pays m2's balance along with its own reward
+	h.seedRound(107, "tx107", map[string]float64{"m1": 1})
+	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
+		return "tx" + strconv.Itoa(len(h.wallet.SentBatches)), nil
+	}
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.wallet.SentBatches[len(h.wallet.SentBatches)-1]; !reflect.DeepEqual(got, map[string]float64{"m2": 10}) {
+		t.Errorf("last transaction paid %v, want m2's 10", got)
+	}
+	if v := h.mr.HGet("TEST:balances", "m2"); v != "0" {
+		t.Errorf("m2 balance after the retry = %q, want 0", v)
+	}
+}
+
+func TestPayout_SendManyFeeOptions(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinConfirmations: 100, FeeRate: 2.5, SubtractFee: true})
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.seedRound(107, "tx107", map[string]float64{"minerB": 1, "minerA": 1})
+	h.wallet.gettx = generateTx(120, 20.0)
+	h.wallet.sendmany = func(_ bool, _ map[string]float64) (string, *daemons.JsonRpcError) { return "txid", nil }
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{nil, nil, []interface{}{"minerA", "minerB"}, nil, nil, nil, 2.5}
+	if len(h.wallet.SentOptions) != 1 || !reflect.DeepEqual(h.wallet.SentOptions[0], want) {
+		t.Errorf("sendmany options = %v, want %v", h.wallet.SentOptions, want)
+	}
+
+	bad := newHarness(t, &config.PaymentOptions{FeeRate: 1, ConfTarget: 6})
+	if err := bad.pm.Init(context.Background()); err == nil {
+		t.Error("feeRate with confTarget must be refused")
+	}
+}
+
+// A payout left unconfirmed past bumpAfter is replaced with bumpfee, and the
+// ledger follows the replacement until it confirms.
+func TestPayout_BumpsStuckPayout(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinConfirmations: 100, BumpAfter: 3600, ConfTarget: 2})
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.seedRound(108, "tx108", map[string]float64{"minerA": 1})
+	h.wallet.gettx = generateTx(120, 10.0)
+	h.wallet.sendmany = func(_ bool, _ map[string]float64) (string, *daemons.JsonRpcError) { return "stuck", nil }
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if opts := h.wallet.SentOptions[0]; len(opts) < 4 || opts[3] != true {
+		t.Errorf("sendmany options = %v, want the payout replaceable", opts)
+	}
+
+	watched, _ := h.db.GetUnconfirmedPayouts()
+	since, ok := watched["stuck"]
+	if !ok {
+		t.Fatalf("watched %v, want the payout followed", watched)
+	}
+	h.wallet.gettx = generateTx(0, 10.0)
+	h.wallet.bump = func(txid string) (string, *daemons.JsonRpcError) { return "bumped", nil }
+
+	// not stuck for long enough yet
+	if err := h.pm.watchPayouts(context.Background(), time.Unix(since+60, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.wallet.BumpOptions) != 0 {
+		t.Fatal("bumped before bumpAfter")
+	}
+
+	if err := h.pm.watchPayouts(context.Background(), time.Unix(since+3600, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{map[string]interface{}{"conf_target": float64(2)}}; !reflect.DeepEqual(h.wallet.BumpOptions, want) {
+		t.Errorf("bumpfee options = %v, want %v", h.wallet.BumpOptions, want)
+	}
+	p, err := h.db.GetPayout("bumped")
+	if err != nil || p == nil {
+		t.Fatalf("no ledger entry for the replacement: %v", err)
+	}
+	if !reflect.DeepEqual(p.Replaced, []string{"stuck"}) || p.Amounts["minerA"] != 10 {
+		t.Errorf("replacement entry = %+v", p)
+	}
+	if old, _ := h.db.GetPayout("stuck"); old != nil {
+		t.Error("the replaced txid must leave the ledger")
+	}
+	if mine, _ := h.db.GetMinerPayouts("minerA", 5); len(mine) != 1 || mine[0].Txid != "bumped" {
+		t.Errorf("minerA payouts = %+v, want the replacement only", mine)
+	}
+
+	// confirmed: no longer followed
+	h.wallet.gettx = generateTx(1, 10.0)
+	if err := h.pm.watchPayouts(context.Background(), time.Unix(since+7200, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if watched, _ := h.db.GetUnconfirmedPayouts(); len(watched) != 0 {
+		t.Errorf("watched %v after confirmation, want none", watched)
+	}
+}
+
+// With feeRate set, a payout sent at feeRate is bumped past its own rate by the
+// incremental relay fee, which BIP 125 requires of a replacement; a configured
+// rate above that is kept.
+func TestPayout_BumpRaisesFeeRate(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinConfirmations: 100, BumpAfter: 60, FeeRate: 5})
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.db.ApplyPayments(&storage.PaymentUpdate{Paid: map[string]float64{"minerA": 1}, Txid: "stuck"}); err != nil {
+		t.Fatal(err)
+	}
+	h.wallet.gettx = generateTx(0, 1.0)
+	h.wallet.bump = func(txid string) (string, *daemons.JsonRpcError) { return txid + "+", nil }
+	h.wallet.mempoolFee = 0.0000125 // 5 sat/vB over 250 vB
+	h.wallet.incrementalFee = 0.00002
+
+	if err := h.pm.watchPayouts(context.Background(), time.Unix(1<<40, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{map[string]interface{}{"fee_rate": 7.0}}; !reflect.DeepEqual(h.wallet.BumpOptions, want) {
+		t.Errorf("bumpfee options = %v, want %v", h.wallet.BumpOptions, want)
+	}
+
+	// a payout underpaying feeRate (sent before it was raised) bumps at feeRate;
+	// without getnetworkinfo the incremental fee is Bitcoin Core's 1 sat/vB
+	h.pm.options.FeeRate = 20
+	h.wallet.incrementalFee = 0
+	h.wallet.BumpOptions = nil
+	if err := h.pm.watchPayouts(context.Background(), time.Unix(1<<40+60, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{map[string]interface{}{"fee_rate": 20.0}}; !reflect.DeepEqual(h.wallet.BumpOptions, want) {
+		t.Errorf("bumpfee options = %v, want %v", h.wallet.BumpOptions, want)
+	}
+}
+
+// A bump the wallet made without the pool recording it (a crash right after
+// bumpfee) is picked up from gettransaction; a payout gone from the mempool is
+// only alerted on, never bumped.
+func TestPayout_WatchRecoversReplacementAndDropped(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinConfirmations: 100, BumpAfter: 60})
+	_ = h.pm.Init(context.Background())
+	if err := h.db.ApplyPayments(&storage.PaymentUpdate{Paid: map[string]float64{"minerA": 1}, Txid: "lost"}); err != nil {
+		t.Fatal(err)
+	}
+	h.wallet.gettx = func(txid string) (*daemons.GetTransaction, *daemons.JsonRpcError) {
+		if txid == "lost" {
+			return &daemons.GetTransaction{Txid: txid, ReplacedByTxid: "found"}, nil
+		}
+		return &daemons.GetTransaction{Txid: txid}, nil
+	}
+	h.wallet.mempool = func(string) bool { return false }
+	h.wallet.bump = func(txid string) (string, *daemons.JsonRpcError) {
+		t.Errorf("bumped %s, which is not in the mempool", txid)
+		return "", nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := h.pm.watchPayouts(context.Background(), time.Unix(5000, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p, _ := h.db.GetPayout("found"); p == nil || !reflect.DeepEqual(p.Replaced, []string{"lost"}) {
+		t.Errorf("replacement entry = %+v", p)
+	}
+	if watched, _ := h.db.GetUnconfirmedPayouts(); !reflect.DeepEqual(watched, map[string]int64{"found": 5000}) {
+		t.Errorf("watched %v, want the replacement still followed", watched)
+	}
+}
+
+// A payout a conflicting transaction beat is never confirmed: its ledger entry
+// is flagged and it stays followed, alerted on each run.
+func TestPayout_WatchFlagsConflicted(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinConfirmations: 100, BumpAfter: 60})
+	_ = h.pm.Init(context.Background())
+	if err := h.db.ApplyPayments(&storage.PaymentUpdate{Paid: map[string]float64{"minerA": 1}, Txid: "beaten"}); err != nil {
+		t.Fatal(err)
+	}
+	h.wallet.gettx = func(txid string) (*daemons.GetTransaction, *daemons.JsonRpcError) {
+		return &daemons.GetTransaction{Txid: txid, Confirmations: -2}, nil
+	}
+	h.wallet.bump = func(txid string) (string, *daemons.JsonRpcError) {
+		t.Errorf("bumped %s, which conflicts with a confirmed transaction", txid)
+		return "", nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := h.pm.watchPayouts(context.Background(), time.Unix(1<<40, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p, _ := h.db.GetPayout("beaten"); p == nil || !p.Conflicted {
+		t.Errorf("ledger entry = %+v, want it flagged conflicted", p)
+	}
+	if mine, _ := h.db.GetMinerPayouts("minerA", 5); len(mine) != 1 || !mine[0].Conflicted {
+		t.Errorf("minerA payouts = %+v, want the payout flagged conflicted", mine)
+	}
+	if watched, _ := h.db.GetUnconfirmedPayouts(); len(watched) != 1 {
+		t.Errorf("watched %v, want the conflicted payout still followed", watched)
+	}
+}
+
+// A dry run works the next run out from the real state and leaves it, and the
+// wallet, untouched.
+func TestDryRun_WritesNothing(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinPayment: 5, MinConfirmations: 100, MaxOutputs: 1})
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.seedRound(109, "tx109", map[string]float64{"minerA": 3, "minerB": 1})
+	h.seedPending(110, "tx110", "minerA", 0)
+	h.mr.HSet("TEST:balances", "minerC", "7")
+	h.wallet.gettx = func(txid string) (*daemons.GetTransaction, *daemons.JsonRpcError) {
+		if txid == "tx110" {
+			return &daemons.GetTransaction{Confirmations: -1}, nil
+		}
+		return generateTx(120, 16.0)(txid)
+	}
+	h.wallet.sendmany = func(_ bool, _ map[string]float64) (string, *daemons.JsonRpcError) {
+		t.Error("a dry run must not send")
+		return "", nil
+	}
+	before := h.mr.Dump()
+
+	plan, err := h.pm.DryRun(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after := h.mr.Dump(); after != before {
+		t.Errorf("the dry run wrote to storage:\n%s", after)
+	}
+
+	want := []MinerPlan{
+		{Miner: "minerA", Reward: 12, Pay: 12},
+		{Miner: "minerB", Reward: 4, Owed: 4},
+		{Miner: "minerC", Balance: 7, Pay: 7},
+	}
+	if !reflect.DeepEqual(plan.Miners, want) {
+		t.Errorf("miners = %+v, want %+v", plan.Miners, want)
+	}
+	if len(plan.Confirmed) != 1 || len(plan.Orphaned) != 1 {
+		t.Errorf("confirmed %v, orphaned %v; want 109 confirmed and 110 orphaned", plan.Confirmed, plan.Orphaned)
+	}
+	if plan.Credited != 16 || plan.Paid != 19 || plan.Owed != 4 || plan.Transactions != 2 {
+		t.Errorf("totals = credited %v paid %v owed %v in %d transactions", plan.Credited, plan.Paid, plan.Owed, plan.Transactions)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinConfirmations: 100})
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.seedRound(111, "tx111", map[string]float64{"minerA": 1, "minerB": 2})
+	h.wallet.gettx = generateTx(120, 3.0)
+	h.wallet.sendmany = func(_ bool, _ map[string]float64) (string, *daemons.JsonRpcError) { return "txid", nil }
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.mr.HSet("TEST:balances", "minerC", "0.5") // credited from nowhere
+	h.wallet.balance = "0.25"
+
+	a, err := h.pm.Audit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Rewards != 3 || a.Blocks != 1 || a.Paid != 3 || a.Balances != 0.5 || a.Wallet != 0.25 {
+		t.Errorf("audit = %+v", a)
+	}
+	if a.Retained != -0.5 || a.Shortfall != 0.25 {
+		t.Errorf("retained %v, shortfall %v; want -0.5 and 0.25", a.Retained, a.Shortfall)
+	}
+
+	// a confirmed block that left the chain is reported, not counted
+	h.wallet.gettx = func(string) (*daemons.GetTransaction, *daemons.JsonRpcError) {
+		return &daemons.GetTransaction{Confirmations: -3}, nil
+	}
+	if a, err := h.pm.Audit(context.Background()); err != nil || len(a.Reorged) != 1 || a.Rewards != 0 {
+		t.Errorf("audit after a reorg = %+v, %v", a, err)
+	}
+}
+
 // --- pay modes ---
 
 func TestPayout_Solo(t *testing.T) {
 	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, PayMode: "solo"})
-	if err := h.pm.Init(); err != nil {
+	if err := h.pm.Init(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	// round shares exist for other miners, but solo pays only the block finder.
@@ -455,7 +914,7 @@ func TestPayout_Solo(t *testing.T) {
 		}
 		return "txid", nil
 	}
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	if v := h.mr.HGet("TEST:payouts", "minerFinder"); v != "50" {
@@ -465,7 +924,7 @@ func TestPayout_Solo(t *testing.T) {
 
 func TestPayout_PPLNS(t *testing.T) {
 	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, PayMode: "pplns", PPLNSWindow: 40})
-	if err := h.pm.Init(); err != nil {
+	if err := h.pm.Init(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	// pplns log (seq → miner:diff): A older, then B, then C. Window=40 looks back
@@ -488,16 +947,195 @@ func TestPayout_PPLNS(t *testing.T) {
 		}
 		return "txid", nil
 	}
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A block solved by another share group's share is split the way that group
+// pays, from that group's shares only.
+func TestPayout_ShareGroups(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, PayMode: "pplns", PPLNSWindow: 40})
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.seedPPLNS("minerA", 10, 1)
+	h.seedPPLNS("minerB", 10, 2)
+	h.seedPending(301, "tx301", "minerB", 2)
+	// the solo block is the finder's, whatever the pool's window holds
+	solo := &storage.PendingBlock{Hash: "blk302", TxHash: "tx302", Height: 302, Finder: "minerS", Mark: 3, PayMode: config.PayModeSolo}
+	h.mr.SAdd("TEST:blocks:pending", solo.String())
+	// the prop block pays its sealed round
+	h.seedRoundShares(303, map[string]float64{"minerP": 1, "minerQ": 3})
+	prop := &storage.PendingBlock{Hash: "blk303", TxHash: "tx303", Height: 303, Finder: "minerP", Mark: 4, PayMode: config.PayModeProp}
+	h.mr.SAdd("TEST:blocks:pending", prop.String())
+
+	h.wallet.gettx = generateTx(120, 40.0)
+	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
+		want := map[string]float64{"minerA": 20, "minerB": 20, "minerS": 40, "minerP": 10, "minerQ": 30}
+		if !reflect.DeepEqual(amounts, want) {
+			t.Errorf("split = %v, want %v", amounts, want)
+		}
+		return "txid", nil
+	}
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPayout_PPLNT(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, PayMode: "pplnt", PPLNTWindow: 600})
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the window is the 600s before the share at the block's mark (t=2000):
+	// minerA's share at t=1000 is too old
+	h.seedShareAt("minerA", 10, 1, 1000)
+	h.seedShareAt("minerB", 10, 2, 1500)
+	h.seedShareAt("minerC", 10, 3, 2000)
+	h.seedShareAt("minerD", 10, 4, 2100) // after the block
+	h.seedPending(303, "tx303", "minerC", 3)
+	h.wallet.gettx = generateTx(120, 40.0)
+	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
+		if want := map[string]float64{"minerB": 20, "minerC": 20}; !reflect.DeepEqual(amounts, want) {
+			t.Errorf("pplnt split = %v, want %v", amounts, want)
+		}
+		return "txid", nil
+	}
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPayout_Score(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, PayMode: "score", ScoreDecay: 100})
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// minerB's share is one time constant older, so it scores 1/e of minerA's;
+	// minerC's is past the horizon and scores nothing
+	h.seedShareAt("minerC", 10, 1, 1)
+	h.seedShareAt("minerB", 10, 2, 5000)
+	h.seedShareAt("minerA", 10, 3, 5100)
+	h.seedPending(304, "tx304", "minerA", 3)
+	h.wallet.gettx = generateTx(120, 10.0)
+	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
+		wantA := 10 / (1 + 1/math.E)
+		if math.Abs(amounts["minerA"]-wantA) > 1e-7 || math.Abs(amounts["minerB"]-(10-wantA)) > 1e-7 {
+			t.Errorf("score split = %v, want A=%.8f B=%.8f", amounts, wantA, 10-wantA)
+		}
+		if _, ok := amounts["minerC"]; ok {
+			t.Error("a share past the score horizon must not be paid")
+		}
+		return "txid", nil
+	}
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A block whose mark predates timed share logs pays its own round.
+func TestPayout_ScoreUntimedFallsBackToRound(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, PayMode: "score"})
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.seedPPLNS("minerA", 10, 1)
+	h.seedRoundShares(305, map[string]float64{"minerB": 1})
+	h.seedPending(305, "tx305", "minerB", 1)
+	h.wallet.gettx = generateTx(120, 10.0)
+	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
+		if want := map[string]float64{"minerB": 10}; !reflect.DeepEqual(amounts, want) {
+			t.Errorf("untimed score split = %v, want %v", amounts, want)
+		}
+		return "txid", nil
+	}
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// With coinbasePayouts the pool output only carries what the coinbase did not
+// pay directly, so only the miners the coinbase skipped share it. The miners
+// it paid are recorded as paid, with the coinbase in the ledger.
+func TestPayout_CoinbaseRemainder(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, PayMode: "pplns", PPLNSWindow: 40, CoinbasePayouts: true})
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.seedPPLNS("minerA", 30, 1)
+	h.seedPPLNS("minerB", 5, 2)
+	h.seedPPLNS("minerC", 5, 3)
+	h.seedPending(302, "tx302", "minerA", 3)
+	h.mr.HSet("TEST:coinbase:paid302", "minerA", "3000000000") // paid 30 in the coinbase
+	h.wallet.gettx = generateTx(120, 10.0)                     // remainder left in the pool output
+	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
+		if amounts["minerB"] != 5.0 || amounts["minerC"] != 5.0 {
+			t.Errorf("remainder split wrong (want B=5 C=5): %v", amounts)
+		}
+		if _, ok := amounts["minerA"]; ok {
+			t.Errorf("minerA was paid in the coinbase and must not be paid again")
+		}
+		return "txid", nil
+	}
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
+	if h.mr.Exists("TEST:coinbase:paid302") {
+		t.Error("coinbase payout record should be dropped with the round")
+	}
+	if paid, _ := h.db.GetAllMinerPaid(); paid["minerA"] != 30 || paid["minerB"] != 5 {
+		t.Errorf("paid = %v, want minerA's coinbase payout counted", paid)
+	}
+	if mine, _ := h.db.GetMinerPayouts("minerA", 5); len(mine) != 1 || mine[0].Txid != "tx302" || mine[0].Amount != 30 {
+		t.Errorf("minerA payouts = %+v, want the coinbase", mine)
+	}
+	// the audit counts the coinbase payout as a reward, as well as paid
+	if a, err := h.pm.Audit(context.Background()); err != nil || a.Rewards != 40 || a.Paid != 40 || a.Retained != 0 {
+		t.Errorf("audit = %+v, %v; want 40 rewarded and paid", a, err)
+	}
+}
+
+// The remainder is split over the window the coinbase was split from, not the
+// block's: shares logged after the job was made were not in the coinbase.
+func TestPayout_CoinbaseRemainderUsesJobWindow(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, PayMode: "pplns", PPLNSWindow: 40, CoinbasePayouts: true})
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.seedPPLNS("minerA", 30, 1)
+	h.seedPPLNS("minerB", 5, 2)
+	h.seedPPLNS("minerC", 5, 3) // logged after the block's job was made
+	h.seedPending(302, "tx302", "minerA", 3)
+	h.mr.HSet("TEST:coinbase:paid302", "minerA", "3000000000")
+	h.mr.HSet("TEST:coinbase:window302", "minerA", "30", "minerB", "5")
+	h.wallet.gettx = generateTx(120, 5.0) // minerB's cut, folded back as dust
+	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
+		if want := map[string]float64{"minerB": 5}; !reflect.DeepEqual(amounts, want) {
+			t.Errorf("remainder split = %v, want %v", amounts, want)
+		}
+		return "txid", nil
+	}
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if h.mr.Exists("TEST:coinbase:window302") {
+		t.Error("coinbase window should be dropped with the round")
+	}
+}
+
+func TestCoinbasePayouts_RequiresPPLNSWindow(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{PayMode: "prop", CoinbasePayouts: true})
+	if err := h.pm.Init(context.Background()); err == nil {
+		t.Error("coinbasePayouts outside pplns must fail Init")
+	}
 }
 
 func TestPayout_PPS(t *testing.T) {
 	// ppsRate 0.5 coin per diff unit: A(10 diff)->5, B(20 diff)->10. The found
 	// block's 50-coin reward funds the wallet and is NOT distributed.
 	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, PayMode: "pps", PPSRate: 0.5})
-	if err := h.pm.Init(); err != nil {
+	if err := h.pm.Init(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	h.seedPPLNS("minerA", 10, 1)
@@ -510,7 +1148,7 @@ func TestPayout_PPS(t *testing.T) {
 		}
 		return "txid", nil
 	}
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	if v := h.mr.HGet("TEST:payouts", "minerB"); v != "10" {
@@ -525,7 +1163,7 @@ func TestPayout_PPS(t *testing.T) {
 	}
 	// re-run: no new shares -> no further payout.
 	h.wallet.SentBatches = nil
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	for _, b := range h.wallet.SentBatches {
@@ -537,11 +1175,118 @@ func TestPayout_PPS(t *testing.T) {
 
 func TestPPS_RequiresRate(t *testing.T) {
 	h := newHarness(t, &config.PaymentOptions{PayMode: "pps"}) // ppsRate defaults to 0
-	if err := h.pm.Init(); err == nil {
+	if err := h.pm.Init(context.Background()); err == nil {
 		t.Error("payMode pps without ppsRate must fail Init")
 	}
 }
 
+// fpps credits each share the value it was logged with, priced on its own
+// job: A's share at 0.5 coin per diff unit, B's after a difficulty rise at 0.25.
+func TestPayout_FPPS(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, PayMode: "fpps"})
+	h.pm.PricedShares = true
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.seedPricedShare("minerA", 10, 5e8, 1)
+	h.seedPricedShare("minerB", 40, 10e8, 2)
+	h.seedPending(401, "tx401", "minerB", 2)
+	h.wallet.gettx = generateTx(120, 50.0)
+	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
+		if amounts["minerA"] != 5.0 || amounts["minerB"] != 10.0 {
+			t.Errorf("fpps payout wrong (want the logged A=5 B=10): %v", amounts)
+		}
+		return "txid", nil
+	}
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := h.mr.Get("TEST:pps:cursor"); got != "2" {
+		t.Errorf("fpps cursor = %q, want 2", got)
+	}
+}
+
+// pps+ pays the subsidy value each share was logged with (0.4 coin per diff
+// unit here) and splits a matured block's fees over its pplns window: the
+// block's 50-coin reward holds 10 coin of fees, shared 1:3 by A and B.
+func TestPayout_PPSPlus(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, PayMode: "pps+", PPLNSWindow: 40})
+	h.pm.PricedShares = true
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.seedPricedShare("minerA", 10, 4e8, 1)
+	h.seedPricedShare("minerB", 30, 12e8, 2)
+	h.seedPending(402, "tx402", "minerB", 2)
+	h.wallet.gettx = generateTx(120, 50.0)
+
+	// without getblockstats the fees can't be told apart: only the pps part is
+	// paid and the block waits
+	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
+		if amounts["minerA"] != 4.0 || amounts["minerB"] != 12.0 {
+			t.Errorf("pps+ subsidy payout wrong (want A=4 B=12): %v", amounts)
+		}
+		return "txid1", nil
+	}
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pb := (&storage.PendingBlock{Hash: "blk402", TxHash: "tx402", Height: 402, Finder: "minerB", Mark: 2}).String()
+	if ok, _ := h.mr.SIsMember("TEST:blocks:pending", pb); !ok {
+		t.Fatal("a block whose fees are unknown must stay pending")
+	}
+
+	h.wallet.stats = func(string) (uint64, uint64) { return 40e8, 10e8 }
+	h.wallet.sendmany = func(_ bool, amounts map[string]float64) (string, *daemons.JsonRpcError) {
+		if amounts["minerA"] != 2.5 || amounts["minerB"] != 7.5 {
+			t.Errorf("pps+ fee split wrong (want A=2.5 B=7.5): %v", amounts)
+		}
+		return "txid2", nil
+	}
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := h.mr.SIsMember("TEST:blocks:confirmed", pb); !ok {
+		t.Error("the matured block should be confirmed once its fees are split")
+	}
+	if v := h.mr.HGet("TEST:payouts", "minerB"); v != "19.5" {
+		t.Errorf("pps+ payouts minerB = %q, want 19.5", v)
+	}
+}
+
+func TestFPPS_RequiresPricedShares(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{PayMode: "fpps"})
+	if err := h.pm.Init(context.Background()); err == nil {
+		t.Error("payMode fpps without priced shares must fail Init")
+	}
+	h = newHarness(t, &config.PaymentOptions{PayMode: "pps+"})
+	h.pm.PricedShares = true
+	if err := h.pm.Init(context.Background()); err == nil {
+		t.Error("payMode pps+ without pplnsWindow must fail Init")
+	}
+}
+
+// An fpps run needs no block template, so orphans move before the pool has
+// seen its first one.
+func TestFPPS_MovesOrphansWithoutShares(t *testing.T) {
+	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, PayMode: "fpps"})
+	h.pm.PricedShares = true
+	if err := h.pm.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.seedPending(403, "tx403", "minerA", 0)
+	h.wallet.gettx = func(string) (*daemons.GetTransaction, *daemons.JsonRpcError) {
+		return nil, &daemons.JsonRpcError{Code: -5, Message: "Invalid or non-wallet transaction id"}
+	}
+	if err := h.pm.processPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pb := (&storage.PendingBlock{Hash: "blk403", TxHash: "tx403", Height: 403, Finder: "minerA"}).String()
+	if ok, _ := h.mr.SIsMember("TEST:blocks:orphaned", pb); !ok {
+		t.Error("the orphaned block must move to the orphaned set")
+	}
+}
+
 // --- fork configurability ---
 
 func TestForkConfig_ValidateAddressAndNoDummy(t *testing.T) {
@@ -551,7 +1296,7 @@ func TestForkConfig_ValidateAddressAndNoDummy(t *testing.T) {
 		AddressCheckMethod: "validateaddress",
 		OmitSendManyDummy:  true, // fork whose sendmany drops the leading arg
 	})
-	if err := h.pm.Init(); err != nil {
+	if err := h.pm.Init(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	if h.wallet.AddrMethod != "validateaddress" {
@@ -565,7 +1310,7 @@ func TestForkConfig_ValidateAddressAndNoDummy(t *testing.T) {
 		}
 		return "txid", nil
 	}
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	if len(h.wallet.SentBatches) != 1 {
@@ -587,7 +1332,7 @@ func TestPaymentOptionsDefaults(t *testing.T) {
 // not pay every retained share across earlier rounds.
 func TestPayout_PPLNSZeroWindowFallsBackToRound(t *testing.T) {
 	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, PayMode: "pplns", PPLNSWindow: 0})
-	if err := h.pm.Init(); err != nil {
+	if err := h.pm.Init(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	// round 500 contains only minerA; the pplns log additionally holds minerB from
@@ -606,7 +1351,7 @@ func TestPayout_PPLNSZeroWindowFallsBackToRound(t *testing.T) {
 		}
 		return "txid", nil
 	}
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -616,7 +1361,7 @@ func TestPayout_PPLNSZeroWindowFallsBackToRound(t *testing.T) {
 func TestPayout_InvalidAddressSkipped(t *testing.T) {
 	h := newHarness(t, &config.PaymentOptions{MinPayment: 0, MinConfirmations: 100})
 	h.wallet.badAddr = map[string]bool{"minerBad": true}
-	if err := h.pm.Init(); err != nil {
+	if err := h.pm.Init(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	h.seedRound(600, "tx600", map[string]float64{"minerGood": 30, "minerBad": 70})
@@ -630,7 +1375,7 @@ func TestPayout_InvalidAddressSkipped(t *testing.T) {
 		}
 		return "txid", nil
 	}
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	if v := h.mr.HGet("TEST:balances", "minerBad"); v != "70" {
@@ -650,7 +1395,7 @@ func TestPayout_UsesConfiguredDaemonIndex(t *testing.T) {
 	t.Cleanup(mr.Close)
 	host, portStr := splitHostPort(mr.Addr())
 	port, _ := strconv.Atoi(portStr)
-	db := storage.NewStorage("TEST", &config.RedisOptions{Network: "tcp", Host: host, Port: port})
+	db := storage.NewRedisDB("TEST", &config.RedisOptions{Network: "tcp", Host: host, Port: port})
 
 	// daemon 0 is a mining node that has no wallet; every wallet RPC errors there.
 	mining := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
@@ -673,13 +1418,13 @@ func TestPayout_UsesConfiguredDaemonIndex(t *testing.T) {
 	pm := NewPaymentManager(&config.PaymentOptions{MinPayment: 0, MinConfirmations: 100, Daemon: 1}, &config.Recipient{Address: poolAddr, Type: "p2pkh"}, dm, db)
 	h := &harness{pm: pm, db: db, wallet: w, mr: mr}
 
-	if err := h.pm.Init(); err != nil {
+	if err := h.pm.Init(context.Background()); err != nil {
 		t.Fatalf("Init must reach the wallet at daemon index 1: %v", err)
 	}
 	h.seedRound(700, "tx700", map[string]float64{"minerA": 100})
 	h.wallet.gettx = generateTx(120, 50.0)
 	h.wallet.sendmany = func(_ bool, _ map[string]float64) (string, *daemons.JsonRpcError) { return "txid", nil }
-	if err := h.pm.processPayments(); err != nil {
+	if err := h.pm.processPayments(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	if len(h.wallet.SentBatches) != 1 {
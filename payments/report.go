@@ -0,0 +1,191 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mining-pool/not-only-mining-pool/storage"
+)
+
+// Plan is what the next payout run would do, as DryRun works it out.
+type Plan struct {
+	PayMode string
+	// Intent is the unfinished payout the run would resolve first, "" when
+	// there is none; the plan below assumes it resolves cleanly.
+	Intent string
+
+	Confirmed []string // pending blocks settled as mature
+	Orphaned  []string // pending blocks orphaned
+	Miners    []MinerPlan
+
+	Credited     float64 // rewards credited this run
+	Paid         float64 // sent this run
+	Owed         float64 // carried over after it
+	Transactions int     // sendmany calls, at most maxOutputs payees each
+}
+
+// MinerPlan is one miner's part of a Plan, in coin.
+type MinerPlan struct {
+	Miner   string
+	Balance float64 // carried into the run
+	Reward  float64 // credited this run
+	Pay     float64 // sent this run
+	Owed    float64 // carried over after it
+	Held    bool    // owed but held back by the miner's daily schedule
+}
+
+// DryRun works out the next payout run from real storage and daemon state —
+// classification, attribution and the miners' settings — without writing to
+// storage or sending from the wallet. The fee withheld when the wallet can't
+// cover sendmany's fee is not foreseen.
+func (pm *PaymentManager) DryRun(ctx context.Context) (*Plan, error) {
+	plan := &Plan{PayMode: pm.options.PayMode}
+	update, txid, exists, err := pm.db.GetPayoutIntent()
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if txid != "" {
+			plan.Intent = fmt.Sprintf("payout %s was sent but not applied; the run applies it (paid %v)", txid, update.Paid)
+		} else {
+			plan.Intent = fmt.Sprintf("a payout may have been sent without its txid; the run halts until it is cleared (paid %v)", update.Paid)
+		}
+	}
+
+	workers, update, pay, err := pm.planRun(ctx, time.Now())
+	if err != nil || update == nil {
+		return plan, err
+	}
+	plan.Confirmed, plan.Orphaned = update.Confirmed, update.Orphaned
+	if !pay {
+		return plan, nil
+	}
+
+	var payees int
+	var credited, sent, carried uint64
+	for _, w := range workers {
+		owed := w.Balance + w.Reward
+		if owed == 0 {
+			continue
+		}
+		mp := MinerPlan{Miner: w.Address, Balance: pm.SatToCoin(w.Balance), Reward: pm.SatToCoin(w.Reward), Held: w.Held}
+		if pm.payable(ctx, w, owed) {
+			mp.Pay = pm.SatToCoin(owed)
+			sent += owed
+			payees++
+		} else {
+			mp.Owed = pm.SatToCoin(owed)
+			carried += owed
+		}
+		credited += w.Reward
+		plan.Miners = append(plan.Miners, mp)
+	}
+	plan.Credited, plan.Paid, plan.Owed = pm.SatToCoin(credited), pm.SatToCoin(sent), pm.SatToCoin(carried)
+	sort.Slice(plan.Miners, func(i, j int) bool { return plan.Miners[i].Miner < plan.Miners[j].Miner })
+	plan.Transactions = (payees + pm.options.MaxOutputs - 1) / pm.options.MaxOutputs
+	return plan, nil
+}
+
+// Audit reconciles the pool's accounting with the chain and the wallet, in
+// coin.
+type Audit struct {
+	Balances float64 // owed to miners
+	Paid     float64 // paid to miners, ever
+	Rewards  float64 // credited to the pool address by the confirmed blocks, or paid in their coinbases
+	Blocks   int     // confirmed blocks counted in Rewards
+	Wallet   float64 // the payment wallet's spendable balance
+
+	// Retained is what the pool kept of the rewards: Rewards - Balances - Paid,
+	// rounding dust and coinbase remainders. Negative means miners were
+	// credited more than the blocks paid; in the per-share modes it is the
+	// pool's luck instead.
+	Retained float64
+	// Shortfall is how much more the wallet needs to pay every balance, 0 when
+	// it can.
+	Shortfall float64
+
+	Unknown []string // confirmed blocks the wallet can't tell the reward of
+	Reorged []string // confirmed blocks no longer on the chain
+}
+
+// Audit sums balances and payouts and checks them against the rewards of the
+// confirmed blocks and the payment wallet's balance. Nothing is written.
+func (pm *PaymentManager) Audit(ctx context.Context) (*Audit, error) {
+	// summed in satoshis, so the totals carry no float dust
+	a := &Audit{}
+	var owed, paidOut, rewards uint64
+	balances, err := pm.db.GetAllMinerBalances()
+	if err != nil {
+		return nil, err
+	}
+	for _, bal := range balances {
+		owed += pm.CoinToSat(bal)
+	}
+	paid, err := pm.db.GetAllMinerPaid()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paid {
+		paidOut += pm.CoinToSat(p)
+	}
+
+	confirmed, err := pm.db.GetConfirmedBlocks()
+	if err != nil {
+		return nil, err
+	}
+	for _, pb := range confirmed {
+		reward, category, _, ok := pm.classifyBlock(ctx, pb)
+		switch {
+		case !ok:
+			a.Unknown = append(a.Unknown, pb.String())
+		case category == string(storage.Orphan) || category == string(storage.Kicked):
+			a.Reorged = append(a.Reorged, pb.String())
+		default:
+			rewards += pm.CoinToSat(reward)
+			a.Blocks++
+			// the miners its coinbase paid are in Paid too
+			coinbase, err := pm.db.GetPayout(pb.TxHash)
+			if err != nil {
+				return nil, err
+			}
+			if coinbase != nil {
+				for _, amount := range coinbase.Amounts {
+					rewards += pm.CoinToSat(amount)
+				}
+			}
+		}
+	}
+
+	if a.Wallet, err = pm.walletBalance(ctx); err != nil {
+		return nil, err
+	}
+
+	a.Balances, a.Paid, a.Rewards = pm.SatToCoin(owed), pm.SatToCoin(paidOut), pm.SatToCoin(rewards)
+	a.Retained = float64(int64(rewards)-int64(owed)-int64(paidOut)) / pm.Magnitude
+	if wallet := pm.CoinToSat(a.Wallet); wallet < owed {
+		a.Shortfall = pm.SatToCoin(owed - wallet)
+	}
+	return a, nil
+}
+
+// walletBalance is what the payment wallet, or the pool's account, can spend.
+func (pm *PaymentManager) walletBalance(ctx context.Context) (float64, error) {
+	if pm.account != nil {
+		return pm.accountBalance(ctx)
+	}
+	instance, result := pm.cmd(ctx, "getbalance", []interface{}{})
+	if result == nil {
+		return 0, fmt.Errorf("no response from payment daemon on getbalance")
+	}
+	if result.Error != nil {
+		return 0, fmt.Errorf("payment daemon %s: %s", instance.String(), result.Error.Message)
+	}
+	var balance float64
+	if err := json.Unmarshal(result.Result, &balance); err != nil {
+		return 0, fmt.Errorf("getbalance: %w", err)
+	}
+	return balance, nil
+}
@@ -0,0 +1,48 @@
+package payments
+
+import (
+	"time"
+)
+
+// applySettings loads each miner's own payout settings into workers: a
+// threshold above the pool's minPayment, and a daily schedule that holds the
+// payout until the miner's hour has come round since they were last paid.
+func (pm *PaymentManager) applySettings(workers map[string]*worker, now time.Time) error {
+	settings, err := pm.db.GetAllMinerSettings()
+	if err != nil {
+		return err
+	}
+	for _, w := range workers {
+		w.MinPayment, w.Held = pm.MinPayment, false
+		s := settings[w.Address]
+		if s == nil {
+			continue
+		}
+		if min := pm.CoinToSat(s.MinPayment); min > w.MinPayment {
+			w.MinPayment = min
+		}
+		if s.DailyAt != nil {
+			due, err := pm.dailyDue(w.Address, *s.DailyAt, now)
+			if err != nil {
+				return err
+			}
+			w.Held = !due
+		}
+	}
+	return nil
+}
+
+// dailyDue reports whether a miner paid daily at hour (UTC) is due a payout
+// at now: they haven't been paid since the hour last came round.
+func (pm *PaymentManager) dailyDue(miner string, hour int, now time.Time) (bool, error) {
+	now = now.UTC()
+	last := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.UTC)
+	if last.After(now) {
+		last = last.AddDate(0, 0, -1)
+	}
+	payouts, err := pm.db.GetMinerPayouts(miner, 1)
+	if err != nil {
+		return false, err
+	}
+	return len(payouts) == 0 || payouts[0].Time < last.Unix(), nil
+}
@@ -0,0 +1,57 @@
+package payments
+
+import (
+	"math"
+
+	"github.com/mining-pool/not-only-mining-pool/storage"
+)
+
+// scoreHorizon is how many scoreDecay time constants a score walk looks back:
+// older shares weigh less than e^-10 of the block's own.
+const scoreHorizon = 10
+
+// timedShares walks the log of a block's share group back from its mark,
+// weighting each share by its age relative to the share at the mark. The walk ends where
+// weight returns false or at a share logged without a time. ok is false when
+// the mark's own share has no time: the block predates timed logs.
+func (pm *PaymentManager) timedShares(pb *storage.PendingBlock, weight func(diff float64, age int64) (float64, bool)) (shares map[string]float64, ok bool, err error) {
+	shares = make(map[string]float64)
+	var end int64
+	err = pm.db.WalkShareLog(pb.PayMode, pb.Mark, func(ls *storage.LoggedShare) bool {
+		if ls.Time == 0 {
+			return false
+		}
+		if end == 0 {
+			end, ok = ls.Time, true
+		}
+		age := end - ls.Time
+		if age < 0 {
+			age = 0
+		}
+		w, more := weight(ls.Diff, age)
+		if !more {
+			return false
+		}
+		shares[ls.Miner] += w
+		return true
+	})
+	return shares, ok, err
+}
+
+// pplntShares sums the difficulty of the shares logged in the pplntWindow
+// seconds up to the block.
+func (pm *PaymentManager) pplntShares(pb *storage.PendingBlock) (map[string]float64, bool, error) {
+	return pm.timedShares(pb, func(diff float64, age int64) (float64, bool) {
+		return diff, age < pm.options.PPLNTWindow
+	})
+}
+
+// scoreShares sums share scores, each share's difficulty decayed by
+// e^(-age/scoreDecay), so a miner who stops mining before the block loses most
+// of their claim within a few time constants.
+func (pm *PaymentManager) scoreShares(pb *storage.PendingBlock) (map[string]float64, bool, error) {
+	decay := pm.options.ScoreDecay
+	return pm.timedShares(pb, func(diff float64, age int64) (float64, bool) {
+		return diff * math.Exp(-float64(age)/decay), float64(age) <= scoreHorizon*decay
+	})
+}
@@ -2,6 +2,7 @@ package pool
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
@@ -30,7 +31,7 @@ var log = logging.Logger("pool")
 type Pool struct {
 	DaemonManager *daemons.DaemonManager
 	JobManager    *jobs.JobManager
-	P2PManager    *p2p.Peer
+	P2PManager    *p2p.Manager
 
 	StratumServer *stratum.Server
 
@@ -60,9 +61,7 @@ func NewEnginePool(options *config.Options) *Pool {
 		log.Panicf("engine %q is not registered; build with the matching build tag (e.g. -tags ethash) to include it. Registered engines: %v", options.Engine, engine.Registered())
 	}
 
-	if err := eng.Init(options); err != nil {
-		log.Fatal("engine init failed: ", err)
-	}
+	options.BindAddressNetworks()
 
 	db := storage.NewStorage(options.Coin.Name, options.Storage)
 	bm := bans.NewBanningManager(options.Banning)
@@ -73,14 +72,20 @@ func NewEnginePool(options *config.Options) *Pool {
 	ss.DB = db // engine-mode share persistence (stats/accounting)
 
 	// Payout is available to bitcoin-family engine coins (e.g. Ravencoin/kawpow),
-	// whose shares carry a coinbase txid the payment processor can attribute.
-	// Non-bitcoin engines leave payments disabled; enabling one there fails fast
-	// in PaymentManager.Init when the wallet RPCs are unavailable.
+	// whose shares carry a coinbase txid the payment processor can attribute,
+	// and to account-model coins whose engine prices their blocks (ethash),
+	// paid by transfers from the pool's account. Other engines leave payments
+	// disabled; enabling one there fails fast in PaymentManager.Init when the
+	// wallet RPCs are unavailable.
 	var dm *daemons.DaemonManager
 	var pm *payments.PaymentManager
 	if !options.DisablePayment && options.PaymentOptions != nil {
-		dm = daemons.NewDaemonManager(options.Daemons, options.Coin)
-		pm = payments.NewPaymentManager(options.PaymentOptions, options.PoolAddress, dm, db)
+		if rewards, ok := eng.(payments.AccountRewards); ok {
+			pm = payments.NewAccountPaymentManager(options.PaymentOptions, options.PoolAddress, options.Daemons, rewards, db)
+		} else {
+			dm = daemons.NewDaemonManager(options.Daemons, options.Coin)
+			pm = payments.NewPaymentManager(options.PaymentOptions, options.PoolAddress, dm, db)
+		}
 	}
 
 	return &Pool{
@@ -115,7 +120,9 @@ func NewPool(options *config.Options) *Pool {
 
 	dm := daemons.NewDaemonManager(options.Daemons, options.Coin)
 	dm.Check()
+	dm.StartHealthCheck(nil)
 
+	options.BindAddressNetworks()
 	if options.PoolAddress.GetScript() == nil {
 		log.Panicf("failed to get poolAddress' script, check the address and type")
 	}
@@ -128,7 +135,7 @@ func NewPool(options *config.Options) *Pool {
 
 	var magnitude int64 = 100000000 //sat
 	if !options.DisablePayment {
-		_, getBalance, _ := dm.Cmd("getbalance", []interface{}{})
+		_, getBalance := dm.Cmd("getbalance", []interface{}{})
 
 		if getBalance.Error != nil {
 			log.Fatal(errors.New(fmt.Sprint(getBalance.Error)))
@@ -151,7 +158,9 @@ func NewPool(options *config.Options) *Pool {
 	jm := jobs.NewJobManager(options, dm, db)
 	bm := bans.NewBanningManager(options.Banning)
 	s := api.NewAPIServer(options, db)
+	s.SetDaemonManager(dm)
 	pm := payments.NewPaymentManager(options.PaymentOptions, options.PoolAddress, dm, db)
+	pm.PricedShares = true // the job manager prices each share for fpps and pps+
 
 	return &Pool{
 		Options:        options,
@@ -167,14 +176,19 @@ func NewPool(options *config.Options) *Pool {
 	}
 }
 
-func (p *Pool) Init() {
+// Init starts the pool. ctx is its lifetime: node calls and subscriptions end
+// once it is cancelled.
+func (p *Pool) Init(ctx context.Context) {
 	if p.Engine != nil {
-		// Engine-driven pool: the engine already fetched its first work in
-		// NewEnginePool; just serve stratum + API (no GBT/p2p machinery). Payout
-		// runs only for bitcoin-family engine coins that enabled it.
-		p.StartStratumServer()
+		// Engine-driven pool: the engine fetches its first work, then just serve
+		// stratum + API (no GBT/p2p machinery). Payout runs only for
+		// bitcoin-family engine coins that enabled it.
+		if err := p.Engine.Init(ctx, p.Options); err != nil {
+			log.Fatal("engine init failed: ", err)
+		}
+		p.StartStratumServer(ctx)
 		p.APIServer.Serve()
-		p.startPaymentsIfEnabled()
+		p.startPaymentsIfEnabled(ctx)
 		log.Warnf("Stratum Pool Server Started for %s [%s] using the %q engine, serving ports %v",
 			p.Options.Coin.Name, strings.ToUpper(p.Options.Coin.Symbol), p.Engine.Name(), p.Stats.StratumPorts)
 		return
@@ -183,7 +197,7 @@ func (p *Pool) Init() {
 	p.CheckAllReady()
 	p.DetectCoinData()
 
-	initGBT, err := p.DaemonManager.GetBlockTemplate()
+	initGBT, err := p.DaemonManager.GetBlockTemplateContext(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -193,10 +207,10 @@ func (p *Pool) Init() {
 
 	p.JobManager.Init(initGBT)
 
-	p.StartStratumServer()
+	p.StartStratumServer(ctx)
 	p.APIServer.Serve()
 
-	p.startPaymentsIfEnabled()
+	p.startPaymentsIfEnabled(ctx)
 
 	p.OutputPoolInfo()
 }
@@ -204,14 +218,14 @@ func (p *Pool) Init() {
 // startPaymentsIfEnabled initializes and serves the payout processor when
 // payments are configured. It is a no-op otherwise, and fatal if the wallet
 // cannot be validated (e.g. payments enabled on a non-bitcoin-family coin).
-func (p *Pool) startPaymentsIfEnabled() {
+func (p *Pool) startPaymentsIfEnabled(ctx context.Context) {
 	if p.Options.DisablePayment || p.Options.PaymentOptions == nil {
 		return
 	}
-	if err := p.PaymentManager.Init(); err != nil {
+	if err := p.PaymentManager.Init(ctx); err != nil {
 		log.Fatal("payment processing init failed: ", err)
 	}
-	go p.PaymentManager.Serve()
+	go p.PaymentManager.Serve(ctx)
 }
 
 func (p *Pool) SetupP2PBlockNotify() {
@@ -219,21 +233,18 @@ func (p *Pool) SetupP2PBlockNotify() {
 		return
 	}
 
-	p.P2PManager = p2p.NewPeer(p.ProtocolVersion, p.Options.P2P)
-	p.Init()
+	p.P2PManager = p2p.NewManager(p.ProtocolVersion, p.Options.P2P, p.JobManager.BlockHasher())
+	p.P2PManager.Init()
+	p.JobManager.BlockRelay = p.P2PManager.RelayBlock
 
 	go func() {
-		for {
-			blockHash, ok := <-p.P2PManager.BlockNotifyCh
-			if !ok {
-				log.Warn("Block notify is stopped!")
-				return
-			}
-
+		// peers reconnect on their own, so the channel is never closed
+		for blockHash := range p.P2PManager.BlockNotifyCh {
 			if p.JobManager.CurrentJob != nil && blockHash != p.JobManager.CurrentJob.GetBlockTemplate.PreviousBlockHash {
 				gbt, err := p.DaemonManager.GetBlockTemplate()
 				if err != nil {
 					log.Error("p2p block notify failed getting block template: ", err)
+					continue
 				}
 				p.JobManager.ProcessTemplate(gbt)
 			}
@@ -249,8 +260,8 @@ func (p *Pool) AttachMiners(miners []*stratum.Client) {
 	p.StratumServer.BroadcastCurrentMiningJob(p.JobManager.CurrentJob.GetJobParams(true))
 }
 
-func (p *Pool) StartStratumServer() {
-	portStarted := p.StratumServer.Init()
+func (p *Pool) StartStratumServer(ctx context.Context) {
+	portStarted := p.StratumServer.Init(ctx)
 	p.Stats.StratumPorts = portStarted
 }
 
@@ -259,8 +270,8 @@ func (p *Pool) DetectCoinData() {
 	var diff float64
 
 	// getdifficulty
-	_, rpcResponse, _ := p.DaemonManager.Cmd("getdifficulty", []interface{}{})
-	if rpcResponse.Error != nil || rpcResponse == nil {
+	_, rpcResponse := p.DaemonManager.Cmd("getdifficulty", []interface{}{})
+	if rpcResponse == nil || rpcResponse.Error != nil {
 		log.Error("Could not start pool, error with init batch RPC call: " + string(utils.Jsonify(rpcResponse)))
 		return
 	}
@@ -283,15 +294,15 @@ func (p *Pool) DetectCoinData() {
 	}
 
 	// getmininginfo
-	_, rpcResponse, _ = p.DaemonManager.Cmd("getmininginfo", []interface{}{})
-	if rpcResponse.Error != nil || rpcResponse == nil {
+	_, rpcResponse = p.DaemonManager.Cmd("getmininginfo", []interface{}{})
+	if rpcResponse == nil || rpcResponse.Error != nil {
 		log.Error("Could not start pool, error with init batch RPC call: " + string(utils.Jsonify(rpcResponse)))
 		return
 	}
 	getMiningInfo := daemons.BytesToGetMiningInfo(rpcResponse.Result)
 	p.Stats.NetworkHashrate = getMiningInfo.Networkhashps
 
-	_, rpcResponse, _ = p.DaemonManager.Cmd("submitblock", []interface{}{})
+	_, rpcResponse = p.DaemonManager.Cmd("submitblock", []interface{}{})
 	if rpcResponse == nil || rpcResponse.Error == nil {
 		log.Error("Could not start pool, error with init batch RPC call: " + utils.JsonifyIndentString(rpcResponse))
 		return
@@ -305,14 +316,14 @@ func (p *Pool) DetectCoinData() {
 		log.Fatal("Could not detect block submission RPC method, " + utils.JsonifyIndentString(rpcResponse))
 	}
 
-	_, rpcResponse, _ = p.DaemonManager.Cmd("getwalletinfo", []interface{}{})
-	if rpcResponse.Error != nil || rpcResponse == nil {
+	_, rpcResponse = p.DaemonManager.Cmd("getwalletinfo", []interface{}{})
+	if rpcResponse == nil || rpcResponse.Error != nil {
 		log.Error("Could not start pool, error with init batch RPC call: " + string(utils.Jsonify(rpcResponse)))
 		return
 	}
 
-	_, rpcResponse, _ = p.DaemonManager.Cmd("getinfo", []interface{}{})
-	if rpcResponse.Error == nil && rpcResponse != nil {
+	_, rpcResponse = p.DaemonManager.Cmd("getinfo", []interface{}{})
+	if rpcResponse != nil && rpcResponse.Error == nil {
 		getInfo := daemons.BytesToGetInfo(rpcResponse.Result)
 
 		p.Options.Coin.Testnet = getInfo.Testnet
@@ -321,15 +332,15 @@ func (p *Pool) DetectCoinData() {
 
 		p.Stats.Connections = getInfo.Connections
 	} else {
-		_, rpcResponse, _ := p.DaemonManager.Cmd("getnetworkinfo", []interface{}{})
-		if rpcResponse.Error != nil || rpcResponse == nil {
+		_, rpcResponse := p.DaemonManager.Cmd("getnetworkinfo", []interface{}{})
+		if rpcResponse == nil || rpcResponse.Error != nil {
 			log.Error("Could not start pool, error with init batch RPC call: " + string(utils.Jsonify(rpcResponse)))
 			return
 		}
 		getNetworkInfo := daemons.BytesToGetNetworkInfo(rpcResponse.Result)
 
-		_, rpcResponse, _ = p.DaemonManager.Cmd("getblockchaininfo", []interface{}{})
-		if rpcResponse.Error != nil || rpcResponse == nil {
+		_, rpcResponse = p.DaemonManager.Cmd("getblockchaininfo", []interface{}{})
+		if rpcResponse == nil || rpcResponse.Error != nil {
 			log.Error("Could not start pool, error with init batch RPC call: " + string(utils.Jsonify(rpcResponse)))
 			return
 		}
@@ -341,6 +352,12 @@ func (p *Pool) DetectCoinData() {
 		p.Stats.Connections = getNetworkInfo.Connections
 	}
 
+	// an "auto" address already proved it belongs to the coin; still flag a
+	// mainnet address on a test chain and vice versa
+	if n := p.Options.PoolAddress.Network(); n != "" && (n == "mainnet") == p.Options.Coin.Testnet {
+		log.Warnf("poolAddress %s is a %s address but the daemon reports testnet=%v", p.Options.PoolAddress.Address, n, p.Options.Coin.Testnet)
+	}
+
 	mul := 1 << p.Options.Algorithm.Multiplier
 	p.Stats.Difficulty = diff * float64(mul)
 }
@@ -379,15 +396,22 @@ func (p *Pool) CheckAllReady() {
 	if p.Options.Coin.GBTRules != nil {
 		rules = p.Options.Coin.GBTRules
 	}
-	_, results := p.DaemonManager.CmdAll("getblocktemplate", []interface{}{map[string]interface{}{"capabilities": []string{"coinbasetxn", "workid", "coinbase/append"}, "rules": rules}})
+	results := p.DaemonManager.CmdAll("getblocktemplate", []interface{}{map[string]interface{}{"capabilities": []string{"coinbasetxn", "workid", "coinbase/append"}, "rules": rules}})
+	ready := 0
 	for i := range results {
-		if results[i] == nil {
-			log.Fatalf("daemon %s is not available", p.DaemonManager.Daemons[i])
+		switch {
+		case results[i] == nil:
+			log.Warnf("daemon %s is not available", p.DaemonManager.Daemons[i])
+		case results[i].Error != nil:
+			log.Warnf("daemon %s is not ready for mining: %s", p.DaemonManager.Daemons[i], results[i].Error.Message)
+		default:
+			ready++
 		}
+	}
 
-		if results[i].Error != nil {
-			log.Fatalf("daemon %s is not ready for mining: %s", p.DaemonManager.Daemons[i], results[i].Error.Message)
-		}
+	// work fails over to the ready daemons; the others rejoin once healthy
+	if ready == 0 {
+		log.Fatal("no daemon is ready for mining")
 	}
 }
 
@@ -0,0 +1,353 @@
+// Package rpc is the HTTP JSON-RPC client shared by the DaemonManager and the
+// engines, so contexts and deadlines, retries, batching, the 1.0/2.0
+// envelopes, cookie auth, connection reuse and metrics behave the same for
+// every node the pool talks to.
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Version selects the request envelope.
+type Version string
+
+const (
+	// V1 is bitcoind style: no "jsonrpc" member, null result/error both present.
+	V1 Version = "1.0"
+	// V2 adds "jsonrpc":"2.0", as geth, monerod and most newer nodes expect.
+	V2 Version = "2.0"
+)
+
+// DefaultTimeout bounds a request whose context has no earlier deadline.
+const DefaultTimeout = 30 * time.Second
+
+// Authenticator adds credentials to requests. config.DaemonOptions implements
+// it with basic auth or a cookie file re-read after a 401.
+type Authenticator interface {
+	SetAuth(req *http.Request) error
+	// ReloadCookie refreshes rotated credentials and reports whether they
+	// changed, i.e. whether retrying a 401 can help.
+	ReloadCookie() bool
+}
+
+// Options configure a Client.
+type Options struct {
+	URL     string
+	Version Version       // "" = V1
+	Timeout time.Duration // per attempt; 0 = DefaultTimeout
+	// Retries is how many more attempts a transport failure or timeout gets.
+	// Leave it 0 for calls that must not run twice, like sendmany.
+	Retries int
+	// Retryable, when set, limits Retries to the JSON-RPC methods it reports
+	// true for; the others are sent once. A batch is retried only if all of
+	// its methods are.
+	Retryable func(method string) bool
+	Auth      Authenticator // nil = no auth
+	Header    http.Header   // extra headers, e.g. an API key
+	TLS       *tls.Config
+}
+
+// Request is one call of a batch.
+type Request struct {
+	Method string
+	Params interface{}
+}
+
+// Response is a decoded JSON-RPC answer. An RPC-level failure is in Error,
+// not in the error returned alongside.
+type Response struct {
+	ID     json.RawMessage `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// Error is a JSON-RPC error object.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message) }
+
+// HTTPError is a non-2xx answer whose body is not a JSON-RPC response.
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string { return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body) }
+
+// Stats are a Client's counters since it was created.
+type Stats struct {
+	Requests  uint64  `json:"requests"`  // HTTP attempts, retries included
+	Failures  uint64  `json:"failures"`  // transport, HTTP and decode failures
+	Timeouts  uint64  `json:"timeouts"`  // failures that were deadlines
+	RPCErrors uint64  `json:"rpcErrors"` // answers carrying an error object
+	LatencyMs float64 `json:"latencyMs"` // mean round trip of answered attempts
+}
+
+// Client talks to one endpoint. It is safe for concurrent use and keeps its
+// connections alive between calls.
+type Client struct {
+	opts Options
+	http *http.Client
+	id   int64
+
+	requests, failures, timeouts, rpcErrors, answered, latencyNs uint64
+}
+
+func NewClient(opts Options) *Client {
+	if opts.Version == "" {
+		opts.Version = V1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 16 // concurrent CmdAll/submit bursts reuse connections
+	if opts.TLS != nil {
+		transport.TLSClientConfig = opts.TLS
+	}
+
+	return &Client{opts: opts, http: &http.Client{Transport: transport}}
+}
+
+// URL is the endpoint the client posts to.
+func (c *Client) URL() string { return c.opts.URL }
+
+// Stats returns a snapshot of the client's counters.
+func (c *Client) Stats() Stats {
+	s := Stats{
+		Requests:  atomic.LoadUint64(&c.requests),
+		Failures:  atomic.LoadUint64(&c.failures),
+		Timeouts:  atomic.LoadUint64(&c.timeouts),
+		RPCErrors: atomic.LoadUint64(&c.rpcErrors),
+	}
+	if n := atomic.LoadUint64(&c.answered); n > 0 {
+		s.LatencyMs = float64(atomic.LoadUint64(&c.latencyNs)) / float64(n) / float64(time.Millisecond)
+	}
+	return s
+}
+
+func (c *Client) envelope(method string, params interface{}) map[string]interface{} {
+	if params == nil {
+		params = []interface{}{}
+	}
+	msg := map[string]interface{}{
+		"id":     atomic.AddInt64(&c.id, 1),
+		"method": method,
+		"params": params,
+	}
+	if c.opts.Version == V2 {
+		msg["jsonrpc"] = "2.0"
+	}
+	return msg
+}
+
+// CallRaw sends one request and returns the decoded response, RPC errors
+// included. The error is set only when no JSON-RPC answer was received.
+func (c *Client) CallRaw(ctx context.Context, method string, params interface{}) (*Response, error) {
+	body, err := json.Marshal(c.envelope(method, params))
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := c.post(ctx, http.MethodPost, "", body, c.retries(method))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", method, err)
+	}
+
+	var res Response
+	if err := json.Unmarshal(raw, &res); err != nil {
+		atomic.AddUint64(&c.failures, 1)
+		return nil, fmt.Errorf("decode %s response: %w (body: %s)", method, err, raw)
+	}
+	if res.Error != nil {
+		atomic.AddUint64(&c.rpcErrors, 1)
+	}
+	return &res, nil
+}
+
+// Call sends one request and decodes its result into result (skipped when
+// nil). An RPC error is returned as *Error.
+func (c *Client) Call(ctx context.Context, method string, params, result interface{}) error {
+	res, err := c.CallRaw(ctx, method, params)
+	if err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(res.Result, result)
+}
+
+// Batch sends reqs in one HTTP request and returns their responses in the
+// same order, matched by id. A request the node left unanswered gets a nil
+// response.
+func (c *Client) Batch(ctx context.Context, reqs []Request) ([]*Response, error) {
+	batch := make([]map[string]interface{}, len(reqs))
+	for i, r := range reqs {
+		batch[i] = c.envelope(r.Method, r.Params)
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	retries := c.opts.Retries
+	for _, r := range reqs {
+		retries = min(retries, c.retries(r.Method))
+	}
+	raw, err := c.post(ctx, http.MethodPost, "", body, retries)
+	if err != nil {
+		return nil, fmt.Errorf("batch: %w", err)
+	}
+
+	var answers []*Response
+	if err := json.Unmarshal(raw, &answers); err != nil {
+		atomic.AddUint64(&c.failures, 1)
+		return nil, fmt.Errorf("decode batch response: %w (body: %s)", err, raw)
+	}
+
+	byID := make(map[string]*Response, len(answers))
+	for _, a := range answers {
+		if a == nil {
+			continue
+		}
+		byID[string(a.ID)] = a
+		if a.Error != nil {
+			atomic.AddUint64(&c.rpcErrors, 1)
+		}
+	}
+	out := make([]*Response, len(reqs))
+	for i := range reqs {
+		id, _ := json.Marshal(batch[i]["id"])
+		out[i] = byID[string(id)]
+	}
+	return out, nil
+}
+
+// REST sends a plain HTTP request to path under the client's URL with the
+// same auth, headers, deadlines, retries and metrics as the JSON-RPC calls,
+// for nodes with REST mining APIs (e.g. Ergo). body and result are JSON; nil
+// skips them.
+func (c *Client) REST(ctx context.Context, method, path string, body, result interface{}) error {
+	var raw []byte
+	if body != nil {
+		var err error
+		if raw, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	answer, err := c.post(ctx, method, path, raw, c.opts.Retries)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(answer, result)
+}
+
+// retries is how many more attempts a call of the JSON-RPC method gets.
+func (c *Client) retries(method string) int {
+	if c.opts.Retryable != nil && !c.opts.Retryable(method) {
+		return 0
+	}
+	return c.opts.Retries
+}
+
+// post runs the request with up to retries more attempts and returns the body
+// of an answer that is either 2xx or looks like JSON (bitcoind reports RPC
+// errors with 500).
+func (c *Client) post(ctx context.Context, method, path string, body []byte, retries int) ([]byte, error) {
+	var err error
+	for attempt := 0; ; attempt++ {
+		var raw []byte
+		raw, err = c.attempt(ctx, method, path, body)
+		if err == nil {
+			return raw, nil
+		}
+
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) || attempt >= retries || ctx.Err() != nil {
+			return nil, err // the node answered, or we are out of attempts or time
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(time.Duration(attempt+1) * 100 * time.Millisecond):
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := c.send(ctx, method, path, body)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && c.opts.Auth != nil && c.opts.Auth.ReloadCookie() {
+		_ = resp.Body.Close()
+		resp, err = c.send(ctx, method, path, body) // the node restarted and rotated its cookie
+	}
+	if err != nil {
+		atomic.AddUint64(&c.failures, 1)
+		if errors.Is(err, context.DeadlineExceeded) {
+			atomic.AddUint64(&c.timeouts, 1)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		atomic.AddUint64(&c.failures, 1)
+		return nil, err
+	}
+	atomic.AddUint64(&c.answered, 1)
+	atomic.AddUint64(&c.latencyNs, uint64(time.Since(start)))
+
+	if resp.StatusCode/100 != 2 && (path != "" || !json.Valid(raw)) {
+		atomic.AddUint64(&c.failures, 1)
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Body: string(bytes.TrimSpace(raw))}
+	}
+	return raw, nil
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	atomic.AddUint64(&c.requests, 1)
+
+	req, err := http.NewRequestWithContext(ctx, method, c.opts.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, vs := range c.opts.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if c.opts.Auth != nil {
+		if err := c.opts.Auth.SetAuth(req); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.http.Do(req)
+}
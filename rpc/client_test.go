@@ -0,0 +1,177 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type wireRequest struct {
+	JSONRPC *string         `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// echoNode answers every call with its method name, "fail" with an RPC error
+// (as bitcoind does, with HTTP 500) and "slow" after a delay. Batches are
+// answered in reverse to check id matching.
+func echoNode(t *testing.T, seen chan<- wireRequest) *httptest.Server {
+	t.Helper()
+	answer := func(req wireRequest) map[string]interface{} {
+		if seen != nil {
+			seen <- req
+		}
+		if req.Method == "fail" {
+			return map[string]interface{}{"id": req.ID, "result": nil, "error": map[string]interface{}{"code": -8, "message": "bad params"}}
+		}
+		return map[string]interface{}{"id": req.ID, "result": req.Method, "error": nil}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		var batch []wireRequest
+		if json.Unmarshal(body, &batch) == nil {
+			out := make([]map[string]interface{}, len(batch))
+			for i := range batch {
+				out[len(batch)-1-i] = answer(batch[i])
+			}
+			_ = json.NewEncoder(rw).Encode(out)
+			return
+		}
+
+		var req wireRequest
+		_ = json.Unmarshal(body, &req)
+		if strings.HasPrefix(req.Method, "slow") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		a := answer(req)
+		if a["error"] != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+		_ = json.NewEncoder(rw).Encode(a)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCall_Envelopes(t *testing.T) {
+	seen := make(chan wireRequest, 2)
+	srv := echoNode(t, seen)
+
+	for _, v := range []Version{V1, V2} {
+		var got string
+		if err := NewClient(Options{URL: srv.URL, Version: v}).Call(context.Background(), "getinfo", nil, &got); err != nil || got != "getinfo" {
+			t.Fatalf("%s: got %q, %v", v, got, err)
+		}
+
+		req := <-seen
+		if (req.JSONRPC != nil) != (v == V2) || string(req.Params) != "[]" {
+			t.Errorf("%s: jsonrpc member %v, params %s", v, req.JSONRPC, req.Params)
+		}
+	}
+}
+
+func TestCall_RPCError(t *testing.T) {
+	c := NewClient(Options{URL: echoNode(t, nil).URL})
+
+	err := c.Call(context.Background(), "fail", nil, nil)
+	var rpcErr *Error
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -8 {
+		t.Fatalf("err = %v, want the node's rpc error", err)
+	}
+
+	res, err := c.CallRaw(context.Background(), "fail", nil)
+	if err != nil || res.Error == nil {
+		t.Fatalf("CallRaw = %+v, %v; want the error inside the response", res, err)
+	}
+	if s := c.Stats(); s.RPCErrors != 2 || s.Failures != 0 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestBatch_MatchesIDs(t *testing.T) {
+	c := NewClient(Options{URL: echoNode(t, nil).URL})
+
+	answers, err := c.Batch(context.Background(), []Request{{Method: "a"}, {Method: "fail"}, {Method: "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 3 || string(answers[0].Result) != `"a"` || answers[1].Error == nil || string(answers[2].Result) != `"c"` {
+		t.Fatalf("answers out of order: %s %v %s", answers[0].Result, answers[1].Error, answers[2].Result)
+	}
+}
+
+func TestCall_Deadlines(t *testing.T) {
+	c := NewClient(Options{URL: echoNode(t, nil).URL, Timeout: 50 * time.Millisecond, Retries: 1})
+
+	if err := c.Call(context.Background(), "slow", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want a deadline", err)
+	}
+	if s := c.Stats(); s.Requests != 2 || s.Timeouts != 2 {
+		t.Errorf("stats %+v, want the timeout retried once", s)
+	}
+
+	// the caller's context wins over the client timeout
+	c = NewClient(Options{URL: c.URL()})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Call(ctx, "slow", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the context deadline", err)
+	}
+}
+
+func TestCall_HTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	err := NewClient(Options{URL: srv.URL, Retries: 3}).Call(context.Background(), "getinfo", nil, nil)
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("err = %v, want HTTP 401", err)
+	}
+}
+
+func TestREST(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("api_key") != "secret" || r.URL.Path != "/mining/candidate" {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = rw.Write([]byte(`{"h":7}`))
+	}))
+	defer srv.Close()
+
+	var out struct{ H int }
+	c := NewClient(Options{URL: srv.URL, Header: http.Header{"api_key": []string{"secret"}}})
+	if err := c.REST(context.Background(), http.MethodGet, "/mining/candidate", nil, &out); err != nil || out.H != 7 {
+		t.Fatalf("got %+v, %v", out, err)
+	}
+
+	if err := c.REST(context.Background(), http.MethodGet, "/elsewhere", nil, nil); err == nil {
+		t.Fatal("a 403 must be an error")
+	}
+}
+
+func TestCall_RetryableMethods(t *testing.T) {
+	retryable := func(method string) bool { return method == "slow" }
+	c := NewClient(Options{URL: echoNode(t, nil).URL, Timeout: 50 * time.Millisecond, Retries: 1, Retryable: retryable})
+
+	_ = c.Call(context.Background(), "slow", nil, nil)
+	if s := c.Stats(); s.Requests != 2 {
+		t.Errorf("requests = %d, want the retryable method retried once", s.Requests)
+	}
+	_ = c.Call(context.Background(), "slowsend", nil, nil)
+	if s := c.Stats(); s.Requests != 3 {
+		t.Errorf("requests = %d, want any other method sent once", s.Requests)
+	}
+}
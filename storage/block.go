@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+
+	"github.com/mining-pool/not-only-mining-pool/types"
 )
 
 type BlockCategory string
@@ -24,16 +26,23 @@ type PendingBlock struct {
 	Height uint64
 	Finder string // miner who submitted the block-solving share (solo payMode)
 	Mark   int64  // pplns share-sequence at block time (window upper bound)
+	// PayMode is the share group of the share that found the block, whose pay
+	// mode splits it; "" is the pool's payMode.
+	PayMode string
 }
 
 func (pb *PendingBlock) String() string {
-	return strings.Join([]string{
+	fields := []string{
 		pb.Hash, pb.TxHash, strconv.FormatUint(pb.Height, 10), pb.Finder, strconv.FormatInt(pb.Mark, 10),
-	}, ":")
+	}
+	if pb.PayMode != "" {
+		fields = append(fields, pb.PayMode)
+	}
+	return strings.Join(fields, ":")
 }
 
-// NewPendingBlockFromString parses a stored pending block. Finder and Mark are
-// optional (older 3-field records parse fine) so the format can evolve.
+// NewPendingBlockFromString parses a stored pending block. Finder, Mark and
+// PayMode are optional (older 3-field records parse fine) so the format can evolve.
 func NewPendingBlockFromString(str string) (*PendingBlock, error) {
 	split := strings.Split(str, ":")
 	if len(split) < 3 {
@@ -51,5 +60,107 @@ func NewPendingBlockFromString(str string) (*PendingBlock, error) {
 	if len(split) > 4 {
 		pb.Mark, _ = strconv.ParseInt(split[4], 10, 64)
 	}
+	if len(split) > 5 {
+		pb.PayMode = split[5]
+	}
 	return pb, nil
 }
+
+// Block states: the status of a FoundBlock, and of the blocks table and the
+// redis blocks:<state> sets the payer works from.
+const (
+	blockPending   = "pending"
+	blockConfirmed = "confirmed"
+	blockOrphaned  = "orphaned"
+)
+
+// FoundBlock is the history record of a block the pool found, written when its
+// share is recorded and updated as the payer settles it.
+type FoundBlock struct {
+	Height      int64   `json:"height"`
+	Hash        string  `json:"hash"`
+	TxHash      string  `json:"txHash"`
+	Miner       string  `json:"miner"`
+	Rig         string  `json:"rig"`
+	Time        int64   `json:"time"`
+	NetworkDiff float64 `json:"networkDiff"`
+	RoundShares float64 `json:"roundShares"` // difficulty the pool submitted in the round the block closed
+	Effort      float64 `json:"effort"`      // RoundShares / NetworkDiff; 1 is the expected work, 0 unknown
+	Reward      uint64  `json:"reward"`      // coinbase value at find time, satoshis
+
+	Status      string            `json:"status"` // pending, confirmed or orphaned
+	Transitions []BlockTransition `json:"transitions"`
+}
+
+type BlockTransition struct {
+	Status string `json:"status"`
+	Time   int64  `json:"time"`
+}
+
+// newFoundBlock records the block a share found, closing a round of
+// roundShares difficulty.
+func newFoundBlock(share *types.Share, roundShares float64, now int64) *FoundBlock {
+	b := &FoundBlock{
+		Height:      share.BlockHeight,
+		Hash:        share.BlockHash,
+		TxHash:      share.TxHash,
+		Miner:       share.Miner,
+		Rig:         share.Rig,
+		Time:        now,
+		NetworkDiff: share.NetworkDiff,
+		RoundShares: roundShares,
+		Reward:      share.BlockReward,
+	}
+	if share.NetworkDiff > 0 {
+		b.Effort = roundShares / share.NetworkDiff
+	}
+	b.transition(blockPending, now)
+	return b
+}
+
+// transition moves the block to status, reporting false if it already is there.
+func (b *FoundBlock) transition(status string, now int64) bool {
+	if b.Status == status {
+		return false
+	}
+	b.Status = status
+	b.Transitions = append(b.Transitions, BlockTransition{Status: status, Time: now})
+	return true
+}
+
+// AverageEffort is the pool luck over the newest n of blocks (given newest
+// first): their mean effort, under 1 when blocks came quicker than expected.
+// Blocks without a known effort are skipped; 0 means none had one.
+func AverageEffort(blocks []*FoundBlock, n int) float64 {
+	var sum float64
+	var count int
+	for _, b := range blocks {
+		if count == n {
+			break
+		}
+		if b.Effort > 0 {
+			sum += b.Effort
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return sum / float64(count)
+}
+
+// rejectedBlocksCap bounds the rejected-block history kept for diagnosis.
+const rejectedBlocksCap = 1000
+
+// RejectedBlock records a block candidate that failed the pre-submit check or
+// that the daemon refused, with the reasons from either side.
+type RejectedBlock struct {
+	Height   int64  `json:"height"`
+	Hash     string `json:"hash"`
+	Miner    string `json:"miner"`
+	Rig      string `json:"rig"`
+	Time     int64  `json:"time"`
+	Accepted bool   `json:"accepted"` // the daemon took it despite a local rejection
+
+	*types.BlockRejection
+}
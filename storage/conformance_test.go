@@ -0,0 +1,692 @@
+package storage
+
+import (
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+	"github.com/mining-pool/not-only-mining-pool/types"
+)
+
+// testConformance is the behaviour every DB backend must share. open returns a
+// fresh, empty store for each subtest.
+func testConformance(t *testing.T, open func(t *testing.T) DB) {
+	share := func(miner string, diff float64, height int64) *types.Share {
+		return &types.Share{Miner: miner, Rig: "r", Diff: diff, BlockHeight: height}
+	}
+	block := func(miner string, height int64) *types.Share {
+		s := share(miner, 1, height)
+		s.BlockHex, s.BlockHash, s.TxHash = "00", "blk"+strconv.FormatInt(height, 10), "tx"+strconv.FormatInt(height, 10)
+		return s
+	}
+
+	t.Run("RoundSealIsOrdered", func(t *testing.T) {
+		db := open(t)
+		db.PutShare(share("A", 1, 100), false)
+		db.PutShare(share("B", 2, 100), false)
+		db.PutShare(share("A", 1, 100), false)
+		db.PutShare(block("A", 100), true)
+		db.PutShare(share("C", 5, 101), false)
+		db.Flush()
+
+		round, err := db.GetRoundContrib(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]float64{"A": 3, "B": 2}; !reflect.DeepEqual(round, want) {
+			t.Errorf("round 100 = %v, want %v", round, want)
+		}
+		if c, _ := db.GetMinerCurrentRoundContrib("C"); c != 5 {
+			t.Errorf("current round C = %v, want 5", c)
+		}
+		if a, err := db.GetMinerCurrentRoundContrib("A"); err != nil || a != 0 {
+			t.Errorf("current round A = %v, %v; want 0 (sealed)", a, err)
+		}
+
+		pending, err := db.GetAllPendingBlocks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 1 {
+			t.Fatalf("%d pending blocks, want 1", len(pending))
+		}
+		pb := pending[0]
+		if pb.Hash != "blk100" || pb.TxHash != "tx100" || pb.Height != 100 || pb.Finder != "A" {
+			t.Errorf("pending block %+v", pb)
+		}
+		// the mark closes the PPLNS window on the block's own share
+		window, err := db.GetPPLNSShares("", pb.Mark, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]float64{"A": 3, "B": 2}; !reflect.DeepEqual(window, want) {
+			t.Errorf("pplns up to the block mark = %v, want %v", window, want)
+		}
+	})
+
+	t.Run("ShareGroups", func(t *testing.T) {
+		db := open(t)
+		solo := func(s *types.Share) *types.Share {
+			s.PayMode = config.PayModeSolo
+			return s
+		}
+		db.PutShare(share("A", 1, 100), false)
+		db.PutShare(solo(share("B", 2, 100)), false)
+		db.PutShare(solo(block("B", 100)), true)
+		db.PutShare(share("A", 3, 101), false)
+		db.Flush()
+
+		// the solo block sealed only the solo round
+		if round, _ := db.GetRoundContrib(100); !reflect.DeepEqual(round, map[string]float64{"B": 3}) {
+			t.Errorf("round 100 = %v, want the solo shares only", round)
+		}
+		if a, _ := db.GetMinerCurrentRoundContrib("A"); a != 4 {
+			t.Errorf("current round A = %v, want 4", a)
+		}
+		pending, err := db.GetAllPendingBlocks()
+		if err != nil || len(pending) != 1 {
+			t.Fatalf("pending blocks = %v, %v; want 1", pending, err)
+		}
+		pb := pending[0]
+		if pb.PayMode != config.PayModeSolo {
+			t.Errorf("pending block pay mode = %q, want solo", pb.PayMode)
+		}
+		if got, _ := db.GetPPLNSShares(config.PayModeSolo, pb.Mark, 0); !reflect.DeepEqual(got, map[string]float64{"B": 3}) {
+			t.Errorf("solo log = %v, want B only", got)
+		}
+		if got, _ := db.GetPPLNSShares("", math.MaxInt64, 0); !reflect.DeepEqual(got, map[string]float64{"A": 4}) {
+			t.Errorf("default log = %v, want A only", got)
+		}
+	})
+
+	t.Run("Statistics", func(t *testing.T) {
+		db := open(t)
+		db.PutShare(share("A", 2, 100), false)
+		db.PutShare(&types.Share{Miner: "A", Rig: "r2", Diff: 4, BlockHeight: 100}, false)
+		db.PutShare(&types.Share{Miner: "B", Rig: "r", Diff: 1, ErrorCode: 23}, false)
+		db.PutShare(block("A", 100), true)
+		db.PutShare(block("B", 101), false)
+		db.Flush()
+
+		for name, get := range map[string]func() (uint64, error){
+			"valid shares":   db.GetPoolTotalValidShares,
+			"invalid shares": db.GetPoolTotalInvalidShares,
+			"valid blocks":   db.GetPoolTotalValidBlocks,
+			"invalid blocks": db.GetPoolTotalInvalidBlocks,
+		} {
+			n, err := get()
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			want := map[string]uint64{"valid shares": 4, "invalid shares": 1, "valid blocks": 1, "invalid blocks": 1}[name]
+			if n != want {
+				t.Errorf("%s = %d, want %d", name, n, want)
+			}
+		}
+
+		miners, _ := db.GetMinerIndex()
+		if len(miners) != 2 {
+			t.Errorf("miner index %v, want A and B", miners)
+		}
+		rigs, _ := db.GetRigIndex("A")
+		if len(rigs) != 2 {
+			t.Errorf("rig index of A %v, want r and r2", rigs)
+		}
+
+		// the range widens to whole minute buckets, and the rate is taken over
+		// the time they cover up to the query
+		now := time.Now().Unix()
+		covered := func(h, diff float64) bool {
+			first := bucket(now-99, 60)
+			return h >= diff/float64(now+2-first) && h <= diff/float64(now-first)
+		}
+		if h, err := db.GetPoolHashrate(now-99, now+1); err != nil || !covered(h, 8) {
+			t.Errorf("pool hashrate = %v, %v; want 8 over the buckets since %d", h, err, now-99)
+		}
+		if h, _ := db.GetMinerHashrate("A", now-99, now+1); !covered(h, 7) {
+			t.Errorf("miner A hashrate = %v, want 7 over the buckets since %d", h, now-99)
+		}
+		if h, _ := db.GetRigHashrate("A", "r2", now-99, now+1); !covered(h, 4) {
+			t.Errorf("rig A.r2 hashrate = %v, want 4 over the buckets since %d", h, now-99)
+		}
+		if h, _ := db.GetPoolHashrate(now-200, now-100); h != 0 {
+			t.Errorf("pool hashrate before any share = %v, want 0", h)
+		}
+	})
+
+	// Each resolution is pruned on its own retention, so a day-long query still
+	// reads the 10-minute buckets after the minute ones are gone.
+	t.Run("HashrateRetention", func(t *testing.T) {
+		db := open(t)
+		db.PutShare(share("A", 6, 100), false)
+		db.Flush()
+
+		now := time.Now().Unix()
+		if h, _ := db.GetPoolHashrate(now-24*3600, now); h <= 0 {
+			t.Fatalf("day hashrate = %v before pruning, want > 0", h)
+		}
+		if err := db.PruneHashrate(now + 2*24*3600); err != nil {
+			t.Fatal(err)
+		}
+		if h, _ := db.GetPoolHashrate(now-60, now); h != 0 {
+			t.Errorf("minute hashrate = %v after its retention, want 0", h)
+		}
+		if h, _ := db.GetMinerHashrate("A", now-24*3600, now); h <= 0 {
+			t.Errorf("day hashrate of A = %v within the 10-minute retention, want > 0", h)
+		}
+		if err := db.PruneHashrate(now + 100*24*3600); err != nil {
+			t.Fatal(err)
+		}
+		if h, _ := db.GetPoolHashrate(now-30*24*3600, now); h != 0 {
+			t.Errorf("month hashrate = %v after every retention, want 0", h)
+		}
+	})
+
+	t.Run("PPLNSWindow", func(t *testing.T) {
+		db := open(t)
+		db.PutShare(share("A", 4, 100), false)
+		db.PutShare(share("B", 2, 100), false)
+		db.PutShare(share("C", 1, 100), false)
+		db.Flush()
+
+		got, err := db.GetPPLNSShares("", math.MaxInt64, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]float64{"C": 1, "B": 2}; !reflect.DeepEqual(got, want) {
+			t.Errorf("window of 3 = %v, want %v (newest first)", got, want)
+		}
+		if got, _ := db.GetPPLNSShares("", math.MaxInt64, 0); len(got) != 3 {
+			t.Errorf("uncapped window = %v, want all three miners", got)
+		}
+	})
+
+	t.Run("WalkShareLog", func(t *testing.T) {
+		db := open(t)
+		before := time.Now().Unix()
+		for _, m := range []string{"A", "B", "C"} {
+			db.PutShare(share(m, 1, 100), false)
+		}
+		db.Flush()
+
+		var walked []*LoggedShare
+		if err := db.WalkShareLog("", math.MaxInt64, func(ls *LoggedShare) bool {
+			walked = append(walked, ls)
+			return len(walked) < 2
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(walked) != 2 || walked[0].Miner != "C" || walked[1].Miner != "B" || walked[0].Seq <= walked[1].Seq {
+			t.Fatalf("walk = %+v, want C then B, newest first, stopping there", walked)
+		}
+		if walked[0].Time < before || walked[0].Diff != 1 {
+			t.Errorf("logged share %+v, want difficulty 1 and a time from %d", walked[0], before)
+		}
+
+		var from []string
+		_ = db.WalkShareLog("", walked[1].Seq, func(ls *LoggedShare) bool {
+			from = append(from, ls.Miner)
+			return true
+		})
+		if !reflect.DeepEqual(from, []string{"B", "A"}) {
+			t.Errorf("walk from B's seq = %v, want [B A]", from)
+		}
+	})
+
+	// A share written late, e.g. replayed from the journal after an outage,
+	// is recorded at its submit time rather than when it is written.
+	t.Run("SubmitTime", func(t *testing.T) {
+		db := open(t)
+		submitted := time.Now().Unix() - 3600
+		late := share("A", 5, 100)
+		late.Time = submitted
+		db.PutShare(late, false)
+		found := block("A", 100)
+		found.Time = submitted
+		db.PutShare(found, true)
+		db.Flush()
+
+		_ = db.WalkShareLog("", math.MaxInt64, func(ls *LoggedShare) bool {
+			if ls.Time != submitted {
+				t.Errorf("logged share time = %d, want %d", ls.Time, submitted)
+			}
+			return true
+		})
+		if h, _ := db.GetPoolHashrate(submitted-600, submitted+600); h <= 0 {
+			t.Errorf("hashrate around the submit time = %v, want > 0", h)
+		}
+		now := time.Now().Unix()
+		if h, _ := db.GetPoolHashrate(now-600, now); h != 0 {
+			t.Errorf("hashrate at write time = %v, want 0", h)
+		}
+		if blocks, _ := db.GetFoundBlocks(1); len(blocks) != 1 || blocks[0].Time != submitted {
+			t.Errorf("found block = %+v, want time %d", blocks, submitted)
+		}
+	})
+
+	t.Run("LogCappedOutsidePPS", func(t *testing.T) {
+		pplnsLogCap.Store(3)
+		defer pplnsLogCap.Store(200000)
+		db := open(t)
+		for i := 0; i < 8; i++ {
+			db.PutShare(share("A", 1, 100), false)
+		}
+		db.Flush()
+		if got, _, _, _ := db.GetSharesSince(0); got["A"] != 3 {
+			t.Errorf("log holds %v of A, want the newest 3", got["A"])
+		}
+	})
+
+	t.Run("PPSCursor", func(t *testing.T) {
+		pplnsLogCap.Store(3)
+		defer pplnsLogCap.Store(200000)
+		db := open(t)
+		db.SetPPSMode(true)
+		if c, err := db.GetPPSCursor(); err != nil || c != 0 {
+			t.Fatalf("initial cursor = %d, %v", c, err)
+		}
+		for i := 0; i < 8; i++ {
+			db.PutShare(share("A", 1, 100), false)
+		}
+		db.Flush()
+
+		got, _, last, err := db.GetSharesSince(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got["A"] != 8 {
+			t.Fatalf("uncredited A = %v, want all 8 despite the cap", got["A"])
+		}
+		if err := db.ApplyPayments(&PaymentUpdate{PPSCursor: last}); err != nil {
+			t.Fatal(err)
+		}
+		if c, _ := db.GetPPSCursor(); c != last {
+			t.Errorf("cursor = %d, want %d", c, last)
+		}
+
+		priced := share("B", 2, 100)
+		priced.Value = 150
+		db.PutShare(priced, false)
+		db.Flush()
+		got, values, next, _ := db.GetSharesSince(last)
+		if want := map[string]float64{"B": 2}; !reflect.DeepEqual(got, want) || next <= last {
+			t.Errorf("since cursor = %v up to %d, want %v past %d", got, next, want, last)
+		}
+		if values["B"] != 150 {
+			t.Errorf("value of B since cursor = %v, want the 150 it was logged with", values["B"])
+		}
+		if _, _, same, _ := db.GetSharesSince(next); same != next {
+			t.Errorf("empty read moved the cursor from %d to %d", next, same)
+		}
+		// the newest pplnsLogCap shares outlive crediting, for pps+ fee splits
+		if err := db.ApplyPayments(&PaymentUpdate{PPSCursor: next}); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := db.GetPPLNSShares("", next, 0); got["A"] != 2 || got["B"] != 2 {
+			t.Errorf("log after crediting everything = %v, want the newest 3 shares", got)
+		}
+	})
+
+	t.Run("ApplyPayments", func(t *testing.T) {
+		db := open(t)
+		db.PutShare(share("A", 1, 100), false)
+		paid := block("A", 100)
+		paid.CoinbasePaid = map[string]uint64{"A": 3000}
+		paid.CoinbaseWindow = map[string]float64{"A": 3, "B": 1}
+		db.PutShare(paid, true)
+		db.PutShare(block("B", 101), true)
+		db.PutShare(block("B", 102), true)
+		db.Flush()
+
+		if cb, _ := db.GetCoinbasePaid(100); cb["A"] != 3000 {
+			t.Errorf("coinbase paid at 100 = %v", cb)
+		}
+		if w, _ := db.GetCoinbaseWindow(100); !reflect.DeepEqual(w, map[string]float64{"A": 3, "B": 1}) {
+			t.Errorf("coinbase window at 100 = %v", w)
+		}
+
+		pending, _ := db.GetAllPendingBlocks()
+		byHeight := make(map[uint64]string)
+		for _, pb := range pending {
+			byHeight[pb.Height] = pb.String()
+		}
+		err := db.ApplyPayments(&PaymentUpdate{
+			Balances:     map[string]float64{"A": 0.5, "B": 0},
+			Paid:         map[string]float64{"A": 10},
+			Confirmed:    []string{byHeight[100]},
+			Orphaned:     []string{byHeight[101]},
+			DeleteRounds: []uint64{100, 101},
+			Coinbase:     []*Payout{{Txid: "cb100", Amounts: map[string]float64{"A": 30}, Blocks: []uint64{100}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pending, _ = db.GetAllPendingBlocks()
+		if len(pending) != 1 || pending[0].Height != 102 {
+			t.Errorf("pending after settling = %v, want only 102", pending)
+		}
+		if round, _ := db.GetRoundContrib(100); len(round) != 0 {
+			t.Errorf("paid round 100 still holds %v", round)
+		}
+		if cb, _ := db.GetCoinbasePaid(100); len(cb) != 0 {
+			t.Errorf("paid round 100 still holds coinbase payouts %v", cb)
+		}
+		if w, _ := db.GetCoinbaseWindow(100); len(w) != 0 {
+			t.Errorf("paid round 100 still holds its coinbase window %v", w)
+		}
+		if bal, _ := db.GetAllMinerBalances(); !reflect.DeepEqual(bal, map[string]float64{"A": 0.5, "B": 0}) {
+			t.Errorf("balances = %v", bal)
+		}
+		if paid, _ := db.GetAllMinerPaid(); !reflect.DeepEqual(paid, map[string]float64{"A": 40}) {
+			t.Errorf("paid = %v, want the payout and the coinbase's", paid)
+		}
+		// the coinbase payout is in the ledger, confirmed with its block
+		if p, _ := db.GetPayout("cb100"); p == nil || p.Amounts["A"] != 30 || p.Time == 0 {
+			t.Errorf("coinbase ledger entry = %+v", p)
+		}
+		if watched, _ := db.GetUnconfirmedPayouts(); len(watched) != 0 {
+			t.Errorf("unconfirmed = %v, want the coinbase payout not followed", watched)
+		}
+		if confirmed, _ := db.GetConfirmedBlocks(); len(confirmed) != 1 || confirmed[0].String() != byHeight[100] {
+			t.Errorf("confirmed = %v, want only 100", confirmed)
+		}
+
+		// balances are absolute: a second run overwrites rather than adds
+		if err := db.ApplyPayments(&PaymentUpdate{Balances: map[string]float64{"A": 0.25}}); err != nil {
+			t.Fatal(err)
+		}
+		if bal, _ := db.GetAllMinerBalances(); bal["A"] != 0.25 {
+			t.Errorf("balance A = %v, want 0.25", bal["A"])
+		}
+	})
+
+	t.Run("FoundBlocks", func(t *testing.T) {
+		db := open(t)
+		db.PutShare(share("A", 2, 100), false)
+		db.PutShare(&types.Share{Miner: "B", Rig: "r", Diff: 1, ErrorCode: 23}, false) // invalid: no effort
+		db.PutShare(share("B", 3, 100), false)
+		first := block("A", 100)
+		first.Rig, first.NetworkDiff, first.BlockReward = "r7", 12, 5000
+		db.PutShare(first, true)
+		db.PutShare(share("B", 4, 101), false)
+		second := block("B", 101)
+		second.NetworkDiff = 10
+		db.PutShare(second, true)
+		db.PutShare(block("C", 102), false) // rejected by the daemon: not found
+		db.Flush()
+
+		found, err := db.GetFoundBlocks(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 2 || found[0].Height != 101 || found[1].Height != 100 {
+			t.Fatalf("found blocks = %v, want 101 then 100", found)
+		}
+		fb := found[1]
+		if fb.Hash != "blk100" || fb.TxHash != "tx100" || fb.Miner != "A" || fb.Rig != "r7" || fb.Reward != 5000 || fb.Time == 0 {
+			t.Errorf("block 100 = %+v", fb)
+		}
+		// round 100: 2 + 3 + the block share's 1 against a network difficulty of 12
+		if fb.RoundShares != 6 || fb.NetworkDiff != 12 || fb.Effort != 0.5 {
+			t.Errorf("block 100 round %v / %v, effort %v; want 6 / 12, 0.5", fb.RoundShares, fb.NetworkDiff, fb.Effort)
+		}
+		if found[0].Effort != 0.5 {
+			t.Errorf("block 101 effort = %v, want 5/10", found[0].Effort)
+		}
+		if fb.Status != "pending" || len(fb.Transitions) != 1 {
+			t.Errorf("block 100 status %q %v, want pending", fb.Status, fb.Transitions)
+		}
+
+		pending, _ := db.GetAllPendingBlocks()
+		byHeight := make(map[uint64]string)
+		for _, pb := range pending {
+			byHeight[pb.Height] = pb.String()
+		}
+		update := &PaymentUpdate{Confirmed: []string{byHeight[100]}, Orphaned: []string{byHeight[101]}}
+		for i := 0; i < 2; i++ { // a resumed run re-applying adds no transition
+			if err := db.ApplyPayments(update); err != nil {
+				t.Fatal(err)
+			}
+		}
+		found, _ = db.GetFoundBlocks(1)
+		if len(found) != 1 || found[0].Status != "orphaned" || len(found[0].Transitions) != 2 || found[0].Transitions[1].Status != "orphaned" {
+			t.Errorf("newest block after settling = %+v, want orphaned", found)
+		}
+		found, _ = db.GetFoundBlocks(10)
+		if found[1].Status != "confirmed" || len(found[1].Transitions) != 2 {
+			t.Errorf("block 100 after settling = %+v, want confirmed", found[1])
+		}
+		if luck := AverageEffort(found, 10); luck != 0.5 {
+			t.Errorf("luck = %v, want 0.5", luck)
+		}
+	})
+
+	t.Run("PayoutLedger", func(t *testing.T) {
+		db := open(t)
+		db.PutShare(block("A", 100), true)
+		db.PutShare(block("A", 101), true)
+		db.Flush()
+		pending, _ := db.GetAllPendingBlocks()
+		byHeight := make(map[uint64]string)
+		for _, pb := range pending {
+			byHeight[pb.Height] = pb.String()
+		}
+
+		// a run that sent nothing writes no entry
+		if err := db.ApplyPayments(&PaymentUpdate{Orphaned: []string{byHeight[101]}}); err != nil {
+			t.Fatal(err)
+		}
+		first := &PaymentUpdate{
+			Paid:      map[string]float64{"A": 1.5, "B": 0.5},
+			Confirmed: []string{byHeight[100]},
+			Txid:      "tx-a",
+		}
+		// a resumed run re-applying the same transaction adds no second entry
+		for i := 0; i < 2; i++ {
+			if err := db.ApplyPayments(first); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.ApplyPayments(&PaymentUpdate{Paid: map[string]float64{"B": 2}, Txid: "tx-b"}); err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := db.GetPayout("tx-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p == nil || p.Time == 0 || !reflect.DeepEqual(p.Amounts, first.Paid) || !reflect.DeepEqual(p.Blocks, []uint64{100}) {
+			t.Errorf("payout tx-a = %+v, want %v for block 100", p, first.Paid)
+		}
+		if p, err := db.GetPayout("unknown"); err != nil || p != nil {
+			t.Errorf("unknown payout = %+v, %v; want none", p, err)
+		}
+
+		all, _ := db.GetPayouts(10)
+		if len(all) != 2 {
+			t.Fatalf("ledger = %+v, want tx-a and tx-b", all)
+		}
+		b, _ := db.GetMinerPayouts("B", 10)
+		if len(b) != 2 || b[0].Amount+b[1].Amount != 2.5 {
+			t.Errorf("payouts to B = %+v, want 0.5 and 2", b)
+		}
+		if a, _ := db.GetMinerPayouts("A", 1); len(a) != 1 || a[0].Txid != "tx-a" || a[0].Amount != 1.5 {
+			t.Errorf("payouts to A = %+v, want 1.5 in tx-a", a)
+		}
+		if c, _ := db.GetMinerPayouts("C", 10); len(c) != 0 {
+			t.Errorf("payouts to C = %+v, want none", c)
+		}
+	})
+
+	t.Run("UnconfirmedPayouts", func(t *testing.T) {
+		db := open(t)
+		_ = db.ApplyPayments(&PaymentUpdate{Paid: map[string]float64{"A": 1}, Txid: "tx-a"})
+		_ = db.ApplyPayments(&PaymentUpdate{Paid: map[string]float64{"B": 2}, Txid: "tx-b"})
+		watched, err := db.GetUnconfirmedPayouts()
+		if err != nil || len(watched) != 2 || watched["tx-a"] == 0 {
+			t.Fatalf("unconfirmed = %v, %v; want tx-a and tx-b", watched, err)
+		}
+
+		if err := db.ConfirmPayout("tx-b"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.ReplacePayout("tx-a", "tx-a2", 1234); err != nil {
+			t.Fatal(err)
+		}
+		if watched, _ := db.GetUnconfirmedPayouts(); !reflect.DeepEqual(watched, map[string]int64{"tx-a2": 1234}) {
+			t.Errorf("unconfirmed = %v, want the replacement only", watched)
+		}
+		if p, _ := db.GetPayout("tx-a"); p != nil {
+			t.Errorf("the replaced txid is still in the ledger: %+v", p)
+		}
+		p, err := db.GetPayout("tx-a2")
+		if err != nil || p == nil || p.Amounts["A"] != 1 || !reflect.DeepEqual(p.Replaced, []string{"tx-a"}) {
+			t.Errorf("replacement = %+v, %v; want A's 1, replacing tx-a", p, err)
+		}
+		if a, _ := db.GetMinerPayouts("A", 10); len(a) != 1 || a[0].Txid != "tx-a2" || len(a[0].Replaced) != 1 {
+			t.Errorf("payouts to A = %+v, want the replacement", a)
+		}
+
+		// an intent still carrying the old txid follows it
+		_ = db.PutPayoutIntent(&PaymentUpdate{Paid: map[string]float64{"C": 1}})
+		_ = db.SetPayoutIntentTxid("tx-c")
+		_ = db.ReplacePayout("tx-c", "tx-c2", 1300)
+		if _, txid, _, _ := db.GetPayoutIntent(); txid != "tx-c2" {
+			t.Errorf("intent txid = %q, want tx-c2", txid)
+		}
+
+		// a conflicted payout is flagged, and still followed
+		if err := db.ConflictPayout("tx-a2"); err != nil {
+			t.Fatal(err)
+		}
+		if p, _ := db.GetPayout("tx-a2"); p == nil || !p.Conflicted || p.Amounts["A"] != 1 {
+			t.Errorf("conflicted entry = %+v, want it flagged", p)
+		}
+		if a, _ := db.GetMinerPayouts("A", 10); len(a) != 1 || !a[0].Conflicted {
+			t.Errorf("payouts to A = %+v, want the payout flagged", a)
+		}
+		if watched, _ := db.GetUnconfirmedPayouts(); watched["tx-a2"] != 1234 {
+			t.Errorf("unconfirmed = %v, want the conflicted payout still followed", watched)
+		}
+	})
+
+	t.Run("PayoutIntent", func(t *testing.T) {
+		db := open(t)
+		if _, _, exists, err := db.GetPayoutIntent(); err != nil || exists {
+			t.Fatalf("fresh store has an intent (%v)", err)
+		}
+
+		u := &PaymentUpdate{Balances: map[string]float64{"A": 1}, Paid: map[string]float64{"B": 2}}
+		if err := db.PutPayoutIntent(u); err != nil {
+			t.Fatal(err)
+		}
+		got, txid, exists, err := db.GetPayoutIntent()
+		if err != nil || !exists || txid != "" || !reflect.DeepEqual(got, u) {
+			t.Fatalf("intent = %+v %q %v %v", got, txid, exists, err)
+		}
+		if err := db.SetPayoutIntentTxid("abcd"); err != nil {
+			t.Fatal(err)
+		}
+		if _, txid, _, _ := db.GetPayoutIntent(); txid != "abcd" {
+			t.Errorf("txid = %q, want abcd", txid)
+		}
+
+		// applying the run it describes clears it
+		if err := db.ApplyPayments(u); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, exists, _ := db.GetPayoutIntent(); exists {
+			t.Error("intent survived ApplyPayments")
+		}
+
+		_ = db.PutPayoutIntent(u)
+		if err := db.DelPayoutIntent(); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, exists, _ := db.GetPayoutIntent(); exists {
+			t.Error("intent survived DelPayoutIntent")
+		}
+	})
+
+	t.Run("MinerSettings", func(t *testing.T) {
+		db := open(t)
+		if s, err := db.GetMinerSettings("A"); err != nil || s != nil {
+			t.Fatalf("settings of a new miner = %+v, %v; want none", s, err)
+		}
+
+		hour := 6
+		a := &MinerSettings{MinPayment: 0.5, DailyAt: &hour, Time: 100}
+		b := &MinerSettings{MinPayment: 2, Time: 200}
+		if err := db.SetMinerSettings("A", a); err != nil {
+			t.Fatal(err)
+		}
+		_ = db.SetMinerSettings("B", b)
+		if got, err := db.GetMinerSettings("A"); err != nil || !reflect.DeepEqual(got, a) {
+			t.Errorf("settings of A = %+v, %v; want %+v", got, err, a)
+		}
+		if all, err := db.GetAllMinerSettings(); err != nil || !reflect.DeepEqual(all, map[string]*MinerSettings{"A": a, "B": b}) {
+			t.Errorf("all settings = %v, %v", all, err)
+		}
+
+		// a new signature replaces them, dropping the schedule
+		a = &MinerSettings{MinPayment: 1, Time: 300}
+		_ = db.SetMinerSettings("A", a)
+		if got, _ := db.GetMinerSettings("A"); !reflect.DeepEqual(got, a) {
+			t.Errorf("replaced settings of A = %+v, want %+v", got, a)
+		}
+	})
+
+	t.Run("RejectedBlocks", func(t *testing.T) {
+		db := open(t)
+		first := block("A", 100)
+		first.BlockRejection = &types.BlockRejection{Reason: "high-hash"}
+		second := block("B", 101)
+		second.BlockRejection = &types.BlockRejection{DaemonReason: "bad-txnmrklroot"}
+		db.PutShare(first, false)
+		db.PutShare(second, true)
+		db.Flush()
+
+		rejected, err := db.GetRejectedBlocks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rejected) != 2 || rejected[0].Hash != "blk101" || rejected[1].Reason != "high-hash" || !rejected[0].Accepted {
+			t.Errorf("rejected blocks = %+v, want newest first", rejected)
+		}
+	})
+}
+
+func TestRedisDB_Conformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) DB {
+		db, _ := newTestDB(t)
+		return db
+	})
+}
+
+// TestPostgresDB_Conformance runs against the database in NOMP_TEST_POSTGRES,
+// e.g. "postgres://postgres@127.0.0.1/nomp_test?sslmode=disable". Each subtest
+// uses its own coin, so the database needn't be empty.
+func TestPostgresDB_Conformance(t *testing.T) {
+	dsn := os.Getenv("NOMP_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("NOMP_TEST_POSTGRES is not set")
+	}
+	testConformance(t, func(t *testing.T) DB {
+		db := NewPostgresDB("T"+strconv.FormatInt(time.Now().UnixNano(), 36), &config.PostgresOptions{DSN: dsn})
+		t.Cleanup(func() { _ = db.Close() })
+		return db
+	})
+}
+
+func TestSQLiteDB_Conformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) DB {
+		db := NewSQLiteDB("T", &config.SQLiteOptions{DataDir: t.TempDir()})
+		t.Cleanup(func() { _ = db.Close() })
+		return db
+	})
+}
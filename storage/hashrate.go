@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+)
+
+// hashrateResolutions are the bucket widths, in seconds, every valid share's
+// difficulty is summed into. Each is kept for its own retention, so old
+// history survives only at the coarser resolutions.
+var hashrateResolutions = [...]int64{60, 600, 3600}
+
+// maxHashrateBuckets bounds the buckets one query reads: a range that would
+// need more of the finest retained resolution moves to a coarser one.
+const maxHashrateBuckets = 360
+
+// hashrateBuckets is embedded by every backend: it holds the retention of each
+// resolution and runs the background pruning of expired buckets.
+type hashrateBuckets struct {
+	mu        sync.Mutex
+	retention [len(hashrateResolutions)]int64 // seconds
+	prune     func(now int64) error
+	stop      chan struct{}
+}
+
+func (h *hashrateBuckets) startHashrate(prune func(now int64) error) {
+	h.prune = prune
+	h.setRetention(nil)
+}
+
+func (h *hashrateBuckets) setRetention(options *config.HashrateOptions) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, res := range hashrateResolutions {
+		h.retention[i] = int64(options.Retention(time.Duration(res) * time.Second).Seconds())
+	}
+}
+
+// KeepHashrate applies the retention in options and prunes expired buckets in
+// the background until Close.
+func (h *hashrateBuckets) KeepHashrate(options *config.HashrateOptions) {
+	h.setRetention(options)
+	if h.stop != nil {
+		return
+	}
+	h.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(options.GetPruneInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+				if err := h.prune(time.Now().Unix()); err != nil {
+					log.Error("failed to prune the hashrate series: ", err)
+				}
+			}
+		}
+	}()
+}
+
+func (h *hashrateBuckets) stopHashrate() {
+	if h.stop != nil {
+		close(h.stop)
+	}
+}
+
+// cutoffs returns, per resolution, the oldest bucket start still retained.
+func (h *hashrateBuckets) cutoffs(now int64) [len(hashrateResolutions)]int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cut [len(hashrateResolutions)]int64
+	for i, res := range hashrateResolutions {
+		cut[i] = bucket(now-h.retention[i], res)
+	}
+	return cut
+}
+
+// hashrateQuery is the run of buckets covering a query range.
+type hashrateQuery struct {
+	res         int64
+	first, last int64   // bucket starts, inclusive
+	span        float64 // seconds the buckets cover, up to now
+}
+
+// bucketsFor picks the finest resolution that still retains from and reads at
+// most maxHashrateBuckets for [from, to]. The range is widened to whole
+// buckets, and the rate is taken over the time they cover, so the current,
+// partly filled bucket doesn't drag the rate down.
+func (h *hashrateBuckets) bucketsFor(from, to, now int64) (q hashrateQuery, ok bool) {
+	if to <= from {
+		return q, false
+	}
+	cut := h.cutoffs(now)
+	i := 0
+	for ; i < len(hashrateResolutions)-1; i++ {
+		res := hashrateResolutions[i]
+		if from >= cut[i] && (to-from)/res <= maxHashrateBuckets {
+			break
+		}
+	}
+
+	q.res = hashrateResolutions[i]
+	q.first, q.last = bucket(from, q.res), bucket(to, q.res)
+	end := q.last + q.res
+	if end > now {
+		end = now
+	}
+	if end <= q.first {
+		return q, false
+	}
+	q.span = float64(end - q.first)
+	return q, true
+}
+
+// bucket returns the start of the bucket of res that holds t.
+func bucket(t, res int64) int64 {
+	return t / res * res
+}
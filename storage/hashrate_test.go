@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+)
+
+func TestHashrateBuckets_Resolution(t *testing.T) {
+	var h hashrateBuckets
+	h.setRetention(&config.HashrateOptions{Retention1m: 1})
+	now := int64(1_000_000_220) // 20s into a minute
+
+	for _, tc := range []struct {
+		name     string
+		from, to int64
+		res      int64
+	}{
+		{"a minute", now - 60, now, 60},
+		{"two hours, past the minute retention", now - 2*3600, now, 600},
+		{"a day", now - 24*3600, now, 600},
+		{"a month", now - 30*24*3600, now, 3600},
+	} {
+		q, ok := h.bucketsFor(tc.from, tc.to, now)
+		if !ok || q.res != tc.res {
+			t.Errorf("%s: resolution %d (%v), want %d", tc.name, q.res, ok, tc.res)
+		}
+	}
+
+	// the current bucket counts only the time elapsed in it
+	if q, _ := h.bucketsFor(now-60, now, now); q.first != now-80 || q.span != 80 {
+		t.Errorf("minute query covers %+v, want from %d over 80s", q, now-80)
+	}
+	if _, ok := h.bucketsFor(now+60, now+120, now); ok {
+		t.Error("a range in the future has buckets")
+	}
+}
+
+// Pruning also drops the raw per-share ZSets older versions wrote.
+func TestRedisDB_PruneDropsLegacySeries(t *testing.T) {
+	db, mr := newTestDB(t)
+	ctx := context.Background()
+	db.SAdd(ctx, "T:pool:miners", "A")
+	db.SAdd(ctx, "T:miner:A:rigs", "r")
+	for _, key := range []string{"T:pool:shares", "T:miner:A:hashes", "T:miner:A:rig:r:hashes"} {
+		db.ZAdd(ctx, key, &redis.Z{Score: 1, Member: "1:1"})
+	}
+
+	if err := db.PruneHashrate(time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range mr.Keys() {
+		if key != "T:pool:miners" && key != "T:miner:A:rigs" {
+			t.Errorf("%s survived the prune", key)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mining-pool/not-only-mining-pool/types"
+)
+
+// journalCompactSize is how large a fully applied journal may grow before it
+// is truncated back to empty.
+const journalCompactSize = 1 << 20
+
+// journalRecord is one line of the journal.
+type journalRecord struct {
+	Share    *types.Share `json:"share"`
+	Accepted bool         `json:"accepted"`
+}
+
+// journal is a shareWriter that appends every share to a local file before
+// returning, and applies the file to the backend in order from a persisted
+// byte offset. An outage only grows the file, and whatever is unapplied at
+// shutdown or a crash is replayed on the next start.
+//
+// Delivery is at-least-once: a crash between applying a share and saving the
+// offset replays that one share.
+type journal struct {
+	queueCounters
+	path  string
+	fsync bool
+	apply applyFunc
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	file     *os.File // O_APPEND writer
+	reader   *os.File
+	offsets  *os.File // the applied offset, as fixed-width decimal
+	end      int64    // journal size
+	offset   int64    // bytes applied
+	appended uint64   // records written, counting those replayed from a previous run
+	applied  uint64
+	stopping bool
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func openJournal(path string, fsync bool, apply applyFunc) (*journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("creating the journal directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening the journal: %w", err)
+	}
+	j := &journal{
+		path:    path,
+		fsync:   fsync,
+		apply:   apply,
+		file:    file,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	j.cond = sync.NewCond(&j.mu)
+	if err := j.recover(); err != nil {
+		j.closeFiles()
+		return nil, err
+	}
+
+	if j.appended > 0 {
+		log.Warnf("replaying %d shares from the journal %s", j.appended, path)
+	}
+	go j.run()
+	return j, nil
+}
+
+// recover trims a record cut short by a crash, loads the applied offset and
+// counts the records still to apply.
+func (j *journal) recover() error {
+	var err error
+	if j.reader, err = os.Open(j.path); err != nil {
+		return fmt.Errorf("opening the journal: %w", err)
+	}
+	if j.offsets, err = os.OpenFile(j.path+".offset", os.O_RDWR|os.O_CREATE, 0o644); err != nil {
+		return fmt.Errorf("opening the journal offset: %w", err)
+	}
+
+	raw, err := io.ReadAll(j.offsets)
+	if err != nil {
+		return fmt.Errorf("reading the journal offset: %w", err)
+	}
+	if s := strings.TrimSpace(string(raw)); s != "" {
+		if j.offset, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return fmt.Errorf("bad journal offset %q: %w", s, err)
+		}
+	}
+
+	// j.end stops at the last complete record; records at or past the offset
+	// are pending.
+	var records uint64
+	r := bufio.NewReader(j.reader)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading the journal: %w", err)
+		}
+		records++
+		if j.end >= j.offset {
+			j.appended++
+		}
+		j.end += int64(len(line))
+	}
+	if info, err := j.file.Stat(); err != nil {
+		return fmt.Errorf("reading the journal: %w", err)
+	} else if info.Size() > j.end {
+		log.Warnf("trimming %d bytes of a partial record from the journal %s", info.Size()-j.end, j.path)
+		if err := j.file.Truncate(j.end); err != nil {
+			return fmt.Errorf("trimming the journal: %w", err)
+		}
+	}
+
+	// An offset past the end means a compaction truncated the journal but
+	// crashed before resetting the offset.
+	if j.offset > j.end {
+		j.offset, j.appended = 0, records
+	}
+	j.pending.Store(int64(j.appended))
+	return j.saveOffset()
+}
+
+func (j *journal) put(share *types.Share, accepted bool) {
+	shareCopy := *share
+	shareCopy.RemoteAddr = nil // an interface JSON can't read back, and not stored anyway
+	line, err := json.Marshal(journalRecord{Share: &shareCopy, Accepted: accepted})
+	if err != nil {
+		j.dropped.Add(1)
+		log.Error("failed to encode a share for the journal: ", err)
+		return
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err = j.file.Write(line); err == nil && j.fsync {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		// drop whatever part of the record made it, so the next one starts a line
+		_ = j.file.Truncate(j.end)
+		j.dropped.Add(1)
+		j.setStalled(err)
+		log.Errorf("failed to journal a share of %s: %s", share.Miner, err)
+		return
+	}
+	j.end += int64(len(line))
+	j.appended++
+	j.pending.Add(1)
+	j.cond.Broadcast()
+}
+
+// flush waits until every share journaled so far has been applied, or the
+// journal is closed.
+func (j *journal) flush() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	target := j.appended
+	for j.applied < target && !j.stopping {
+		j.cond.Wait()
+	}
+}
+
+func (j *journal) stats() QueueStats {
+	stats := j.snapshot()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	stats.Journal = j.path
+	stats.JournalBytes = j.end - j.offset
+	return stats
+}
+
+// close stops the writer without waiting for the backend: the shares it
+// hasn't applied stay in the journal for the next start.
+func (j *journal) close() error {
+	j.mu.Lock()
+	if j.stopping {
+		j.mu.Unlock()
+		return nil
+	}
+	j.stopping = true
+	j.cond.Broadcast()
+	j.mu.Unlock()
+
+	close(j.stop)
+	<-j.stopped
+	if n := j.pending.Load(); n > 0 {
+		log.Warnf("%d shares left in the journal %s for the next start", n, j.path)
+	}
+	return j.closeFiles()
+}
+
+func (j *journal) closeFiles() error {
+	var errs []error
+	for _, f := range []*os.File{j.file, j.reader, j.offsets} {
+		if f != nil {
+			errs = append(errs, f.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// run applies journaled records in order until the journal is closed.
+func (j *journal) run() {
+	defer close(j.stopped)
+	wait := func(d time.Duration) bool {
+		select {
+		case <-j.stop:
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+
+	for {
+		j.mu.Lock()
+		for j.offset == j.end && !j.stopping {
+			j.cond.Wait()
+		}
+		if j.stopping {
+			j.mu.Unlock()
+			return
+		}
+		from, to := j.offset, j.end
+		j.mu.Unlock()
+
+		r := bufio.NewReader(io.NewSectionReader(j.reader, from, to-from))
+		for pos := from; ; {
+			select {
+			case <-j.stop:
+				return
+			default:
+			}
+			line, err := r.ReadBytes('\n')
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Error("failed to read the journal: ", err)
+				wait(maxWriteBackoff)
+				break
+			}
+
+			var rec journalRecord
+			if err := json.Unmarshal(bytes.TrimSpace(line), &rec); err != nil || rec.Share == nil {
+				j.dropped.Add(1)
+				j.pending.Add(-1)
+				log.Errorf("skipping an unreadable journal record at %d: %v", pos, err)
+			} else if !j.retry(j.apply, rec.Share, rec.Accepted, wait) {
+				return
+			}
+			j.advance(int64(len(line)))
+			pos += int64(len(line))
+		}
+		j.compact()
+	}
+}
+
+// advance records one more applied record.
+func (j *journal) advance(n int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.offset += n
+	j.applied++
+	if err := j.saveOffset(); err != nil {
+		log.Error("failed to save the journal offset: ", err)
+	}
+	j.cond.Broadcast()
+}
+
+// compact empties a fully applied journal once it is large enough. The file is
+// truncated before the offset is reset, so a crash in between leaves an offset
+// past the end, which recover treats as zero.
+func (j *journal) compact() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.offset != j.end || j.end < journalCompactSize {
+		return
+	}
+	if err := j.file.Truncate(0); err != nil {
+		log.Error("failed to compact the journal: ", err)
+		return
+	}
+	j.offset, j.end = 0, 0
+	if err := j.saveOffset(); err != nil {
+		log.Error("failed to save the journal offset: ", err)
+	}
+}
+
+// saveOffset overwrites the offset file in place with a fixed-width value, so
+// a torn write can't leave a shorter, wrong number behind.
+func (j *journal) saveOffset() error {
+	if _, err := j.offsets.WriteAt([]byte(fmt.Sprintf("%020d\n", j.offset)), 0); err != nil {
+		return err
+	}
+	if j.fsync {
+		return j.offsets.Sync()
+	}
+	return nil
+}
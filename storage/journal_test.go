@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+	"github.com/mining-pool/not-only-mining-pool/types"
+)
+
+// Shares journaled while redis is down survive a pool restart and are applied
+// once redis is back.
+func TestJournal_ReplaysAfterRestart(t *testing.T) {
+	journal := &config.JournalOptions{Dir: t.TempDir()}
+	db, mr := newTestDB(t)
+	if err := db.UseJournal(journal); err != nil {
+		t.Fatal(err)
+	}
+	db.PutShare(&types.Share{Miner: "A", Rig: "r", Diff: 1}, false)
+	db.Flush()
+
+	mr.Close()
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3333}
+	for i := 0; i < 5; i++ {
+		db.PutShare(&types.Share{Miner: "A", Rig: "r", Diff: 1, RemoteAddr: addr}, false)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !db.ShareQueueStats().Stalled {
+		if time.Now().After(deadline) {
+			t.Fatal("the writer never reported the outage")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := db.ShareQueueStats(); stats.Pending != 5 || stats.JournalBytes == 0 || stats.Retries == 0 {
+		t.Errorf("stats during the outage = %+v, want 5 pending journaled shares and retries", stats)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	db = NewRedisDB("T", &config.RedisOptions{Network: "tcp", Host: "127.0.0.1", Port: mr.Server().Addr().Port})
+	if err := db.UseJournal(journal); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Flush()
+
+	if n, err := db.GetPoolTotalValidShares(); err != nil || n != 6 {
+		t.Fatalf("valid shares after the restart = %d, %v; want 6", n, err)
+	}
+	if stats := db.ShareQueueStats(); stats.Pending != 0 || stats.JournalBytes != 0 || stats.Written != 5 || stats.Stalled {
+		t.Errorf("stats after the replay = %+v, want 5 written and nothing pending", stats)
+	}
+}
+
+type recordedShares struct {
+	mu     sync.Mutex
+	miners []string
+}
+
+func (r *recordedShares) apply(share *types.Share, _ bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.miners = append(r.miners, share.Miner)
+	return nil
+}
+
+func (r *recordedShares) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.miners...)
+}
+
+// A record cut short by a crash is dropped, and appends after it still parse.
+func TestJournal_TrimsPartialRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "T.journal")
+	if err := os.WriteFile(path, []byte(`{"share":{"miner":"A"},"accepted":false}`+"\n"+`{"share":{"mi`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got recordedShares
+	j, err := openJournal(path, false, got.apply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.put(&types.Share{Miner: "B"}, false)
+	j.flush()
+	if err := j.close(); err != nil {
+		t.Fatal(err)
+	}
+	if m := got.get(); len(m) != 2 || m[0] != "A" || m[1] != "B" {
+		t.Errorf("applied %v, want [A B]", m)
+	}
+
+	// everything was applied, so a reopen replays nothing
+	var again recordedShares
+	if j, err = openJournal(path, false, again.apply); err != nil {
+		t.Fatal(err)
+	}
+	j.flush()
+	_ = j.close()
+	if m := again.get(); len(m) != 0 {
+		t.Errorf("reopen replayed %v, want nothing", m)
+	}
+}
+
+// An offset past the end is what a crash mid-compaction leaves: the journal was
+// emptied, so whatever was appended since is all pending.
+func TestJournal_OffsetPastEnd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "T.journal")
+	if err := os.WriteFile(path, []byte(`{"share":{"miner":"A"},"accepted":true}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".offset", []byte("00000000000000099999\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got recordedShares
+	j, err := openJournal(path, false, got.apply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.flush()
+	_ = j.close()
+	if m := got.get(); len(m) != 1 || m[0] != "A" {
+		t.Errorf("applied %v, want [A]", m)
+	}
+}
@@ -0,0 +1,60 @@
+package storage
+
+// Payout is one ledger entry: a payout transaction and what it paid. Entries
+// are append-only, written by ApplyPayments in the same transaction as the
+// balances they settle.
+type Payout struct {
+	Txid    string             `json:"txid"`
+	Time    int64              `json:"time"`
+	Amounts map[string]float64 `json:"amounts"` // miner -> coin
+	Blocks  []uint64           `json:"blocks"`  // heights of the blocks the run confirmed
+	// Replaced are the txids fee bumps replaced with Txid, oldest first.
+	Replaced []string `json:"replaced,omitempty"`
+	// Conflicted is set once a conflicting transaction confirmed instead of
+	// Txid: the miners were never paid, though their balances were settled.
+	Conflicted bool `json:"conflicted,omitempty"`
+}
+
+// MinerPayout is a miner's share of a Payout.
+type MinerPayout struct {
+	Txid   string   `json:"txid"`
+	Time   int64    `json:"time"`
+	Amount float64  `json:"amount"`
+	Blocks []uint64 `json:"blocks"`
+
+	Replaced   []string `json:"replaced,omitempty"`
+	Conflicted bool     `json:"conflicted,omitempty"`
+}
+
+// newPayout builds the ledger entry of a payout run, nil when it sent nothing.
+func newPayout(u *PaymentUpdate, now int64) (*Payout, error) {
+	if u.Txid == "" || len(u.Paid) == 0 {
+		return nil, nil
+	}
+	p := &Payout{Txid: u.Txid, Time: now, Amounts: u.Paid, Blocks: make([]uint64, 0, len(u.Confirmed))}
+	for _, str := range u.Confirmed {
+		pb, err := NewPendingBlockFromString(str)
+		if err != nil {
+			return nil, err
+		}
+		p.Blocks = append(p.Blocks, pb.Height)
+	}
+	return p, nil
+}
+
+// coinbasePayouts returns the coinbase payouts of a payout run, stamped with
+// now.
+func coinbasePayouts(u *PaymentUpdate, now int64) []*Payout {
+	payouts := make([]*Payout, len(u.Coinbase))
+	for i, p := range u.Coinbase {
+		stamped := *p
+		stamped.Time = now
+		payouts[i] = &stamped
+	}
+	return payouts
+}
+
+func (p *Payout) forMiner(miner string) *MinerPayout {
+	return &MinerPayout{Txid: p.Txid, Time: p.Time, Amount: p.Amounts[miner], Blocks: p.Blocks,
+		Replaced: p.Replaced, Conflicted: p.Conflicted}
+}
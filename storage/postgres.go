@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"database/sql"
+
+	_ "github.com/lib/pq" // registers the "postgres" driver
+	"github.com/mining-pool/not-only-mining-pool/config"
+)
+
+func NewPostgresDB(coinName string, options *config.PostgresOptions) *SQLDB {
+	db, err := sql.Open("postgres", options.DSN)
+	if err != nil {
+		log.Panicf("failed to open the postgres database: %s", err)
+	}
+	if options.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(options.MaxOpenConns)
+	}
+	if err := db.Ping(); err != nil {
+		log.Panicf("failed to connect to the postgres database: %s", err)
+	}
+
+	s, err := newSQLDB(db, coinName, "BIGSERIAL PRIMARY KEY")
+	if err != nil {
+		log.Panicf("postgres: %s", err)
+	}
+	return s
+}
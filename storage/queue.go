@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+	"github.com/mining-pool/not-only-mining-pool/types"
+)
+
+// applyFunc writes one share to a backend. It returns an error only when the
+// write may be retried as a whole (the backend was unreachable and nothing
+// was applied); any other failure is the backend's to log.
+type applyFunc func(share *types.Share, accepted bool) error
+
+// shareWriter feeds shares to a backend's apply in submission order, so a
+// submitting client goroutine never blocks on the database. Ordering matters:
+// a block's round seal must capture exactly the shares recorded before it — a
+// per-share goroutine let the seal race the round-contribution increments and
+// mis-attribute rounds.
+type shareWriter interface {
+	put(share *types.Share, accepted bool)
+	flush()
+	stats() QueueStats
+	close() error
+}
+
+// QueueStats is the back-pressure of a share writer.
+type QueueStats struct {
+	Journal      string `json:"journal,omitempty"` // journal file; empty when shares queue in memory
+	Pending      int64  `json:"pending"`           // shares accepted but not yet in the store
+	JournalBytes int64  `json:"journalBytes"`      // journal bytes not yet applied
+	Written      uint64 `json:"written"`           // shares applied since start
+	Retries      uint64 `json:"retries"`           // failed attempts while the store was unreachable
+	Dropped      uint64 `json:"dropped"`           // shares lost: memory backlog full, or unwritable journal
+	Stalled      bool   `json:"stalled"`           // the store is unreachable right now
+	LastError    string `json:"lastError,omitempty"`
+}
+
+// maxShareBacklog bounds the shares held in memory while the backend is
+// unreachable and no journal is configured; past it new shares are dropped.
+const maxShareBacklog = 1 << 20
+
+// Backoff bounds for re-applying a share while the backend is unreachable.
+const (
+	minWriteBackoff = 100 * time.Millisecond
+	maxWriteBackoff = 30 * time.Second
+)
+
+// queueCounters is the bookkeeping both writers share.
+type queueCounters struct {
+	pending atomic.Int64
+	written atomic.Uint64
+	retries atomic.Uint64
+	dropped atomic.Uint64
+
+	mu        sync.Mutex
+	stalled   bool
+	lastError string
+}
+
+func (c *queueCounters) snapshot() QueueStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return QueueStats{
+		Pending:   c.pending.Load(),
+		Written:   c.written.Load(),
+		Retries:   c.retries.Load(),
+		Dropped:   c.dropped.Load(),
+		Stalled:   c.stalled,
+		LastError: c.lastError,
+	}
+}
+
+func (c *queueCounters) setStalled(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stalled = err != nil
+	if err != nil {
+		c.lastError = err.Error()
+	}
+}
+
+// retry applies one share until the backend takes it, calling wait between
+// attempts. It returns false if wait gave up (the writer is stopping).
+func (c *queueCounters) retry(apply applyFunc, share *types.Share, accepted bool, wait func(time.Duration) bool) bool {
+	backoff := minWriteBackoff
+	for {
+		err := apply(share, accepted)
+		if err == nil {
+			c.setStalled(nil)
+			c.written.Add(1)
+			c.pending.Add(-1)
+			return true
+		}
+
+		c.retries.Add(1)
+		c.setStalled(err)
+		log.Warnf("storage unreachable (%s), %d shares pending, retrying in %s", err, c.pending.Load(), backoff)
+		if !wait(backoff) {
+			return false
+		}
+		if backoff *= 2; backoff > maxWriteBackoff {
+			backoff = maxWriteBackoff
+		}
+	}
+}
+
+type shareJob struct {
+	share    *types.Share
+	accepted bool
+	done     chan struct{} // set on a Flush barrier instead of a share
+}
+
+// memoryQueue buffers shares in memory: through an outage the writer keeps
+// retrying the oldest share and moves everything queued behind it into a
+// backlog, so PutShare never blocks. A crash loses the backlog; UseJournal
+// closes that gap.
+type memoryQueue struct {
+	queueCounters
+	ch chan shareJob
+}
+
+func newMemoryQueue(apply applyFunc) *memoryQueue {
+	q := &memoryQueue{ch: make(chan shareJob, 4096)}
+	go func() {
+		var backlog []shareJob
+		for job := range q.ch {
+			backlog = append(backlog, job)
+			for len(backlog) > 0 {
+				job := backlog[0]
+				if job.done != nil {
+					close(job.done)
+				} else {
+					q.retry(apply, job.share, job.accepted, func(wait time.Duration) bool {
+						backlog = q.buffer(backlog, wait)
+						return true
+					})
+				}
+				backlog = backlog[1:]
+			}
+		}
+	}()
+	return q
+}
+
+// buffer moves newly queued jobs into backlog for wait, so PutShare doesn't
+// block while the writer is backing off.
+func (q *memoryQueue) buffer(backlog []shareJob, wait time.Duration) []shareJob {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case job := <-q.ch:
+			if job.done == nil && len(backlog) >= maxShareBacklog {
+				q.dropped.Add(1)
+				q.pending.Add(-1)
+				log.Error("share backlog full, dropping a share of ", job.share.Miner)
+				continue
+			}
+			backlog = append(backlog, job)
+		case <-timer.C:
+			return backlog
+		}
+	}
+}
+
+func (q *memoryQueue) put(share *types.Share, accepted bool) {
+	q.pending.Add(1)
+	q.ch <- shareJob{share: share, accepted: accepted}
+}
+
+// flush waits for everything queued before it, including a backlog held
+// through an outage.
+func (q *memoryQueue) flush() {
+	done := make(chan struct{})
+	q.ch <- shareJob{done: done}
+	<-done
+}
+
+func (q *memoryQueue) stats() QueueStats {
+	return q.snapshot()
+}
+
+func (q *memoryQueue) close() error {
+	q.flush()
+	return nil
+}
+
+// shareQueue is embedded by every backend: it owns the backend's share writer
+// and provides the share-recording half of DB on top of its apply function.
+type shareQueue struct {
+	writer shareWriter
+	apply  applyFunc
+	name   string // journal file name, without extension
+}
+
+func (q *shareQueue) start(name string, apply applyFunc) {
+	q.name, q.apply = name, apply
+	q.writer = newMemoryQueue(apply)
+}
+
+// PutShare enqueues a share for the single ordered writer and returns at once.
+// A share without a submit time is stamped with the current one.
+func (q *shareQueue) PutShare(share *types.Share, accepted bool) {
+	if share.Time == 0 {
+		share.Time = time.Now().Unix()
+	}
+	q.writer.put(share, accepted)
+}
+
+// Flush waits until every share queued so far has been applied.
+func (q *shareQueue) Flush() {
+	q.writer.flush()
+}
+
+func (q *shareQueue) ShareQueueStats() QueueStats {
+	return q.writer.stats()
+}
+
+// UseJournal switches to an on-disk journal, first replaying whatever an
+// earlier run left unapplied in it.
+func (q *shareQueue) UseJournal(options *config.JournalOptions) error {
+	j, err := openJournal(options.Path(q.name), options.Fsync, q.apply)
+	if err != nil {
+		return err
+	}
+	_ = q.writer.close()
+	q.writer = j
+	return nil
+}
@@ -3,6 +3,8 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -12,6 +14,7 @@ import (
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/mining-pool/not-only-mining-pool/config"
 	"github.com/mining-pool/not-only-mining-pool/types"
+	"github.com/mining-pool/not-only-mining-pool/utils"
 )
 
 var log = logging.Logger("storage")
@@ -21,120 +24,181 @@ var log = logging.Logger("storage")
 // Atomic so tests can shrink it without racing the writer goroutine. NOTE: this
 // rank cap is applied only outside PPS mode — see putShareNow — because it would
 // otherwise drop shares the PPS cursor hasn't credited yet (underpayment). In PPS
-// the log is trimmed by the cursor instead (ApplyPayments), retaining exactly the
-// uncredited shares.
+// the log is trimmed by the cursor instead (ApplyPayments), retaining the
+// uncredited shares and, credited or not, the newest pplnsLogCap.
 var pplnsLogCap atomic.Int64
 
 func init() { pplnsLogCap.Store(200000) }
 
-type DB struct {
-	*redis.Client
-	coin    string
-	shares  chan shareJob
+// RedisDB is the redis backend of DB, keeping every series under "<coin>:" keys.
+// In cluster mode the prefix is the hash tag "{<coin>}:", which puts every key
+// in one slot so the MULTI pipelines in putShareNow and ApplyPayments and the
+// round-seal Rename stay legal.
+type RedisDB struct {
+	redis.UniversalClient
+	shareQueue
+	hashrateBuckets
+	prefix  string
 	ppsMode bool // pps retains uncredited shares (trimmed by cursor, not by rank)
+
+	// failed is the share whose last write returned an error, with the seq it
+	// took and the write id its MULTI records in shares:applied, so retrying
+	// it can tell whether the MULTI ran before the connection dropped. Only
+	// the share writer touches it.
+	failed struct {
+		share   *types.Share
+		seq     int64
+		writeID string
+	}
 }
 
 // SetPPSMode switches the PPLNS-log retention policy: in PPS mode the log is not
 // rank-capped (that could drop uncredited shares); it is trimmed by the payout
 // cursor instead. Set once at startup, before shares flow.
-func (s *DB) SetPPSMode(pps bool) { s.ppsMode = pps }
+func (s *RedisDB) SetPPSMode(pps bool) { s.ppsMode = pps }
 
-type shareJob struct {
-	share    *types.Share
-	accepted bool
-}
-
-func NewStorage(coinName string, options *config.RedisOptions) *DB {
-	client := redis.NewClient(options.ToRedisOptions())
-	if client == nil {
-		log.Panic("failed to connect to the redis server. If you dont wanna db storage please delete redis config in config file")
-		return nil
+func NewRedisDB(coinName string, options *config.RedisOptions) *RedisDB {
+	client, err := options.NewClient()
+	if err != nil {
+		log.Panic("bad redis config: ", err)
 	}
 
+	// An unreachable server is not fatal: the client reconnects by itself and
+	// the share writer buffers until it answers.
 	result, err := client.Ping(context.Background()).Result()
 	if err != nil || strings.ToLower(result) != "pong" {
-		log.Panicf("failed to connect to the redis server: %s %s", result, err)
+		log.Errorf("redis is not reachable yet, shares will be buffered: %s %s", result, err)
 	}
 
-	db := &DB{
-		Client: client,
-		coin:   coinName,
-		shares: make(chan shareJob, 4096),
+	prefix := coinName
+	if options.GetMode() == config.RedisCluster {
+		prefix = "{" + coinName + "}"
 	}
-	go db.shareWriter()
+	db := &RedisDB{
+		UniversalClient: client,
+		prefix:          prefix,
+	}
+	db.start(coinName, db.putShareNow)
+	db.startHashrate(db.PruneHashrate)
 	return db
 }
 
-// PutShare enqueues a share for the single ordered writer and returns at once, so
-// a submitting client goroutine never blocks on redis. Ordering matters: shares
-// are applied FIFO so a block's round seal (Rename roundCurrent -> round<height>)
-// captures exactly the shares recorded before it — a per-share goroutine let the
-// seal race the round-contribution increments and mis-attribute rounds.
-func (s *DB) PutShare(share *types.Share, accepted bool) {
-	s.shares <- shareJob{share: share, accepted: accepted}
+// Close applies the queued shares, or leaves them in the journal, and
+// disconnects.
+func (s *RedisDB) Close() error {
+	s.stopHashrate()
+	err := s.writer.close()
+	if cerr := s.UniversalClient.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
-// shareWriter drains the queue and applies each share in submission order.
-func (s *DB) shareWriter() {
-	for job := range s.shares {
-		s.putShareNow(job.share, job.accepted)
+// unreachable reports whether err is a connection failure, or a server that
+// can't take writes during a failover or resharding, so the command is worth
+// retrying. A dropped connection may still have run it.
+func unreachable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) {
+		return true
 	}
+	for _, prefix := range []string{"LOADING", "READONLY", "MASTERDOWN", "CLUSTERDOWN", "TRYAGAIN"} {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true
+		}
+	}
+	return false
 }
 
-func (s *DB) putShareNow(share *types.Share, accepted bool) {
-	now := time.Now().Unix()
-
-	ppl := s.Pipeline()
+// putShareNow writes one share in a MULTI pipeline and returns unreachable
+// errors so the writer retries it. The MULTI also sets shares:applied to the
+// write's id: a retry whose id is already there was applied with its reply
+// lost, and is not credited or sealed again. The round seal is a Rename
+// roundCurrent -> round<height> in the same pipeline.
+func (s *RedisDB) putShareNow(share *types.Share, accepted bool) error {
+	now := share.Time
 	ctx := context.Background()
 
-	strDiff := strconv.FormatFloat(share.Diff, 'f', 5, 64)
-	ppl.SAdd(ctx, s.coin+":pool:miners", share.Miner)              // miner index
-	ppl.SAdd(ctx, s.coin+":miner:"+share.Miner+":rigs", share.Rig) // rig index
+	if share == s.failed.share {
+		applied, err := s.Get(ctx, s.prefix+":shares:applied").Result()
+		if unreachable(err) {
+			return err
+		}
+		if applied == s.failed.writeID {
+			s.failed.share = nil
+			return nil
+		}
+	} else {
+		s.failed.share, s.failed.seq, s.failed.writeID = share, 0, utils.RandHexUint64()
+	}
+
+	seq := s.failed.seq
+	if share.ErrorCode == 0 && seq == 0 {
+		// seq is fetched first so it can also mark the block's window upper bound.
+		var err error
+		if seq, err = s.Incr(ctx, s.prefix+":shares:seq").Result(); unreachable(err) {
+			return err
+		}
+		s.failed.seq = seq
+	}
+
+	var found *FoundBlock
+	if len(share.BlockHex) > 0 && accepted {
+		// the round total is read ahead of the MULTI; this writer is the only
+		// one adding to the round, so it holds until the seal below
+		roundShares, err := s.roundTotal(ctx, share.PayMode)
+		if unreachable(err) {
+			return err
+		}
+		if share.ErrorCode == 0 {
+			roundShares += share.Diff
+		}
+		found = newFoundBlock(share, roundShares, now)
+	}
+
+	ppl := s.TxPipeline()
+
+	ppl.Set(ctx, s.prefix+":shares:applied", s.failed.writeID, 0)
+	ppl.SAdd(ctx, s.prefix+":pool:miners", share.Miner)              // miner index
+	ppl.SAdd(ctx, s.prefix+":miner:"+share.Miner+":rigs", share.Rig) // rig index
 
-	var seq int64
 	if share.ErrorCode == 0 {
 		log.Info("recording valid share")
 		// PPLNS log: append this share to a capped, monotonically-scored ZSet so a
-		// block can pay the last-N-difficulty window across rounds. seq is fetched
-		// synchronously so it can also mark the block's window upper bound.
-		seq, _ = s.Incr(ctx, s.coin+":shares:seq").Result()
-		ppl.ZAdd(ctx, s.coin+":shares:pplnslog", &redis.Z{
+		// block can pay the last-N-difficulty window across rounds.
+		member := share.Miner + ":" + strconv.FormatFloat(share.Diff, 'f', -1, 64) + ":" + strconv.FormatInt(seq, 10) +
+			":" + strconv.FormatInt(now, 10) + ":" + strconv.FormatFloat(share.Value, 'f', -1, 64)
+		ppl.ZAdd(ctx, s.shareLogKey(share.PayMode), &redis.Z{
 			Score:  float64(seq),
-			Member: share.Miner + ":" + strconv.FormatFloat(share.Diff, 'f', -1, 64) + ":" + strconv.FormatInt(seq, 10),
+			Member: member,
 		})
 		// Rank-cap the log so it can't grow unbounded — but ONLY outside PPS mode.
 		// In PPS the log is trimmed by the payout cursor (ApplyPayments), so a burst
 		// of >pplnsLogCap shares between runs never drops uncredited ones.
 		if !s.ppsMode {
-			ppl.ZRemRangeByRank(ctx, s.coin+":shares:pplnslog", 0, -(pplnsLogCap.Load() + 1))
+			ppl.ZRemRangeByRank(ctx, s.shareLogKey(share.PayMode), 0, -(pplnsLogCap.Load() + 1))
 		}
 		// current-round contribution, sealed to shares:round<height> on a block.
-		ppl.HIncrByFloat(ctx, s.coin+":shares:roundCurrent", share.Miner, share.Diff)
-		ppl.HIncrBy(ctx, s.coin+":miners:validShares", share.Miner, 1)
-
-		ppl.HIncrBy(ctx, s.coin+":pool", "validShares", 1)
-
-		// cost storage for speed, dont use for range to replace this
-		ppl.ZAdd(ctx, s.coin+":pool:shares", &redis.Z{
-			Score:  float64(now),
-			Member: strDiff,
-		})
+		ppl.HIncrByFloat(ctx, s.roundKey(share.PayMode), share.Miner, share.Diff)
+		ppl.HIncrBy(ctx, s.prefix+":miners:validShares", share.Miner, 1)
 
-		ppl.ZAdd(ctx, s.coin+":miner:"+share.Miner+":hashes", &redis.Z{
-			Score:  float64(now),
-			Member: strDiff,
-		})
-
-		ppl.ZAdd(ctx, s.coin+":miner:"+share.Miner+":rig:"+share.Rig+":hashes", &redis.Z{
-			Score:  float64(now),
-			Member: strDiff,
-		})
+		ppl.HIncrBy(ctx, s.prefix+":pool", "validShares", 1)
 
+		// hashrate: the difficulty summed per bucket at every resolution
+		for _, res := range hashrateResolutions {
+			field := strconv.FormatInt(bucket(now, res), 10)
+			for _, series := range []string{"pool", "miner:" + share.Miner, "rig:" + share.Miner + ":" + share.Rig} {
+				ppl.HIncrByFloat(ctx, s.hashrateKey(res, series), field, share.Diff)
+			}
+		}
 	} else {
 		log.Warn("recording invalid share")
-		ppl.HIncrBy(ctx, s.coin+":miners:invalidShares", share.Miner, 1)
+		ppl.HIncrBy(ctx, s.prefix+":miners:invalidShares", share.Miner, 1)
 
-		ppl.HIncrBy(ctx, s.coin+":pool", "invalidShares", 1)
+		ppl.HIncrBy(ctx, s.prefix+":pool", "invalidShares", 1)
 	}
 
 	// when mined one => seal roundCount,
@@ -147,173 +211,572 @@ func (s *DB) putShareNow(share *types.Share, accepted bool) {
 			// exactly the miners who contributed to this block, and record the
 			// block as pending with the data the payer needs: hash (block id),
 			// txHash (coinbase, for gettransaction) and height (the round key).
-			ppl.Rename(ctx, s.coin+":shares:roundCurrent", s.coin+":shares:round"+strconv.FormatInt(share.BlockHeight, 10))
-			ppl.SAdd(ctx, s.coin+":blocks:pending", (&PendingBlock{
-				Hash:   share.BlockHash,
-				TxHash: share.TxHash,
-				Height: uint64(share.BlockHeight),
-				Finder: share.Miner, // solo payMode
-				Mark:   seq,         // pplns window upper bound
+			ppl.Rename(ctx, s.roundKey(share.PayMode), s.prefix+":shares:round"+strconv.FormatInt(share.BlockHeight, 10))
+			s.putFoundBlock(ctx, ppl, found)
+			ppl.SAdd(ctx, s.prefix+":blocks:pending", (&PendingBlock{
+				Hash:    share.BlockHash,
+				TxHash:  share.TxHash,
+				Height:  uint64(share.BlockHeight),
+				Finder:  share.Miner, // solo payMode
+				Mark:    seq,         // pplns window upper bound
+				PayMode: share.PayMode,
 			}).String())
 
-			ppl.HIncrBy(ctx, s.coin+":pool", "validBlocks", 1)
+			// Record who the coinbase already paid so the payer only pays the
+			// remainder left in the pool output.
+			for miner, sat := range share.CoinbasePaid {
+				ppl.HSet(ctx, s.prefix+":coinbase:paid"+strconv.FormatInt(share.BlockHeight, 10), miner, sat)
+			}
+			for miner, diff := range share.CoinbaseWindow {
+				ppl.HSet(ctx, s.prefix+":coinbase:window"+strconv.FormatInt(share.BlockHeight, 10), miner,
+					strconv.FormatFloat(diff, 'f', -1, 64))
+			}
+
+			ppl.HIncrBy(ctx, s.prefix+":pool", "validBlocks", 1)
 		} else {
 			log.Warn("recording invalid block")
-			ppl.HIncrBy(ctx, s.coin+":pool", "invalidBlocks", 1)
+			ppl.HIncrBy(ctx, s.prefix+":pool", "invalidBlocks", 1)
+		}
+
+		if share.BlockRejection != nil {
+			raw, _ := json.Marshal(&RejectedBlock{
+				Height:         share.BlockHeight,
+				Hash:           share.BlockHash,
+				Miner:          share.Miner,
+				Rig:            share.Rig,
+				Time:           now,
+				Accepted:       accepted,
+				BlockRejection: share.BlockRejection,
+			})
+			ppl.LPush(ctx, s.prefix+":blocks:rejected", raw)
+			ppl.LTrim(ctx, s.prefix+":blocks:rejected", 0, rejectedBlocksCap-1)
 		}
 	}
 
 	_, err := ppl.Exec(ctx)
+	if unreachable(err) {
+		return err
+	}
+	s.failed.share = nil
 	if err != nil {
 		log.Error(err)
 	}
+	return nil
 }
 
-func (s *DB) GetMinerIndex() ([]string, error) {
-	return s.SMembers(context.Background(), s.coin+":pool:miners").Result()
+// roundTotal sums the difficulty submitted in the current round.
+func (s *RedisDB) roundTotal(ctx context.Context, group string) (float64, error) {
+	values, err := s.HVals(ctx, s.roundKey(group)).Result()
+	if err != nil {
+		return 0, err
+	}
+	var total float64
+	for _, v := range values {
+		diff, _ := strconv.ParseFloat(v, 64)
+		total += diff
+	}
+	return total, nil
 }
 
-func (s *DB) GetRigIndex(minerName string) ([]string, error) {
-	return s.SMembers(context.Background(), s.coin+":miner:"+minerName+":rigs").Result()
+// putFoundBlock writes a found-block record: JSON in blocks:found by hash,
+// ordered by time in blocks:found:order.
+func (s *RedisDB) putFoundBlock(ctx context.Context, ppl redis.Pipeliner, fb *FoundBlock) {
+	raw, _ := json.Marshal(fb)
+	ppl.HSet(ctx, s.prefix+":blocks:found", fb.Hash, raw)
+	ppl.ZAdd(ctx, s.prefix+":blocks:found:order", &redis.Z{Score: float64(fb.Time), Member: fb.Hash})
 }
 
-// GetCurrentRoundCount will return a total diff of shares the miner submitted
-func (s *DB) GetMinerCurrentRoundContrib(minerName string) (float64, error) {
-	return s.HGet(context.Background(), s.coin+":shares:roundCurrent", minerName).Float64()
+// GetFoundBlocks returns the newest limit found blocks, newest first.
+func (s *RedisDB) GetFoundBlocks(limit int) ([]*FoundBlock, error) {
+	ctx := context.Background()
+	hashes, err := s.ZRevRange(ctx, s.prefix+":blocks:found:order", 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return s.foundBlocks(ctx, hashes)
 }
 
-// GetMinerTotalShares will return the number of all valid shares
-func (s *DB) GetPoolTotalValidShares() (uint64, error) {
-	return s.HGet(context.Background(), s.coin+":pool", "validShares").Uint64()
+func (s *RedisDB) foundBlocks(ctx context.Context, hashes []string) ([]*FoundBlock, error) {
+	blocks := make([]*FoundBlock, 0, len(hashes))
+	if len(hashes) == 0 {
+		return blocks, nil
+	}
+	raws, err := s.HMGet(ctx, s.prefix+":blocks:found", hashes...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, raw := range raws {
+		str, ok := raw.(string)
+		if !ok {
+			continue
+		}
+		var fb FoundBlock
+		if err := json.Unmarshal([]byte(str), &fb); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, &fb)
+	}
+	return blocks, nil
 }
 
-// GetMinerTotalShares will return the number of all valid blocks
-func (s *DB) GetPoolTotalValidBlocks() (uint64, error) {
-	return s.HGet(context.Background(), s.coin+":pool", "validBlocks").Uint64()
+func (s *RedisDB) GetMinerIndex() ([]string, error) {
+	return s.SMembers(context.Background(), s.prefix+":pool:miners").Result()
 }
 
-// GetMinerTotalShares will return the number of all invalid shares
-func (s *DB) GetPoolTotalInvalidShares() (uint64, error) {
-	return s.HGet(context.Background(), s.coin+":pool", "validShares").Uint64()
+func (s *RedisDB) GetRigIndex(minerName string) ([]string, error) {
+	return s.SMembers(context.Background(), s.prefix+":miner:"+minerName+":rigs").Result()
 }
 
-// GetMinerTotalShares will return the number of all invalid blocks
-func (s *DB) GetPoolTotalInvalidBlocks() (uint64, error) {
-	return s.HGet(context.Background(), s.coin+":pool", "invalidBlocks").Uint64()
+// GetMinerCurrentRoundContrib returns the total diff of shares the miner
+// submitted in the current round of every share group, 0 when none.
+func (s *RedisDB) GetMinerCurrentRoundContrib(minerName string) (float64, error) {
+	ctx := context.Background()
+	ppl := s.Pipeline()
+	cmds := make([]*redis.StringCmd, 0, len(shareGroups))
+	for _, group := range shareGroups {
+		cmds = append(cmds, ppl.HGet(ctx, s.roundKey(group), minerName))
+	}
+	if _, err := ppl.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	var total float64
+	for _, cmd := range cmds {
+		if v, err := cmd.Float64(); err == nil {
+			total += v
+		}
+	}
+	return total, nil
 }
 
-// GetMinerTotalShares will return the number of all invalid blocks
-func (s *DB) GetRigHashrate(minerName, rigName string, from, to int64) (hashrate float64, err error) {
-	slice, err := s.ZRange(context.Background(), s.coin+":miner:"+minerName+":rig:"+rigName+":hashes", from, to).Result()
-	if err != nil {
-		return 0.0, err
+// roundKey is the current round of a share group; the rounds sealed from it
+// are keyed by block height alone, so they are shared by every group.
+func (s *RedisDB) roundKey(group string) string {
+	if group == "" {
+		return s.prefix + ":shares:roundCurrent"
 	}
+	return s.prefix + ":shares:roundCurrent:" + group
+}
 
-	var totalDiff float64
-	for i := range slice {
-		diff, err := strconv.ParseFloat(slice[i], 64)
-		if err != nil {
-			return 0.0, err
-		}
+// shareLogKey is the share log of a share group.
+func (s *RedisDB) shareLogKey(group string) string {
+	if group == "" {
+		return s.prefix + ":shares:pplnslog"
+	}
+	return s.prefix + ":shares:pplnslog:" + group
+}
 
-		totalDiff += diff
+// GetPoolTotalValidShares returns the number of all valid shares
+func (s *RedisDB) GetPoolTotalValidShares() (uint64, error) {
+	return s.poolCounter("validShares")
+}
+
+// GetPoolTotalValidBlocks returns the number of all valid blocks
+func (s *RedisDB) GetPoolTotalValidBlocks() (uint64, error) {
+	return s.poolCounter("validBlocks")
+}
+
+// GetPoolTotalInvalidShares returns the number of all invalid shares
+func (s *RedisDB) GetPoolTotalInvalidShares() (uint64, error) {
+	return s.poolCounter("invalidShares")
+}
+
+// GetPoolTotalInvalidBlocks returns the number of all invalid blocks
+func (s *RedisDB) GetPoolTotalInvalidBlocks() (uint64, error) {
+	return s.poolCounter("invalidBlocks")
+}
+
+func (s *RedisDB) poolCounter(field string) (uint64, error) {
+	v, err := s.HGet(context.Background(), s.prefix+":pool", field).Uint64()
+	if err == redis.Nil {
+		return 0, nil
 	}
+	return v, err
+}
+
+// GetRigHashrate returns the difficulty per second the rig submitted in [from, to].
+func (s *RedisDB) GetRigHashrate(minerName, rigName string, from, to int64) (hashrate float64, err error) {
+	return s.hashrate("rig:"+minerName+":"+rigName, from, to)
+}
+
+// GetMinerHashrate returns the difficulty per second the miner submitted in [from, to].
+func (s *RedisDB) GetMinerHashrate(minerName string, from, to int64) (hashrate float64, err error) {
+	return s.hashrate("miner:"+minerName, from, to)
+}
 
-	return totalDiff / float64(to-from), nil
+// GetPoolHashrate returns the difficulty per second the pool received in [from, to].
+func (s *RedisDB) GetPoolHashrate(from, to int64) (float64, error) {
+	return s.hashrate("pool", from, to)
 }
 
-// GetMinerTotalShares will return the number of all invalid blocks
-func (s *DB) GetMinerHashrate(minerName string, from, to int64) (hashrate float64, err error) {
-	slice, err := s.ZRange(context.Background(), s.coin+":miner:"+minerName+":shares", from, to).Result()
+// hashrateKey is the hash of a series' buckets at res, keyed by bucket start.
+func (s *RedisDB) hashrateKey(res int64, series string) string {
+	return s.prefix + ":hashrate:" + strconv.FormatInt(res, 10) + ":" + series
+}
+
+func (s *RedisDB) hashrate(series string, from, to int64) (float64, error) {
+	q, ok := s.bucketsFor(from, to, time.Now().Unix())
+	if !ok {
+		return 0, nil
+	}
+	fields := make([]string, 0, (q.last-q.first)/q.res+1)
+	for b := q.first; b <= q.last; b += q.res {
+		fields = append(fields, strconv.FormatInt(b, 10))
+	}
+	values, err := s.HMGet(context.Background(), s.hashrateKey(q.res, series), fields...).Result()
 	if err != nil {
-		return 0.0, err
+		return 0, err
 	}
 
 	var totalDiff float64
-	for i := range slice {
-		diff, err := strconv.ParseFloat(slice[i], 64)
+	for _, v := range values {
+		str, ok := v.(string)
+		if !ok {
+			continue // empty bucket
+		}
+		diff, err := strconv.ParseFloat(str, 64)
 		if err != nil {
-			return 0.0, err
+			return 0, err
 		}
-
 		totalDiff += diff
 	}
 
-	return totalDiff / float64(to-from), nil
+	return totalDiff / q.span, nil
 }
 
-// GetMinerTotalShares will return the number of all invalid blocks
-func (s *DB) GetPoolHashrate(from, to int64) (float64, error) {
-	slice, err := s.ZRange(context.Background(), s.coin+":pool:shares", from, to).Result()
+// PruneHashrate drops the buckets older than their resolution's retention,
+// along with the raw per-share series kept before bucketing.
+func (s *RedisDB) PruneHashrate(now int64) error {
+	ctx := context.Background()
+	miners, err := s.SMembers(ctx, s.prefix+":pool:miners").Result()
 	if err != nil {
-		return 0.0, err
+		return err
+	}
+	ppl := s.Pipeline()
+	rigCmds := make([]*redis.StringSliceCmd, len(miners))
+	for i, miner := range miners {
+		rigCmds[i] = ppl.SMembers(ctx, s.prefix+":miner:"+miner+":rigs")
+	}
+	if _, err := ppl.Exec(ctx); err != nil && err != redis.Nil {
+		return err
 	}
 
-	var totalDiff float64
-	for i := range slice {
-		diff, err := strconv.ParseFloat(slice[i], 64)
-		if err != nil {
-			return 0.0, err
+	series := []string{"pool"}
+	legacy := []string{s.prefix + ":pool:shares"}
+	for i, miner := range miners {
+		series = append(series, "miner:"+miner)
+		legacy = append(legacy, s.prefix+":miner:"+miner+":hashes")
+		for _, rig := range rigCmds[i].Val() {
+			series = append(series, "rig:"+miner+":"+rig)
+			legacy = append(legacy, s.prefix+":miner:"+miner+":rig:"+rig+":hashes")
 		}
+	}
 
-		totalDiff += diff
+	ppl = s.Pipeline()
+	var keys []string
+	var keyCmds []*redis.StringSliceCmd
+	var keyCuts []int64
+	cut := s.cutoffs(now)
+	for i, res := range hashrateResolutions {
+		for _, name := range series {
+			key := s.hashrateKey(res, name)
+			keys = append(keys, key)
+			keyCmds = append(keyCmds, ppl.HKeys(ctx, key))
+			keyCuts = append(keyCuts, cut[i])
+		}
+	}
+	if _, err := ppl.Exec(ctx); err != nil && err != redis.Nil {
+		return err
 	}
 
-	return totalDiff / float64(to-from), nil
+	ppl = s.Pipeline()
+	for i, cmd := range keyCmds {
+		var stale []string
+		for _, field := range cmd.Val() {
+			if start, err := strconv.ParseInt(field, 10, 64); err != nil || start < keyCuts[i] {
+				stale = append(stale, field)
+			}
+		}
+		if len(stale) > 0 {
+			ppl.HDel(ctx, keys[i], stale...)
+		}
+	}
+	ppl.Del(ctx, legacy...)
+	_, err = ppl.Exec(ctx)
+	return err
 }
 
 // GetCurrentRoundCount will return a total diff of shares the miner submitted
-func (s *DB) GetMinerRigs(minerName string) (float64, error) {
-	return s.HGet(context.Background(), s.coin+":shares:contrib", minerName).Float64()
-}
-
-// PaymentUpdate is the atomic result of one payout run, applied by ApplyPayments
-// in a single redis pipeline so balances, payouts and block state never diverge.
-type PaymentUpdate struct {
-	Balances     map[string]float64 // miner -> new carried-over balance (coin), absolute
-	Paid         map[string]float64 // miner -> amount paid this run (coin), added to payouts
-	Confirmed    []string           // pending block strings moving to confirmed
-	Orphaned     []string           // pending block strings moving to orphaned
-	DeleteRounds []uint64           // sealed round heights whose shares are now accounted
-	PPSCursor    int64              // pps: advance the credited-share cursor (0 = leave)
+func (s *RedisDB) GetMinerRigs(minerName string) (float64, error) {
+	return s.HGet(context.Background(), s.prefix+":shares:contrib", minerName).Float64()
 }
 
 // ApplyPayments persists one payout run atomically: it overwrites each miner's
 // carried-over balance, adds this run's payouts, moves settled blocks out of the
 // pending set, and drops the sealed rounds that were paid.
-func (s *DB) ApplyPayments(u *PaymentUpdate) error {
+func (s *RedisDB) ApplyPayments(u *PaymentUpdate) error {
 	ctx := context.Background()
+	settled, err := s.settledBlocks(ctx, u)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	payout, err := newPayout(u, now)
+	if err != nil {
+		return fmt.Errorf("settling block: %w", err)
+	}
+	trim, err := s.ppsTrim(ctx, u.PPSCursor)
+	if err != nil {
+		return err
+	}
+
 	// TxPipeline wraps the writes in MULTI/EXEC so a payout run's balance, payout,
 	// block-state, round-deletion and cursor updates apply all-or-nothing.
 	ppl := s.TxPipeline()
 	for miner, bal := range u.Balances {
-		ppl.HSet(ctx, s.coin+":balances", miner, strconv.FormatFloat(bal, 'f', -1, 64))
+		ppl.HSet(ctx, s.prefix+":balances", miner, strconv.FormatFloat(bal, 'f', -1, 64))
 	}
 	for miner, paid := range u.Paid {
-		ppl.HIncrByFloat(ctx, s.coin+":payouts", miner, paid)
+		ppl.HIncrByFloat(ctx, s.prefix+":payouts", miner, paid)
 	}
 	for _, b := range u.Confirmed {
-		ppl.SMove(ctx, s.coin+":blocks:pending", s.coin+":blocks:confirmed", b)
+		ppl.SMove(ctx, s.prefix+":blocks:pending", s.prefix+":blocks:confirmed", b)
 	}
 	for _, b := range u.Orphaned {
-		ppl.SMove(ctx, s.coin+":blocks:pending", s.coin+":blocks:orphaned", b)
+		ppl.SMove(ctx, s.prefix+":blocks:pending", s.prefix+":blocks:orphaned", b)
+	}
+	for _, fb := range settled {
+		s.putFoundBlock(ctx, ppl, fb)
+	}
+	if payout != nil {
+		s.putPayout(ctx, ppl, payout)
+		ppl.HSet(ctx, s.prefix+":payouts:unconfirmed", payout.Txid, payout.Time)
+	}
+	for _, p := range coinbasePayouts(u, now) {
+		for miner, paid := range p.Amounts {
+			ppl.HIncrByFloat(ctx, s.prefix+":payouts", miner, paid)
+		}
+		s.putPayout(ctx, ppl, p)
 	}
 	for _, h := range u.DeleteRounds {
-		ppl.Del(ctx, s.coin+":shares:round"+strconv.FormatUint(h, 10))
+		ppl.Del(ctx, s.prefix+":shares:round"+strconv.FormatUint(h, 10))
+		ppl.Del(ctx, s.prefix+":coinbase:paid"+strconv.FormatUint(h, 10))
+		ppl.Del(ctx, s.prefix+":coinbase:window"+strconv.FormatUint(h, 10))
 	}
 	if u.PPSCursor > 0 {
-		ppl.Set(ctx, s.coin+":pps:cursor", u.PPSCursor, 0)
-		// Shares up to the cursor are now credited — drop them so the PPS log stays
-		// bounded by the uncredited tail instead of the (skipped) rank cap.
-		ppl.ZRemRangeByScore(ctx, s.coin+":shares:pplnslog", "0", strconv.FormatInt(u.PPSCursor, 10))
+		ppl.Set(ctx, s.prefix+":pps:cursor", u.PPSCursor, 0)
+		// Shares up to the cursor are now credited — drop those past the cap so the
+		// PPS log stays bounded by the uncredited tail and the cap.
+		if trim > 0 {
+			ppl.ZRemRangeByScore(ctx, s.shareLogKey(""), "0", strconv.FormatInt(trim, 10))
+		}
 	}
 	// This run's intent is now realized — drop it in the same atomic commit so a
 	// resumed run can't re-apply it.
-	ppl.Del(ctx, s.coin+":payouts:intent")
-	_, err := ppl.Exec(ctx)
+	ppl.Del(ctx, s.prefix+":payouts:intent")
+	_, err = ppl.Exec(ctx)
+	return err
+}
+
+// putPayout appends a ledger entry: JSON in payouts:ledger by txid, ordered by
+// time in payouts:ledger:order and in payouts:miner:<miner> for each payee.
+func (s *RedisDB) putPayout(ctx context.Context, ppl redis.Pipeliner, p *Payout) {
+	raw, _ := json.Marshal(p)
+	ppl.HSet(ctx, s.prefix+":payouts:ledger", p.Txid, raw)
+	z := &redis.Z{Score: float64(p.Time), Member: p.Txid}
+	ppl.ZAdd(ctx, s.prefix+":payouts:ledger:order", z)
+	for miner := range p.Amounts {
+		ppl.ZAdd(ctx, s.prefix+":payouts:miner:"+miner, z)
+	}
+}
+
+func (s *RedisDB) GetPayouts(limit int) ([]*Payout, error) {
+	return s.payoutsIn(s.prefix+":payouts:ledger:order", limit)
+}
+
+func (s *RedisDB) GetPayout(txid string) (*Payout, error) {
+	payouts, err := s.payouts(context.Background(), []string{txid})
+	if err != nil || len(payouts) == 0 {
+		return nil, err
+	}
+	return payouts[0], nil
+}
+
+func (s *RedisDB) GetMinerPayouts(miner string, limit int) ([]*MinerPayout, error) {
+	payouts, err := s.payoutsIn(s.prefix+":payouts:miner:"+miner, limit)
+	if err != nil {
+		return nil, err
+	}
+	mine := make([]*MinerPayout, len(payouts))
+	for i, p := range payouts {
+		mine[i] = p.forMiner(miner)
+	}
+	return mine, nil
+}
+
+func (s *RedisDB) GetUnconfirmedPayouts() (map[string]int64, error) {
+	m, err := s.HGetAll(context.Background(), s.prefix+":payouts:unconfirmed").Result()
+	if err != nil {
+		return nil, err
+	}
+	watched := make(map[string]int64, len(m))
+	for txid, since := range m {
+		if watched[txid], err = strconv.ParseInt(since, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return watched, nil
+}
+
+func (s *RedisDB) ConfirmPayout(txid string) error {
+	return s.HDel(context.Background(), s.prefix+":payouts:unconfirmed", txid).Err()
+}
+
+func (s *RedisDB) ConflictPayout(txid string) error {
+	ctx := context.Background()
+	payouts, err := s.payouts(ctx, []string{txid})
+	if err != nil || len(payouts) == 0 {
+		return err
+	}
+	p := payouts[0]
+	p.Conflicted = true
+	raw, _ := json.Marshal(p)
+	return s.HSet(ctx, s.prefix+":payouts:ledger", txid, raw).Err()
+}
+
+func (s *RedisDB) ReplacePayout(old, txid string, now int64) error {
+	ctx := context.Background()
+	payouts, err := s.payouts(ctx, []string{old})
+	if err != nil {
+		return err
+	}
+	intentTxid, err := s.HGet(ctx, s.prefix+":payouts:intent", "txid").Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	ppl := s.TxPipeline()
+	if len(payouts) > 0 {
+		p := payouts[0]
+		ppl.HDel(ctx, s.prefix+":payouts:ledger", old)
+		ppl.ZRem(ctx, s.prefix+":payouts:ledger:order", old)
+		for miner := range p.Amounts {
+			ppl.ZRem(ctx, s.prefix+":payouts:miner:"+miner, old)
+		}
+		p.Txid, p.Replaced = txid, append(p.Replaced, old)
+		s.putPayout(ctx, ppl, p)
+	}
+	if intentTxid == old {
+		ppl.HSet(ctx, s.prefix+":payouts:intent", "txid", txid)
+	}
+	ppl.HDel(ctx, s.prefix+":payouts:unconfirmed", old)
+	ppl.HSet(ctx, s.prefix+":payouts:unconfirmed", txid, now)
+	_, err = ppl.Exec(ctx)
 	return err
 }
 
+func (s *RedisDB) GetMinerSettings(miner string) (*MinerSettings, error) {
+	raw, err := s.HGet(context.Background(), s.prefix+":miners:settings", miner).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var settings MinerSettings
+	if err := json.Unmarshal([]byte(raw), &settings); err != nil {
+		return nil, fmt.Errorf("settings of %s: %w", miner, err)
+	}
+	return &settings, nil
+}
+
+func (s *RedisDB) GetAllMinerSettings() (map[string]*MinerSettings, error) {
+	raws, err := s.HGetAll(context.Background(), s.prefix+":miners:settings").Result()
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]*MinerSettings, len(raws))
+	for miner, raw := range raws {
+		var settings MinerSettings
+		if err := json.Unmarshal([]byte(raw), &settings); err != nil {
+			return nil, fmt.Errorf("settings of %s: %w", miner, err)
+		}
+		all[miner] = &settings
+	}
+	return all, nil
+}
+
+func (s *RedisDB) SetMinerSettings(miner string, settings *MinerSettings) error {
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return s.HSet(context.Background(), s.prefix+":miners:settings", miner, raw).Err()
+}
+
+// payoutsIn reads the newest limit ledger entries listed in the order ZSet key.
+func (s *RedisDB) payoutsIn(key string, limit int) ([]*Payout, error) {
+	ctx := context.Background()
+	txids, err := s.ZRevRange(ctx, key, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return s.payouts(ctx, txids)
+}
+
+func (s *RedisDB) payouts(ctx context.Context, txids []string) ([]*Payout, error) {
+	payouts := make([]*Payout, 0, len(txids))
+	if len(txids) == 0 {
+		return payouts, nil
+	}
+	raws, err := s.HMGet(ctx, s.prefix+":payouts:ledger", txids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, raw := range raws {
+		str, ok := raw.(string)
+		if !ok {
+			continue
+		}
+		var p Payout
+		if err := json.Unmarshal([]byte(str), &p); err != nil {
+			return nil, err
+		}
+		payouts = append(payouts, &p)
+	}
+	return payouts, nil
+}
+
+// settledBlocks returns the found-block records the update changes the status
+// of, already moved to their new status.
+func (s *RedisDB) settledBlocks(ctx context.Context, u *PaymentUpdate) ([]*FoundBlock, error) {
+	status := map[string]string{}
+	var hashes []string
+	for state, blocks := range map[string][]string{blockConfirmed: u.Confirmed, blockOrphaned: u.Orphaned} {
+		for _, str := range blocks {
+			pb, err := NewPendingBlockFromString(str)
+			if err != nil {
+				return nil, fmt.Errorf("settling block: %w", err)
+			}
+			status[pb.Hash] = state
+			hashes = append(hashes, pb.Hash)
+		}
+	}
+
+	found, err := s.foundBlocks(ctx, hashes)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	settled := found[:0]
+	for _, fb := range found {
+		if fb.transition(status[fb.Hash], now) {
+			settled = append(settled, fb)
+		}
+	}
+	return settled, nil
+}
+
 // --- durable payout intent (double-spend guard) ---
 //
 // sendmany broadcasts on-chain, then ApplyPayments records it in redis. If the
@@ -324,23 +787,23 @@ func (s *DB) ApplyPayments(u *PaymentUpdate) error {
 
 // PutPayoutIntent records the update a payout run is about to broadcast (txid
 // empty until the send returns).
-func (s *DB) PutPayoutIntent(u *PaymentUpdate) error {
+func (s *RedisDB) PutPayoutIntent(u *PaymentUpdate) error {
 	b, err := json.Marshal(u)
 	if err != nil {
 		return err
 	}
-	return s.HSet(context.Background(), s.coin+":payouts:intent", "update", b, "txid", "").Err()
+	return s.HSet(context.Background(), s.prefix+":payouts:intent", "update", b, "txid", "").Err()
 }
 
 // SetPayoutIntentTxid stamps the broadcast transaction id onto the current intent
 // as soon as sendmany returns, narrowing the ambiguous window to the RPC itself.
-func (s *DB) SetPayoutIntentTxid(txid string) error {
-	return s.HSet(context.Background(), s.coin+":payouts:intent", "txid", txid).Err()
+func (s *RedisDB) SetPayoutIntentTxid(txid string) error {
+	return s.HSet(context.Background(), s.prefix+":payouts:intent", "txid", txid).Err()
 }
 
 // GetPayoutIntent returns the in-flight payout intent, if any.
-func (s *DB) GetPayoutIntent() (update *PaymentUpdate, txid string, exists bool, err error) {
-	m, err := s.HGetAll(context.Background(), s.coin+":payouts:intent").Result()
+func (s *RedisDB) GetPayoutIntent() (update *PaymentUpdate, txid string, exists bool, err error) {
+	m, err := s.HGetAll(context.Background(), s.prefix+":payouts:intent").Result()
 	if err != nil {
 		return nil, "", false, err
 	}
@@ -356,29 +819,47 @@ func (s *DB) GetPayoutIntent() (update *PaymentUpdate, txid string, exists bool,
 
 // DelPayoutIntent clears the intent (used when a send is known not to have
 // broadcast — e.g. the node rejected it).
-func (s *DB) DelPayoutIntent() error {
-	return s.Del(context.Background(), s.coin+":payouts:intent").Err()
+func (s *RedisDB) DelPayoutIntent() error {
+	return s.Del(context.Background(), s.prefix+":payouts:intent").Err()
+}
+
+func (s *RedisDB) GetAllMinerBalances() (map[string]float64, error) {
+	return s.minerAmounts(s.prefix + ":balances")
 }
 
-func (s *DB) GetAllMinerBalances() (map[string]float64, error) {
-	ss, err := s.HGetAll(context.Background(), s.coin+":balances").Result()
+func (s *RedisDB) GetAllMinerPaid() (map[string]float64, error) {
+	return s.minerAmounts(s.prefix + ":payouts")
+}
+
+// minerAmounts reads a miner -> coin hash.
+func (s *RedisDB) minerAmounts(key string) (map[string]float64, error) {
+	ss, err := s.HGetAll(context.Background(), key).Result()
 	if err != nil {
 		return nil, err
 	}
-	balances := make(map[string]float64)
-	for minerName, strBalance := range ss {
-		balance, err := strconv.ParseFloat(strBalance, 64)
+	amounts := make(map[string]float64)
+	for minerName, strAmount := range ss {
+		amount, err := strconv.ParseFloat(strAmount, 64)
 		if err != nil {
 			return nil, err
 		}
-		balances[minerName] = balance
+		amounts[minerName] = amount
 	}
 
-	return balances, nil
+	return amounts, nil
+}
+
+func (s *RedisDB) GetAllPendingBlocks() ([]*PendingBlock, error) {
+	return s.blockSet(s.prefix + ":blocks:pending")
 }
 
-func (s *DB) GetAllPendingBlocks() ([]*PendingBlock, error) {
-	strBlocks, err := s.SMembers(context.Background(), s.coin+":blocks:pending").Result()
+func (s *RedisDB) GetConfirmedBlocks() ([]*PendingBlock, error) {
+	return s.blockSet(s.prefix + ":blocks:confirmed")
+}
+
+// blockSet reads one of the sets of block strings a block moves through.
+func (s *RedisDB) blockSet(key string) ([]*PendingBlock, error) {
+	strBlocks, err := s.SMembers(context.Background(), key).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -396,12 +877,33 @@ func (s *DB) GetAllPendingBlocks() ([]*PendingBlock, error) {
 	return blocks, nil
 }
 
+// GetRejectedBlocks returns the most recent block candidates that failed the
+// pre-submit check or were refused by the daemon, newest first.
+func (s *RedisDB) GetRejectedBlocks() ([]*RejectedBlock, error) {
+	raws, err := s.LRange(context.Background(), s.prefix+":blocks:rejected", 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]*RejectedBlock, 0, len(raws))
+	for i := range raws {
+		var block RejectedBlock
+		if err := json.Unmarshal([]byte(raws[i]), &block); err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, &block)
+	}
+
+	return blocks, nil
+}
+
 // GetPPLNSShares returns per-miner share difficulty over the last-N window
 // ending at uptoSeq: it walks the PPLNS log backward from that mark, summing
 // difficulty per miner until the cumulative difficulty reaches window (window<=0
 // means no cap, bounded only by the log's own size).
-func (s *DB) GetPPLNSShares(uptoSeq int64, window float64) (map[string]float64, error) {
-	members, err := s.ZRevRangeByScore(context.Background(), s.coin+":shares:pplnslog", &redis.ZRangeBy{
+func (s *RedisDB) GetPPLNSShares(group string, uptoSeq int64, window float64) (map[string]float64, error) {
+	members, err := s.ZRevRangeByScore(context.Background(), s.shareLogKey(group), &redis.ZRangeBy{
 		Min: "-inf",
 		Max: strconv.FormatInt(uptoSeq, 10),
 	}).Result()
@@ -412,7 +914,7 @@ func (s *DB) GetPPLNSShares(uptoSeq int64, window float64) (map[string]float64,
 	out := make(map[string]float64)
 	var cum float64
 	for _, m := range members {
-		p := strings.SplitN(m, ":", 3) // miner:diff:seq
+		p := strings.SplitN(m, ":", 3) // miner:diff:seq[:time[:value]]
 		if len(p) < 2 {
 			continue
 		}
@@ -429,31 +931,131 @@ func (s *DB) GetPPLNSShares(uptoSeq int64, window float64) (map[string]float64,
 	return out, nil
 }
 
+// shareLogPage is how many log entries WalkShareLog reads per round trip.
+const shareLogPage = 1000
+
+// WalkShareLog pages the share log backward from uptoSeq, so a walk that stops
+// early reads only what it visited.
+func (s *RedisDB) WalkShareLog(group string, uptoSeq int64, visit func(*LoggedShare) bool) error {
+	max := strconv.FormatInt(uptoSeq, 10)
+	for {
+		zs, err := s.ZRevRangeByScoreWithScores(context.Background(), s.shareLogKey(group), &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   max,
+			Count: shareLogPage,
+		}).Result()
+		if err != nil {
+			return err
+		}
+		for _, z := range zs {
+			m, _ := z.Member.(string)
+			p := strings.Split(m, ":") // miner:diff:seq[:time[:value]]
+			if len(p) < 3 {
+				continue
+			}
+			diff, err := strconv.ParseFloat(p[1], 64)
+			if err != nil {
+				continue
+			}
+			ls := &LoggedShare{Seq: int64(z.Score), Miner: p[0], Diff: diff}
+			if len(p) > 3 {
+				ls.Time, _ = strconv.ParseInt(p[3], 10, 64)
+			}
+			if !visit(ls) {
+				return nil
+			}
+		}
+		if len(zs) < shareLogPage {
+			return nil
+		}
+		max = "(" + strconv.FormatInt(int64(zs[len(zs)-1].Score), 10)
+	}
+}
+
+// GetCoinbasePaid returns what the block at height paid miners directly in its
+// coinbase (miner -> satoshis); empty when coinbase payouts were off.
+func (s *RedisDB) GetCoinbasePaid(height uint64) (map[string]uint64, error) {
+	m, err := s.HGetAll(context.Background(), s.prefix+":coinbase:paid"+strconv.FormatUint(height, 10)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	paid := make(map[string]uint64, len(m))
+	for miner, v := range m {
+		sat, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		paid[miner] = sat
+	}
+	return paid, nil
+}
+
+// GetCoinbaseWindow returns the PPLNS window the coinbase of the block at
+// height was split over; empty when it paid nobody directly.
+func (s *RedisDB) GetCoinbaseWindow(height uint64) (map[string]float64, error) {
+	m, err := s.HGetAll(context.Background(), s.prefix+":coinbase:window"+strconv.FormatUint(height, 10)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	window := make(map[string]float64, len(m))
+	for miner, v := range m {
+		diff, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, err
+		}
+		window[miner] = diff
+	}
+	return window, nil
+}
+
+// ppsTrim is the sequence the PPS log can be trimmed up to once shares are
+// credited to cursor: the newest pplnsLogCap shares stay even when credited, so
+// pps+ can still split a block's fees over its pplns window. It is read before
+// the MULTI; shares appended meanwhile only make it more conservative.
+func (s *RedisDB) ppsTrim(ctx context.Context, cursor int64) (int64, error) {
+	if cursor <= 0 {
+		return 0, nil
+	}
+	capped, err := s.ZRevRangeWithScores(ctx, s.shareLogKey(""), pplnsLogCap.Load(), pplnsLogCap.Load()).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(capped) == 0 {
+		return 0, nil // the log is within the cap
+	}
+	if seq := int64(capped[0].Score); seq < cursor {
+		return seq, nil
+	}
+	return cursor, nil
+}
+
 // GetPPSCursor returns the highest share sequence already credited in pps mode.
-func (s *DB) GetPPSCursor() (int64, error) {
-	v, err := s.Get(context.Background(), s.coin+":pps:cursor").Int64()
+func (s *RedisDB) GetPPSCursor() (int64, error) {
+	v, err := s.Get(context.Background(), s.prefix+":pps:cursor").Int64()
 	if err == redis.Nil {
 		return 0, nil
 	}
 	return v, err
 }
 
-// GetSharesSince returns per-miner share difficulty for every logged share newer
-// than cursor, plus the highest sequence seen (so pps can advance the cursor).
-func (s *DB) GetSharesSince(cursor int64) (map[string]float64, int64, error) {
-	zs, err := s.ZRangeByScoreWithScores(context.Background(), s.coin+":shares:pplnslog", &redis.ZRangeBy{
+// GetSharesSince returns per-miner share difficulty and value for every logged
+// share newer than cursor, and the highest seq seen (cursor when none).
+func (s *RedisDB) GetSharesSince(cursor int64) (diffs, values map[string]float64, maxSeq int64, err error) {
+	zs, err := s.ZRangeByScoreWithScores(context.Background(), s.shareLogKey(""), &redis.ZRangeBy{
 		Min: "(" + strconv.FormatInt(cursor, 10), // exclusive
 		Max: "+inf",
 	}).Result()
 	if err != nil {
-		return nil, cursor, err
+		return nil, nil, cursor, err
 	}
 
-	out := make(map[string]float64)
-	maxSeq := cursor
+	diffs, values = make(map[string]float64), make(map[string]float64)
+	maxSeq = cursor
 	for _, z := range zs {
 		m, _ := z.Member.(string)
-		p := strings.SplitN(m, ":", 3) // miner:diff:seq
+		p := strings.Split(m, ":") // miner:diff:seq[:time[:value]]
 		if len(p) < 2 {
 			continue
 		}
@@ -461,16 +1063,20 @@ func (s *DB) GetSharesSince(cursor int64) (map[string]float64, int64, error) {
 		if err != nil {
 			continue
 		}
-		out[p[0]] += diff
+		diffs[p[0]] += diff
+		if len(p) > 4 {
+			value, _ := strconv.ParseFloat(p[4], 64)
+			values[p[0]] += value
+		}
 		if int64(z.Score) > maxSeq {
 			maxSeq = int64(z.Score)
 		}
 	}
-	return out, maxSeq, nil
+	return diffs, values, maxSeq, nil
 }
 
-func (s *DB) GetRoundContrib(height uint64) (map[string]float64, error) {
-	m, err := s.HGetAll(context.Background(), s.coin+":shares:round"+strconv.FormatUint(height, 10)).Result()
+func (s *RedisDB) GetRoundContrib(height uint64) (map[string]float64, error) {
+	m, err := s.HGetAll(context.Background(), s.prefix+":shares:round"+strconv.FormatUint(height, 10)).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+	"github.com/mining-pool/not-only-mining-pool/types"
+)
+
+// A redis outage must delay shares, not drop them or stall the submitter.
+func TestRedisDB_BuffersSharesWhileDown(t *testing.T) {
+	db, mr := newTestDB(t)
+	db.PutShare(&types.Share{Miner: "A", Rig: "r", Diff: 1}, false)
+	db.Flush()
+
+	mr.Close()
+	queued := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			db.PutShare(&types.Share{Miner: "A", Rig: "r", Diff: 1}, false)
+		}
+		close(queued)
+	}()
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("PutShare blocked while redis was down")
+	}
+
+	time.Sleep(300 * time.Millisecond) // let the writer fail and back off
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	db.Flush()
+
+	if n, err := db.GetPoolTotalValidShares(); err != nil || n != 11 {
+		t.Fatalf("valid shares after the outage = %d, %v; want 11", n, err)
+	}
+	if c, _ := db.GetMinerCurrentRoundContrib("A"); c != 11 {
+		t.Errorf("round contribution of A = %v, want 11", c)
+	}
+}
+
+func TestRedisDB_ClusterConformance(t *testing.T) {
+	var mr *miniredis.Miniredis
+	testConformance(t, func(t *testing.T) DB {
+		mr = miniredis.RunT(t)
+		db := NewRedisDB("T", &config.RedisOptions{Mode: config.RedisCluster, Addrs: []string{mr.Addr()}})
+		t.Cleanup(func() {
+			// every key carries the {T} hash tag, so one slot holds the pool
+			for _, key := range mr.Keys() {
+				if !strings.HasPrefix(key, "{T}:") {
+					t.Errorf("key %q is not hash-tagged", key)
+				}
+			}
+			_ = db.Close()
+		})
+		return db
+	})
+}
+
+func TestRedisOptions_SentinelNeedsMaster(t *testing.T) {
+	if _, err := (&config.RedisOptions{Mode: "sentinel", Addrs: []string{"127.0.0.1:26379"}}).NewClient(); err == nil {
+		t.Error("sentinel mode without masterName was accepted")
+	}
+	client, err := (&config.RedisOptions{Mode: "Sentinel", MasterName: "pool", Addrs: []string{"127.0.0.1:26379"}}).NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+}
+
+// dropReply runs one MULTI and then fails it as a dropped connection would.
+type dropReply struct{ dropped atomic.Bool }
+
+func (h *dropReply) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *dropReply) AfterProcess(context.Context, redis.Cmder) error { return nil }
+
+func (h *dropReply) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *dropReply) AfterProcessPipeline(context.Context, []redis.Cmder) error {
+	if h.dropped.CompareAndSwap(false, true) {
+		return errors.New("read: connection reset by peer")
+	}
+	return nil
+}
+
+// A block share whose MULTI ran but whose reply was lost is retried without
+// crediting the share or sealing its round twice.
+func TestRedisDB_RetryAfterLostReply(t *testing.T) {
+	db, mr := newTestDB(t)
+	db.PutShare(&types.Share{Miner: "A", Rig: "r", Diff: 2}, false)
+	db.Flush()
+
+	hook := &dropReply{}
+	db.AddHook(hook)
+	db.PutShare(&types.Share{Miner: "B", Rig: "r", Diff: 1, BlockHeight: 7, BlockHex: "00", BlockHash: "blk7", TxHash: "tx7"}, true)
+	db.Flush()
+
+	if !hook.dropped.Load() {
+		t.Fatal("the block share's reply was not dropped")
+	}
+	if n, _ := db.GetPoolTotalValidShares(); n != 2 {
+		t.Errorf("valid shares = %d, want 2", n)
+	}
+	if n, _ := db.GetPoolTotalValidBlocks(); n != 1 {
+		t.Errorf("valid blocks = %d, want 1", n)
+	}
+	if round, _ := db.GetRoundContrib(7); round["A"] != 2 || round["B"] != 1 {
+		t.Errorf("sealed round 7 = %v, want A 2 and B 1", round)
+	}
+	if members, _ := mr.ZMembers("T:shares:pplnslog"); len(members) != 2 {
+		t.Errorf("share log = %v, want 2 shares", members)
+	}
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// MinerSettings are the payout preferences a miner sets through the API,
+// authenticated by a message signed with their payout address.
+type MinerSettings struct {
+	// MinPayment is the miner's payout threshold in coin; the pool's
+	// minPayment applies when it is lower.
+	MinPayment float64 `json:"minPayment"`
+	// DailyAt, when set, pays the miner at most once a day, in the first
+	// payout run at or after this hour (UTC, 0-23).
+	DailyAt *int `json:"dailyAt,omitempty"`
+	// Time is when the miner signed the settings, in unix seconds. Settings
+	// signed no later than the stored ones are refused, so a signature can't
+	// be replayed.
+	Time int64 `json:"time"`
+}
+
+// Message is the text a miner signs with their payout address to set s.
+func (s *MinerSettings) Message(coin, miner string) string {
+	daily := "none"
+	if s.DailyAt != nil {
+		daily = strconv.Itoa(*s.DailyAt)
+	}
+	return fmt.Sprintf("%s payout settings for %s: minPayment=%s dailyAt=%s time=%d",
+		coin, miner, strconv.FormatFloat(s.MinPayment, 'f', -1, 64), daily, s.Time)
+}
@@ -2,7 +2,11 @@ package storage
 
 import (
 	"context"
+	"database/sql"
+	"math"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -13,7 +17,7 @@ import (
 	"github.com/mining-pool/not-only-mining-pool/types"
 )
 
-func newTestDB(t *testing.T) (*DB, *miniredis.Miniredis) {
+func newTestDB(t *testing.T) (*RedisDB, *miniredis.Miniredis) {
 	t.Helper()
 	mr, err := miniredis.Run()
 	if err != nil {
@@ -22,11 +26,11 @@ func newTestDB(t *testing.T) (*DB, *miniredis.Miniredis) {
 	t.Cleanup(mr.Close)
 	host, portStr, _ := net.SplitHostPort(mr.Addr())
 	port, _ := strconv.Atoi(portStr)
-	return NewStorage("T", &config.RedisOptions{Network: "tcp", Host: host, Port: port}), mr
+	return NewRedisDB("T", &config.RedisOptions{Network: "tcp", Host: host, Port: port}), mr
 }
 
 // waitZCard polls until the pplnslog reaches n members (the writer is async).
-func waitZCard(t *testing.T, db *DB, key string, n int64) {
+func waitZCard(t *testing.T, db *RedisDB, key string, n int64) {
 	t.Helper()
 	for i := 0; i < 200; i++ {
 		if c, _ := db.ZCard(context.Background(), key).Result(); c == n {
@@ -68,6 +72,16 @@ func TestPPS_LogRetainedUntilCredited(t *testing.T) {
 	if c, _ := db.ZCard(context.Background(), "T:shares:pplnslog").Result(); c != 3 {
 		t.Errorf("after crediting to seq 5, pplnslog card = %d, want 3 (seq 6-8)", c)
 	}
+
+	// credited shares within the cap stay, for pps+ to split fees over
+	db.PutShare(&types.Share{Miner: "A", Rig: "r", Diff: 1, BlockHeight: 100}, false)
+	waitZCard(t, db, "T:shares:pplnslog", 4)
+	if err := db.ApplyPayments(&PaymentUpdate{PPSCursor: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := db.ZCard(context.Background(), "T:shares:pplnslog").Result(); c != 3 {
+		t.Errorf("after crediting everything, pplnslog card = %d, want the newest 3", c)
+	}
 }
 
 // The single ordered writer must seal a block's round with exactly the shares
@@ -118,3 +132,77 @@ func TestPutShare_RoundSealIsOrdered(t *testing.T) {
 		t.Errorf("roundCurrent minerA = %q, want empty (its shares were sealed)", got)
 	}
 }
+
+// WalkShareLog pages through a log longer than one read, including entries
+// logged before the log kept share times.
+func TestRedisDB_WalkShareLogPages(t *testing.T) {
+	db, mr := newTestDB(t)
+	n := shareLogPage*2 + 10
+	for seq := 1; seq <= n; seq++ {
+		mr.ZAdd("T:shares:pplnslog", float64(seq), "A:1:"+strconv.Itoa(seq))
+	}
+	_ = mr.Set("T:shares:seq", strconv.Itoa(n))
+	db.PutShare(&types.Share{Miner: "B", Rig: "r", Diff: 2}, false)
+	db.Flush()
+
+	var visited int
+	var untimed bool
+	if err := db.WalkShareLog("", int64(n+1), func(ls *LoggedShare) bool {
+		if visited == 0 && (ls.Miner != "B" || ls.Time == 0) {
+			t.Errorf("newest share = %+v, want B with a time", ls)
+		}
+		untimed = ls.Time == 0
+		visited++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if visited != n+1 || !untimed {
+		t.Errorf("visited %d shares (oldest untimed %v), want %d", visited, untimed, n+1)
+	}
+}
+
+// A share_log created before shares carried times gains the column on open.
+func TestSQLiteDB_UpgradesSchema(t *testing.T) {
+	options := &config.SQLiteOptions{DataDir: t.TempDir()}
+	if err := os.MkdirAll(filepath.Dir(options.Path()), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	old, err := sql.Open("sqlite", "file:"+options.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(`CREATE TABLE share_log (seq INTEGER PRIMARY KEY AUTOINCREMENT, coin TEXT NOT NULL, miner TEXT NOT NULL, diff DOUBLE PRECISION NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(`INSERT INTO share_log (coin, miner, diff) VALUES ('T', 'A', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(`CREATE TABLE round_current (coin TEXT NOT NULL, miner TEXT NOT NULL, diff DOUBLE PRECISION NOT NULL, PRIMARY KEY (coin, miner))`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(`INSERT INTO round_current (coin, miner, diff) VALUES ('T', 'A', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	_ = old.Close()
+
+	db := NewSQLiteDB("T", options)
+	defer db.Close()
+	db.PutShare(&types.Share{Miner: "B", Rig: "r", Diff: 1}, false)
+	db.Flush()
+
+	var times []int64
+	if err := db.WalkShareLog("", math.MaxInt64, func(ls *LoggedShare) bool {
+		times = append(times, ls.Time)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 2 || times[0] == 0 || times[1] != 0 {
+		t.Errorf("share times = %v, want the new share timed and the old one 0", times)
+	}
+	// the old current round is the default group's
+	if a, err := db.GetMinerCurrentRoundContrib("A"); err != nil || a != 1 {
+		t.Errorf("current round A = %v, %v; want 1", a, err)
+	}
+}
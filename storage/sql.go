@@ -0,0 +1,947 @@
+package storage
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mining-pool/not-only-mining-pool/types"
+)
+
+// sqlSchema is applied on every start; {serial} is the dialect's auto-increment
+// key. Each row carries its coin, so several pools can share one database the
+// way they share one redis.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS rigs (
+		coin TEXT NOT NULL, miner TEXT NOT NULL, rig TEXT NOT NULL,
+		PRIMARY KEY (coin, miner, rig))`,
+	`CREATE TABLE IF NOT EXISTS pool_stats (
+		coin TEXT NOT NULL, name TEXT NOT NULL, value BIGINT NOT NULL,
+		PRIMARY KEY (coin, name))`,
+	`CREATE TABLE IF NOT EXISTS miner_stats (
+		coin TEXT NOT NULL, miner TEXT NOT NULL,
+		valid_shares BIGINT NOT NULL DEFAULT 0, invalid_shares BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (coin, miner))`,
+	// the PPLNS / PPS share log; seq is the share sequence blocks mark, and
+	// pay_mode the share group (types.Share.PayMode)
+	`CREATE TABLE IF NOT EXISTS share_log (
+		seq {serial}, coin TEXT NOT NULL, miner TEXT NOT NULL,
+		diff DOUBLE PRECISION NOT NULL, time BIGINT NOT NULL DEFAULT 0,
+		pay_mode TEXT NOT NULL DEFAULT '', value DOUBLE PRECISION NOT NULL DEFAULT 0)`,
+	`CREATE INDEX IF NOT EXISTS share_log_coin_seq ON share_log (coin, seq)`,
+	// the difficulty summed per bucket of each resolution; series is "pool",
+	// "miner:<miner>" or "rig:<miner>:<rig>"
+	`CREATE TABLE IF NOT EXISTS hashrate (
+		coin TEXT NOT NULL, series TEXT NOT NULL, resolution BIGINT NOT NULL,
+		bucket BIGINT NOT NULL, diff DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (coin, series, resolution, bucket))`,
+	`CREATE INDEX IF NOT EXISTS hashrate_coin_resolution_bucket ON hashrate (coin, resolution, bucket)`,
+	// the raw per-share series kept before bucketing
+	`DROP TABLE IF EXISTS hashes`,
+	// the current round of each share group
+	`CREATE TABLE IF NOT EXISTS open_rounds (
+		coin TEXT NOT NULL, pay_mode TEXT NOT NULL, miner TEXT NOT NULL, diff DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (coin, pay_mode, miner))`,
+	`CREATE TABLE IF NOT EXISTS rounds (
+		coin TEXT NOT NULL, height BIGINT NOT NULL, miner TEXT NOT NULL,
+		diff DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (coin, height, miner))`,
+	`CREATE TABLE IF NOT EXISTS blocks (
+		coin TEXT NOT NULL, height BIGINT NOT NULL, hash TEXT NOT NULL,
+		tx_hash TEXT NOT NULL, finder TEXT NOT NULL, mark BIGINT NOT NULL,
+		status TEXT NOT NULL, pay_mode TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (coin, height, hash))`,
+	// found-block history; blocks above holds only what the payer needs
+	`CREATE TABLE IF NOT EXISTS found_blocks (
+		coin TEXT NOT NULL, hash TEXT NOT NULL, height BIGINT NOT NULL, tx_hash TEXT NOT NULL,
+		miner TEXT NOT NULL, rig TEXT NOT NULL, time BIGINT NOT NULL,
+		network_diff DOUBLE PRECISION NOT NULL, round_shares DOUBLE PRECISION NOT NULL,
+		effort DOUBLE PRECISION NOT NULL, reward BIGINT NOT NULL, status TEXT NOT NULL,
+		PRIMARY KEY (coin, hash))`,
+	`CREATE INDEX IF NOT EXISTS found_blocks_coin_time ON found_blocks (coin, time)`,
+	`CREATE TABLE IF NOT EXISTS block_transitions (
+		coin TEXT NOT NULL, hash TEXT NOT NULL, status TEXT NOT NULL, time BIGINT NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS block_transitions_coin_hash ON block_transitions (coin, hash)`,
+	`CREATE TABLE IF NOT EXISTS coinbase_paid (
+		coin TEXT NOT NULL, height BIGINT NOT NULL, miner TEXT NOT NULL, sat BIGINT NOT NULL,
+		PRIMARY KEY (coin, height, miner))`,
+	// the PPLNS window a block's coinbase was split over, kept with coinbase_paid
+	`CREATE TABLE IF NOT EXISTS coinbase_window (
+		coin TEXT NOT NULL, height BIGINT NOT NULL, miner TEXT NOT NULL, diff DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (coin, height, miner))`,
+	`CREATE TABLE IF NOT EXISTS rejected_blocks (
+		id {serial}, coin TEXT NOT NULL, body TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS balances (
+		coin TEXT NOT NULL, miner TEXT NOT NULL, balance DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (coin, miner))`,
+	`CREATE TABLE IF NOT EXISTS payouts (
+		coin TEXT NOT NULL, miner TEXT NOT NULL, paid DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (coin, miner))`,
+	// the append-only payout ledger: one row per transaction, one per payee
+	`CREATE TABLE IF NOT EXISTS payout_ledger (
+		coin TEXT NOT NULL, txid TEXT NOT NULL, time BIGINT NOT NULL, blocks TEXT NOT NULL,
+		replaced TEXT NOT NULL DEFAULT '[]', conflicted BOOLEAN NOT NULL DEFAULT FALSE,
+		PRIMARY KEY (coin, txid))`,
+	`CREATE INDEX IF NOT EXISTS payout_ledger_coin_time ON payout_ledger (coin, time)`,
+	`CREATE TABLE IF NOT EXISTS payout_ledger_amounts (
+		coin TEXT NOT NULL, txid TEXT NOT NULL, miner TEXT NOT NULL, amount DOUBLE PRECISION NOT NULL,
+		time BIGINT NOT NULL,
+		PRIMARY KEY (coin, txid, miner))`,
+	`CREATE INDEX IF NOT EXISTS payout_ledger_amounts_coin_miner_time ON payout_ledger_amounts (coin, miner, time)`,
+	// payout transactions not yet seen confirmed, since they were sent or replaced
+	`CREATE TABLE IF NOT EXISTS payout_unconfirmed (
+		coin TEXT NOT NULL, txid TEXT NOT NULL, since BIGINT NOT NULL,
+		PRIMARY KEY (coin, txid))`,
+	// payout settings miners set through the API; daily_at is NULL for none
+	`CREATE TABLE IF NOT EXISTS miner_settings (
+		coin TEXT NOT NULL, miner TEXT NOT NULL, min_payment DOUBLE PRECISION NOT NULL,
+		daily_at BIGINT, time BIGINT NOT NULL,
+		PRIMARY KEY (coin, miner))`,
+	`CREATE TABLE IF NOT EXISTS pps_cursor (
+		coin TEXT PRIMARY KEY, seq BIGINT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS payout_intents (
+		coin TEXT PRIMARY KEY, update_json TEXT NOT NULL, txid TEXT NOT NULL)`,
+}
+
+// sqlColumns are columns added to a table after its first release; newSQLDB
+// adds them to databases created before.
+var sqlColumns = []struct{ table, column, def string }{
+	{"share_log", "time", "BIGINT NOT NULL DEFAULT 0"},
+	{"share_log", "pay_mode", "TEXT NOT NULL DEFAULT ''"},
+	{"share_log", "value", "DOUBLE PRECISION NOT NULL DEFAULT 0"},
+	{"blocks", "pay_mode", "TEXT NOT NULL DEFAULT ''"},
+	{"payout_ledger", "replaced", "TEXT NOT NULL DEFAULT '[]'"},
+	{"payout_ledger", "conflicted", "BOOLEAN NOT NULL DEFAULT FALSE"},
+}
+
+// SQLDB is the SQL backend of DB, over PostgreSQL or an embedded SQLite file.
+// Every write a share or payout run makes is one transaction, where redis uses
+// a pipeline. The statements stick to syntax both dialects accept.
+type SQLDB struct {
+	shareQueue
+	hashrateBuckets
+	db      *sql.DB
+	coin    string
+	ppsMode bool
+}
+
+// newSQLDB creates the schema, with serial as the auto-increment key, and
+// starts the share writer.
+func newSQLDB(db *sql.DB, coinName, serial string) (*SQLDB, error) {
+	for _, stmt := range sqlSchema {
+		if _, err := db.Exec(strings.Replace(stmt, "{serial}", serial, 1)); err != nil {
+			return nil, fmt.Errorf("creating the schema: %w", err)
+		}
+	}
+	for _, c := range sqlColumns {
+		if _, err := db.Exec(`SELECT ` + c.column + ` FROM ` + c.table + ` LIMIT 0`); err == nil {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE ` + c.table + ` ADD COLUMN ` + c.column + ` ` + c.def); err != nil {
+			return nil, fmt.Errorf("adding %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
+	s := &SQLDB{db: db, coin: coinName}
+	// round_current held the one current round before share groups; its
+	// shares move to the default group
+	if _, err := db.Exec(`SELECT 1 FROM round_current LIMIT 0`); err == nil {
+		b := s.begin()
+		b.exec(`INSERT INTO open_rounds (coin, pay_mode, miner, diff) SELECT coin, '', miner, diff FROM round_current`)
+		b.exec(`DROP TABLE round_current`)
+		if err := b.commit(); err != nil {
+			return nil, fmt.Errorf("moving round_current: %w", err)
+		}
+	}
+	s.start(coinName, s.putShareNow)
+	s.startHashrate(s.PruneHashrate)
+	return s, nil
+}
+
+func (s *SQLDB) SetPPSMode(pps bool) { s.ppsMode = pps }
+
+// Close applies the queued shares, or leaves them in the journal, and
+// disconnects.
+func (s *SQLDB) Close() error {
+	s.stopHashrate()
+	err := s.writer.close()
+	if cerr := s.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// sqlBatch runs statements in one transaction, keeping the first error, so a
+// run of writes reads like the redis pipeline it replaces.
+type sqlBatch struct {
+	tx  *sql.Tx
+	err error
+}
+
+func (s *SQLDB) begin() *sqlBatch {
+	tx, err := s.db.Begin()
+	return &sqlBatch{tx: tx, err: err}
+}
+
+func (b *sqlBatch) exec(query string, args ...interface{}) {
+	if b.err == nil {
+		_, b.err = b.tx.Exec(query, args...)
+	}
+}
+
+func (b *sqlBatch) queryRow(query string, args ...interface{}) *sql.Row {
+	return b.tx.QueryRow(query, args...)
+}
+
+func (b *sqlBatch) commit() error {
+	if b.tx == nil {
+		return b.err
+	}
+	if b.err != nil {
+		_ = b.tx.Rollback()
+		return b.err
+	}
+	return b.tx.Commit()
+}
+
+// connLost reports whether err means the database could not be reached; the
+// transaction was then rolled back and the share may be written again.
+func connLost(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr)
+}
+
+func (s *SQLDB) putShareNow(share *types.Share, accepted bool) error {
+	now := share.Time
+	b := s.begin()
+
+	b.exec(`INSERT INTO rigs (coin, miner, rig) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, s.coin, share.Miner, share.Rig)
+
+	var seq int64
+	if share.ErrorCode == 0 {
+		log.Info("recording valid share")
+		if b.err == nil {
+			b.err = b.queryRow(`INSERT INTO share_log (coin, miner, diff, time, pay_mode, value) VALUES ($1, $2, $3, $4, $5, $6) RETURNING seq`,
+				s.coin, share.Miner, share.Diff, now, share.PayMode, share.Value).Scan(&seq)
+		}
+		// outside PPS the log is capped by rank; in PPS the payout cursor trims it
+		if !s.ppsMode {
+			b.exec(`DELETE FROM share_log WHERE coin = $1 AND pay_mode = $2 AND seq <= (
+				SELECT seq FROM share_log WHERE coin = $1 AND pay_mode = $2 ORDER BY seq DESC LIMIT 1 OFFSET $3)`,
+				s.coin, share.PayMode, pplnsLogCap.Load())
+		}
+		b.exec(`INSERT INTO open_rounds (coin, pay_mode, miner, diff) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (coin, pay_mode, miner) DO UPDATE SET diff = open_rounds.diff + EXCLUDED.diff`,
+			s.coin, share.PayMode, share.Miner, share.Diff)
+		b.exec(`INSERT INTO miner_stats (coin, miner, valid_shares) VALUES ($1, $2, 1)
+			ON CONFLICT (coin, miner) DO UPDATE SET valid_shares = miner_stats.valid_shares + 1`,
+			s.coin, share.Miner)
+		for _, res := range hashrateResolutions {
+			for _, series := range []string{"pool", "miner:" + share.Miner, "rig:" + share.Miner + ":" + share.Rig} {
+				b.exec(`INSERT INTO hashrate (coin, series, resolution, bucket, diff) VALUES ($1, $2, $3, $4, $5)
+					ON CONFLICT (coin, series, resolution, bucket) DO UPDATE SET diff = hashrate.diff + EXCLUDED.diff`,
+					s.coin, series, res, bucket(now, res), share.Diff)
+			}
+		}
+		s.incrPool(b, "validShares")
+	} else {
+		log.Warn("recording invalid share")
+		b.exec(`INSERT INTO miner_stats (coin, miner, invalid_shares) VALUES ($1, $2, 1)
+			ON CONFLICT (coin, miner) DO UPDATE SET invalid_shares = miner_stats.invalid_shares + 1`,
+			s.coin, share.Miner)
+		s.incrPool(b, "invalidShares")
+	}
+
+	if len(share.BlockHex) > 0 {
+		if accepted {
+			log.Warn("recording valid block")
+			// seal the current round under the block height, replacing any
+			// earlier seal there as the redis Rename does
+			b.exec(`DELETE FROM rounds WHERE coin = $1 AND height = $2
+				AND EXISTS (SELECT 1 FROM open_rounds WHERE coin = $1 AND pay_mode = $3)`, s.coin, share.BlockHeight, share.PayMode)
+			b.exec(`INSERT INTO rounds (coin, height, miner, diff)
+				SELECT coin, CAST($2 AS BIGINT), miner, diff FROM open_rounds WHERE coin = $1 AND pay_mode = $3`, s.coin, share.BlockHeight, share.PayMode)
+			var roundShares float64
+			if b.err == nil {
+				b.err = b.queryRow(`SELECT COALESCE(SUM(diff), 0) FROM open_rounds WHERE coin = $1 AND pay_mode = $2`, s.coin, share.PayMode).Scan(&roundShares)
+			}
+			s.putFoundBlock(b, newFoundBlock(share, roundShares, now))
+			b.exec(`DELETE FROM open_rounds WHERE coin = $1 AND pay_mode = $2`, s.coin, share.PayMode)
+			b.exec(`INSERT INTO blocks (coin, height, hash, tx_hash, finder, mark, status, pay_mode)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING`,
+				s.coin, share.BlockHeight, share.BlockHash, share.TxHash, share.Miner, seq, blockPending, share.PayMode)
+			for miner, sat := range share.CoinbasePaid {
+				b.exec(`INSERT INTO coinbase_paid (coin, height, miner, sat) VALUES ($1, $2, $3, $4)
+					ON CONFLICT (coin, height, miner) DO UPDATE SET sat = EXCLUDED.sat`,
+					s.coin, share.BlockHeight, miner, sat)
+			}
+			for miner, diff := range share.CoinbaseWindow {
+				b.exec(`INSERT INTO coinbase_window (coin, height, miner, diff) VALUES ($1, $2, $3, $4)
+					ON CONFLICT (coin, height, miner) DO UPDATE SET diff = EXCLUDED.diff`,
+					s.coin, share.BlockHeight, miner, diff)
+			}
+			s.incrPool(b, "validBlocks")
+		} else {
+			log.Warn("recording invalid block")
+			s.incrPool(b, "invalidBlocks")
+		}
+
+		if share.BlockRejection != nil {
+			raw, _ := json.Marshal(&RejectedBlock{
+				Height:         share.BlockHeight,
+				Hash:           share.BlockHash,
+				Miner:          share.Miner,
+				Rig:            share.Rig,
+				Time:           now,
+				Accepted:       accepted,
+				BlockRejection: share.BlockRejection,
+			})
+			b.exec(`INSERT INTO rejected_blocks (coin, body) VALUES ($1, $2)`, s.coin, string(raw))
+			b.exec(`DELETE FROM rejected_blocks WHERE coin = $1 AND id <= (
+				SELECT id FROM rejected_blocks WHERE coin = $1 ORDER BY id DESC LIMIT 1 OFFSET $2)`,
+				s.coin, rejectedBlocksCap)
+		}
+	}
+
+	if err := b.commit(); err != nil {
+		if connLost(err) {
+			return err
+		}
+		log.Error(err)
+	}
+	return nil
+}
+
+func (s *SQLDB) incrPool(b *sqlBatch, name string) {
+	b.exec(`INSERT INTO pool_stats (coin, name, value) VALUES ($1, $2, 1)
+		ON CONFLICT (coin, name) DO UPDATE SET value = pool_stats.value + 1`, s.coin, name)
+}
+
+func (s *SQLDB) queryStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]string, 0)
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// querySums reads (miner, amount) rows into a map.
+func (s *SQLDB) querySums(query string, args ...interface{}) (map[string]float64, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string]float64)
+	for rows.Next() {
+		var miner string
+		var v float64
+		if err := rows.Scan(&miner, &v); err != nil {
+			return nil, err
+		}
+		out[miner] = v
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLDB) GetMinerIndex() ([]string, error) {
+	return s.queryStrings(`SELECT DISTINCT miner FROM rigs WHERE coin = $1`, s.coin)
+}
+
+func (s *SQLDB) GetRigIndex(minerName string) ([]string, error) {
+	return s.queryStrings(`SELECT rig FROM rigs WHERE coin = $1 AND miner = $2`, s.coin, minerName)
+}
+
+func (s *SQLDB) GetMinerCurrentRoundContrib(minerName string) (float64, error) {
+	var v float64
+	err := s.db.QueryRow(`SELECT COALESCE(SUM(diff), 0) FROM open_rounds WHERE coin = $1 AND miner = $2`, s.coin, minerName).Scan(&v)
+	return v, err
+}
+
+func (s *SQLDB) GetPoolTotalValidShares() (uint64, error) {
+	return s.poolCounter("validShares")
+}
+
+func (s *SQLDB) GetPoolTotalValidBlocks() (uint64, error) {
+	return s.poolCounter("validBlocks")
+}
+
+func (s *SQLDB) GetPoolTotalInvalidShares() (uint64, error) {
+	return s.poolCounter("invalidShares")
+}
+
+func (s *SQLDB) GetPoolTotalInvalidBlocks() (uint64, error) {
+	return s.poolCounter("invalidBlocks")
+}
+
+func (s *SQLDB) poolCounter(name string) (uint64, error) {
+	var v uint64
+	err := s.db.QueryRow(`SELECT value FROM pool_stats WHERE coin = $1 AND name = $2`, s.coin, name).Scan(&v)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return v, err
+}
+
+func (s *SQLDB) GetPoolHashrate(from, to int64) (float64, error) {
+	return s.hashrate("pool", from, to)
+}
+
+func (s *SQLDB) GetMinerHashrate(minerName string, from, to int64) (float64, error) {
+	return s.hashrate("miner:"+minerName, from, to)
+}
+
+func (s *SQLDB) GetRigHashrate(minerName, rigName string, from, to int64) (float64, error) {
+	return s.hashrate("rig:"+minerName+":"+rigName, from, to)
+}
+
+func (s *SQLDB) hashrate(series string, from, to int64) (float64, error) {
+	q, ok := s.bucketsFor(from, to, time.Now().Unix())
+	if !ok {
+		return 0, nil
+	}
+	var total float64
+	err := s.db.QueryRow(`SELECT COALESCE(SUM(diff), 0) FROM hashrate
+		WHERE coin = $1 AND series = $2 AND resolution = $3 AND bucket BETWEEN $4 AND $5`,
+		s.coin, series, q.res, q.first, q.last).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+	return total / q.span, nil
+}
+
+// PruneHashrate drops the buckets older than their resolution's retention.
+func (s *SQLDB) PruneHashrate(now int64) error {
+	cut := s.cutoffs(now)
+	b := s.begin()
+	for i, res := range hashrateResolutions {
+		b.exec(`DELETE FROM hashrate WHERE coin = $1 AND resolution = $2 AND bucket < $3`, s.coin, res, cut[i])
+	}
+	return b.commit()
+}
+
+func (s *SQLDB) GetRejectedBlocks() ([]*RejectedBlock, error) {
+	raws, err := s.queryStrings(`SELECT body FROM rejected_blocks WHERE coin = $1 ORDER BY id DESC`, s.coin)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]*RejectedBlock, 0, len(raws))
+	for i := range raws {
+		var block RejectedBlock
+		if err := json.Unmarshal([]byte(raws[i]), &block); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, &block)
+	}
+	return blocks, nil
+}
+
+func (s *SQLDB) GetAllPendingBlocks() ([]*PendingBlock, error) {
+	return s.blocksIn(blockPending)
+}
+
+func (s *SQLDB) GetConfirmedBlocks() ([]*PendingBlock, error) {
+	return s.blocksIn(blockConfirmed)
+}
+
+func (s *SQLDB) blocksIn(status string) ([]*PendingBlock, error) {
+	rows, err := s.db.Query(`SELECT hash, tx_hash, height, finder, mark, pay_mode FROM blocks
+		WHERE coin = $1 AND status = $2 ORDER BY height`, s.coin, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := make([]*PendingBlock, 0)
+	for rows.Next() {
+		var pb PendingBlock
+		if err := rows.Scan(&pb.Hash, &pb.TxHash, &pb.Height, &pb.Finder, &pb.Mark, &pb.PayMode); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, &pb)
+	}
+	return blocks, rows.Err()
+}
+
+func (s *SQLDB) GetRoundContrib(height uint64) (map[string]float64, error) {
+	return s.querySums(`SELECT miner, diff FROM rounds WHERE coin = $1 AND height = $2`, s.coin, height)
+}
+
+func (s *SQLDB) GetCoinbasePaid(height uint64) (map[string]uint64, error) {
+	rows, err := s.db.Query(`SELECT miner, sat FROM coinbase_paid WHERE coin = $1 AND height = $2`, s.coin, height)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paid := make(map[string]uint64)
+	for rows.Next() {
+		var miner string
+		var sat uint64
+		if err := rows.Scan(&miner, &sat); err != nil {
+			return nil, err
+		}
+		paid[miner] = sat
+	}
+	return paid, rows.Err()
+}
+
+func (s *SQLDB) GetCoinbaseWindow(height uint64) (map[string]float64, error) {
+	return s.querySums(`SELECT miner, diff FROM coinbase_window WHERE coin = $1 AND height = $2`, s.coin, height)
+}
+
+// GetPPLNSShares walks the share log backward from uptoSeq, summing difficulty
+// per miner until the cumulative difficulty reaches window (<= 0: no cap).
+func (s *SQLDB) GetPPLNSShares(group string, uptoSeq int64, window float64) (map[string]float64, error) {
+	rows, err := s.db.Query(`SELECT miner, diff FROM share_log WHERE coin = $1 AND pay_mode = $2 AND seq <= $3 ORDER BY seq DESC`, s.coin, group, uptoSeq)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string]float64)
+	var cum float64
+	for rows.Next() {
+		var miner string
+		var diff float64
+		if err := rows.Scan(&miner, &diff); err != nil {
+			return nil, err
+		}
+		out[miner] += diff
+		cum += diff
+		if window > 0 && cum >= window {
+			break
+		}
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLDB) WalkShareLog(group string, uptoSeq int64, visit func(*LoggedShare) bool) error {
+	rows, err := s.db.Query(`SELECT seq, miner, diff, time FROM share_log WHERE coin = $1 AND pay_mode = $2 AND seq <= $3 ORDER BY seq DESC`, s.coin, group, uptoSeq)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ls LoggedShare
+		if err := rows.Scan(&ls.Seq, &ls.Miner, &ls.Diff, &ls.Time); err != nil {
+			return err
+		}
+		if !visit(&ls) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLDB) GetSharesSince(cursor int64) (diffs, values map[string]float64, maxSeq int64, err error) {
+	rows, err := s.db.Query(`SELECT miner, SUM(diff), SUM(value) FROM share_log WHERE coin = $1 AND pay_mode = '' AND seq > $2 GROUP BY miner`, s.coin, cursor)
+	if err != nil {
+		return nil, nil, cursor, err
+	}
+	defer rows.Close()
+	diffs, values = make(map[string]float64), make(map[string]float64)
+	for rows.Next() {
+		var miner string
+		var diff, value float64
+		if err := rows.Scan(&miner, &diff, &value); err != nil {
+			return nil, nil, cursor, err
+		}
+		diffs[miner], values[miner] = diff, value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, cursor, err
+	}
+
+	var last sql.NullInt64
+	if err := s.db.QueryRow(`SELECT MAX(seq) FROM share_log WHERE coin = $1 AND pay_mode = '' AND seq > $2`, s.coin, cursor).Scan(&last); err != nil {
+		return nil, nil, cursor, err
+	}
+	if !last.Valid {
+		return diffs, values, cursor, nil
+	}
+	return diffs, values, last.Int64, nil
+}
+
+func (s *SQLDB) GetPPSCursor() (int64, error) {
+	var v int64
+	err := s.db.QueryRow(`SELECT seq FROM pps_cursor WHERE coin = $1`, s.coin).Scan(&v)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return v, err
+}
+
+func (s *SQLDB) GetAllMinerBalances() (map[string]float64, error) {
+	return s.querySums(`SELECT miner, balance FROM balances WHERE coin = $1`, s.coin)
+}
+
+func (s *SQLDB) GetAllMinerPaid() (map[string]float64, error) {
+	return s.querySums(`SELECT miner, paid FROM payouts WHERE coin = $1`, s.coin)
+}
+
+// ApplyPayments persists one payout run in a single transaction.
+func (s *SQLDB) ApplyPayments(u *PaymentUpdate) error {
+	b := s.begin()
+	for miner, bal := range u.Balances {
+		b.exec(`INSERT INTO balances (coin, miner, balance) VALUES ($1, $2, $3)
+			ON CONFLICT (coin, miner) DO UPDATE SET balance = EXCLUDED.balance`, s.coin, miner, bal)
+	}
+	for miner, paid := range u.Paid {
+		b.exec(`INSERT INTO payouts (coin, miner, paid) VALUES ($1, $2, $3)
+			ON CONFLICT (coin, miner) DO UPDATE SET paid = payouts.paid + EXCLUDED.paid`, s.coin, miner, paid)
+	}
+	now := time.Now().Unix()
+	s.moveBlocks(b, u.Confirmed, blockConfirmed, now)
+	s.moveBlocks(b, u.Orphaned, blockOrphaned, now)
+	if payout, err := newPayout(u, now); err != nil {
+		if b.err == nil {
+			b.err = fmt.Errorf("settling block: %w", err)
+		}
+	} else if payout != nil {
+		s.putPayout(b, payout)
+		b.exec(`INSERT INTO payout_unconfirmed (coin, txid, since) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+			s.coin, payout.Txid, payout.Time)
+	}
+	for _, p := range coinbasePayouts(u, now) {
+		for miner, paid := range p.Amounts {
+			b.exec(`INSERT INTO payouts (coin, miner, paid) VALUES ($1, $2, $3)
+				ON CONFLICT (coin, miner) DO UPDATE SET paid = payouts.paid + EXCLUDED.paid`, s.coin, miner, paid)
+		}
+		s.putPayout(b, p)
+	}
+	for _, h := range u.DeleteRounds {
+		b.exec(`DELETE FROM rounds WHERE coin = $1 AND height = $2`, s.coin, h)
+		b.exec(`DELETE FROM coinbase_paid WHERE coin = $1 AND height = $2`, s.coin, h)
+		b.exec(`DELETE FROM coinbase_window WHERE coin = $1 AND height = $2`, s.coin, h)
+	}
+	if u.PPSCursor > 0 {
+		b.exec(`INSERT INTO pps_cursor (coin, seq) VALUES ($1, $2)
+			ON CONFLICT (coin) DO UPDATE SET seq = EXCLUDED.seq`, s.coin, u.PPSCursor)
+		// credited shares go, except the newest pplnsLogCap, which pps+ splits
+		// block fees over
+		b.exec(`DELETE FROM share_log WHERE coin = $1 AND pay_mode = '' AND seq <= $2 AND seq <= (
+			SELECT seq FROM share_log WHERE coin = $1 AND pay_mode = '' ORDER BY seq DESC LIMIT 1 OFFSET $3)`,
+			s.coin, u.PPSCursor, pplnsLogCap.Load())
+	}
+	b.exec(`DELETE FROM payout_intents WHERE coin = $1`, s.coin)
+	return b.commit()
+}
+
+// moveBlocks settles pending blocks given in their PendingBlock.String form.
+// The found-block history gains a transition when the status changes.
+func (s *SQLDB) moveBlocks(b *sqlBatch, blocks []string, status string, now int64) {
+	for _, str := range blocks {
+		pb, err := NewPendingBlockFromString(str)
+		if err != nil {
+			if b.err == nil {
+				b.err = fmt.Errorf("settling block: %w", err)
+			}
+			return
+		}
+		b.exec(`UPDATE blocks SET status = $4 WHERE coin = $1 AND height = $2 AND hash = $3 AND status = $5`,
+			s.coin, pb.Height, pb.Hash, status, blockPending)
+		b.exec(`INSERT INTO block_transitions (coin, hash, status, time)
+			SELECT coin, hash, $3, CAST($4 AS BIGINT) FROM found_blocks WHERE coin = $1 AND hash = $2 AND status <> $3`,
+			s.coin, pb.Hash, status, now)
+		b.exec(`UPDATE found_blocks SET status = $3 WHERE coin = $1 AND hash = $2`, s.coin, pb.Hash, status)
+	}
+}
+
+func (s *SQLDB) putPayout(b *sqlBatch, p *Payout) {
+	blocks, _ := json.Marshal(p.Blocks)
+	b.exec(`INSERT INTO payout_ledger (coin, txid, time, blocks) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`,
+		s.coin, p.Txid, p.Time, string(blocks))
+	for miner, amount := range p.Amounts {
+		b.exec(`INSERT INTO payout_ledger_amounts (coin, txid, miner, amount, time) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING`, s.coin, p.Txid, miner, amount, p.Time)
+	}
+}
+
+func (s *SQLDB) GetPayouts(limit int) ([]*Payout, error) {
+	txids, err := s.queryStrings(`SELECT txid FROM payout_ledger WHERE coin = $1 ORDER BY time DESC, txid DESC LIMIT $2`,
+		s.coin, limit)
+	if err != nil {
+		return nil, err
+	}
+	payouts := make([]*Payout, 0, len(txids))
+	for _, txid := range txids {
+		p, err := s.GetPayout(txid)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			payouts = append(payouts, p)
+		}
+	}
+	return payouts, nil
+}
+
+func (s *SQLDB) GetPayout(txid string) (*Payout, error) {
+	p := &Payout{Txid: txid}
+	var blocks, replaced string
+	err := s.db.QueryRow(`SELECT time, blocks, replaced, conflicted FROM payout_ledger WHERE coin = $1 AND txid = $2`,
+		s.coin, txid).Scan(&p.Time, &blocks, &replaced, &p.Conflicted)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(blocks), &p.Blocks); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(replaced), &p.Replaced); err != nil {
+		return nil, err
+	}
+	if p.Amounts, err = s.querySums(`SELECT miner, amount FROM payout_ledger_amounts WHERE coin = $1 AND txid = $2`,
+		s.coin, txid); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *SQLDB) GetMinerPayouts(miner string, limit int) ([]*MinerPayout, error) {
+	rows, err := s.db.Query(`SELECT a.txid, a.time, a.amount, l.blocks, l.replaced, l.conflicted FROM payout_ledger_amounts a
+		JOIN payout_ledger l ON l.coin = a.coin AND l.txid = a.txid
+		WHERE a.coin = $1 AND a.miner = $2 ORDER BY a.time DESC, a.txid DESC LIMIT $3`, s.coin, miner, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payouts := make([]*MinerPayout, 0)
+	for rows.Next() {
+		var p MinerPayout
+		var blocks, replaced string
+		if err := rows.Scan(&p.Txid, &p.Time, &p.Amount, &blocks, &replaced, &p.Conflicted); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(blocks), &p.Blocks); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(replaced), &p.Replaced); err != nil {
+			return nil, err
+		}
+		payouts = append(payouts, &p)
+	}
+	return payouts, rows.Err()
+}
+
+func (s *SQLDB) GetUnconfirmedPayouts() (map[string]int64, error) {
+	rows, err := s.db.Query(`SELECT txid, since FROM payout_unconfirmed WHERE coin = $1`, s.coin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	watched := make(map[string]int64)
+	for rows.Next() {
+		var txid string
+		var since int64
+		if err := rows.Scan(&txid, &since); err != nil {
+			return nil, err
+		}
+		watched[txid] = since
+	}
+	return watched, rows.Err()
+}
+
+func (s *SQLDB) ConfirmPayout(txid string) error {
+	_, err := s.db.Exec(`DELETE FROM payout_unconfirmed WHERE coin = $1 AND txid = $2`, s.coin, txid)
+	return err
+}
+
+func (s *SQLDB) ConflictPayout(txid string) error {
+	_, err := s.db.Exec(`UPDATE payout_ledger SET conflicted = $3 WHERE coin = $1 AND txid = $2`, s.coin, txid, true)
+	return err
+}
+
+func (s *SQLDB) ReplacePayout(old, txid string, now int64) error {
+	b := s.begin()
+	var raw string
+	var replaced []string
+	if b.err == nil {
+		b.err = b.queryRow(`SELECT replaced FROM payout_ledger WHERE coin = $1 AND txid = $2`, s.coin, old).Scan(&raw)
+		if b.err == sql.ErrNoRows {
+			b.err, raw = nil, "[]" // the run that sent it is still in flight
+		}
+	}
+	if b.err == nil {
+		b.err = json.Unmarshal([]byte(raw), &replaced)
+	}
+	updated, _ := json.Marshal(append(replaced, old))
+	b.exec(`UPDATE payout_ledger SET txid = $3, replaced = $4 WHERE coin = $1 AND txid = $2`, s.coin, old, txid, string(updated))
+	b.exec(`UPDATE payout_ledger_amounts SET txid = $3 WHERE coin = $1 AND txid = $2`, s.coin, old, txid)
+	b.exec(`UPDATE payout_intents SET txid = $3 WHERE coin = $1 AND txid = $2`, s.coin, old, txid)
+	b.exec(`DELETE FROM payout_unconfirmed WHERE coin = $1 AND txid = $2`, s.coin, old)
+	b.exec(`INSERT INTO payout_unconfirmed (coin, txid, since) VALUES ($1, $2, $3)
+		ON CONFLICT (coin, txid) DO UPDATE SET since = EXCLUDED.since`, s.coin, txid, now)
+	return b.commit()
+}
+
+func (s *SQLDB) GetMinerSettings(miner string) (*MinerSettings, error) {
+	all, err := s.minerSettings(`SELECT miner, min_payment, daily_at, time FROM miner_settings
+		WHERE coin = $1 AND miner = $2`, s.coin, miner)
+	if err != nil {
+		return nil, err
+	}
+	return all[miner], nil
+}
+
+func (s *SQLDB) GetAllMinerSettings() (map[string]*MinerSettings, error) {
+	return s.minerSettings(`SELECT miner, min_payment, daily_at, time FROM miner_settings WHERE coin = $1`, s.coin)
+}
+
+func (s *SQLDB) minerSettings(query string, args ...interface{}) (map[string]*MinerSettings, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := make(map[string]*MinerSettings)
+	for rows.Next() {
+		var miner string
+		var settings MinerSettings
+		var dailyAt sql.NullInt64
+		if err := rows.Scan(&miner, &settings.MinPayment, &dailyAt, &settings.Time); err != nil {
+			return nil, err
+		}
+		if dailyAt.Valid {
+			hour := int(dailyAt.Int64)
+			settings.DailyAt = &hour
+		}
+		all[miner] = &settings
+	}
+	return all, rows.Err()
+}
+
+func (s *SQLDB) SetMinerSettings(miner string, settings *MinerSettings) error {
+	var dailyAt sql.NullInt64
+	if settings.DailyAt != nil {
+		dailyAt = sql.NullInt64{Int64: int64(*settings.DailyAt), Valid: true}
+	}
+	_, err := s.db.Exec(`INSERT INTO miner_settings (coin, miner, min_payment, daily_at, time) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (coin, miner) DO UPDATE SET min_payment = EXCLUDED.min_payment, daily_at = EXCLUDED.daily_at, time = EXCLUDED.time`,
+		s.coin, miner, settings.MinPayment, dailyAt, settings.Time)
+	return err
+}
+
+func (s *SQLDB) putFoundBlock(b *sqlBatch, fb *FoundBlock) {
+	b.exec(`INSERT INTO found_blocks (coin, hash, height, tx_hash, miner, rig, time,
+			network_diff, round_shares, effort, reward, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) ON CONFLICT DO NOTHING`,
+		s.coin, fb.Hash, fb.Height, fb.TxHash, fb.Miner, fb.Rig, fb.Time,
+		fb.NetworkDiff, fb.RoundShares, fb.Effort, int64(fb.Reward), fb.Status)
+	for _, t := range fb.Transitions {
+		b.exec(`INSERT INTO block_transitions (coin, hash, status, time) VALUES ($1, $2, $3, $4)`,
+			s.coin, fb.Hash, t.Status, t.Time)
+	}
+}
+
+// GetFoundBlocks returns the newest limit found blocks, newest first.
+func (s *SQLDB) GetFoundBlocks(limit int) ([]*FoundBlock, error) {
+	rows, err := s.db.Query(`SELECT hash, height, tx_hash, miner, rig, time, network_diff, round_shares, effort, reward, status
+		FROM found_blocks WHERE coin = $1 ORDER BY time DESC, height DESC LIMIT $2`, s.coin, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := make([]*FoundBlock, 0)
+	for rows.Next() {
+		var fb FoundBlock
+		var reward int64
+		if err := rows.Scan(&fb.Hash, &fb.Height, &fb.TxHash, &fb.Miner, &fb.Rig, &fb.Time,
+			&fb.NetworkDiff, &fb.RoundShares, &fb.Effort, &reward, &fb.Status); err != nil {
+			return nil, err
+		}
+		fb.Reward = uint64(reward)
+		blocks = append(blocks, &fb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, fb := range blocks {
+		if fb.Transitions, err = s.blockTransitions(fb.Hash); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+func (s *SQLDB) blockTransitions(hash string) ([]BlockTransition, error) {
+	rows, err := s.db.Query(`SELECT status, time FROM block_transitions WHERE coin = $1 AND hash = $2 ORDER BY time`,
+		s.coin, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transitions := make([]BlockTransition, 0)
+	for rows.Next() {
+		var t BlockTransition
+		if err := rows.Scan(&t.Status, &t.Time); err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, t)
+	}
+	return transitions, rows.Err()
+}
+
+func (s *SQLDB) PutPayoutIntent(u *PaymentUpdate) error {
+	raw, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO payout_intents (coin, update_json, txid) VALUES ($1, $2, '')
+		ON CONFLICT (coin) DO UPDATE SET update_json = EXCLUDED.update_json, txid = ''`, s.coin, string(raw))
+	return err
+}
+
+func (s *SQLDB) SetPayoutIntentTxid(txid string) error {
+	_, err := s.db.Exec(`UPDATE payout_intents SET txid = $2 WHERE coin = $1`, s.coin, txid)
+	return err
+}
+
+func (s *SQLDB) GetPayoutIntent() (update *PaymentUpdate, txid string, exists bool, err error) {
+	var raw string
+	err = s.db.QueryRow(`SELECT update_json, txid FROM payout_intents WHERE coin = $1`, s.coin).Scan(&raw, &txid)
+	if err == sql.ErrNoRows {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	var u PaymentUpdate
+	if err := json.Unmarshal([]byte(raw), &u); err != nil {
+		return nil, "", false, err
+	}
+	return &u, txid, true, nil
+}
+
+func (s *SQLDB) DelPayoutIntent() error {
+	_, err := s.db.Exec(`DELETE FROM payout_intents WHERE coin = $1`, s.coin)
+	return err
+}
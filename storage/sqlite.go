@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+
+	"github.com/mining-pool/not-only-mining-pool/config"
+	_ "modernc.org/sqlite" // registers the "sqlite" driver, pure Go
+)
+
+// NewSQLiteDB opens (creating if needed) the embedded database under the data
+// directory, so a single-node pool needs no database server.
+func NewSQLiteDB(coinName string, options *config.SQLiteOptions) *SQLDB {
+	path := options.Path()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		log.Panicf("failed to create the sqlite data directory: %s", err)
+	}
+
+	// WAL lets the API read while the share writer commits; busy_timeout
+	// rides out a checkpoint instead of failing with SQLITE_BUSY.
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		log.Panicf("failed to open the sqlite database: %s", err)
+	}
+	// one connection serializes writers, which SQLite would do anyway
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		log.Panicf("failed to open the sqlite database %s: %s", path, err)
+	}
+
+	s, err := newSQLDB(db, coinName, "INTEGER PRIMARY KEY AUTOINCREMENT")
+	if err != nil {
+		log.Panicf("sqlite: %s", err)
+	}
+	return s
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"github.com/mining-pool/not-only-mining-pool/config"
+	"github.com/mining-pool/not-only-mining-pool/types"
+)
+
+// DB is everything the pool persists: shares and round seals, the PPLNS / PPS
+// share log, statistics, balances and the in-flight payout intent. Every
+// backend must pass the conformance suite in conformance_test.go.
+type DB interface {
+	// PutShare records a share, and the block it solved if any, without
+	// blocking the caller. Shares are applied in submission order, so a block
+	// seals exactly the round contributions recorded before it.
+	PutShare(share *types.Share, accepted bool)
+	// Flush waits until every share queued so far has been applied.
+	Flush()
+	// SetPPSMode keeps uncredited shares in the log instead of capping it.
+	// Set once at startup, before shares flow.
+	SetPPSMode(pps bool)
+	// UseJournal writes shares to an on-disk journal before the store, so
+	// none is lost while the store is unreachable. Call it before shares flow.
+	UseJournal(options *config.JournalOptions) error
+	// ShareQueueStats reports the shares waiting for the store.
+	ShareQueueStats() QueueStats
+	// KeepHashrate sets how long each hashrate resolution is kept and prunes
+	// expired buckets in the background until Close.
+	KeepHashrate(options *config.HashrateOptions)
+	// PruneHashrate drops the hashrate buckets that are past their retention.
+	PruneHashrate(now int64) error
+
+	GetMinerIndex() ([]string, error)
+	GetRigIndex(minerName string) ([]string, error)
+	GetMinerCurrentRoundContrib(minerName string) (float64, error)
+	GetPoolTotalValidShares() (uint64, error)
+	GetPoolTotalValidBlocks() (uint64, error)
+	GetPoolTotalInvalidShares() (uint64, error)
+	GetPoolTotalInvalidBlocks() (uint64, error)
+	GetPoolHashrate(from, to int64) (float64, error)
+	GetMinerHashrate(minerName string, from, to int64) (float64, error)
+	GetRigHashrate(minerName, rigName string, from, to int64) (float64, error)
+	GetRejectedBlocks() ([]*RejectedBlock, error)
+
+	GetAllPendingBlocks() ([]*PendingBlock, error)
+	// GetConfirmedBlocks returns every block a payout run settled as mature.
+	GetConfirmedBlocks() ([]*PendingBlock, error)
+	// GetFoundBlocks returns the newest limit found blocks, newest first.
+	GetFoundBlocks(limit int) ([]*FoundBlock, error)
+	GetRoundContrib(height uint64) (map[string]float64, error)
+	GetCoinbasePaid(height uint64) (map[string]uint64, error)
+	// GetCoinbaseWindow returns the PPLNS window the coinbase of the block at
+	// height was split over (miner -> share difficulty); empty when it paid
+	// nobody directly.
+	GetCoinbaseWindow(height uint64) (map[string]float64, error)
+	// GetPPLNSShares and WalkShareLog read the share log of a share group (see
+	// types.Share.PayMode); pps reads and trims only the pool's own, "".
+	GetPPLNSShares(group string, uptoSeq int64, window float64) (map[string]float64, error)
+	// WalkShareLog visits the share log backward from uptoSeq, newest first,
+	// until visit returns false or the log ends.
+	WalkShareLog(group string, uptoSeq int64, visit func(*LoggedShare) bool) error
+	// GetSharesSince sums the difficulty and the value (types.Share.Value) of
+	// each miner's shares in the pool's log after cursor, with the last seq.
+	GetSharesSince(cursor int64) (diffs, values map[string]float64, maxSeq int64, err error)
+	GetPPSCursor() (int64, error)
+	// GetPayouts returns the newest limit ledger entries, newest first.
+	GetPayouts(limit int) ([]*Payout, error)
+	// GetPayout returns the ledger entry of txid, nil when there is none.
+	GetPayout(txid string) (*Payout, error)
+	// GetMinerPayouts returns the newest limit payouts to the miner, newest first.
+	GetMinerPayouts(miner string, limit int) ([]*MinerPayout, error)
+	// GetUnconfirmedPayouts returns the payout transactions ApplyPayments
+	// recorded and nobody has confirmed since: txid -> when it was sent or last
+	// replaced, in unix seconds.
+	GetUnconfirmedPayouts() (map[string]int64, error)
+	// ConfirmPayout stops following txid, once it is confirmed or given up on.
+	ConfirmPayout(txid string) error
+	// ConflictPayout flags the ledger entry of txid as conflicted, when a
+	// transaction spending its inputs confirmed instead. txid stays followed.
+	ConflictPayout(txid string) error
+	// ReplacePayout records that a fee bump replaced the payout transaction old
+	// with txid at now: the ledger entry, the intent if it is still in flight,
+	// and the unconfirmed payouts move to txid.
+	ReplacePayout(old, txid string, now int64) error
+	GetAllMinerBalances() (map[string]float64, error)
+	// GetAllMinerPaid returns what each miner has been paid in total, in coin.
+	GetAllMinerPaid() (map[string]float64, error)
+	// GetMinerSettings returns the payout settings of a miner, nil when they
+	// never set any.
+	GetMinerSettings(miner string) (*MinerSettings, error)
+	GetAllMinerSettings() (map[string]*MinerSettings, error)
+	SetMinerSettings(miner string, settings *MinerSettings) error
+	ApplyPayments(u *PaymentUpdate) error
+
+	PutPayoutIntent(u *PaymentUpdate) error
+	SetPayoutIntentTxid(txid string) error
+	GetPayoutIntent() (update *PaymentUpdate, txid string, exists bool, err error)
+	DelPayoutIntent() error
+
+	Close() error
+}
+
+// NewStorage connects the backend chosen in options, panicking when it can't,
+// as the pool cannot run without its storage.
+func NewStorage(coinName string, options *config.StorageOptions) DB {
+	db := Open(coinName, options)
+	db.KeepHashrate(options.Hashrate)
+	if options.Journal != nil {
+		if err := db.UseJournal(options.Journal); err != nil {
+			log.Panic("failed to open the share journal: ", err)
+		}
+	}
+	return db
+}
+
+// Open connects the backend chosen in options, panicking when it can't. Unlike
+// NewStorage it starts no background upkeep, for tools that only read.
+func Open(coinName string, options *config.StorageOptions) DB {
+	switch options.GetBackend() {
+	case config.StorageRedis:
+		return NewRedisDB(coinName, &options.RedisOptions)
+	case config.StoragePostgres:
+		if options.Postgres == nil {
+			log.Panic("storage backend is postgres but storage.postgres is not configured")
+		}
+		return NewPostgresDB(coinName, options.Postgres)
+	case config.StorageSQLite:
+		if options.SQLite == nil {
+			options.SQLite = &config.SQLiteOptions{}
+		}
+		return NewSQLiteDB(coinName, options.SQLite)
+	default:
+		log.Panicf("unknown storage backend %q, use redis, postgres or sqlite", options.Backend)
+		return nil
+	}
+}
+
+// shareGroups are the accounting groups a share can be in: the pool's pay
+// mode, "", and each mode a port or miner may choose instead.
+var shareGroups = append([]string{""}, config.BlockPayModes...)
+
+// LoggedShare is one entry of the share log. Time is 0 for shares logged
+// before the log kept it.
+type LoggedShare struct {
+	Seq   int64
+	Miner string
+	Diff  float64
+	Time  int64
+}
+
+// PaymentUpdate is the atomic result of one payout run, applied by ApplyPayments
+// in a single transaction so balances, payouts and block state never diverge.
+type PaymentUpdate struct {
+	Balances     map[string]float64 // miner -> new carried-over balance (coin), absolute
+	Paid         map[string]float64 // miner -> amount paid this run (coin), added to payouts
+	Confirmed    []string           // pending block strings moving to confirmed
+	Orphaned     []string           // pending block strings moving to orphaned
+	DeleteRounds []uint64           // sealed round heights whose shares are now accounted
+	PPSCursor    int64              // pps: advance the credited-share cursor (0 = leave)
+	Txid         string             // the payout transaction, recorded in the ledger with Paid
+	// Coinbase are the direct coinbase payouts of the blocks moving to
+	// confirmed, one per block by its coinbase txid. They are added to payouts
+	// and the ledger, already confirmed; Time is set when they are applied.
+	Coinbase []*Payout
+}
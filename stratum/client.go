@@ -10,6 +10,7 @@ import (
 	"math/big"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mining-pool/not-only-mining-pool/types"
@@ -44,6 +45,9 @@ type Client struct {
 
 	WorkerName string
 	WorkerPass string
+	// PayMode is the accounting group the client's shares are tagged with (see
+	// config.PaymentOptions.ShareGroup), set on authorize.
+	PayMode string
 
 	PendingDifficulty  *big.Float
 	CurrentDifficulty  *big.Float
@@ -58,7 +62,7 @@ type Client struct {
 	Engine engine.Engine
 	// DB persists engine-mode shares for stats/accounting (nil in the GBT path,
 	// which persists via JobManager.Storage instead).
-	DB *storage.DB
+	DB storage.DB
 }
 
 func NewStratumClient(subscriptionId []byte, socket net.Conn, options *config.Options, jm *jobs.JobManager, bm *bans.BanningManager) *Client {
@@ -200,6 +204,9 @@ func (sc *Client) HandleAuthorize(message *daemons.JsonRpcRequest, replyToSocket
 	sc.WorkerPass = utils.RawJsonToString(authParams[1])
 
 	authorized, disconnect, err := sc.AuthorizeFn(sc.RemoteAddress, sc.Socket.LocalAddr().(*net.TCPAddr).Port, sc.WorkerName, sc.WorkerPass)
+	if err == nil && authorized {
+		err = sc.choosePayMode()
+	}
 	sc.IsAuthorized = err == nil && authorized
 
 	if replyToSocket {
@@ -233,6 +240,36 @@ func (sc *Client) HandleAuthorize(message *daemons.JsonRpcRequest, replyToSocket
 	sc.SendMiningJob(sc.JobManager.CurrentJob.GetJobParams(true))
 }
 
+// choosePayMode sets the accounting group of the client's shares: the pay mode
+// the miner asked for with "m=<mode>" in the password, else the port's.
+func (sc *Client) choosePayMode() error {
+	var mode string
+	if p := sc.Options.Ports[sc.Socket.LocalAddr().(*net.TCPAddr).Port]; p != nil {
+		mode = p.PayMode
+	}
+	if m, ok := passwordOption(sc.WorkerPass, "m"); ok {
+		mode = m
+	}
+	group, err := sc.Options.PaymentOptions.ShareGroup(mode)
+	if err != nil {
+		log.Warnf("refusing %s: %s", sc.WorkerName, err)
+		return err
+	}
+	sc.PayMode = group
+	return nil
+}
+
+// passwordOption looks up key in a password of comma-separated key=value
+// options, as in "x,m=solo".
+func passwordOption(password, key string) (string, bool) {
+	for _, opt := range strings.Split(password, ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(opt), "="); ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
 // TODO: Can be DIY
 func (sc *Client) AuthorizeFn(ip net.Addr, port int, workerName string, password string) (authorized bool, disconnect bool, err error) {
 	log.Info("Authorize " + workerName + ": " + password + "@" + ip.String())
@@ -290,6 +327,7 @@ func (sc *Client) HandleSubmit(message *daemons.JsonRpcRequest) {
 		utils.RawJsonToString(submitParams[0]),
 	)
 
+	share.PayMode = sc.PayMode
 	sc.JobManager.ProcessShare(share)
 
 	if share.ErrorCode == types.ErrLowDiffShare {
@@ -5,6 +5,7 @@ import (
 	"math/big"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/mining-pool/not-only-mining-pool/daemons"
 	"github.com/mining-pool/not-only-mining-pool/engine"
@@ -160,6 +161,14 @@ func (sc *Client) handleEngineMessage(message *daemons.JsonRpcRequest) {
 		}
 		if arr := message.ParamsArray(); len(arr) > 0 {
 			sc.WorkerName = utils.RawJsonToString(arr[0])
+			if len(arr) > 1 {
+				sc.WorkerPass = utils.RawJsonToString(arr[1])
+			}
+		}
+		if err := sc.choosePayMode(); err != nil {
+			sc.SendJsonRPC(&daemons.JsonRpcResponse{Id: message.Id, Result: utils.Jsonify(false),
+				Error: &daemons.JsonRpcError{Code: 20, Message: err.Error()}})
+			return
 		}
 		sc.IsAuthorized = true
 		if sc.CurrentDifficulty == nil {
@@ -181,8 +190,16 @@ func (sc *Client) handleEngineMessage(message *daemons.JsonRpcRequest) {
 				if l, ok := obj["login"].(string); ok {
 					sc.WorkerName = l
 				}
+				if p, ok := obj["pass"].(string); ok {
+					sc.WorkerPass = p
+				}
 			}
 		}
+		if err := sc.choosePayMode(); err != nil {
+			sc.SendJsonRPC(&daemons.JsonRpcResponse{Id: message.Id, Result: nil,
+				Error: &daemons.JsonRpcError{Code: 20, Message: err.Error()}})
+			return
+		}
 		sc.IsAuthorized = true
 		if sc.CurrentDifficulty == nil {
 			sc.CurrentDifficulty = big.NewFloat(sc.portDefaultDiff())
@@ -211,7 +228,9 @@ func (sc *Client) handleEngineMessage(message *daemons.JsonRpcRequest) {
 			return
 		}
 
+		submitTime := time.Now()
 		share := sc.Engine.OnSubmit(sess, rawParamsToIface(message.Params))
+		share.Time = submitTime.Unix()
 		achievedDiff := share.Diff // engines report the achieved hash difficulty here
 		// vardiff boundary tolerance: honour a share that met the difficulty in
 		// force before the last retarget — the miner may still be on work targeted
@@ -220,6 +239,7 @@ func (sc *Client) handleEngineMessage(message *daemons.JsonRpcRequest) {
 		if share.ErrorCode == types.ErrLowDiffShare && sc.meetsPreviousEngineDiff(achievedDiff) {
 			share.ErrorCode = 0
 		}
+		share.PayMode = sc.PayMode
 		valid := share.ErrorCode == 0
 
 		if valid {
@@ -229,9 +249,10 @@ func (sc *Client) handleEngineMessage(message *daemons.JsonRpcRequest) {
 			share.Miner, share.Rig = splitWorker(sc.WorkerName)
 			share.Diff = sc.creditedEngineDiff(achievedDiff)
 			// A block is payable (recorded as pending) only if the engine resolved
-			// its coinbase txid, i.e. a bitcoin-family coin like Ravencoin whose
-			// wallet the payout processor can drive. Other engines' blocks are left
-			// as ordinary share contributions (their payout is coin-specific).
+			// what the payer finds it by: the coinbase txid of a bitcoin-family coin
+			// like Ravencoin, or the seal nonce of an ethash block. Other engines'
+			// blocks are left as ordinary share contributions (their payout is
+			// coin-specific).
 			blockAccepted := share.TxHash != ""
 			if share.BlockHex != "" && !blockAccepted {
 				share.BlockHex = ""
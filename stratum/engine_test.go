@@ -3,6 +3,7 @@ package stratum
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"math/big"
 	"net"
@@ -43,9 +44,9 @@ type fakeEngine struct {
 	height    int64
 }
 
-func (f *fakeEngine) Name() string                     { return "fake" }
-func (f *fakeEngine) Init(_ *config.Options) error     { return nil }
-func (f *fakeEngine) Watch(_ func()) error            { select {} }
+func (f *fakeEngine) Name() string                                    { return "fake" }
+func (f *fakeEngine) Init(_ context.Context, _ *config.Options) error { return nil }
+func (f *fakeEngine) Watch(ctx context.Context, _ func()) error       { <-ctx.Done(); return ctx.Err() }
 func (f *fakeEngine) OnSubscribe(_ engine.Session, _ []interface{}) (interface{}, []byte, int) {
 	return true, nil, 0
 }
@@ -137,6 +138,34 @@ func TestEngineLoginPushesWorkAtPortDiff(t *testing.T) {
 	}
 }
 
+// The port's pay mode tags the client's shares unless the password picks
+// another; a mode that can't be mixed with the pool's refuses the login.
+func TestEngineLoginPicksPayMode(t *testing.T) {
+	for _, tc := range []struct {
+		pass, want string
+		ok         bool
+	}{
+		{"x", config.PayModeSolo, true},
+		{"x,m=pplns", "", true},
+		{"m=prop", config.PayModeProp, true},
+		{"x,m=pps", "", false},
+	} {
+		sc, out := newEngineTestClient(&fakeEngine{valid: true})
+		sc.Options.Ports[3032].PayMode = config.PayModeSolo
+		sc.Options.PaymentOptions = &config.PaymentOptions{PayMode: config.PayModePPLNS}
+
+		sc.HandleMessage(req("eth_submitLogin", "0xworker", tc.pass))
+		msgs := drainResponses(t, out)
+		if sc.IsAuthorized != tc.ok || len(msgs) == 0 || (msgs[0]["result"] == true) != tc.ok {
+			t.Errorf("password %q: authorized %v (%v), want %v", tc.pass, sc.IsAuthorized, msgs, tc.ok)
+			continue
+		}
+		if tc.ok && sc.PayMode != tc.want {
+			t.Errorf("password %q: pay mode %q, want %q", tc.pass, sc.PayMode, tc.want)
+		}
+	}
+}
+
 func TestEngineGetWorkAndSubmitRouting(t *testing.T) {
 	eng := &fakeEngine{valid: true}
 	sc, out := newEngineTestClient(eng)
@@ -330,7 +359,7 @@ func TestEngineSharePersisted(t *testing.T) {
 	defer mr.Close()
 	host, portStr, _ := net.SplitHostPort(mr.Addr())
 	port, _ := strconv.Atoi(portStr)
-	db := storage.NewStorage("TESTENG", &config.RedisOptions{Network: "tcp", Host: host, Port: port})
+	db := storage.NewRedisDB("TESTENG", &config.RedisOptions{Network: "tcp", Host: host, Port: port})
 
 	eng := &fakeEngine{valid: true}
 	sc, _ := newEngineTestClient(eng)
@@ -363,7 +392,7 @@ func TestEngineSharePersisted(t *testing.T) {
 // A bitcoin-family engine block (coinbase txid resolved) is sealed as a pending,
 // payable block; a block without a txid is kept as an ordinary share only.
 func TestEngineBlockShareRecording(t *testing.T) {
-	newDB := func(t *testing.T) (*storage.DB, *miniredis.Miniredis) {
+	newDB := func(t *testing.T) (*storage.RedisDB, *miniredis.Miniredis) {
 		mr, err := miniredis.Run()
 		if err != nil {
 			t.Fatal(err)
@@ -371,7 +400,7 @@ func TestEngineBlockShareRecording(t *testing.T) {
 		t.Cleanup(mr.Close)
 		host, portStr, _ := net.SplitHostPort(mr.Addr())
 		port, _ := strconv.Atoi(portStr)
-		return storage.NewStorage("TESTENG", &config.RedisOptions{Network: "tcp", Host: host, Port: port}), mr
+		return storage.NewRedisDB("TESTENG", &config.RedisOptions{Network: "tcp", Host: host, Port: port}), mr
 	}
 	submit := func(sc *Client) {
 		sc.IsAuthorized = true
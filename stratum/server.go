@@ -2,6 +2,7 @@ package stratum
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"net"
@@ -38,7 +39,7 @@ type Server struct {
 	// the server then skips the Bitcoin/GBT rebroadcast loop.
 	Engine engine.Engine
 	// DB persists engine-mode shares (the GBT path persists via JobManager.Storage).
-	DB *storage.DB
+	DB storage.DB
 
 	rebroadcastTicker *time.Ticker
 }
@@ -54,12 +55,17 @@ func NewStratumServer(options *config.Options, jm *jobs.JobManager, bm *bans.Ban
 	}
 }
 
-func (ss *Server) Init() (portStarted []int) {
+// Init listens on the configured ports and serves miners; an engine watches its
+// node for new work until ctx is done.
+func (ss *Server) Init(ctx context.Context) (portStarted []int) {
 	if ss.Options.Banning != nil {
 		ss.BanningManager.Init()
 	}
 
 	for port, options := range ss.Options.Ports {
+		if _, err := ss.Options.PaymentOptions.ShareGroup(options.PayMode); err != nil {
+			log.Panicf("port %d: %s", port, err)
+		}
 		var err error
 		if options.TLS != nil {
 			ss.Listener, err = tls.Listen("tcp", ":"+strconv.Itoa(port), options.TLS.ToTLSConfig())
@@ -87,7 +93,7 @@ func (ss *Server) Init() (portStarted []int) {
 		// only as fallback) and calls back on every new-work signal.
 		go func() {
 			defer log.Warn("engine watcher stopped")
-			if err := ss.Engine.Watch(ss.BroadcastEngineWork); err != nil {
+			if err := ss.Engine.Watch(ctx, ss.BroadcastEngineWork); err != nil {
 				log.Error("engine watch stopped: ", err)
 			}
 		}()
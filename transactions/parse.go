@@ -0,0 +1,245 @@
+package transactions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var errShortRead = errors.New("unexpected end of data")
+
+// TxLayout describes fork-specific fields around the Bitcoin transaction
+// format, matching what CreateGeneration emits for the coin.
+type TxLayout struct {
+	// Timestamp: POS coins carry a 4-byte nTime after the version.
+	Timestamp bool
+	// Comment: txMessages coins append a var-string comment after the lock time
+	// of version >= 2 transactions.
+	Comment bool
+}
+
+type TxIn struct {
+	PrevOutHash  []byte
+	PrevOutIndex uint32
+	ScriptSig    []byte
+	Sequence     uint32
+}
+
+type TxOut struct {
+	Value        uint64
+	ScriptPubKey []byte
+}
+
+// Tx is a parsed transaction. Stripped is its serialization without witness
+// data (what the txid hashes); Size counts every byte, witness included.
+type Tx struct {
+	Version    int32
+	Inputs     []*TxIn
+	Outputs    []*TxOut
+	LockTime   uint32
+	HasWitness bool
+
+	Stripped []byte
+	Size     int
+}
+
+// Weight is the BIP141 weight: stripped size * 3 + total size.
+func (tx *Tx) Weight() int {
+	return len(tx.Stripped)*3 + tx.Size
+}
+
+// OutputValue sums the transaction's outputs.
+func (tx *Tx) OutputValue() uint64 {
+	var total uint64
+	for _, out := range tx.Outputs {
+		total += out.Value
+	}
+	return total
+}
+
+// txReader walks a serialized transaction while copying every non-witness
+// byte into stripped.
+type txReader struct {
+	data     []byte
+	pos      int
+	stripped bytes.Buffer
+}
+
+func (r *txReader) read(n int, keep bool) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, errShortRead
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	if keep {
+		r.stripped.Write(b)
+	}
+	return b, nil
+}
+
+func (r *txReader) uint32(keep bool) (uint32, error) {
+	b, err := r.read(4, keep)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (r *txReader) varInt(keep bool) (uint64, error) {
+	b, err := r.read(1, keep)
+	if err != nil {
+		return 0, err
+	}
+	switch b[0] {
+	case 0xFD:
+		b, err = r.read(2, keep)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.LittleEndian.Uint16(b)), nil
+	case 0xFE:
+		b, err = r.read(4, keep)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.LittleEndian.Uint32(b)), nil
+	case 0xFF:
+		b, err = r.read(8, keep)
+		if err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(b), nil
+	default:
+		return uint64(b[0]), nil
+	}
+}
+
+func (r *txReader) varBytes(keep bool) ([]byte, error) {
+	n, err := r.varInt(keep)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.data)) {
+		return nil, errShortRead
+	}
+	return r.read(int(n), keep)
+}
+
+// ReadVarInt decodes the Bitcoin CompactSize at the start of data, returning
+// the value and the number of bytes it occupied.
+func ReadVarInt(data []byte) (uint64, int, error) {
+	r := &txReader{data: data}
+	n, err := r.varInt(false)
+	return n, r.pos, err
+}
+
+// ParseTx decodes one transaction from the start of data and returns it with
+// the number of bytes consumed, so a block's transactions can be walked in
+// sequence. It understands BIP144 witness serialization and Dash DIP2 special
+// transaction payloads, plus the fork fields selected by layout.
+func ParseTx(data []byte, layout TxLayout) (*Tx, int, error) {
+	r := &txReader{data: data}
+	tx := &Tx{}
+
+	version, err := r.uint32(true)
+	if err != nil {
+		return nil, 0, err
+	}
+	tx.Version = int32(version)
+
+	if layout.Timestamp {
+		if _, err := r.read(4, true); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// BIP144: a zero input count followed by a non-zero flag marks witness data.
+	if r.pos+2 <= len(data) && data[r.pos] == 0x00 && data[r.pos+1] != 0x00 {
+		if data[r.pos+1] != 0x01 {
+			return nil, 0, fmt.Errorf("unknown witness flag %#x", data[r.pos+1])
+		}
+		tx.HasWitness = true
+		r.pos += 2
+	}
+
+	inCount, err := r.varInt(true)
+	if err != nil {
+		return nil, 0, err
+	}
+	if inCount > uint64(len(data)) {
+		return nil, 0, errShortRead
+	}
+	tx.Inputs = make([]*TxIn, inCount)
+	for i := range tx.Inputs {
+		in := &TxIn{}
+		if in.PrevOutHash, err = r.read(32, true); err != nil {
+			return nil, 0, err
+		}
+		if in.PrevOutIndex, err = r.uint32(true); err != nil {
+			return nil, 0, err
+		}
+		if in.ScriptSig, err = r.varBytes(true); err != nil {
+			return nil, 0, err
+		}
+		if in.Sequence, err = r.uint32(true); err != nil {
+			return nil, 0, err
+		}
+		tx.Inputs[i] = in
+	}
+
+	outCount, err := r.varInt(true)
+	if err != nil {
+		return nil, 0, err
+	}
+	if outCount > uint64(len(data)) {
+		return nil, 0, errShortRead
+	}
+	tx.Outputs = make([]*TxOut, outCount)
+	for i := range tx.Outputs {
+		value, err := r.read(8, true)
+		if err != nil {
+			return nil, 0, err
+		}
+		script, err := r.varBytes(true)
+		if err != nil {
+			return nil, 0, err
+		}
+		tx.Outputs[i] = &TxOut{Value: binary.LittleEndian.Uint64(value), ScriptPubKey: script}
+	}
+
+	if tx.HasWitness {
+		for range tx.Inputs {
+			items, err := r.varInt(false)
+			if err != nil {
+				return nil, 0, err
+			}
+			for ; items > 0; items-- {
+				if _, err := r.varBytes(false); err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+	}
+
+	if tx.LockTime, err = r.uint32(true); err != nil {
+		return nil, 0, err
+	}
+
+	if layout.Comment && tx.Version >= 2 {
+		if _, err := r.varBytes(true); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// DIP2: version 3+ with a non-zero type carries an extra payload.
+	if tx.Version&0xffff >= 3 && tx.Version>>16 != 0 {
+		if _, err := r.varBytes(true); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	tx.Stripped = r.stripped.Bytes()
+	tx.Size = r.pos
+	return tx, r.pos, nil
+}
@@ -0,0 +1,45 @@
+package transactions
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/mining-pool/not-only-mining-pool/utils"
+)
+
+// TestParseTx_Witness checks a segwit transaction parses to its txid (stripped
+// serialization) and wtxid (full serialization).
+func TestParseTx_Witness(t *testing.T) {
+	raw, _ := hex.DecodeString("01000000000101899522d55c2fdf575cfb549f15f6c7c34e43e98b17300ae34edc63f8272311410100000000ffffffff020000000000000000136a0c0701007ac01b000140000000530345d471abcc1e0b000000001600148d5ce2c127c03ad8d1f9fc9bbe3fad1023bb2aa202473044022029ba3fbd618616a48ff211450008d0ced9654ffdd3f46640e51535322cef122c022017db76be63a080580144cebdefceee4032d4c481f2961a8dc67f23f2d0ccfc70012103df64a645452a26c559adeff4825e6ab5a4935a0627b4b13b5f5d716e818906a700000000")
+
+	tx, n, err := ParseTx(append(raw, 0xde, 0xad), TxLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(raw) {
+		t.Errorf("consumed %d bytes, want %d", n, len(raw))
+	}
+	if !tx.HasWitness || len(tx.Inputs) != 1 || len(tx.Outputs) != 2 {
+		t.Errorf("parsed witness=%v inputs=%d outputs=%d, want true 1 2", tx.HasWitness, len(tx.Inputs), len(tx.Outputs))
+	}
+
+	txid := hex.EncodeToString(utils.ReverseBytes(utils.Sha256d(tx.Stripped)))
+	if txid != "78c1505e1312bdc723e4a86aad3e2e798cd6761d0a589b87de248b33f2c5773f" {
+		t.Errorf("txid = %s, want 78c1505e…", txid)
+	}
+	wtxid := hex.EncodeToString(utils.ReverseBytes(utils.Sha256d(raw[:n])))
+	if wtxid != "d12deb5951b796a3c478ae446598f5591b3ee571188980eba4c8bb3276260c0d" {
+		t.Errorf("wtxid = %s, want d12deb59…", wtxid)
+	}
+	if tx.Weight() <= tx.Size || tx.Weight() >= tx.Size*4 {
+		t.Errorf("weight = %d, want between size %d and 4x", tx.Weight(), tx.Size)
+	}
+}
+
+// TestParseTx_Truncated checks a cut-off transaction fails instead of panicking.
+func TestParseTx_Truncated(t *testing.T) {
+	raw, _ := hex.DecodeString("0100000001979a795a82096fc375487778939d9193bb284c58525e5df9c3a404c81c9220ef01000000")
+	if _, _, err := ParseTx(raw, TxLayout{}); err == nil {
+		t.Error("ParseTx on truncated data succeeded, want an error")
+	}
+}
@@ -0,0 +1,116 @@
+package transactions
+
+import (
+	"bytes"
+	"math"
+	"sort"
+
+	"github.com/mining-pool/not-only-mining-pool/utils"
+)
+
+// CoinbasePayout is a coinbase output paying a miner directly.
+type CoinbasePayout struct {
+	Miner  string
+	Script []byte
+	Amount uint64 // satoshis
+}
+
+// CoinbaseSplit pays a PPLNS window straight from the coinbase: the pool's part
+// of the reward is divided across the window's miners by share difficulty.
+// Payouts under Dust, past MaxOutputs or to miners without a script stay in the
+// pool output, and the payer pays those remainders from the wallet as usual.
+type CoinbaseSplit struct {
+	Shares     map[string]float64 // PPLNS window: miner -> share difficulty
+	Dust       uint64             // smallest output worth creating (satoshis)
+	MaxOutputs int                // most miner outputs in one coinbase (<=0: no cap)
+
+	// Script returns the output script paying a miner, or nil if the miner name
+	// is not a payable address.
+	Script func(miner string) []byte
+
+	// Paid is filled in by GenerateOutputTransactions with the outputs it built.
+	Paid []*CoinbasePayout
+}
+
+// Payouts divides reward across the window. Every miner's cut is taken from the
+// window's full difficulty, so folded-back miners leave their own cut (not a
+// bigger one) in the pool output. The largest contributors are kept first, with
+// ties broken by name so the coinbase is the same on every rebuild.
+func (s *CoinbaseSplit) Payouts(reward uint64) []*CoinbasePayout {
+	var total float64
+	miners := make([]string, 0, len(s.Shares))
+	for miner, diff := range s.Shares {
+		if diff > 0 {
+			total += diff
+			miners = append(miners, miner)
+		}
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	sort.Slice(miners, func(i, j int) bool {
+		if s.Shares[miners[i]] != s.Shares[miners[j]] {
+			return s.Shares[miners[i]] > s.Shares[miners[j]]
+		}
+		return miners[i] < miners[j]
+	})
+
+	payouts := make([]*CoinbasePayout, 0, len(miners))
+	for _, miner := range miners {
+		if s.MaxOutputs > 0 && len(payouts) >= s.MaxOutputs {
+			break
+		}
+
+		amount := uint64(math.Floor(float64(reward) * (s.Shares[miner] / total)))
+		if amount == 0 || amount < s.Dust {
+			continue
+		}
+
+		script := s.Script(miner)
+		if script == nil {
+			continue
+		}
+
+		payouts = append(payouts, &CoinbasePayout{Miner: miner, Script: script, Amount: amount})
+	}
+
+	return payouts
+}
+
+// PaidAmounts returns the coinbase payouts as miner -> satoshis.
+func (s *CoinbaseSplit) PaidAmounts() map[string]uint64 {
+	if s == nil || len(s.Paid) == 0 {
+		return nil
+	}
+
+	paid := make(map[string]uint64, len(s.Paid))
+	for _, p := range s.Paid {
+		paid[p.Miner] = p.Amount
+	}
+	return paid
+}
+
+// PaidWindow returns the window the payouts were split from, nil when the
+// coinbase pays nobody directly.
+func (s *CoinbaseSplit) PaidWindow() map[string]float64 {
+	if s == nil || len(s.Paid) == 0 {
+		return nil
+	}
+	return s.Shares
+}
+
+// coinbasePayoutOutputs serializes the split's outputs and returns their total.
+func coinbasePayoutOutputs(payouts []*CoinbasePayout) ([][]byte, uint64) {
+	var total uint64
+	outputs := make([][]byte, len(payouts))
+	for i, p := range payouts {
+		total += p.Amount
+		outputs[i] = bytes.Join([][]byte{
+			utils.PackUint64LE(p.Amount),
+			utils.VarIntBytes(uint64(len(p.Script))),
+			p.Script,
+		}, nil)
+	}
+	return outputs, total
+}
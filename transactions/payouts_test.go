@@ -0,0 +1,80 @@
+package transactions
+
+import (
+	"testing"
+)
+
+// TestCoinbaseSplit_Payouts checks the dust threshold, the output cap and
+// unpayable miners all leave their cut in the pool output.
+func TestCoinbaseSplit_Payouts(t *testing.T) {
+	split := &CoinbaseSplit{
+		Shares: map[string]float64{
+			"big":     50,
+			"mid":     30,
+			"bad":     10,
+			"small":   9,
+			"dust":    1,
+			"nothing": 0,
+		},
+		Dust:       20,
+		MaxOutputs: 3,
+		Script: func(miner string) []byte {
+			if miner == "bad" {
+				return nil
+			}
+			return []byte(miner)
+		},
+	}
+
+	payouts := split.Payouts(1000)
+	want := []struct {
+		miner  string
+		amount uint64
+	}{{"big", 500}, {"mid", 300}, {"small", 90}}
+	if len(payouts) != len(want) {
+		t.Fatalf("got %d payouts, want %d", len(payouts), len(want))
+	}
+	for i, w := range want {
+		if payouts[i].Miner != w.miner || payouts[i].Amount != w.amount {
+			t.Errorf("payout %d = %s:%d, want %s:%d", i, payouts[i].Miner, payouts[i].Amount, w.miner, w.amount)
+		}
+	}
+
+	split.MaxOutputs = 1
+	if payouts = split.Payouts(1000); len(payouts) != 1 || payouts[0].Miner != "big" {
+		t.Errorf("MaxOutputs=1 payouts = %v, want only big", payouts)
+	}
+}
+
+// TestGenerateOutputTransactions_CoinbaseSplit checks miner outputs come out of
+// the pool output and are recorded in split.Paid.
+func TestGenerateOutputTransactions_CoinbaseSplit(t *testing.T) {
+	rpcData := segwitTemplate(t)
+	rpcData.Transactions = nil
+	rpcData.DefaultWitnessCommitment = ""
+	rpcData.CoinbaseValue = 1000
+
+	split := &CoinbaseSplit{
+		Shares: map[string]float64{"a": 3, "b": 1},
+		Script: func(miner string) []byte { return []byte{0x51} },
+	}
+	outputs, err := GenerateOutputTransactions([]byte{0x52}, nil, rpcData, nil, split)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wrap the outputs in a one-input transaction so ParseTx can read them back
+	raw := append([]byte{1, 0, 0, 0, 1}, make([]byte, 32)...)
+	raw = append(raw, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0)
+	raw = append(append(raw, outputs...), 0, 0, 0, 0)
+	tx, _, err := ParseTx(raw, TxLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.Outputs) != 3 || tx.Outputs[0].Value != 0 || tx.Outputs[1].Value != 750 || tx.Outputs[2].Value != 250 {
+		t.Errorf("outputs = pool %d + %d miners, want pool 0, a 750, b 250", tx.Outputs[0].Value, len(tx.Outputs)-1)
+	}
+	if paid := split.PaidAmounts(); paid["a"] != 750 || paid["b"] != 250 {
+		t.Errorf("PaidAmounts = %v, want a:750 b:250", paid)
+	}
+}
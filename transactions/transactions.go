@@ -3,12 +3,14 @@ package transactions
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
 	"math"
 	"time"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/mining-pool/not-only-mining-pool/config"
 	"github.com/mining-pool/not-only-mining-pool/daemons"
+	"github.com/mining-pool/not-only-mining-pool/merkletree"
 	"github.com/mining-pool/not-only-mining-pool/utils"
 )
 
@@ -21,7 +23,13 @@ var log = logging.Logger("tx")
 //	DefaultWitnessCommitment string
 //}
 
-func GenerateOutputTransactions(poolRecipient []byte, recipients []*config.Recipient, rpcData *daemons.GetBlockTemplate) []byte {
+// GenerateOutputTransactions serializes the coinbase outputs: the witness
+// commitment (when the block needs one), the pool's remainder, then any
+// masternode/superblock/payee and recipient outputs. hasher is the coin's txid
+// hasher (nil = double-SHA256), used to verify the witness commitment. A non-nil
+// split pays miners directly out of the pool's remainder and records the outputs
+// it built in split.Paid.
+func GenerateOutputTransactions(poolRecipient []byte, recipients []*config.Recipient, rpcData *daemons.GetBlockTemplate, hasher merkletree.Hasher, split *CoinbaseSplit) ([]byte, error) {
 	reward := rpcData.CoinbaseValue
 	rewardToPool := reward
 	txOutputBuffers := make([][]byte, 0)
@@ -40,8 +48,9 @@ func GenerateOutputTransactions(poolRecipient []byte, recipients []*config.Recip
 				payeeScript = utils.P2PKHAddressToScript(rpcData.Masternode[i].Payee)
 			}
 			txOutputBuffers = append(txOutputBuffers, bytes.Join([][]byte{
-				utils.PackUint64BE(payeeReward),
+				utils.PackUint64LE(payeeReward),
 				utils.VarIntBytes(uint64(len(payeeScript))),
+				payeeScript,
 			}, nil))
 		}
 	}
@@ -68,6 +77,24 @@ func GenerateOutputTransactions(poolRecipient []byte, recipients []*config.Recip
 		}
 	}
 
+	for _, payee := range rpcData.Payees {
+		payeeScript, err := templatePayeeScript(payee, rpcData.Networks)
+		if err != nil {
+			return nil, err
+		}
+		reward -= payee.Amount
+		rewardToPool -= payee.Amount
+
+		txOutputBuffers = append(txOutputBuffers, bytes.Join([][]byte{
+			utils.PackUint64LE(payee.Amount),
+			utils.VarIntBytes(uint64(len(payeeScript))),
+			payeeScript,
+		}, nil))
+	}
+	if rewardToPool > rpcData.CoinbaseValue {
+		return nil, fmt.Errorf("template payees at height %d claim more than the coinbase value %d", rpcData.Height, rpcData.CoinbaseValue)
+	}
+
 	if rpcData.Payee != nil {
 		var payeeReward uint64
 		if rpcData.PayeeAmount != nil {
@@ -100,18 +127,25 @@ func GenerateOutputTransactions(poolRecipient []byte, recipients []*config.Recip
 		}, nil))
 	}
 
+	if split != nil {
+		split.Paid = split.Payouts(rewardToPool)
+		minerOutputs, minerTotal := coinbasePayoutOutputs(split.Paid)
+		rewardToPool -= minerTotal
+		txOutputBuffers = append(txOutputBuffers, minerOutputs...)
+	}
+
 	txOutputBuffers = append([][]byte{bytes.Join([][]byte{
 		utils.PackUint64LE(rewardToPool),
 		utils.VarIntBytes(uint64(len(poolRecipient))),
 		poolRecipient,
 	}, nil)}, txOutputBuffers...)
 
-	if rpcData.DefaultWitnessCommitment != "" {
-		witnessCommitment, err := hex.DecodeString(rpcData.DefaultWitnessCommitment)
-		if err != nil {
-			log.Error(err)
-		}
+	witnessCommitment, err := ResolveWitnessCommitment(rpcData, hasher)
+	if err != nil {
+		return nil, err
+	}
 
+	if witnessCommitment != nil {
 		txOutputBuffers = append([][]byte{bytes.Join([][]byte{
 			utils.PackUint64LE(0),
 			utils.VarIntBytes(uint64(len(witnessCommitment))),
@@ -122,10 +156,30 @@ func GenerateOutputTransactions(poolRecipient []byte, recipients []*config.Recip
 	return bytes.Join([][]byte{
 		utils.VarIntBytes(uint64(len(txOutputBuffers))),
 		bytes.Join(txOutputBuffers, nil),
-	}, nil)
+	}, nil), nil
 }
 
-func CreateGeneration(rpcData *daemons.GetBlockTemplate, publicKey, extraNoncePlaceholder []byte, reward string, txMessages bool, recipients []*config.Recipient) [][]byte {
+// templatePayeeScript returns the output script of a declared template payee:
+// its scriptPubKey when given, else the P2PKH or P2SH script its address's
+// version byte selects among the coin's networks. An address of no network
+// fails the job instead of paying a script the daemon would not accept.
+func templatePayeeScript(payee *daemons.TemplatePayee, networks map[string]*utils.AddressNetwork) ([]byte, error) {
+	if payee.Script != "" {
+		script, err := hex.DecodeString(payee.Script)
+		if err != nil {
+			return nil, fmt.Errorf("payee %s script %q: %w", payee.Field, payee.Script, err)
+		}
+		return script, nil
+	}
+
+	script, _, err := utils.AutoAddressToScript(payee.Payee, networks)
+	if err != nil {
+		return nil, fmt.Errorf("payee %s: %w", payee.Field, err)
+	}
+	return script, nil
+}
+
+func CreateGeneration(rpcData *daemons.GetBlockTemplate, publicKey, extraNoncePlaceholder []byte, reward string, txMessages bool, recipients []*config.Recipient, hasher merkletree.Hasher, split *CoinbaseSplit) ([][]byte, error) {
 	var txVersion int
 	var txComment []byte
 	txType := 0
@@ -141,7 +195,10 @@ func CreateGeneration(rpcData *daemons.GetBlockTemplate, publicKey, extraNoncePl
 
 	if rpcData.CoinbasePayload != "" && len(rpcData.CoinbasePayload) > 0 {
 		txVersion = 3
-		txType = 5
+		txType = 5 // DIP2 CbTx
+		if rpcData.CoinbasePayloadType != 0 {
+			txType = rpcData.CoinbasePayloadType
+		}
 		txExtraPayload, _ = hex.DecodeString(rpcData.CoinbasePayload)
 	}
 
@@ -181,7 +238,10 @@ func CreateGeneration(rpcData *daemons.GetBlockTemplate, publicKey, extraNoncePl
 		scriptSigPart1,
 	}, nil)
 
-	outputTransactions := GenerateOutputTransactions(publicKey, recipients, rpcData)
+	outputTransactions, err := GenerateOutputTransactions(publicKey, recipients, rpcData, hasher, split)
+	if err != nil {
+		return nil, err
+	}
 
 	p2 := bytes.Join([][]byte{
 		scriptSigPart2,
@@ -204,5 +264,5 @@ func CreateGeneration(rpcData *daemons.GetBlockTemplate, publicKey, extraNoncePl
 		}, nil)
 	}
 
-	return [][]byte{p1, p2}
+	return [][]byte{p1, p2}, nil
 }
@@ -79,7 +79,10 @@ func TestCreateGeneration(t *testing.T) {
 
 	t.Log(hex.EncodeToString(utils.PackUint32LE(uint32(0))))
 
-	gens := CreateGeneration(&rpcData, pk, placeholder, "POW", true, []*config.Recipient{})
+	gens, err := CreateGeneration(&rpcData, pk, placeholder, "POW", true, []*config.Recipient{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	t.Log("0: ", hex.EncodeToString(gens[0]))
 	t.Log("1: ", hex.EncodeToString(gens[1]))
@@ -157,8 +160,115 @@ func TestGenerateOutputTransactions(t *testing.T) {
 `
 	var rpcData daemons.GetBlockTemplate
 	json.Unmarshal([]byte(data), &rpcData)
-	t.Log(hex.EncodeToString(GenerateOutputTransactions(publicKey, recipients, &rpcData)))
+	outputs, err := GenerateOutputTransactions(publicKey, recipients, &rpcData, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(hex.EncodeToString(outputs))
 }
 
 // 00000020fb08e0b3cb0f759671af79f108dd2dbd1a378ba27968c176c1c6d64f94741d262a7ca761bb4397d2c1a7f6cf457d680f054d43cc4f860de21b776054ab93a3cafbe34b5effff0f1e00452ef00401000000010000000000000000000000000000000000000000000000000000000000000000ffffffff1f0377ee1404fce34b5e086b3c0000000000000c2f627920436f6d6d616e642f00000000020000000000000000266a24aa21a9ed8a44e041a5a86878a1742f66fe7196400e784fee5cdc70a4becaf51c8f4a4f0266140395000000001976a91424da8749fde8fcdcde60ba1c5afea8d2bd4a4f2688ac0000000001000000000101df2565bde1779eaa6aad06a03a5262d324de29aa51735ba26d2301c0af426ee90100000000ffffffff020000000000000000136a0c0701007ac0010000c0000000530345d47106fa2f0b0000000016001407fa56d069e6174b6fa1ca3e27556be765064e150247304402203fb97652eee91717f61a9a9a66c8c233648ac3f5942aeb246c2217ffdc64b5f70220210653c0bc9c74b026e80e77a3221a6c64c9529d37a2051c53aefb19213f381d012102a56c007c837c6323332f03f2d22190f1da0aec10c2338da50ebcec85100e9a96000000000100000000010129d40378ffb37a1b2b751e4469aed63df827636e538e76550f6629dc49978f0b0100000000f0ffffff0340420f00000000001976a914ab83ab1e9284beca76ecdd1460f732acdeb5a45688ac0bd9460000000000160014756b524ee4ec544d7828cb849951b75bf46cf9d30000000000000000196a1768747470733a2f2f746c74632e6269746170732e636f6d02483045022100ab49baf3f2f0ebc910f2d7453a5a50bc10810a17d9a77ddc98638b1fc1a93929022062d798622d7f5a55655e1356b9e0e7fb0d2c40d70df0c10c5ba91311a085559c012102ab861da09e496373d8aee62107d68f8275df04dca403c182b6ab648eebb4aca50000000001000000000101fdaffc6f8c94565763bdf4c0e50c389c5eb817d2dff247a0ffc519dda211dce90100000000f0ffffff0340420f00000000001976a914ab83ab1e9284beca76ecdd1460f732acdeb5a45688ac29d5440000000000160014d3cb800cd29671af47dfd95fcb759a7e76e4b0dd0000000000000000196a1768747470733a2f2f746c74632e6269746170732e636f6d02473044022060f807e10801d10ba51870bbbaee01d80d3727730b43b9c710af80857c14e4d102201002940096d20427246a7738c358b29675108260b18cc612922b1a01b2a588ab0121031506590ee0b0a9cfa13dbc765d9ac9666e5e01d031c5bd5b5e293bcdeb2932af00000000
 // 00000020763600ad521ebbb8be835992a5f7e1e315d3978934ed805bfffd2e88b7d65c7c073172cf11eb40f1b663749268e2c63b1c2b1e54fb80d69467c9b5017eb9437cc0e34b5effff0f1e002aaa0e0101000000010000000000000000000000000000000000000000000000000000000000000000ffffffff1f0370ee1404c1e34b5e0840000000000000000c2f627920436f6d6d616e642f00000000020000000000000000266a24aa21a9ede2f61c3f71d1defd3fa999dfa36953755c690689799962b48bebd836974e8cf900f90295000000001976a91424da8749fde8fcdcde60ba1c5afea8d2bd4a4f2688ac00000000
+
+// TestGenerateOutputTransactions_Masternode checks a Dash masternode payee is
+// paid its amount little-endian, followed by its script, out of the pool's
+// share.
+func TestGenerateOutputTransactions_Masternode(t *testing.T) {
+	raw := []byte(`{
+  "height": 100,
+  "coinbasevalue": 1000000000,
+  "masternode": [
+    {"payee": "XpESxaUmonkq8RaLLp46Brx2K39ggQe226", "script": "76a914a4f0b6fda2c1ab1c1dfb0e2a1f9b7b0e6dc5e7b788ac", "amount": 300000000}
+  ]
+}`)
+	var rpcData daemons.GetBlockTemplate
+	if err := json.Unmarshal(raw, &rpcData); err != nil {
+		t.Fatal(err)
+	}
+
+	outputs, err := GenerateOutputTransactions([]byte{0x51}, nil, &rpcData, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pool 700000000, masternode 300000000
+	want := "02" +
+		"0027b92900000000" + "0151" +
+		"00a3e11100000000" + "1976a914a4f0b6fda2c1ab1c1dfb0e2a1f9b7b0e6dc5e7b788ac"
+	if got := hex.EncodeToString(outputs); got != want {
+		t.Errorf("outputs = %s, want %s", got, want)
+	}
+}
+
+// TestGenerateOutputTransactions_TemplatePayees checks declared template payees
+// (a Raptoreum-style smartnode array and gated founder object) are paid out of
+// the pool's share, and that a disabled founder is skipped.
+func TestGenerateOutputTransactions_TemplatePayees(t *testing.T) {
+	raw := []byte(`{
+  "height": 100,
+  "coinbasevalue": 1000000000,
+  "smartnode": [
+    {"payee": "RQKcAZBtsSacMUiGNnbk3h3KJAN94tstvt", "script": "76a914a4f0b6fda2c1ab1c1dfb0e2a1f9b7b0e6dc5e7b788ac", "amount": 450000000}
+  ],
+  "founder": {"payee": "RTtyQU6DoSuNWetT4WUem5qXP5jNYGpwat", "script": "a914a9b8d13cd42a2f4b8f1a1f0fa0f5b6bf8f0bba1587", "amount": 50000000},
+  "founder_payments_started": true
+}`)
+	decls := []*config.TemplatePayee{{Field: "smartnode"}, {Field: "founder", EnabledKey: "founder_payments_started"}}
+
+	var rpcData daemons.GetBlockTemplate
+	if err := json.Unmarshal(raw, &rpcData); err != nil {
+		t.Fatal(err)
+	}
+	payees, err := daemons.ParseTemplatePayees(raw, decls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payees) != 2 || payees[0].Amount != 450000000 || payees[1].Field != "founder" {
+		t.Fatalf("parsed payees = %s, want smartnode 450000000 and founder", utils.Jsonify(payees))
+	}
+	rpcData.Payees = payees
+
+	outputs, err := GenerateOutputTransactions([]byte{0x51}, nil, &rpcData, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pool 500000000, smartnode 450000000, founder 50000000
+	want := "03" +
+		"0065cd1d00000000" + "0151" +
+		"8074d21a00000000" + "1976a914a4f0b6fda2c1ab1c1dfb0e2a1f9b7b0e6dc5e7b788ac" +
+		"80f0fa0200000000" + "17a914a9b8d13cd42a2f4b8f1a1f0fa0f5b6bf8f0bba1587"
+	if got := hex.EncodeToString(outputs); got != want {
+		t.Errorf("outputs = %s, want %s", got, want)
+	}
+
+	disabled := bytes.Replace(raw, []byte(`"founder_payments_started": true`), []byte(`"founder_payments_started": false`), 1)
+	if payees, _ = daemons.ParseTemplatePayees(disabled, decls); len(payees) != 1 {
+		t.Errorf("with founder payments off got %d payees, want 1", len(payees))
+	}
+
+	if _, err = daemons.ParseTemplatePayees(raw, []*config.TemplatePayee{{Field: "treasury", Required: true}}); err == nil {
+		t.Error("a missing required payee field must fail")
+	}
+}
+
+// TestTemplatePayeeScript checks an address-only payee gets the script its
+// version byte selects among the coin's networks, and that an address of no
+// network, or a coin without networks, fails.
+func TestTemplatePayeeScript(t *testing.T) {
+	v := func(b byte) *byte { return &b }
+	networks := map[string]*utils.AddressNetwork{"mainnet": {P2PKHVersion: v(60), P2SHVersion: v(16)}}
+
+	for addr, want := range map[string]string{
+		"RQKKG8k3D7jLjfx7MFbLbhUNNbvmebybkc": "76a914a4f0b6fda2c1ab1c1dfb0e2a1f9b7b0e6dc5e7b788ac",
+		"7ht4MVSET3hk1JQMSd9JVs4kJQ8k8PRxej": "a914a9b8d13cd42a2f4b8f1a1f0fa0f5b6bf8f0bba1587",
+		"1G38BcrkcHvmffaut5cDWB9AcLUAywoNv7": "", // bitcoin's P2PKH version
+	} {
+		script, err := templatePayeeScript(&daemons.TemplatePayee{Field: "founder", Payee: addr, Amount: 1}, networks)
+		if got := hex.EncodeToString(script); got != want || (err != nil) != (want == "") {
+			t.Errorf("payee %s: script %s, err %v; want %s", addr, got, err, want)
+		}
+	}
+
+	if _, err := templatePayeeScript(&daemons.TemplatePayee{Field: "founder", Payee: "RQKKG8k3D7jLjfx7MFbLbhUNNbvmebybkc", Amount: 1}, nil); err == nil {
+		t.Error("an address payee of a coin without networks must fail")
+	}
+}
@@ -0,0 +1,180 @@
+package transactions
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/mining-pool/not-only-mining-pool/daemons"
+	"github.com/mining-pool/not-only-mining-pool/merkletree"
+	"github.com/mining-pool/not-only-mining-pool/utils"
+)
+
+// witnessCommitmentHeader prefixes the BIP141 commitment inside its OP_RETURN
+// output: OP_RETURN OP_PUSHBYTES_36 0xaa21a9ed <32-byte commitment>.
+var witnessCommitmentHeader = []byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}
+
+// witnessReservedValue is the coinbase witness nonce. getblocktemplate commits
+// to all zeros and submitblock fills the matching coinbase witness back in.
+var witnessReservedValue = make([]byte, 32)
+
+// ErrWitnessCommitmentMismatch is returned when the commitment we computed from
+// the template's transactions differs from the daemon's
+// default_witness_commitment; mining on either would risk an invalid block.
+var ErrWitnessCommitmentMismatch = errors.New("witness commitment mismatch")
+
+// HasWitness reports whether a template transaction carries witness data, i.e.
+// its wtxid (hash) differs from its txid. Templates from nodes that report only
+// one of the two (pre-segwit forks, Dash) are treated as witness-free.
+func HasWitness(tx *daemons.TxParams) bool {
+	return tx.TxId != "" && tx.Hash != "" && tx.TxId != tx.Hash
+}
+
+// WitnessMerkleRoot computes the BIP141 witness merkle root over the template's
+// transactions in their block order. The coinbase's wtxid is fixed at zero. A
+// nil hasher defaults to double-SHA256.
+func WitnessMerkleRoot(txs []*daemons.TxParams, hasher merkletree.Hasher) ([]byte, error) {
+	if hasher == nil {
+		hasher = utils.Sha256d
+	}
+
+	leaves := make([][]byte, len(txs)+1)
+	leaves[0] = make([]byte, 32) // coinbase
+	for i, tx := range txs {
+		switch {
+		case tx.Data != "":
+			// wtxid is the hash of the full (witness) serialization, so derive it
+			// from the raw data rather than trusting the reported hash.
+			raw, err := hex.DecodeString(tx.Data)
+			if err != nil {
+				return nil, fmt.Errorf("decoding template tx %d: %w", i, err)
+			}
+			leaves[i+1] = hasher(raw)
+		case tx.Hash != "":
+			leaves[i+1] = utils.Uint256BytesFromHash(tx.Hash)
+		case tx.TxId != "":
+			leaves[i+1] = utils.Uint256BytesFromHash(tx.TxId)
+		default:
+			return nil, fmt.Errorf("template tx %d has neither data nor hash", i)
+		}
+	}
+
+	return merkletree.MerkleRoot(leaves, hasher), nil
+}
+
+// WitnessCommitmentScript builds the coinbase output script committing to txs:
+// hash(witnessRoot || reservedValue) behind the BIP141 header.
+func WitnessCommitmentScript(txs []*daemons.TxParams, hasher merkletree.Hasher) ([]byte, error) {
+	if hasher == nil {
+		hasher = utils.Sha256d
+	}
+
+	root, err := WitnessMerkleRoot(txs, hasher)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.Join([][]byte{
+		witnessCommitmentHeader,
+		hasher(bytes.Join([][]byte{root, witnessReservedValue}, nil)),
+	}, nil), nil
+}
+
+// ResolveWitnessCommitment returns the witness commitment script the coinbase
+// must carry for rpcData, or nil when the block needs none. It never trusts
+// default_witness_commitment blindly:
+//
+//   - when the daemon supplied one, it must equal the commitment computed from
+//     the template's transactions, otherwise ErrWitnessCommitmentMismatch;
+//   - when the daemon omitted it but some transaction carries witness data, the
+//     computed commitment is used instead (without it the block is invalid);
+//   - a witness-free block without a daemon commitment gets none, as before.
+func ResolveWitnessCommitment(rpcData *daemons.GetBlockTemplate, hasher merkletree.Hasher) ([]byte, error) {
+	needed := false
+	for _, tx := range rpcData.Transactions {
+		if HasWitness(tx) {
+			needed = true
+			break
+		}
+	}
+
+	if rpcData.DefaultWitnessCommitment == "" && !needed {
+		return nil, nil
+	}
+
+	computed, err := WitnessCommitmentScript(rpcData.Transactions, hasher)
+	if err != nil {
+		return nil, err
+	}
+
+	if rpcData.DefaultWitnessCommitment == "" {
+		log.Warn("template at height ", rpcData.Height, " has witness transactions but no default_witness_commitment; using the computed one")
+		return computed, nil
+	}
+
+	daemonCommitment, err := hex.DecodeString(rpcData.DefaultWitnessCommitment)
+	if err != nil {
+		return nil, fmt.Errorf("decoding default_witness_commitment: %w", err)
+	}
+
+	if !bytes.Equal(daemonCommitment, computed) {
+		return nil, fmt.Errorf("%w at height %d: daemon %x, computed %x", ErrWitnessCommitmentMismatch, rpcData.Height, daemonCommitment, computed)
+	}
+
+	return computed, nil
+}
+
+// HasWitnessCommitment reports whether tx (a coinbase) carries a BIP141
+// witness commitment output.
+func HasWitnessCommitment(tx *Tx) bool {
+	for _, out := range tx.Outputs {
+		if len(out.ScriptPubKey) >= 38 && bytes.HasPrefix(out.ScriptPubKey, witnessCommitmentHeader) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddCoinbaseWitness returns a serialized coinbase with the witness its
+// commitment is checked against: the BIP144 marker and flag, and the reserved
+// value as the input's only witness item. submitblock fills it in for us, but a
+// block relayed to peers must already carry it. A coinbase that has a witness
+// is returned as is.
+func AddCoinbaseWitness(coinbase []byte, layout TxLayout) ([]byte, error) {
+	tx, size, err := ParseTx(coinbase, layout)
+	if err != nil {
+		return nil, err
+	}
+	if tx.HasWitness {
+		return coinbase, nil
+	}
+	if len(tx.Inputs) != 1 {
+		return nil, fmt.Errorf("coinbase has %d inputs, want 1", len(tx.Inputs))
+	}
+
+	// the witness goes between the outputs and the lock time
+	prefix := 4
+	if layout.Timestamp {
+		prefix += 4
+	}
+	end := prefix + len(utils.VarIntBytes(uint64(len(tx.Inputs))))
+	for _, in := range tx.Inputs {
+		end += 32 + 4 + len(utils.VarIntBytes(uint64(len(in.ScriptSig)))) + len(in.ScriptSig) + 4
+	}
+	end += len(utils.VarIntBytes(uint64(len(tx.Outputs))))
+	for _, out := range tx.Outputs {
+		end += 8 + len(utils.VarIntBytes(uint64(len(out.ScriptPubKey)))) + len(out.ScriptPubKey)
+	}
+	if end+4 > size {
+		return nil, errShortRead
+	}
+
+	return bytes.Join([][]byte{
+		coinbase[:prefix],
+		{0x00, 0x01},
+		coinbase[prefix:end],
+		{1}, utils.VarIntBytes(uint64(len(witnessReservedValue))), witnessReservedValue,
+		coinbase[end:size],
+	}, nil), nil
+}
@@ -16,4 +16,43 @@ type Share struct {
 	BlockHash   string    `json:"blockHash"`
 	BlockHex    string    `json:"blockHex"`
 	TxHash      string    `json:"txHash"`
+
+	// Time is when the share was submitted (unix seconds). Storage records the
+	// share at this time, so one written late from the queue or the journal
+	// keeps its place in the share log, hashrate and block history.
+	Time int64 `json:"time,omitempty"`
+
+	// Value is what the share earns under fpps or pps+ (satoshis), priced on
+	// the template of its job when it is submitted; 0 under other pay modes.
+	Value float64 `json:"value,omitempty"`
+
+	// NetworkDiff is the network difficulty of a block candidate, in the units
+	// of Diff, so the round's effort can be recorded with the block.
+	NetworkDiff float64 `json:"networkDiff,omitempty"`
+
+	// PayMode is the accounting group of the share: "" for the pool's payMode,
+	// or the pay mode its port or miner chose instead. Each group keeps its own
+	// rounds and share log.
+	PayMode string `json:"payMode,omitempty"`
+
+	// BlockRejection is set on a block candidate that failed the local
+	// pre-submit check or was rejected by the daemon.
+	BlockRejection *BlockRejection `json:"blockRejection,omitempty"`
+
+	// CoinbasePaid is what the block's coinbase paid miners directly (miner ->
+	// satoshis), set when coinbase payouts are on.
+	CoinbasePaid map[string]uint64 `json:"coinbasePaid,omitempty"`
+	// CoinbaseWindow is the PPLNS window the coinbase was split over (miner ->
+	// share difficulty), set with CoinbasePaid. The payer splits the pool
+	// output over the rest of it.
+	CoinbaseWindow map[string]float64 `json:"coinbaseWindow,omitempty"`
+}
+
+// BlockRejection explains why a block candidate is invalid. Reasons use the
+// bitcoind reject codes (e.g. "bad-txnmrklroot", "bad-cb-amount") so the local
+// check and the daemon's verdict can be compared directly.
+type BlockRejection struct {
+	Reason       string `json:"reason,omitempty"`       // local pre-submit check
+	Detail       string `json:"detail,omitempty"`       // what the local check expected vs found
+	DaemonReason string `json:"daemonReason,omitempty"` // submitblock's reply
 }
@@ -0,0 +1,268 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/c0mm4nd/go-bech32"
+)
+
+// AddressNetwork lists one network's address encodings for a coin, so an
+// "auto" address can be matched to its coin and network and decoded.
+type AddressNetwork struct {
+	Bech32HRP      string `json:"bech32Hrp,omitempty"`      // segwit HRP, e.g. "bc", "tb", "bcrt"
+	CashAddrPrefix string `json:"cashAddrPrefix,omitempty"` // e.g. "bitcoincash", "bchtest"
+	P2PKHVersion   *byte  `json:"p2pkhVersion,omitempty"`   // base58check version bytes
+	P2SHVersion    *byte  `json:"p2shVersion,omitempty"`
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32 (BIP173) and bech32m (BIP350) differ only in the checksum constant.
+const (
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// fromBase32 maps charset characters to their 5-bit values.
+func fromBase32(s string) ([]byte, error) {
+	out := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		idx := strings.IndexByte(bech32Charset, s[i])
+		if idx < 0 {
+			return nil, fmt.Errorf("invalid character %q", s[i])
+		}
+		out[i] = byte(idx)
+	}
+	return out, nil
+}
+
+// DecodeSegwitAddress decodes a BIP173/BIP350 segwit address, checking that
+// version 0 uses bech32 and later versions bech32m.
+func DecodeSegwitAddress(addr string) (hrp string, version byte, program []byte, err error) {
+	if strings.ToLower(addr) != addr && strings.ToUpper(addr) != addr {
+		return "", 0, nil, errors.New("mixed-case segwit address")
+	}
+	addr = strings.ToLower(addr)
+
+	sep := strings.LastIndexByte(addr, '1')
+	if sep < 1 || sep+7 > len(addr) || len(addr) > 90 {
+		return "", 0, nil, errors.New("malformed segwit address")
+	}
+	hrp = addr[:sep]
+	data, err := fromBase32(addr[sep+1:])
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	expanded := make([]byte, 0, len(hrp)*2+1+len(data))
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	checksum := bech32Polymod(append(expanded, data...))
+
+	version = data[0]
+	switch {
+	case version > 16:
+		return "", 0, nil, fmt.Errorf("invalid witness version %d", version)
+	case version == 0 && checksum != bech32Const:
+		return "", 0, nil, errors.New("bad bech32 checksum")
+	case version > 0 && checksum != bech32mConst:
+		return "", 0, nil, errors.New("bad bech32m checksum")
+	}
+
+	program, err = bech32.ConvertBits(data[1:len(data)-6], 5, 8, false)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if len(program) < 2 || len(program) > 40 || (version == 0 && len(program) != 20 && len(program) != 32) {
+		return "", 0, nil, fmt.Errorf("invalid witness program length %d", len(program))
+	}
+	return hrp, version, program, nil
+}
+
+// SegwitScript builds the scriptPubKey for a witness program:
+// OP_<version> <program>.
+func SegwitScript(version byte, program []byte) []byte {
+	op := byte(0x00)
+	if version > 0 {
+		op = 0x50 + version
+	}
+	return bytes.Join([][]byte{{op, byte(len(program))}, program}, nil)
+}
+
+func cashAddrPolymod(values []byte) uint64 {
+	c := uint64(1)
+	for _, d := range values {
+		c0 := byte(c >> 35)
+		c = (c&0x07ffffffff)<<5 ^ uint64(d)
+		if c0&0x01 != 0 {
+			c ^= 0x98f2bc8e61
+		}
+		if c0&0x02 != 0 {
+			c ^= 0x79b76d99e2
+		}
+		if c0&0x04 != 0 {
+			c ^= 0xf33e5fb3c4
+		}
+		if c0&0x08 != 0 {
+			c ^= 0xae2eabe2a8
+		}
+		if c0&0x10 != 0 {
+			c ^= 0x1e4f43e470
+		}
+	}
+	return c ^ 1
+}
+
+// CashAddr types.
+const (
+	CashAddrP2PKH = 0
+	CashAddrP2SH  = 1
+)
+
+// DecodeCashAddr decodes a CashAddr address. An address given without its
+// "prefix:" part is checked against defaultPrefix.
+func DecodeCashAddr(addr, defaultPrefix string) (prefix string, addrType byte, hash []byte, err error) {
+	if strings.ToLower(addr) != addr && strings.ToUpper(addr) != addr {
+		return "", 0, nil, errors.New("mixed-case cashaddr")
+	}
+	addr = strings.ToLower(addr)
+
+	prefix, payload := defaultPrefix, addr
+	if i := strings.IndexByte(addr, ':'); i >= 0 {
+		prefix, payload = addr[:i], addr[i+1:]
+	}
+	if prefix == "" {
+		return "", 0, nil, errors.New("cashaddr without a prefix")
+	}
+
+	data, err := fromBase32(payload)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if len(data) < 8+1 {
+		return "", 0, nil, errors.New("cashaddr too short")
+	}
+
+	values := make([]byte, 0, len(prefix)+1+len(data))
+	for i := 0; i < len(prefix); i++ {
+		values = append(values, prefix[i]&31)
+	}
+	values = append(values, 0)
+	if cashAddrPolymod(append(values, data...)) != 0 {
+		return "", 0, nil, errors.New("bad cashaddr checksum")
+	}
+
+	decoded, err := bech32.ConvertBits(data[:len(data)-8], 5, 8, false)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	version, hash := decoded[0], decoded[1:]
+	if version&0x80 != 0 {
+		return "", 0, nil, errors.New("cashaddr reserved bit set")
+	}
+	sizes := []int{20, 24, 28, 32, 40, 48, 56, 64}
+	if len(hash) != sizes[version&0x07] {
+		return "", 0, nil, fmt.Errorf("cashaddr hash is %d bytes, version says %d", len(hash), sizes[version&0x07])
+	}
+	return prefix, (version >> 3) & 0x0f, hash, nil
+}
+
+// P2PKHScript is OP_DUP OP_HASH160 <hash> OP_EQUALVERIFY OP_CHECKSIG.
+func P2PKHScript(hash []byte) []byte {
+	return bytes.Join([][]byte{{0x76, 0xA9, 0x14}, hash, {0x88, 0xAC}}, nil)
+}
+
+// P2SHScript is OP_HASH160 <hash> OP_EQUAL.
+func P2SHScript(hash []byte) []byte {
+	return bytes.Join([][]byte{{0xA9, 0x14}, hash, {0x87}}, nil)
+}
+
+// CashAddrScript returns the output script for a CashAddr address.
+func CashAddrScript(addr, defaultPrefix string) ([]byte, error) {
+	_, addrType, hash, err := DecodeCashAddr(addr, defaultPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) != 20 {
+		return nil, fmt.Errorf("unsupported %d-byte cashaddr hash", len(hash))
+	}
+
+	switch addrType {
+	case CashAddrP2PKH:
+		return P2PKHScript(hash), nil
+	case CashAddrP2SH:
+		return P2SHScript(hash), nil
+	default:
+		return nil, fmt.Errorf("unsupported cashaddr type %d", addrType)
+	}
+}
+
+// AutoAddressToScript detects an address's encoding (segwit, CashAddr or
+// base58check) and returns its output script plus the name of the network in
+// networks it belongs to. The address must match one of the networks, so an
+// address of another coin is rejected instead of silently burning its output.
+func AutoAddressToScript(addr string, networks map[string]*AddressNetwork) (script []byte, network string, err error) {
+	if len(networks) == 0 {
+		return nil, "", errors.New("no address networks configured for this coin (set coin.networks)")
+	}
+
+	if hrp, version, program, err := DecodeSegwitAddress(addr); err == nil {
+		for name, n := range networks {
+			if n.Bech32HRP != "" && n.Bech32HRP == hrp {
+				return SegwitScript(version, program), name, nil
+			}
+		}
+		return nil, "", fmt.Errorf("segwit address %s has HRP %q, which is not one of this coin's", addr, hrp)
+	}
+
+	for name, n := range networks {
+		if n.CashAddrPrefix == "" {
+			continue
+		}
+		prefix, _, _, err := DecodeCashAddr(addr, n.CashAddrPrefix)
+		if err == nil && prefix == n.CashAddrPrefix {
+			script, err := CashAddrScript(addr, n.CashAddrPrefix)
+			return script, name, err
+		}
+	}
+
+	version, hash, err := Base58CheckDecode(addr)
+	if err != nil {
+		return nil, "", fmt.Errorf("address %s is not segwit, cashaddr or base58check: %w", addr, err)
+	}
+	if len(hash) != 20 {
+		return nil, "", fmt.Errorf("base58 address %s has a %d-byte payload, want 20", addr, len(hash))
+	}
+	for name, n := range networks {
+		if n.P2PKHVersion != nil && *n.P2PKHVersion == version {
+			return P2PKHScript(hash), name, nil
+		}
+		if n.P2SHVersion != nil && *n.P2SHVersion == version {
+			return P2SHScript(hash), name, nil
+		}
+	}
+	return nil, "", fmt.Errorf("base58 address %s has version %d, which is not one of this coin's", addr, version)
+}
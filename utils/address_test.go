@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestDecodeSegwitAddress(t *testing.T) {
+	// BIP173 and BIP350 test vectors.
+	valid := map[string]string{
+		"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4":                     "0014751e76e8199196d454941c45d1b3a323f1433bd6",
+		"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7": "00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262",
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0": "512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c": "5120000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433",
+	}
+	for addr, want := range valid {
+		_, version, program, err := DecodeSegwitAddress(addr)
+		if err != nil {
+			t.Errorf("%s: %s", addr, err)
+			continue
+		}
+		if got := hex.EncodeToString(SegwitScript(version, program)); got != want {
+			t.Errorf("%s: script %s, want %s", addr, got, want)
+		}
+	}
+
+	invalid := []string{
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh",                     // v0 with a bech32m checksum
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd", // v1 with a bech32 checksum
+		"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3pjxtptv", // bad v0 program length
+		"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3t4",                     // mixed case
+	}
+	for _, addr := range invalid {
+		if _, _, _, err := DecodeSegwitAddress(addr); err == nil {
+			t.Errorf("%s: decoded, want an error", addr)
+		}
+	}
+}
+
+func TestCashAddrScript(t *testing.T) {
+	// Same hash as legacy 1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu.
+	hash := "76a04053bda0a88bda5177b86a15c3b29f559873"
+	cases := map[string]string{
+		"bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a": "76a914" + hash + "88ac",
+		"qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a":             "76a914" + hash + "88ac",
+		"bitcoincash:ppm2qsznhks23z7629mms6s4cwef74vcwvn0h829pq": "a914" + hash + "87",
+	}
+	for addr, want := range cases {
+		script, err := CashAddrScript(addr, "bitcoincash")
+		if err != nil {
+			t.Errorf("%s: %s", addr, err)
+			continue
+		}
+		if got := hex.EncodeToString(script); got != want {
+			t.Errorf("%s: script %s, want %s", addr, got, want)
+		}
+	}
+
+	if _, err := CashAddrScript("bchtest:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a", "bitcoincash"); err == nil {
+		t.Error("address checksummed for bitcoincash decoded under bchtest")
+	}
+}
+
+func TestAutoAddressToScript(t *testing.T) {
+	v := func(b byte) *byte { return &b }
+	networks := map[string]*AddressNetwork{
+		"mainnet": {Bech32HRP: "bc", CashAddrPrefix: "bitcoincash", P2PKHVersion: v(0), P2SHVersion: v(5)},
+		"testnet": {Bech32HRP: "tb", P2PKHVersion: v(111), P2SHVersion: v(196)},
+	}
+
+	cases := []struct {
+		addr, network, script string
+	}{
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", "mainnet", "0014751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7", "testnet", "00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262"},
+		{"1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu", "mainnet", "76a91476a04053bda0a88bda5177b86a15c3b29f55987388ac"},
+		{"bitcoincash:ppm2qsznhks23z7629mms6s4cwef74vcwvn0h829pq", "mainnet", "a91476a04053bda0a88bda5177b86a15c3b29f55987387"},
+	}
+	for _, c := range cases {
+		script, network, err := AutoAddressToScript(c.addr, networks)
+		if err != nil {
+			t.Errorf("%s: %s", c.addr, err)
+			continue
+		}
+		if network != c.network || hex.EncodeToString(script) != c.script {
+			t.Errorf("%s: got %s %x, want %s %s", c.addr, network, script, c.network, c.script)
+		}
+	}
+
+	// A Litecoin segwit address and a Dogecoin base58 address are not this coin's.
+	for _, addr := range []string{
+		"ltc1qw508d6qejxtdg4y5r3zarvary0c5xw7kgmn4n9",
+		"DH5yaieqoZN36fDVciNyRueRGvGLR3mr7L",
+	} {
+		if _, _, err := AutoAddressToScript(addr, networks); err == nil {
+			t.Errorf("%s: decoded, want a foreign-coin error", addr)
+		}
+	}
+
+	if _, _, err := AutoAddressToScript("1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu", nil); err == nil {
+		t.Error("decoded without any configured networks")
+	}
+}
@@ -13,7 +13,6 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/c0mm4nd/go-bech32"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/mr-tron/base58"
 )
@@ -291,6 +290,26 @@ func PublicKeyToScript(key string) []byte {
 	return bKey
 }
 
+// Base58CheckDecode decodes a base58check address and verifies its checksum,
+// returning the version byte and the payload. Unlike the *AddressToScript
+// helpers it never exits, so it is safe on untrusted input such as worker names.
+func Base58CheckDecode(addr string) (version byte, payload []byte, err error) {
+	decoded, err := base58.FastBase58Decoding(addr)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(decoded) < 5 {
+		return 0, nil, fmt.Errorf("base58check string %q is too short", addr)
+	}
+
+	body, checksum := decoded[:len(decoded)-4], decoded[len(decoded)-4:]
+	if !bytes.Equal(Sha256d(body)[:4], checksum) {
+		return 0, nil, fmt.Errorf("base58check string %q has a bad checksum", addr)
+	}
+
+	return body[0], body[1:], nil
+}
+
 // For POW coins - used to format wallet address for use in generation transaction's output
 // Works for p2pkh only
 func P2PKHAddressToScript(addr string) []byte {
@@ -331,20 +350,49 @@ func P2SHAddressToScript(addr string) []byte {
 	}, nil)
 }
 
+// P2WSHAddressToScript returns the scriptPubKey of a version 0 segwit address.
+// The program length comes from the address, so P2WPKH addresses configured
+// as "p2wsh" keep working.
 func P2WSHAddressToScript(addr string) []byte {
-	_, decoded, err := bech32.Decode(addr)
-	if decoded == nil || err != nil {
-		log.Fatal("bech32 decode failed for " + addr)
+	_, version, program, err := DecodeSegwitAddress(addr)
+	if err != nil || version != 0 {
+		log.Fatal("segwit v0 decode failed for ", addr, ": ", err)
 	}
-	witnessProgram, err := bech32.ConvertBits(decoded[1:], 5, 8, true)
+
+	return SegwitScript(version, program)
+}
+
+// P2WPKHAddressToScript returns OP_0 <20-byte key hash> for a native segwit
+// pubkey-hash address.
+func P2WPKHAddressToScript(addr string) []byte {
+	_, version, program, err := DecodeSegwitAddress(addr)
+	if err != nil || version != 0 || len(program) != 20 {
+		log.Fatal("p2wpkh decode failed for ", addr, ": ", err)
+	}
+
+	return SegwitScript(version, program)
+}
+
+// P2TRAddressToScript returns OP_1 <32-byte output key> for a bech32m taproot
+// address.
+func P2TRAddressToScript(addr string) []byte {
+	_, version, program, err := DecodeSegwitAddress(addr)
+	if err != nil || version != 1 || len(program) != 32 {
+		log.Fatal("p2tr decode failed for ", addr, ": ", err)
+	}
+
+	return SegwitScript(version, program)
+}
+
+// CashAddrToScript returns the P2PKH or P2SH script of a Bitcoin Cash style
+// CashAddr. Addresses without a prefix are read with defaultPrefix.
+func CashAddrToScript(addr, defaultPrefix string) []byte {
+	script, err := CashAddrScript(addr, defaultPrefix)
 	if err != nil {
-		log.Panic("")
+		log.Fatal("cashaddr decode failed for ", addr, ": ", err)
 	}
 
-	return bytes.Join([][]byte{
-		{0x00, 0x14},
-		witnessProgram,
-	}, nil)
+	return script
 }
 
 func ScriptPubKeyToScript(addr string) []byte {